@@ -0,0 +1,535 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gyuho/dplearn/pkg/blobstore"
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/lru"
+
+	"github.com/golang/glog"
+)
+
+// AdminQueue describes the queue of a model in '/admin/queues'.
+type AdminQueue struct {
+	Model string `json:"model"`
+	// Queue is the bucket of its jobs, in '/admin/queues/{bucket}'.
+	Queue string `json:"queue"`
+	// Queued is the number of items waiting in the queue.
+	Queued int `json:"queued"`
+	// Running is the number of jobs claimed by workers.
+	Running int `json:"running"`
+	// Workers is the number of live workers of the queue.
+	Workers int `json:"workers"`
+}
+
+// AdminQueueList is the response of 'GET /admin/queues'.
+type AdminQueueList struct {
+	Queues []AdminQueue `json:"queues"`
+}
+
+// Item states in '/admin/queues/{bucket}/items'.
+const (
+	// ItemQueued is the item waiting in the queue.
+	ItemQueued = "queued"
+	// ItemRunning is the item claimed by a worker.
+	ItemRunning = "running"
+	// ItemExpired is the item neither in the queue nor claimed,
+	// after its TTL in the queue (see 'Config.EnqueueTTL').
+	ItemExpired = "expired"
+	// ItemDone is the item completed with the result.
+	ItemDone = "done"
+	// ItemFailed is the item completed with the error.
+	ItemFailed = "failed"
+	// ItemCanceled is the item canceled by operators.
+	ItemCanceled = "canceled"
+)
+
+// AdminItem is the item in the queue, or the job of the server.
+type AdminItem struct {
+	// JobID is the ID in '/admin/jobs/{id}' and '/v1/jobs/{id}'.
+	JobID string      `json:"job_id"`
+	State string      `json:"state"`
+	Item  *queue.Item `json:"item"`
+}
+
+// AdminItemList is the response of 'GET /admin/queues/{bucket}/items'.
+type AdminItemList struct {
+	Items []AdminItem `json:"items"`
+}
+
+// PurgeResponse is the response of 'DELETE /admin/queues/{bucket}'.
+type PurgeResponse struct {
+	// Purged is the number of items deleted from the queue,
+	// whose jobs are canceled.
+	Purged int `json:"purged"`
+}
+
+// AdminImage is the image in the cache, most recently used first.
+type AdminImage struct {
+	URL    string `json:"url"`
+	Digest string `json:"digest"`
+	Path   string `json:"path"`
+	Size   uint64 `json:"size"`
+	// Refs is the number of references from the cache and jobs,
+	// which keep the file in the store.
+	Refs int `json:"refs"`
+}
+
+// AdminImageList is the response of 'GET /admin/images'.
+type AdminImageList struct {
+	Images []AdminImage `json:"images"`
+}
+
+// EvictResponse is the response of 'DELETE /admin/images'.
+type EvictResponse struct {
+	Evicted int `json:"evicted"`
+}
+
+// AdminWorkerList is the response of 'GET /admin/workers'.
+type AdminWorkerList struct {
+	Workers []WorkerStatus `json:"workers"`
+}
+
+// AdminErrorList is the response of 'GET /admin/errors'.
+type AdminErrorList struct {
+	Errors []ErrorEntry `json:"errors"`
+}
+
+var adminRoutes = []route{
+	{
+		method:   http.MethodGet,
+		pattern:  "/admin/queues",
+		summary:  "List the queues of models.",
+		response: AdminQueueList{},
+		status:   http.StatusOK,
+		scope:    ScopeAdmin,
+		handle:   listQueuesHandler,
+	},
+	{
+		method:   http.MethodGet,
+		pattern:  "/admin/queues/{bucket}/items",
+		summary:  "List the items in the queue, and the jobs of the queue in the server.",
+		response: AdminItemList{},
+		status:   http.StatusOK,
+		scope:    ScopeAdmin,
+		handle:   listItemsHandler,
+	},
+	{
+		method:   http.MethodDelete,
+		pattern:  "/admin/queues/{bucket}",
+		summary:  "Delete all items in the queue, and cancel their jobs.",
+		response: PurgeResponse{},
+		status:   http.StatusOK,
+		scope:    ScopeAdmin,
+		handle:   purgeQueueHandler,
+	},
+	{
+		method:   http.MethodPost,
+		pattern:  "/admin/jobs/{id}/requeue",
+		summary:  "Add the job to the queue again, from the start.",
+		response: AdminItem{},
+		status:   http.StatusOK,
+		scope:    ScopeAdmin,
+		handle:   requeueJobHandler,
+	},
+	{
+		method:   http.MethodPost,
+		pattern:  "/admin/jobs/{id}/cancel",
+		summary:  "Cancel the job, and reject updates from its worker.",
+		response: AdminItem{},
+		status:   http.StatusOK,
+		scope:    ScopeAdmin,
+		handle:   cancelJobHandler,
+	},
+	{
+		method:  http.MethodDelete,
+		pattern: "/admin/jobs/{id}",
+		summary: "Delete the job from the queue and the server.",
+		status:  http.StatusNoContent,
+		scope:   ScopeAdmin,
+		handle:  adminDeleteJobHandler,
+	},
+	{
+		method:   http.MethodGet,
+		pattern:  "/admin/images",
+		summary:  "List the images in the cache, most recently used first.",
+		response: AdminImageList{},
+		status:   http.StatusOK,
+		scope:    ScopeAdmin,
+		handle:   listImagesHandler,
+	},
+	{
+		method:   http.MethodDelete,
+		pattern:  "/admin/images",
+		summary:  "Evict the image of 'url' from the cache, or all images without 'url'.",
+		query:    []string{"url"},
+		response: EvictResponse{},
+		status:   http.StatusOK,
+		scope:    ScopeAdmin,
+		handle:   evictImagesHandler,
+	},
+	{
+		method:   http.MethodGet,
+		pattern:  "/admin/workers",
+		summary:  "List the live workers.",
+		response: AdminWorkerList{},
+		status:   http.StatusOK,
+		scope:    ScopeAdmin,
+		handle:   listWorkersHandler,
+	},
+	{
+		method:   http.MethodGet,
+		pattern:  "/admin/errors",
+		summary:  "List the recent server-side errors, newest first.",
+		query:    []string{"source"},
+		response: AdminErrorList{},
+		status:   http.StatusOK,
+		scope:    ScopeAdmin,
+		handle:   listErrorsHandler,
+	},
+}
+
+// adminHandler routes the admin API, which requires API keys of admin
+// scope. It is disabled without API keys.
+func adminHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	srv := ctx.Value(serverKey).(*Server)
+	if srv.keys == nil {
+		return writeErrorResponse(w, newError(CodeNotFound, "admin API requires API keys (see 'WithKeyStore')"))
+	}
+	return serveRoutes(ctx, w, req, adminRoutes)
+}
+
+// adminBucket returns the bucket of the path parameter, if it is
+// the queue of a model.
+func adminBucket(params map[string]string) (string, error) {
+	bucket := "/" + params["bucket"]
+	if _, ok := modelOf(bucket); !ok {
+		return "", newError(CodeNotFound, "unknown queue %q", params["bucket"])
+	}
+	return bucket, nil
+}
+
+// itemState returns the state of the job in the server.
+func (srv *Server) itemState(item *queue.Item) string {
+	switch {
+	case item.Canceled:
+		return ItemCanceled
+	case item.Progress >= queue.MaxProgress && item.Error != "":
+		return ItemFailed
+	case item.Progress >= queue.MaxProgress:
+		return ItemDone
+	case srv.workers.claimed(item.RequestID):
+		return ItemRunning
+	default:
+		return ItemExpired
+	}
+}
+
+// bucketItems returns the items of the bucket: the ones in the queue
+// in the order to pop, and then the other jobs in the server.
+func (srv *Server) bucketItems(ctx context.Context, bucket string) ([]AdminItem, error) {
+	queued, err := srv.qu.List(ctx, bucket)
+	if err != nil {
+		return nil, newError(CodeQueueUnavailable, "%s", err.Error())
+	}
+	items := make([]AdminItem, 0, len(queued))
+	inQueue := make(map[string]struct{}, len(queued))
+	for _, item := range queued {
+		items = append(items, AdminItem{JobID: jobID(item.RequestID), State: ItemQueued, Item: item})
+		inQueue[item.RequestID] = struct{}{}
+	}
+
+	var jobs []AdminItem
+	srv.requestCache.Range(func(k, v interface{}) bool {
+		item := v.(*queue.Item)
+		if _, ok := inQueue[item.RequestID]; ok || item.Bucket != bucket {
+			return true
+		}
+		jobs = append(jobs, AdminItem{JobID: jobID(item.RequestID), State: srv.itemState(item), Item: item})
+		return true
+	})
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Item.CreatedAt.Before(jobs[j].Item.CreatedAt) })
+	return append(items, jobs...), nil
+}
+
+// dequeue deletes the items of the request from the queues,
+// and returns the number of deleted items.
+func (srv *Server) dequeue(ctx context.Context, requestID string) (int, error) {
+	n := 0
+	for _, bucket := range models {
+		items, err := srv.qu.List(ctx, bucket)
+		if err != nil {
+			return n, newError(CodeQueueUnavailable, "%s", err.Error())
+		}
+		for _, item := range items {
+			if item.RequestID != requestID {
+				continue
+			}
+			switch err = srv.qu.Delete(ctx, item); err {
+			case nil:
+				n++
+			case queue.ErrItemNotFound: // claimed in between
+			default:
+				return n, newError(CodeQueueUnavailable, "%s", err.Error())
+			}
+		}
+	}
+	return n, nil
+}
+
+// cancelRequest completes the job with the error, so that its watchers
+// and batch see the error and its worker can no longer update it.
+func (srv *Server) cancelRequest(item *queue.Item, reason string) (*queue.Item, error) {
+	srv.workers.release(item.RequestID)
+	copied := *item
+	copied.Canceled = true
+	copied.Progress = queue.MaxProgress
+	copied.Error = reason
+	if err := srv.updateRequest(&copied); err != nil {
+		return nil, err
+	}
+	glog.Infof("canceled %q (%s)", item.RequestID, reason)
+	return &copied, nil
+}
+
+func listQueuesHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	workers := srv.workers.list(time.Now())
+	resp := AdminQueueList{Queues: []AdminQueue{}}
+	for model, bucket := range models {
+		items, err := srv.bucketItems(ctx, bucket)
+		if err != nil {
+			return writeErrorResponse(w, err)
+		}
+		q := AdminQueue{Model: model, Queue: strings.TrimPrefix(bucket, "/")}
+		for _, item := range items {
+			switch item.State {
+			case ItemQueued:
+				q.Queued++
+			case ItemRunning:
+				q.Running++
+			}
+		}
+		for _, ws := range workers {
+			if ws.Bucket == bucket {
+				q.Workers++
+			}
+		}
+		resp.Queues = append(resp.Queues, q)
+	}
+	sort.Slice(resp.Queues, func(i, j int) bool { return resp.Queues[i].Model < resp.Queues[j].Model })
+	return writeJSON(w, http.StatusOK, &resp)
+}
+
+func listItemsHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	bucket, err := adminBucket(params)
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	items, err := srv.bucketItems(ctx, bucket)
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	return writeJSON(w, http.StatusOK, &AdminItemList{Items: items})
+}
+
+func purgeQueueHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	bucket, err := adminBucket(params)
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	items, err := srv.qu.List(ctx, bucket)
+	if err != nil {
+		return writeErrorResponse(w, newError(CodeQueueUnavailable, "%s", err.Error()))
+	}
+
+	var resp PurgeResponse
+	for _, item := range items {
+		switch err = srv.qu.Delete(ctx, item); err {
+		case nil:
+		case queue.ErrItemNotFound: // claimed in between
+			continue
+		default:
+			return writeErrorResponse(w, newError(CodeQueueUnavailable, "%s", err.Error()))
+		}
+		resp.Purged++
+		if cur, err := srv.getRequest(item.RequestID); err == nil && !cur.Canceled && cur.Progress < queue.MaxProgress {
+			srv.cancelRequest(cur, "purged by operator")
+		}
+	}
+	glog.Infof("purged %d items of %q", resp.Purged, bucket)
+	return writeJSON(w, http.StatusOK, &resp)
+}
+
+// requeueJobHandler enqueues the job again. Running jobs are rejected,
+// since workers update jobs by request ID, and the previous worker
+// would overwrite the requeued job.
+func requeueJobHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	requestID, err := parseJobID(params["id"])
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	traceRequest(ctx, requestID)
+	item, err := srv.getRequest(requestID)
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	if srv.itemState(item) == ItemRunning {
+		return writeErrorResponse(w, newError(CodeValidation, "job %q is running", params["id"]))
+	}
+	v, ok := srv.requestDigests.Load(requestID)
+	if !ok {
+		return writeErrorResponse(w, newError(CodeNotFound, "input of %q is not in the store", requestID))
+	}
+	blob, err := srv.store.Get(v.(string))
+	if err != nil {
+		return writeErrorResponse(w, newError(CodeNotFound, "input of %q is not in the store (%v)", requestID, err))
+	}
+
+	// not to run the job twice
+	if _, err = srv.dequeue(ctx, requestID); err != nil {
+		return writeErrorResponse(w, err)
+	}
+	requeued := queue.CreateItem(item.Bucket, srv.cfg.Priority, blob.Path)
+	requeued.RequestID = requestID
+	requeued.TraceID = item.TraceID
+	if err = srv.qu.Add(ctx, requeued, queue.WithTTL(srv.cfg.EnqueueTTL)); err != nil {
+		return writeErrorResponse(w, newError(CodeQueueUnavailable, "%s", err.Error()))
+	}
+	srv.workers.release(requestID)
+	srv.requestCache.Store(requestID, requeued)
+	srv.notify(requestID)
+	srv.updateHistory(ctx, requestID, func(r *JobRecord) {
+		r.Status, r.Result, r.Error, r.Worker = JobQueued, "", "", ""
+		r.ClaimedAt, r.CompletedAt = nil, nil
+	})
+
+	glog.Infof("requeued %q", requestID)
+	return writeJSON(w, http.StatusOK, &AdminItem{JobID: jobID(requestID), State: ItemQueued, Item: requeued})
+}
+
+func cancelJobHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	requestID, err := parseJobID(params["id"])
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	traceRequest(ctx, requestID)
+	item, err := srv.getRequest(requestID)
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	if item.Progress >= queue.MaxProgress {
+		return writeErrorResponse(w, newError(CodeValidation, "job %q is already %s", params["id"], srv.itemState(item)))
+	}
+	if _, err = srv.dequeue(ctx, requestID); err != nil {
+		return writeErrorResponse(w, err)
+	}
+	canceled, err := srv.cancelRequest(item, "canceled by operator")
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	return writeJSON(w, http.StatusOK, &AdminItem{JobID: params["id"], State: ItemCanceled, Item: canceled})
+}
+
+// adminDeleteJobHandler deletes the job, including the items in the queue
+// without job in the server (e.g. after restart).
+func adminDeleteJobHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	requestID, err := parseJobID(params["id"])
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	traceRequest(ctx, requestID)
+	n, err := srv.dequeue(ctx, requestID)
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	_, err = srv.getRequest(requestID)
+	if err != nil && n == 0 {
+		return writeErrorResponse(w, err)
+	}
+	if err == nil {
+		srv.deleteRequest(requestID)
+	}
+	glog.Infof("deleted %q by operator (%d items in queue)", requestID, n)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func listImagesHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	resp := AdminImageList{Images: []AdminImage{}}
+	err := srv.cache.Range(imageCacheBucket, func(k, v interface{}) bool {
+		blob := v.(blobstore.Blob)
+		resp.Images = append(resp.Images, AdminImage{URL: k.(string), Digest: blob.Digest, Path: blob.Path, Size: blob.Size})
+		return true
+	})
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	// outside of the cache lock
+	for i := range resp.Images {
+		resp.Images[i].Refs = srv.store.Refs(resp.Images[i].Digest)
+	}
+	return writeJSON(w, http.StatusOK, &resp)
+}
+
+// evictImagesHandler evicts the images from the cache. Their files are
+// removed once the jobs of the images are deleted.
+func evictImagesHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	var urls []string
+	if u := req.URL.Query().Get("url"); u != "" {
+		urls = append(urls, u)
+	} else {
+		err := srv.cache.Range(imageCacheBucket, func(k, v interface{}) bool {
+			urls = append(urls, k.(string))
+			return true
+		})
+		if err != nil {
+			return writeErrorResponse(w, err)
+		}
+	}
+
+	var resp EvictResponse
+	for _, u := range urls {
+		switch err := srv.cache.Delete(imageCacheBucket, u); err {
+		case nil:
+			resp.Evicted++
+		case lru.ErrKeyNotFound:
+			if len(urls) == 1 && req.URL.Query().Get("url") != "" {
+				return writeErrorResponse(w, newError(CodeNotFound, "image %q is not in the cache", u))
+			}
+		default:
+			return writeErrorResponse(w, err)
+		}
+	}
+	glog.Infof("evicted %d images by operator", resp.Evicted)
+	return writeJSON(w, http.StatusOK, &resp)
+}
+
+func listWorkersHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	return writeJSON(w, http.StatusOK, &AdminWorkerList{Workers: srv.workers.list(time.Now())})
+}
+
+func listErrorsHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	source := req.URL.Query().Get("source")
+	resp := AdminErrorList{Errors: []ErrorEntry{}}
+	for _, e := range srv.recentErrors.list() {
+		if source == "" || e.Source == source {
+			resp.Errors = append(resp.Errors, e)
+		}
+	}
+	return writeJSON(w, http.StatusOK, &resp)
+}
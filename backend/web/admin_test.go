@@ -0,0 +1,224 @@
+package web
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func TestAdmin(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	defer ts.Close()
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	do := func(method, p, key, body string, v interface{}) int {
+		req, err := http.NewRequest(method, ts.URL+p, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if v != nil {
+			if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("%s %q: %v", method, p, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var er ErrorResponse
+	if code := do(http.MethodGet, "/admin/queues", "", "", &er); code != 404 {
+		t.Fatalf("expected 404 without API keys, got %d %+v", code, er)
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "keys.json")
+	if err = ioutil.WriteFile(keyPath, []byte(`[
+	{"name": "client", "key": "submit-key", "scopes": ["submit"]},
+	{"name": "worker", "key": "worker-key", "scopes": ["worker"]},
+	{"name": "operator", "key": "admin-key", "scopes": ["admin"]}
+]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if srv.keys, err = NewFileKeyStore(keyPath); err != nil {
+		t.Fatal(err)
+	}
+	srv.quota = newQuota()
+
+	if code := do(http.MethodGet, "/admin/queues", "", "", &er); code != 401 {
+		t.Fatalf("expected 401, got %d %+v", code, er)
+	}
+	if code := do(http.MethodGet, "/admin/queues", "worker-key", "", &er); code != 403 {
+		t.Fatalf("expected 403, got %d %+v", code, er)
+	}
+
+	var jobs [4]Job
+	for i := range jobs {
+		input := `{"input": "` + imgServer.URL + "/cat" + strconv.Itoa(i+1) + `.jpeg"}`
+		if code := do(http.MethodPost, "/v1/models/cats/jobs", "submit-key", input, &jobs[i]); code != 201 {
+			t.Fatalf("#%d: expected 201, got %d", i, code)
+		}
+	}
+	var item queue.Item
+	if code := do(http.MethodPost, "/v1/queues/cats-request/claim", "worker-key", "", &item); code != 200 || item.RequestID != jobs[0].RequestID {
+		t.Fatalf("unexpected claim %d %+v", code, item)
+	}
+
+	var ql AdminQueueList
+	if code := do(http.MethodGet, "/admin/queues", "admin-key", "", &ql); code != 200 {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	var cats AdminQueue
+	for _, q := range ql.Queues {
+		if q.Model == "cats" {
+			cats = q
+		}
+	}
+	if cats.Queue != "cats-request" || cats.Queued != 3 || cats.Running != 1 || cats.Workers != 1 {
+		t.Fatalf("unexpected queue %+v", ql)
+	}
+
+	var il AdminItemList
+	if code := do(http.MethodGet, "/admin/queues/cats-request/items", "admin-key", "", &il); code != 200 {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(il.Items) != 4 || il.Items[0].JobID != jobs[1].ID || il.Items[0].State != ItemQueued || il.Items[3].JobID != jobs[0].ID || il.Items[3].State != ItemRunning {
+		t.Fatalf("unexpected items %+v", il)
+	}
+	if code := do(http.MethodGet, "/admin/queues/unknown/items", "admin-key", "", &er); code != 404 {
+		t.Fatalf("expected 404, got %d %+v", code, er)
+	}
+
+	// running job is not requeued, not to be overwritten by its worker
+	if code := do(http.MethodPost, "/admin/jobs/"+jobs[0].ID+"/requeue", "admin-key", "", &er); code != 400 {
+		t.Fatalf("expected 400 on running job, got %d %+v", code, er)
+	}
+
+	// canceled job rejects updates from its worker
+	var ai AdminItem
+	if code := do(http.MethodPost, "/admin/jobs/"+jobs[0].ID+"/cancel", "admin-key", "", &ai); code != 200 || ai.State != ItemCanceled {
+		t.Fatalf("unexpected cancel %d %+v", code, ai)
+	}
+	if code := do(http.MethodPatch, "/v1/jobs/"+jobs[0].ID, "worker-key", `{"progress": 100, "result": "cat"}`, &er); code != 404 {
+		t.Fatalf("expected 404 on canceled job, got %d %+v", code, er)
+	}
+	if code := do(http.MethodPost, "/admin/jobs/"+jobs[0].ID+"/cancel", "admin-key", "", &er); code != 400 {
+		t.Fatalf("expected 400 on canceled job, got %d %+v", code, er)
+	}
+
+	// requeued job is popped again, after the other queued jobs
+	ai = AdminItem{}
+	if code := do(http.MethodPost, "/admin/jobs/"+jobs[0].ID+"/requeue", "admin-key", "", &ai); code != 200 || ai.State != ItemQueued || ai.Item.Canceled {
+		t.Fatalf("unexpected requeue %d %+v", code, ai)
+	}
+	var job Job
+	do(http.MethodGet, "/v1/jobs/"+jobs[0].ID, "submit-key", "", &job)
+	if job.Done || job.Error != "" {
+		t.Fatalf("expected job in progress, got %+v", job)
+	}
+
+	// queued job is dequeued on cancel and delete
+	if code := do(http.MethodPost, "/admin/jobs/"+jobs[1].ID+"/cancel", "admin-key", "", &ai); code != 200 {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := do(http.MethodDelete, "/admin/jobs/"+jobs[2].ID, "admin-key", "", nil); code != 204 {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	if code := do(http.MethodDelete, "/admin/jobs/"+jobs[2].ID, "admin-key", "", &er); code != 404 {
+		t.Fatalf("expected 404, got %d %+v", code, er)
+	}
+	il = AdminItemList{}
+	do(http.MethodGet, "/admin/queues/cats-request/items", "admin-key", "", &il)
+	if len(il.Items) != 3 || il.Items[0].JobID != jobs[3].ID || il.Items[1].JobID != jobs[0].ID || il.Items[2].State != ItemCanceled {
+		t.Fatalf("unexpected items %+v", il)
+	}
+
+	var pr PurgeResponse
+	if code := do(http.MethodDelete, "/admin/queues/cats-request", "admin-key", "", &pr); code != 200 || pr.Purged != 2 {
+		t.Fatalf("unexpected purge %d %+v", code, pr)
+	}
+	do(http.MethodGet, "/v1/jobs/"+jobs[3].ID, "submit-key", "", &job)
+	if !job.Done || job.Error != "purged by operator" {
+		t.Fatalf("expected purged job, got %+v", job)
+	}
+	il = AdminItemList{}
+	do(http.MethodGet, "/admin/queues/cats-request/items", "admin-key", "", &il)
+	for _, it := range il.Items {
+		if it.State != ItemCanceled {
+			t.Fatalf("expected canceled items after purge, got %+v", il)
+		}
+	}
+
+	// image cache
+	var images AdminImageList
+	if code := do(http.MethodGet, "/admin/images", "admin-key", "", &images); code != 200 || len(images.Images) != 4 {
+		t.Fatalf("unexpected images %d %+v", code, images)
+	}
+	if img := images.Images[0]; img.URL != imgServer.URL+"/cat4.jpeg" || img.Digest == "" || img.Size == 0 || img.Refs == 0 {
+		t.Fatalf("expected the most recent image first, got %+v", images)
+	}
+	var ev EvictResponse
+	if code := do(http.MethodDelete, "/admin/images?url="+url.QueryEscape(images.Images[0].URL), "admin-key", "", &ev); code != 200 || ev.Evicted != 1 {
+		t.Fatalf("unexpected evict %d %+v", code, ev)
+	}
+	if code := do(http.MethodDelete, "/admin/images?url="+url.QueryEscape(images.Images[0].URL), "admin-key", "", &er); code != 404 {
+		t.Fatalf("expected 404, got %d %+v", code, er)
+	}
+	ev = EvictResponse{}
+	if code := do(http.MethodDelete, "/admin/images", "admin-key", "", &ev); code != 200 || ev.Evicted != 3 {
+		t.Fatalf("unexpected evict %d %+v", code, ev)
+	}
+
+	// workers and errors
+	var wl AdminWorkerList
+	do(http.MethodGet, "/admin/workers", "admin-key", "", &wl)
+	if len(wl.Workers) != 1 || wl.Workers[0].ID != "key:worker" || wl.Workers[0].Bucket != "/cats-request" || wl.Workers[0].Claimed != 1 {
+		t.Fatalf("unexpected workers %+v", wl)
+	}
+	srv.recentErrors.add(ErrorEntry{Source: "worker", Message: "out of memory"})
+	srv.recentErrors.add(ErrorEntry{Source: "grpc", Message: "unavailable"})
+	var el AdminErrorList
+	do(http.MethodGet, "/admin/errors?source=worker", "admin-key", "", &el)
+	if len(el.Errors) != 1 || el.Errors[0].Message != "out of memory" {
+		t.Fatalf("unexpected errors %+v", el)
+	}
+}
+
+func TestErrorLog(t *testing.T) {
+	var l errorLog
+	if es := l.list(); len(es) != 0 {
+		t.Fatalf("expected no errors, got %+v", es)
+	}
+	for i := 0; i < maxRecentErrors+10; i++ {
+		l.add(ErrorEntry{Message: strconv.Itoa(i)})
+	}
+	es := l.list()
+	if len(es) != maxRecentErrors {
+		t.Fatalf("expected %d errors, got %d", maxRecentErrors, len(es))
+	}
+	if es[0].Message != strconv.Itoa(maxRecentErrors+9) || es[len(es)-1].Message != "10" {
+		t.Fatalf("expected newest first, got %q ... %q", es[0].Message, es[len(es)-1].Message)
+	}
+	if es[0].Time.IsZero() {
+		t.Fatal("expected time of error")
+	}
+}
@@ -0,0 +1,181 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scope is the permission of an API key.
+type Scope string
+
+const (
+	// ScopeSubmit allows to submit, fetch and cancel jobs.
+	ScopeSubmit Scope = "submit"
+	// ScopeWorker allows to claim jobs and report their results.
+	ScopeWorker Scope = "worker"
+	// ScopeAdmin allows to operate queues, jobs, the image cache
+	// and workers under '/admin/'.
+	ScopeAdmin Scope = "admin"
+)
+
+// APIKey describes the API key and its limits.
+type APIKey struct {
+	// Name identifies the key in logs and quotas, without exposing the key.
+	Name   string  `json:"name"`
+	Scopes []Scope `json:"scopes"`
+
+	// DailyQuota is the maximum number of jobs to submit in a day (UTC),
+	// 0 for no limit.
+	DailyQuota int `json:"daily_quota,omitempty"`
+	// MaxConcurrent is the maximum number of jobs in progress,
+	// 0 for no limit.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+}
+
+// HasScope returns true if the key has the scope.
+func (k *APIKey) HasScope(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyHeader is the header field for API key. 'Authorization: Bearer'
+// is also accepted.
+const APIKeyHeader = "X-Api-Key"
+
+// keyFromHeader returns the API key in the request header.
+func keyFromHeader(header http.Header) string {
+	if v := header.Get(APIKeyHeader); v != "" {
+		return v
+	}
+	if v := header.Get("Authorization"); strings.HasPrefix(v, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(v, "Bearer "))
+	}
+	return ""
+}
+
+type apiKeyKeyType struct{}
+
+var apiKeyKey apiKeyKeyType
+
+// authenticate looks up the API key, and returns the context with the key.
+// It is no-op if the server has no key store.
+func authenticate(ctx context.Context, key string, scope Scope) (context.Context, error) {
+	srv := ctx.Value(serverKey).(*Server)
+	if srv.keys == nil || scope == "" {
+		return ctx, nil
+	}
+
+	var k *APIKey
+	if key == "" {
+		k = srv.anonymousKey
+		if k == nil {
+			return ctx, newError(CodeUnauthorized, "missing API key")
+		}
+	} else {
+		var err error
+		k, err = srv.keys.Get(ctx, key)
+		if err == ErrKeyNotFound {
+			return ctx, newError(CodeUnauthorized, "invalid API key")
+		}
+		if err != nil {
+			return ctx, newError(CodeInternal, "failed to look up API key (%v)", err)
+		}
+	}
+	if !k.HasScope(scope) {
+		return ctx, newError(CodeForbidden, "API key %q has no %q scope", k.Name, scope)
+	}
+	return context.WithValue(ctx, apiKeyKey, k), nil
+}
+
+// identity identifies the caller by the name of API key, or by the user ID
+// for requests without API key (e.g. the owner of jobs in history, and
+// workers).
+func identity(ctx context.Context) string {
+	srv := ctx.Value(serverKey).(*Server)
+	if k, ok := ctx.Value(apiKeyKey).(*APIKey); ok && k != srv.anonymousKey {
+		return "key:" + k.Name
+	}
+	return "user:" + ctx.Value(userKey).(string)
+}
+
+// withAuth requires the API key of the scope, and the client certificate
+// of workers and operators with mTLS, before calling the handler.
+func withAuth(h ContextHandler, scope Scope) ContextHandler {
+	return ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+		if err := requireClientCert(ctx, req, scope); err != nil {
+			return writeError(ctx, w, req.URL.Path, err)
+		}
+		ctx, err := authenticate(ctx, keyFromHeader(req.Header), scope)
+		if err != nil {
+			return writeError(ctx, w, req.URL.Path, err)
+		}
+		return h.ServeHTTPContext(ctx, w, req)
+	})
+}
+
+// quota tracks the usage of API keys in memory.
+type quota struct {
+	mu sync.Mutex
+	// days maps key name to the number of jobs submitted on 'day'.
+	day  string
+	days map[string]int
+	// active maps key name to its jobs in progress.
+	active map[string]map[string]struct{}
+	// owners maps request ID to the key name that submitted it.
+	owners map[string]string
+}
+
+func newQuota() *quota {
+	return &quota{
+		days:   make(map[string]int),
+		active: make(map[string]map[string]struct{}),
+		owners: make(map[string]string),
+	}
+}
+
+// acquire counts the new job against the limits of the key.
+func (q *quota) acquire(k *APIKey, requestID string, now time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if day := now.UTC().Format("2006-01-02"); day != q.day {
+		q.day, q.days = day, make(map[string]int)
+	}
+	if k.DailyQuota > 0 && q.days[k.Name] >= k.DailyQuota {
+		return newError(CodeQuotaExceeded, "API key %q exceeded daily quota %d", k.Name, k.DailyQuota)
+	}
+	if k.MaxConcurrent > 0 && len(q.active[k.Name]) >= k.MaxConcurrent {
+		return newError(CodeQuotaExceeded, "API key %q exceeded %d concurrent jobs", k.Name, k.MaxConcurrent)
+	}
+
+	q.days[k.Name]++
+	if q.active[k.Name] == nil {
+		q.active[k.Name] = make(map[string]struct{})
+	}
+	q.active[k.Name][requestID] = struct{}{}
+	q.owners[requestID] = k.Name
+	return nil
+}
+
+// release stops counting the job as in progress, once completed or deleted.
+func (q *quota) release(requestID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	name, ok := q.owners[requestID]
+	if !ok {
+		return
+	}
+	delete(q.owners, requestID)
+	delete(q.active[name], requestID)
+	if len(q.active[name]) == 0 {
+		delete(q.active, name)
+	}
+}
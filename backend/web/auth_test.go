@@ -0,0 +1,257 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gyuho/dplearn/backend/web/webpb"
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestQuota(t *testing.T) {
+	q := newQuota()
+	k := &APIKey{Name: "a", DailyQuota: 3, MaxConcurrent: 2}
+	now := time.Date(2017, 12, 1, 10, 0, 0, 0, time.UTC)
+
+	if err := q.acquire(k, "1", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.acquire(k, "2", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.acquire(k, "3", now); toError(err).Code != CodeQuotaExceeded {
+		t.Fatalf("expected concurrency limit, got %v", err)
+	}
+	q.release("1")
+	q.release("1")
+	if err := q.acquire(k, "3", now); err != nil {
+		t.Fatal(err)
+	}
+	q.release("2")
+	if err := q.acquire(k, "4", now); toError(err).Code != CodeQuotaExceeded {
+		t.Fatalf("expected daily quota, got %v", err)
+	}
+	if err := q.acquire(k, "4", now.Add(24*time.Hour)); err != nil {
+		t.Fatalf("expected quota reset on next day, got %v", err)
+	}
+	if err := q.acquire(&APIKey{Name: "b"}, "5", now); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	defer ts.Close()
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	dir, err := ioutil.TempDir(os.TempDir(), "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "keys.json")
+	if err = ioutil.WriteFile(keyPath, []byte(`[
+	{"name": "client", "key": "submit-key", "scopes": ["submit"], "max_concurrent": 1},
+	{"name": "worker", "sha256": "`+hashKey("worker-key")+`", "scopes": ["worker"]},
+	{"name": "other", "key": "other-key", "scopes": ["submit"]}
+]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv.keys, err = NewFileKeyStore(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.quota = newQuota()
+
+	do := func(method, p, key, body string, v interface{}) int {
+		req, err := http.NewRequest(method, ts.URL+p, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if v != nil {
+			if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("%s %q: %v", method, p, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	input := `{"input": "` + imgServer.URL + `/1.jpg"}`
+	var er ErrorResponse
+	if code := do(http.MethodPost, "/v1/models/cats/jobs", "", input, &er); code != 401 || er.Error.Code != CodeUnauthorized {
+		t.Fatalf("expected 401, got %d %+v", code, er)
+	}
+	if code := do(http.MethodPost, "/v1/models/cats/jobs", "wrong-key", input, &er); code != 401 {
+		t.Fatalf("expected 401, got %d %+v", code, er)
+	}
+	if code := do(http.MethodPost, "/v1/models/cats/jobs", "worker-key", input, &er); code != 403 || er.Error.Code != CodeForbidden {
+		t.Fatalf("expected 403, got %d %+v", code, er)
+	}
+	var job Job
+	if code := do(http.MethodPost, "/v1/models/cats/jobs", "submit-key", input, &job); code != 201 {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if code := do(http.MethodPost, "/v1/models/cats/jobs", "submit-key", `{"input": "`+imgServer.URL+`/2.jpg"}`, &er); code != 429 || er.Error.Code != CodeQuotaExceeded {
+		t.Fatalf("expected 429, got %d %+v", code, er)
+	}
+
+	// workers cannot be faked with submit key
+	if code := do(http.MethodPatch, "/v1/jobs/"+job.ID, "submit-key", `{"progress": 100, "result": "fake"}`, &er); code != 403 {
+		t.Fatalf("expected 403, got %d %+v", code, er)
+	}
+	if code := do(http.MethodPost, "/cats-request/queue", "submit-key", `{}`, &er); code != 403 {
+		t.Fatalf("expected 403 on legacy route, got %d %+v", code, er)
+	}
+	var item queue.Item
+	if code := do(http.MethodPost, "/v1/queues/cats-request/claim", "worker-key", "", &item); code != 200 || item.RequestID != job.RequestID {
+		t.Fatalf("unexpected claim %d %+v", code, item)
+	}
+	if code := do(http.MethodPatch, "/v1/jobs/"+job.ID, "worker-key", `{"progress": 100, "result": "cat"}`, &job); code != 200 || !job.Done {
+		t.Fatalf("unexpected update %d %+v", code, job)
+	}
+
+	// completed job no longer counts against the concurrency limit
+	var job2 Job
+	if code := do(http.MethodPost, "/v1/models/cats/jobs", "submit-key", `{"input": "`+imgServer.URL+`/2.jpg"}`, &job2); code != 201 {
+		t.Fatalf("expected 201, got %d", code)
+	}
+
+	// workers cannot update jobs they have not claimed
+	if code := do(http.MethodPatch, "/v1/jobs/"+job2.ID, "worker-key", `{"progress": 100, "result": "fake"}`, &er); code != 403 || er.Error.Code != CodeForbidden {
+		t.Fatalf("expected 403 on unclaimed job, got %d %+v", code, er)
+	}
+	legacy, err := json.Marshal(queue.Item{Bucket: "/cats-request", Key: "k", Value: "v", RequestID: job2.RequestID, Progress: 101})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := do(http.MethodPost, "/cats-request/queue", "worker-key", string(legacy), &er); code != 400 || er.Error.Code != CodeValidation {
+		t.Fatalf("expected 400 on progress out of range, got %d %+v", code, er)
+	}
+
+	// jobs of other keys are not found
+	if code := do(http.MethodGet, "/v1/jobs/"+job2.ID, "other-key", "", &er); code != 404 || er.Error.Code != CodeNotFound {
+		t.Fatalf("expected 404 on job of other key, got %d %+v", code, er)
+	}
+	if code := do(http.MethodDelete, "/v1/jobs/"+job2.ID, "other-key", "", &er); code != 404 {
+		t.Fatalf("expected 404 on deleting job of other key, got %d %+v", code, er)
+	}
+	if code := do(http.MethodGet, "/v1/jobs/"+job2.ID, "submit-key", "", &job2); code != 200 {
+		t.Fatalf("expected 200 on own job, got %d", code)
+	}
+
+	// same input of other keys creates their own jobs
+	var otherJob Job
+	if code := do(http.MethodPost, "/v1/models/cats/jobs", "other-key", input, &otherJob); code != 201 || otherJob.ID == job.ID || otherJob.Result != "" {
+		t.Fatalf("expected new job of other key, got %d %+v", code, otherJob)
+	}
+	if code := do(http.MethodGet, "/v1/jobs/"+otherJob.ID, "other-key", "", &otherJob); code != 200 {
+		t.Fatalf("expected 200 on own job, got %d", code)
+	}
+	// legacy cancel of other keys does not delete the job
+	do(http.MethodPost, "/cats-request", "other-key", `{"data_from_frontend": "`+imgServer.URL+`/2.jpg", "create_request": false}`, nil)
+	if _, err = srv.getRequest(job2.RequestID); err != nil {
+		t.Fatalf("expected job of submit key after legacy cancel of other key (%v)", err)
+	}
+	if code := do(http.MethodGet, "/v1/openapi.json", "", "", nil); code != 200 {
+		t.Fatalf("expected public OpenAPI document, got %d", code)
+	}
+
+	// anonymous key for the current frontend
+	srv.anonymousKey = &APIKey{Name: "anonymous", Scopes: []Scope{ScopeSubmit}}
+	if code := do(http.MethodPost, "/v1/models/cats/jobs", "", `{"input": "`+imgServer.URL+`/3.jpg"}`, &job); code != 201 {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if code := do(http.MethodPost, "/v1/queues/cats-request/claim", "", "", &er); code != 403 {
+		t.Fatalf("expected 403, got %d %+v", code, er)
+	}
+	srv.anonymousKey = nil
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := newGRPCServer(srv, nil)
+	go gs.Serve(ln)
+	defer gs.Stop()
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cli := webpb.NewQueueClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err = cli.Enqueue(ctx, &webpb.EnqueueRequest{Model: "cats", Input: imgServer.URL + "/4.jpg"}); grpc.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected Unauthenticated, got %v", err)
+	}
+	wctx := metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", "Bearer worker-key"))
+	if _, err = cli.Enqueue(wctx, &webpb.EnqueueRequest{Model: "cats", Input: imgServer.URL + "/4.jpg"}); grpc.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+	cc, err := cli.Claim(wctx, &webpb.ClaimRequest{Model: "cats"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := cc.Recv(); err != nil || claimed.RequestID != job2.RequestID {
+		t.Fatalf("unexpected claim %+v (%v)", claimed, err)
+	}
+}
+
+func TestEtcdKeyStore(t *testing.T) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	qu, err := queue.NewEmbeddedQueue(ctx, 5575, 5576, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ks := NewEtcdKeyStore(qu.Client(), "_auth/keys")
+	if _, err = ks.Get(ctx, "foo"); err != ErrKeyNotFound {
+		t.Fatalf("expected %v, got %v", ErrKeyNotFound, err)
+	}
+	if err = ks.Put(ctx, "foo", APIKey{Name: "foo", Scopes: []Scope{ScopeWorker}}); err != nil {
+		t.Fatal(err)
+	}
+	k, err := ks.Get(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Name != "foo" || !k.HasScope(ScopeWorker) || k.HasScope(ScopeSubmit) {
+		t.Fatalf("unexpected key %+v", k)
+	}
+	if err = ks.Delete(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ks.Get(ctx, "foo"); err != ErrKeyNotFound {
+		t.Fatalf("expected %v, got %v", ErrKeyNotFound, err)
+	}
+}
@@ -0,0 +1,505 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/lru"
+	"github.com/gyuho/dplearn/pkg/trace"
+
+	"github.com/golang/glog"
+)
+
+// maxBatchBodySize is the maximum size of batch inputs, in JSON, JSONL or CSV.
+const maxBatchBodySize = 32 << 20
+
+// Batch is the v1 representation of jobs submitted together.
+type Batch struct {
+	// ID identifies the batch in v1 paths (e.g. '/v1/batches/{id}').
+	ID    string `json:"id"`
+	Model string `json:"model"`
+	// Total is the number of inputs.
+	Total int `json:"total"`
+	// Completed is the number of inputs whose jobs are done,
+	// or failed to be created.
+	Completed int `json:"completed"`
+	// Failed is the number of completed inputs with errors.
+	Failed int `json:"failed"`
+	// Progress is the average progress of all inputs, from 0 to 100.
+	Progress int `json:"progress"`
+	// Done is true if all inputs are completed.
+	Done      bool      `json:"done"`
+	CreatedAt time.Time `json:"created_at"`
+	// TraceID is the trace ID of the request that created the batch.
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// CreateBatchRequest is the JSON body of 'POST /v1/models/{model}/batches'.
+// Inputs can also be sent as JSONL of 'CreateJobRequest', or CSV whose
+// first column is the input, in the body or as the uploaded "file".
+type CreateBatchRequest struct {
+	Inputs []string `json:"inputs"`
+}
+
+// BatchResult is the line of 'GET /v1/batches/{id}/results',
+// in the order of inputs.
+type BatchResult struct {
+	// Index is the index of the input, from 0.
+	Index int    `json:"index"`
+	Input string `json:"input"`
+	// JobID is empty if the job failed to be created
+	// (e.g. failed to download the image).
+	JobID  string `json:"job_id,omitempty"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// batch tracks the jobs of the inputs.
+type batch struct {
+	id        string
+	model     string
+	createdAt time.Time
+	traceID   string
+	// owner is the identity of the creator, the only one to read it.
+	owner string
+
+	mu      sync.Mutex
+	results []BatchResult
+	// done is true for the completed results.
+	done      []bool
+	completed int
+	failed    int
+	doneAt    time.Time
+	// requestIDs maps the request ID of each job to its input indexes,
+	// since the same inputs share the job.
+	requestIDs map[string][]int
+	// changed is closed and replaced on every completion.
+	changed chan struct{}
+}
+
+func newBatchID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func newBatch(model string, inputs []string, traceID, owner string) *batch {
+	b := &batch{
+		id:         newBatchID(),
+		model:      model,
+		createdAt:  time.Now(),
+		traceID:    traceID,
+		owner:      owner,
+		results:    make([]BatchResult, len(inputs)),
+		done:       make([]bool, len(inputs)),
+		requestIDs: make(map[string][]int),
+		changed:    make(chan struct{}),
+	}
+	for i, input := range inputs {
+		b.results[i] = BatchResult{Index: i, Input: input}
+	}
+	return b
+}
+
+// created records the job of the input.
+func (b *batch) created(i int, requestID string) {
+	b.mu.Lock()
+	b.results[i].JobID = jobID(requestID)
+	b.requestIDs[requestID] = append(b.requestIDs[requestID], i)
+	b.mu.Unlock()
+}
+
+// complete completes the input, only once.
+func (b *batch) complete(i int, result, errMsg string) {
+	b.mu.Lock()
+	b.completeLocked(i, result, errMsg)
+	b.mu.Unlock()
+}
+
+// completeJob completes the inputs of the job.
+func (b *batch) completeJob(requestID, result, errMsg string) {
+	b.mu.Lock()
+	for _, i := range b.requestIDs[requestID] {
+		b.completeLocked(i, result, errMsg)
+	}
+	delete(b.requestIDs, requestID)
+	b.mu.Unlock()
+}
+
+func (b *batch) completeLocked(i int, result, errMsg string) {
+	if b.done[i] {
+		return
+	}
+	b.done[i] = true
+	b.results[i].Result, b.results[i].Error = result, errMsg
+	b.completed++
+	if errMsg != "" {
+		b.failed++
+	}
+	if b.completed == len(b.results) {
+		b.doneAt = time.Now()
+	}
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// result returns the result of the input if completed, or the channel
+// to wait for the next completion.
+func (b *batch) result(i int) (BatchResult, bool, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.results[i], b.done[i], b.changed
+}
+
+// status returns the batch, with the progress of jobs in the cache.
+func (b *batch) status(srv *Server) *Batch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	resp := &Batch{
+		ID:        b.id,
+		Model:     b.model,
+		Total:     len(b.results),
+		Completed: b.completed,
+		Failed:    b.failed,
+		Done:      b.completed == len(b.results),
+		CreatedAt: b.createdAt,
+		TraceID:   b.traceID,
+	}
+	sum := b.completed * queue.MaxProgress
+	for requestID := range b.requestIDs {
+		if item, err := srv.getRequest(requestID); err == nil && item.Progress < queue.MaxProgress {
+			sum += item.Progress * len(b.requestIDs[requestID])
+		}
+	}
+	if resp.Total > 0 {
+		resp.Progress = sum / resp.Total
+	}
+	return resp
+}
+
+// batchStore keeps batches in memory, and completes their inputs
+// when the jobs are done or deleted.
+type batchStore struct {
+	mu      sync.Mutex
+	batches map[string]*batch
+	// jobs maps request IDs to the batches waiting for the jobs.
+	jobs map[string][]*batch
+}
+
+func (s *batchStore) add(b *batch) {
+	s.mu.Lock()
+	if s.batches == nil {
+		s.batches = make(map[string]*batch)
+	}
+	s.batches[b.id] = b
+	s.mu.Unlock()
+}
+
+func (s *batchStore) get(id string) (*batch, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.batches[id]
+	return b, ok
+}
+
+// wait registers the batch waiting for the job.
+func (s *batchStore) wait(b *batch, requestID string) {
+	s.mu.Lock()
+	if s.jobs == nil {
+		s.jobs = make(map[string][]*batch)
+	}
+	s.jobs[requestID] = append(s.jobs[requestID], b)
+	s.mu.Unlock()
+}
+
+// pending returns true if any batch waits for the job, so that the job
+// is kept in the cache until done.
+func (s *batchStore) pending(requestID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.jobs[requestID]) > 0
+}
+
+// report completes the inputs of the job, if done.
+func (s *batchStore) report(item *queue.Item) {
+	if item.Progress < queue.MaxProgress {
+		return
+	}
+	result := ""
+	if item.Error == "" {
+		result = item.Value
+	}
+	s.finish(item.RequestID, result, item.Error)
+}
+
+// finish completes the inputs of the job.
+func (s *batchStore) finish(requestID, result, errMsg string) {
+	s.mu.Lock()
+	bs := s.jobs[requestID]
+	delete(s.jobs, requestID)
+	s.mu.Unlock()
+	for _, b := range bs {
+		b.completeJob(requestID, result, errMsg)
+	}
+}
+
+// gc deletes the batches completed before the retention.
+func (s *batchStore) gc(now time.Time, retention time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, b := range s.batches {
+		b.mu.Lock()
+		expired := !b.doneAt.IsZero() && now.Sub(b.doneAt) > retention
+		b.mu.Unlock()
+		if expired {
+			glog.Infof("deleted batch %q completed at %s", id, b.doneAt)
+			delete(s.batches, id)
+		}
+	}
+}
+
+// runBatch creates the jobs of the inputs, downloading at most
+// 'Config.BatchConcurrency' inputs at a time. The context outlives
+// the request that created the batch.
+func (srv *Server) runBatch(ctx context.Context, b *batch, bucket string) {
+	idxc := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(srv.cfg.BatchConcurrency)
+	for n := 0; n < srv.cfg.BatchConcurrency; n++ {
+		go func() {
+			defer wg.Done()
+			for i := range idxc {
+				srv.createBatchJob(ctx, b, bucket, i)
+			}
+		}()
+	}
+	for i := range b.results {
+		idxc <- i
+	}
+	close(idxc)
+	wg.Wait()
+	glog.Infof("created jobs of batch %q (%d inputs)", b.id, len(b.results))
+}
+
+func (srv *Server) createBatchJob(ctx context.Context, b *batch, bucket string, i int) {
+	// each job has its own log entry, for its request ID
+	ctx = context.WithValue(ctx, traceKey, &AccessLog{TraceID: b.traceID})
+	input := b.results[i].Input
+	item, _, err := createRequest(ctx, bucket, input)
+	if err != nil {
+		b.complete(i, "", toError(err).Message)
+		return
+	}
+	b.created(i, item.RequestID)
+	srv.batches.wait(b, item.RequestID)
+
+	// the job may have been done or deleted before waiting
+	cur, err := srv.getRequest(item.RequestID)
+	switch {
+	case err != nil:
+		srv.batches.finish(item.RequestID, "", "job was deleted")
+	case cur.Progress >= queue.MaxProgress:
+		srv.batches.report(cur)
+	}
+}
+
+// batchContext returns the context of the batch, with the values of the
+// request (e.g. user and API key), canceled only when the server stops.
+func batchContext(ctx context.Context) context.Context {
+	srv := ctx.Value(serverKey).(*Server)
+	bctx := withValues(srv.rootCtx, srv, ctx.Value(queueKey).(queue.Queue), ctx.Value(cacheKey).(lru.Cache), ctx.Value(userKey).(string))
+	if k, ok := ctx.Value(apiKeyKey).(*APIKey); ok {
+		bctx = context.WithValue(bctx, apiKeyKey, k)
+	}
+	return trace.WithRemoteParent(bctx, trace.SpanContextFrom(ctx))
+}
+
+// readBatchInputs reads the inputs in JSON, JSONL or CSV, from the body
+// or the uploaded "file" of multipart form.
+func readBatchInputs(w http.ResponseWriter, req *http.Request, limit int) ([]string, error) {
+	req.Body = http.MaxBytesReader(w, req.Body, maxBatchBodySize)
+	defer req.Body.Close()
+
+	ct, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		ct = "application/json"
+	}
+	var inputs []string
+	if ct == "multipart/form-data" {
+		f, fh, ferr := req.FormFile("file")
+		if ferr != nil {
+			return nil, newError(CodeValidation, "failed to read uploaded file (%v)", ferr)
+		}
+		defer f.Close()
+		switch strings.ToLower(filepath.Ext(fh.Filename)) {
+		case ".json":
+			ct = "application/json"
+		case ".jsonl", ".ndjson":
+			ct = "application/x-ndjson"
+		case ".csv":
+			ct = "text/csv"
+		default:
+			ct, _, _ = mime.ParseMediaType(fh.Header.Get("Content-Type"))
+		}
+		inputs, err = decodeBatchInputs(ct, f)
+	} else {
+		inputs, err = decodeBatchInputs(ct, req.Body)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(inputs) == 0 {
+		return nil, newError(CodeValidation, "empty inputs")
+	}
+	if len(inputs) > limit {
+		return nil, newError(CodeTooLarge, "%d inputs exceed the limit %d", len(inputs), limit)
+	}
+	for i, input := range inputs {
+		if input == "" {
+			return nil, newError(CodeValidation, "empty input at index %d", i)
+		}
+	}
+	return inputs, nil
+}
+
+func decodeBatchInputs(contentType string, r io.Reader) ([]string, error) {
+	switch contentType {
+	case "application/json":
+		var creq CreateBatchRequest
+		if err := json.NewDecoder(r).Decode(&creq); err != nil {
+			return nil, newError(CodeValidation, "JSON parse error %q", err.Error())
+		}
+		return creq.Inputs, nil
+
+	case "application/x-ndjson", "application/jsonl", "application/x-jsonlines":
+		var inputs []string
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), maxBatchBodySize)
+		for line := 1; scanner.Scan(); line++ {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			var creq CreateJobRequest
+			if err := json.Unmarshal(scanner.Bytes(), &creq); err != nil {
+				return nil, newError(CodeValidation, "JSON parse error %q at line %d", err.Error(), line)
+			}
+			inputs = append(inputs, creq.Input)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, newError(CodeValidation, "failed to read JSONL (%v)", err)
+		}
+		return inputs, nil
+
+	case "text/csv":
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		records, err := cr.ReadAll()
+		if err != nil {
+			return nil, newError(CodeValidation, "CSV parse error %q", err.Error())
+		}
+		var inputs []string
+		for i, rec := range records {
+			input := strings.TrimSpace(rec[0])
+			if i == 0 && strings.EqualFold(input, "input") {
+				continue // header
+			}
+			inputs = append(inputs, input)
+		}
+		return inputs, nil
+
+	default:
+		return nil, newError(CodeValidation, "unsupported content type %q (expected JSON, JSONL or CSV)", contentType)
+	}
+}
+
+func createBatchHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	bucket, ok := models[params["model"]]
+	if !ok {
+		return writeErrorResponse(w, newError(CodeNotFound, "unknown model %q", params["model"]))
+	}
+	if srv.draining() {
+		return writeErrorResponse(w, errShuttingDown)
+	}
+	inputs, err := readBatchInputs(w, req, srv.cfg.MaxBatchSize)
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+
+	b := newBatch(params["model"], inputs, traceID(ctx), identity(ctx))
+	srv.batches.add(b)
+	glog.Infof("creating batch %q of %d inputs", b.id, len(inputs))
+	go srv.runBatch(batchContext(ctx), b, bucket)
+
+	w.Header().Set("Location", "/v1/batches/"+b.id)
+	return writeJSON(w, http.StatusAccepted, b.status(srv))
+}
+
+// getOwnBatch returns the batch created by the caller. Batches of others
+// are not found, same as jobs.
+func getOwnBatch(ctx context.Context, id string) (*batch, error) {
+	srv := ctx.Value(serverKey).(*Server)
+	b, ok := srv.batches.get(id)
+	if !ok || b.owner != identity(ctx) {
+		return nil, newError(CodeNotFound, "cannot find batch %q", id)
+	}
+	return b, nil
+}
+
+func getBatchHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	b, err := getOwnBatch(ctx, params["id"])
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	return writeJSON(w, http.StatusOK, b.status(srv))
+}
+
+// batchResultsHandler streams the results in JSONL, in the order of inputs,
+// waiting for each input to complete.
+func batchResultsHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	b, err := getOwnBatch(ctx, params["id"])
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for i := range b.results {
+		r, done, changed := b.result(i)
+		for !done {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			r, done, changed = b.result(i)
+		}
+		if err := enc.Encode(&r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
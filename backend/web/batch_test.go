@@ -0,0 +1,271 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func TestBatch(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	defer ts.Close()
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	inputs := []string{
+		imgServer.URL + "/cat1.jpeg",
+		imgServer.URL + "/cat.gif",
+		imgServer.URL + "/cat2.jpeg",
+		imgServer.URL + "/cat1.jpeg",
+	}
+	body, _ := json.Marshal(CreateBatchRequest{Inputs: inputs})
+
+	var er ErrorResponse
+	if resp := doJSON(t, http.MethodPost, ts.URL+"/v1/models/dogs/batches", string(body), &er); resp.StatusCode != 404 {
+		t.Fatalf("expected 404, got %d %+v", resp.StatusCode, er)
+	}
+	if resp := doJSON(t, http.MethodPost, ts.URL+"/v1/models/cats/batches", `{"inputs": []}`, &er); resp.StatusCode != 400 || er.Error.Code != CodeValidation {
+		t.Fatalf("expected validation error, got %d %+v", resp.StatusCode, er)
+	}
+
+	var b Batch
+	resp := doJSON(t, http.MethodPost, ts.URL+"/v1/models/cats/batches", string(body), &b)
+	if resp.StatusCode != 202 || b.ID == "" || b.Model != "cats" || b.Total != 4 || b.Done {
+		t.Fatalf("unexpected batch %d %+v", resp.StatusCode, b)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/v1/batches/"+b.ID {
+		t.Fatalf("unexpected location %q", loc)
+	}
+
+	// results are streamed as inputs complete
+	linec := make(chan BatchResult, len(inputs))
+	go func() {
+		defer close(linec)
+		resp, err := http.Get(ts.URL + "/v1/batches/" + b.ID + "/results")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("unexpected content type %q", ct)
+		}
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var r BatchResult
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				t.Error(err)
+				return
+			}
+			linec <- r
+		}
+	}()
+
+	// two jobs, since the same input shares the job
+	var items [2]queue.Item
+	for i := range items {
+		doJSON(t, http.MethodPost, ts.URL+"/v1/queues/cats-request/claim", "", &items[i])
+	}
+	if !srv.batches.pending(items[0].RequestID) {
+		t.Fatalf("expected %q to be pending", items[0].RequestID)
+	}
+
+	select {
+	case r := <-linec:
+		t.Fatalf("unexpected result before jobs are done %+v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	doJSON(t, http.MethodGet, ts.URL+"/v1/batches/"+b.ID, "", &b)
+	if b.Completed != 1 || b.Failed != 1 || b.Done {
+		t.Fatalf("expected the failed input to be completed, got %+v", b)
+	}
+
+	// batches of others are not found
+	for _, p := range []string{"/v1/batches/" + b.ID, "/v1/batches/" + b.ID + "/results"} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("User-Agent", "other")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Fatalf("%q: expected 404 for other user, got %d", p, resp.StatusCode)
+		}
+	}
+
+	// one job is done, and the other is deleted
+	done, deleted := jobID(items[0].RequestID), jobID(items[1].RequestID)
+	var job Job
+	doJSON(t, http.MethodPatch, ts.URL+"/v1/jobs/"+done, `{"progress": 50}`, &job)
+	doJSON(t, http.MethodGet, ts.URL+"/v1/batches/"+b.ID, "", &b)
+	if b.Progress == 0 || b.Progress == 100 {
+		t.Fatalf("expected partial progress, got %+v", b)
+	}
+	doJSON(t, http.MethodPatch, ts.URL+"/v1/jobs/"+done, `{"progress": 100, "result": "cat"}`, &job)
+	if resp = doJSON(t, http.MethodDelete, ts.URL+"/v1/jobs/"+deleted, "", nil); resp.StatusCode != 204 {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+
+	var results []BatchResult
+	for r := range linec {
+		results = append(results, r)
+	}
+	if len(results) != len(inputs) {
+		t.Fatalf("expected %d results, got %+v", len(inputs), results)
+	}
+	for i, r := range results {
+		if r.Index != i || r.Input != inputs[i] {
+			t.Fatalf("#%d: unexpected result %+v", i, r)
+		}
+		switch r.JobID {
+		case "":
+			if i != 1 || r.Error == "" {
+				t.Fatalf("#%d: expected failed input without job, got %+v", i, r)
+			}
+		case done:
+			if r.Result != "cat" || r.Error != "" {
+				t.Fatalf("#%d: expected result, got %+v", i, r)
+			}
+		case deleted:
+			if r.Error != "job was deleted" {
+				t.Fatalf("#%d: expected deleted job, got %+v", i, r)
+			}
+		default:
+			t.Fatalf("#%d: unexpected job %+v", i, r)
+		}
+	}
+	if results[0].JobID != results[3].JobID {
+		t.Fatalf("expected the same job of the same input, got %+v and %+v", results[0], results[3])
+	}
+
+	doJSON(t, http.MethodGet, ts.URL+"/v1/batches/"+b.ID, "", &b)
+	if !b.Done || b.Completed != 4 || b.Progress != 100 {
+		t.Fatalf("expected done batch, got %+v", b)
+	}
+
+	srv.batches.gc(time.Now().Add(2*srv.cfg.BatchRetention), srv.cfg.BatchRetention)
+	if resp = doJSON(t, http.MethodGet, ts.URL+"/v1/batches/"+b.ID, "", &er); resp.StatusCode != 404 {
+		t.Fatalf("expected 404 after retention, got %d", resp.StatusCode)
+	}
+}
+
+func TestReadBatchInputs(t *testing.T) {
+	multipartBody := func(filename, data string) (string, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		fw, err := mw.CreateFormFile("file", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(data))
+		mw.Close()
+		return mw.FormDataContentType(), buf.String()
+	}
+	csvType, csvBody := multipartBody("inputs.csv", "input,label\na.jpg,cat\nb.jpg,dog\n")
+	jsonlType, jsonlBody := multipartBody("inputs.jsonl", `{"input": "a.jpg"}`+"\n")
+
+	tests := []struct {
+		contentType string
+		body        string
+
+		inputs []string
+		code   ErrorCode
+	}{
+		{"application/json", `{"inputs": ["a.jpg", "b.jpg"]}`, []string{"a.jpg", "b.jpg"}, ""},
+		{"", `{"inputs": ["a.jpg"]}`, []string{"a.jpg"}, ""},
+		{"application/x-ndjson", `{"input": "a.jpg"}` + "\n\n" + `{"input": "b.jpg"}` + "\n", []string{"a.jpg", "b.jpg"}, ""},
+		{"application/x-ndjson", `{"input": "a.jpg"}` + "\n" + `{"input":`, nil, CodeValidation},
+		{"text/csv; charset=utf-8", "a.jpg\nb.jpg,extra\n", []string{"a.jpg", "b.jpg"}, ""},
+		{csvType, csvBody, []string{"a.jpg", "b.jpg"}, ""},
+		{jsonlType, jsonlBody, []string{"a.jpg"}, ""},
+		{"application/json", `{"inputs": ["a.jpg", "b.jpg", "c.jpg"]}`, nil, CodeTooLarge},
+		{"application/json", `{"inputs": ["a.jpg", ""]}`, nil, CodeValidation},
+		{"text/plain", "a.jpg", nil, CodeValidation},
+		{"text/csv", "", nil, CodeValidation},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/v1/models/cats/batches", strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		inputs, err := readBatchInputs(httptest.NewRecorder(), req, 2)
+		if tt.code != "" {
+			if e, ok := err.(*Error); !ok || e.Code != tt.code {
+				t.Fatalf("#%d: expected %q, got %v", i, tt.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(inputs, tt.inputs) {
+			t.Fatalf("#%d: expected %q, got %q", i, tt.inputs, inputs)
+		}
+	}
+}
+
+func TestBatchJobTimeout(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	defer ts.Close()
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	var b Batch
+	doJSON(t, http.MethodPost, ts.URL+"/v1/models/cats/batches", `{"inputs": ["`+imgServer.URL+`/cat.jpeg"]}`, &b)
+
+	// worker claims the job, and dies
+	var item queue.Item
+	doJSON(t, http.MethodPost, ts.URL+"/v1/queues/cats-request/claim", "", &item)
+	for i := 0; !srv.batches.pending(item.RequestID); i++ {
+		if i == 50 {
+			t.Fatalf("expected %q to be pending", item.RequestID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	srv.gc(time.Now(), srv.cfg.GCPeriod)
+	doJSON(t, http.MethodGet, ts.URL+"/v1/batches/"+b.ID, "", &b)
+	if b.Done {
+		t.Fatalf("expected batch in progress before timeout, got %+v", b)
+	}
+
+	now := time.Now().Add(srv.cfg.BatchJobTimeout + time.Minute)
+	srv.gc(now, srv.cfg.GCPeriod)
+	doJSON(t, http.MethodGet, ts.URL+"/v1/batches/"+b.ID, "", &b)
+	if !b.Done || b.Failed != 1 {
+		t.Fatalf("expected failed batch after timeout, got %+v", b)
+	}
+	var r BatchResult
+	resp, err := http.Get(ts.URL + "/v1/batches/" + b.ID + "/results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(r.Error, "timed out") {
+		t.Fatalf("expected timed out result, got %+v", r)
+	}
+
+	srv.gc(now, srv.cfg.GCPeriod)
+	if _, err = srv.getRequest(item.RequestID); err == nil {
+		t.Fatalf("expected %q to be deleted after timeout", item.RequestID)
+	}
+}
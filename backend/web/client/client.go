@@ -0,0 +1,307 @@
+// Package client implements the Go client of backend/web HTTP API.
+//
+// Backend reports errors with the JSON error envelope and 4xx or 5xx
+// status, or in the 'error' field of the response item with 200 status
+// in legacy mode. The client converts both to *Error.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+// RequestIDHeader is the header field for request ID,
+// same as 'web.RequestIDHeader'.
+const RequestIDHeader = "Request-Id"
+
+// Error is the error reported by backend.
+type Error struct {
+	Bucket string
+	// StatusCode is the HTTP status code, 200 in legacy mode.
+	StatusCode int
+	// Code is the error code (e.g. "not_found"), empty in legacy mode.
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%s: %s", e.Bucket, e.Message)
+	}
+	return fmt.Sprintf("%s: %s (%s)", e.Bucket, e.Message, e.Code)
+}
+
+// errorResponse is the error envelope, same as 'web.ErrorResponse'.
+type errorResponse struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// request is the request body, same as 'web.Request'.
+type request struct {
+	DataFromFrontend string `json:"data_from_frontend"`
+	CreateRequest    bool   `json:"create_request"`
+}
+
+// Op configures the client.
+type Op struct {
+	client       *http.Client
+	pollInterval time.Duration
+	apiKey       string
+}
+
+// OpOption configures the client.
+type OpOption func(*Op)
+
+// WithHTTPClient sets the HTTP client. Queue endpoints block until an
+// item is available, so the client should not have timeout to claim items.
+func WithHTTPClient(cli *http.Client) OpOption {
+	return func(op *Op) { op.client = cli }
+}
+
+// WithPollInterval sets the interval to poll request status.
+func WithPollInterval(d time.Duration) OpOption {
+	return func(op *Op) { op.pollInterval = d }
+}
+
+// WithAPIKey sets the API key, when backend requires keys. Submitting
+// requires 'submit' scope, and claiming or updating requires 'worker' scope.
+func WithAPIKey(key string) OpOption {
+	return func(op *Op) { op.apiKey = key }
+}
+
+func (op *Op) applyOpts(opts []OpOption) {
+	for _, opt := range opts {
+		opt(op)
+	}
+}
+
+// Client sends requests to backend/web.
+type Client struct {
+	endpoint string
+	op       Op
+}
+
+// New returns a new client of the backend endpoint
+// (e.g. "http://localhost:2200").
+func New(endpoint string, opts ...OpOption) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("client: invalid endpoint %q", endpoint)
+	}
+	op := Op{client: http.DefaultClient, pollInterval: time.Second}
+	op.applyOpts(opts)
+	return &Client{endpoint: strings.TrimSuffix(endpoint, "/"), op: op}, nil
+}
+
+// Handle identifies the submitted request.
+type Handle struct {
+	// RequestID is generated by backend, and sent in 'Request-Id' header.
+	RequestID string
+	// Model is the name of the model (e.g. "cats").
+	Model string
+	// Input is the submitted input (e.g. image URL).
+	Input string
+}
+
+// bucket returns the bucket of the model (e.g. "/cats-request").
+func bucket(model string) string {
+	return "/" + model + "-request"
+}
+
+// Submit schedules the input for the model (e.g. "cats" and an image URL).
+func (c *Client) Submit(ctx context.Context, model, input string) (*Handle, error) {
+	if model == "" || input == "" {
+		return nil, fmt.Errorf("client: empty model or input")
+	}
+	item, header, err := c.do(ctx, http.MethodPost, bucket(model), nil, &request{DataFromFrontend: input, CreateRequest: true})
+	if err != nil {
+		return nil, err
+	}
+	requestID := header.Get(RequestIDHeader)
+	if requestID == "" && item != nil {
+		// older backend without the header
+		requestID = item.RequestID
+	}
+	if requestID == "" {
+		return nil, fmt.Errorf("client: no request ID in response %+v", item)
+	}
+	return &Handle{RequestID: requestID, Model: model, Input: input}, nil
+}
+
+// Status returns the current status of the request.
+func (c *Client) Status(ctx context.Context, h *Handle) (*etcdqueue.Item, error) {
+	item, _, err := c.do(ctx, http.MethodGet, bucket(h.Model), map[string]string{RequestIDHeader: h.RequestID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, fmt.Errorf("client: empty response for %q", h.RequestID)
+	}
+	return item, nil
+}
+
+// Watch streams the status of the request whenever its progress or value
+// changes, until it completes or the context is canceled. Failures are
+// sent as items with the Error field, as 'etcdqueue.ItemWatcher'.
+func (c *Client) Watch(ctx context.Context, h *Handle) etcdqueue.ItemWatcher {
+	ch := make(chan *etcdqueue.Item, 1)
+	go func() {
+		defer close(ch)
+		var last *etcdqueue.Item
+		for {
+			item, err := c.Status(ctx, h)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				ch <- &etcdqueue.Item{Bucket: bucket(h.Model), RequestID: h.RequestID, Error: err.Error()}
+				return
+			}
+			if last == nil || last.Progress != item.Progress || last.Value != item.Value || last.Error != item.Error {
+				select {
+				case ch <- item:
+				case <-ctx.Done():
+					return
+				}
+				last = item
+			}
+			if item.Progress >= etcdqueue.MaxProgress {
+				return
+			}
+			select {
+			case <-time.After(c.op.pollInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// Wait blocks until the request completes, and returns the final item.
+// The error reported by the worker is returned as *Error with the item.
+func (c *Client) Wait(ctx context.Context, h *Handle) (*etcdqueue.Item, error) {
+	var last *etcdqueue.Item
+	for item := range c.Watch(ctx, h) {
+		last = item
+	}
+	if err := ctx.Err(); err != nil {
+		return last, err
+	}
+	if last == nil {
+		return nil, fmt.Errorf("client: no status for %q", h.RequestID)
+	}
+	if last.Error != "" {
+		return last, &Error{Bucket: last.Bucket, StatusCode: http.StatusOK, Message: last.Error}
+	}
+	return last, nil
+}
+
+// Cancel deletes the request from backend. Workers stop reporting on
+// the request, since backend rejects its updates.
+func (c *Client) Cancel(ctx context.Context, h *Handle) error {
+	_, _, err := c.do(ctx, http.MethodPost, bucket(h.Model), nil, &request{DataFromFrontend: h.Input, CreateRequest: false})
+	return err
+}
+
+// Claim blocks until an item of the model is available in the queue,
+// and removes it from the queue.
+func (c *Client) Claim(ctx context.Context, model string) (*etcdqueue.Item, error) {
+	item, _, err := c.do(ctx, http.MethodGet, bucket(model)+"/queue", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, fmt.Errorf("client: empty response from %q queue", model)
+	}
+	return item, nil
+}
+
+// Update posts the progress or result of the claimed item,
+// and returns the item stored in backend.
+func (c *Client) Update(ctx context.Context, item *etcdqueue.Item) (*etcdqueue.Item, error) {
+	if item.Bucket == "" {
+		return nil, fmt.Errorf("client: empty bucket in %+v", item)
+	}
+	ret, _, err := c.do(ctx, http.MethodPost, item.Bucket+"/queue", nil, item)
+	if err != nil {
+		return nil, err
+	}
+	if ret == nil {
+		return nil, fmt.Errorf("client: empty response for %q", item.RequestID)
+	}
+	return ret, nil
+}
+
+// do sends the request, and decodes the response item with the response
+// header. It returns nil item when the response is empty (e.g. on cancel).
+func (c *Client) do(ctx context.Context, method, p string, header map[string]string, body interface{}) (*etcdqueue.Item, http.Header, error) {
+	var rd io.Reader
+	if body != nil {
+		bts, err := json.Marshal(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		rd = bytes.NewReader(bts)
+	}
+	req, err := http.NewRequest(method, c.endpoint+p, rd)
+	if err != nil {
+		return nil, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if c.op.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.op.apiKey)
+	}
+
+	resp, err := c.op.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	rb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var er errorResponse
+		if json.Unmarshal(rb, &er) == nil && er.Error.Code != "" {
+			return nil, resp.Header, &Error{Bucket: p, StatusCode: resp.StatusCode, Code: er.Error.Code, Message: er.Error.Message}
+		}
+		return nil, resp.Header, fmt.Errorf("client: %s %q returned %s (%q)", method, p, resp.Status, strings.TrimSpace(string(rb)))
+	}
+	if len(bytes.TrimSpace(rb)) == 0 {
+		return nil, resp.Header, nil
+	}
+
+	var item etcdqueue.Item
+	if err = json.Unmarshal(rb, &item); err != nil {
+		return nil, resp.Header, fmt.Errorf("client: cannot decode %q (%v)", string(rb), err)
+	}
+	if item.Error != "" && item.Key == "" {
+		// backend failed to handle the request, as opposed to
+		// returning the item whose job has failed
+		return nil, resp.Header, &Error{Bucket: item.Bucket, StatusCode: resp.StatusCode, Message: item.Error}
+	}
+	return &item, resp.Header, nil
+}
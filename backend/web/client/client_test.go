@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+// fakeBackend emulates the error-in-body convention of backend/web.
+type fakeBackend struct {
+	mu    sync.Mutex
+	items map[string]*etcdqueue.Item
+	queue chan *etcdqueue.Item
+}
+
+func (fb *fakeBackend) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	switch req.URL.Path {
+	case "/cats-request":
+		if req.Method == http.MethodGet {
+			id := req.Header.Get(RequestIDHeader)
+			item, ok := fb.items[id]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprintf(w, `{"error":{"code":"not_found","message":"cannot find request ID %s"}}`, id)
+				return
+			}
+			enc.Encode(item)
+			return
+		}
+		var creq request
+		json.NewDecoder(req.Body).Decode(&creq)
+		id := "/cats-request-" + creq.DataFromFrontend
+		if !creq.CreateRequest {
+			delete(fb.items, id)
+			return
+		}
+		if creq.DataFromFrontend == "invalid" {
+			enc.Encode(&etcdqueue.Item{Bucket: req.URL.Path, Error: "not support"})
+			return
+		}
+		item := etcdqueue.CreateItem(req.URL.Path, 100, creq.DataFromFrontend)
+		item.RequestID = id
+		fb.items[id] = item
+		fb.queue <- item
+		w.Header().Set(RequestIDHeader, id)
+		enc.Encode(item)
+
+	case "/cats-request/queue":
+		if req.Method == http.MethodGet {
+			fb.mu.Unlock()
+			item := <-fb.queue
+			fb.mu.Lock()
+			enc.Encode(item)
+			return
+		}
+		var item etcdqueue.Item
+		json.NewDecoder(req.Body).Decode(&item)
+		if _, ok := fb.items[item.RequestID]; !ok {
+			enc.Encode(&etcdqueue.Item{Bucket: "/cats-request", Error: fmt.Sprintf("unknown request ID %q", item.RequestID)})
+			return
+		}
+		fb.items[item.RequestID] = &item
+		enc.Encode(&item)
+
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestClient(t *testing.T) {
+	fb := &fakeBackend{items: make(map[string]*etcdqueue.Item), queue: make(chan *etcdqueue.Item, 10)}
+	ts := httptest.NewServer(fb)
+	defer ts.Close()
+
+	cli, err := New(ts.URL, WithPollInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err = cli.Submit(ctx, "cats", "invalid"); err == nil {
+		t.Fatal("expected error")
+	} else if e, ok := err.(*Error); !ok || e.Message != "not support" {
+		t.Fatalf("expected *Error, got %v", err)
+	}
+
+	h, err := cli.Submit(ctx, "cats", "cat.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.RequestID != "/cats-request-cat.jpg" {
+		t.Fatalf("unexpected handle %+v", h)
+	}
+
+	// simulate worker
+	item, err := cli.Claim(ctx, "cats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.RequestID != h.RequestID {
+		t.Fatalf("unexpected item %+v", item)
+	}
+	donec := make(chan struct{})
+	go func() {
+		defer close(donec)
+		for _, p := range []int{30, 60, 100} {
+			time.Sleep(30 * time.Millisecond)
+			it := *item
+			it.Progress = p
+			if p == 100 {
+				it.Value = "done"
+			}
+			if _, err := cli.Update(ctx, &it); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	var progress []int
+	for item := range cli.Watch(ctx, h) {
+		if item.Error != "" {
+			t.Fatal(item.Error)
+		}
+		progress = append(progress, item.Progress)
+	}
+	<-donec
+	if len(progress) < 2 || progress[len(progress)-1] != 100 {
+		t.Fatalf("unexpected progress %v", progress)
+	}
+	item, err = cli.Wait(ctx, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Value != "done" {
+		t.Fatalf("unexpected item %+v", item)
+	}
+
+	if err = cli.Cancel(ctx, h); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.Status(ctx, h); err == nil {
+		t.Fatal("expected error after cancel")
+	} else if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusNotFound || e.Code != "not_found" {
+		t.Fatalf("expected not found *Error, got %v", err)
+	}
+	if _, err = cli.Update(ctx, item); err == nil {
+		t.Fatal("expected error on canceled request")
+	}
+
+	// worker reports the failure with the item
+	h, err = cli.Submit(ctx, "cats", "fail.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err = cli.Claim(ctx, "cats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.Progress, item.Error = 100, "cannot find image"
+	if _, err = cli.Update(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	item, err = cli.Wait(ctx, h)
+	if e, ok := err.(*Error); !ok || e.Message != "cannot find image" || item == nil {
+		t.Fatalf("expected *Error with item, got %v, %+v", err, item)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	h, err = cli.Submit(ctx, "cats", "slow.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.Wait(tctx, h); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,68 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gyuho/dplearn/backend/web/client"
+)
+
+func TestClient(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	defer ts.Close()
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	cli, err := client.New(ts.URL, client.WithPollInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	h, err := cli.Submit(ctx, "cats", imgServer.URL+"/cat.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = srv.getRequest(h.RequestID); err != nil {
+		t.Fatalf("expected request ID %q from 'Request-Id' header (%v)", h.RequestID, err)
+	}
+
+	// simulate worker
+	item, err := cli.Claim(ctx, "cats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.RequestID != h.RequestID || !strings.HasSuffix(item.Value, ".jpeg") {
+		t.Fatalf("unexpected item %+v", item)
+	}
+	item.Progress, item.Value = 100, "cat"
+	if _, err = cli.Update(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	item, err = cli.Wait(ctx, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Value != "cat" {
+		t.Fatalf("unexpected item %+v", item)
+	}
+
+	if err = cli.Cancel(ctx, h); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.Status(ctx, h); err == nil {
+		t.Fatal("expected error after cancel")
+	} else if e, ok := err.(*client.Error); !ok || e.Code != string(CodeNotFound) {
+		t.Fatalf("expected not found *client.Error, got %v", err)
+	}
+
+	var created Job
+	resp := doJSON(t, http.MethodPost, ts.URL+"/cats-request", `{"data_from_frontend": "`+imgServer.URL+`/dog.jpeg", "create_request": true}`, &created)
+	if id := resp.Header.Get(RequestIDHeader); id == "" || id != created.RequestID {
+		t.Fatalf("expected %q in 'Request-Id' header, got %q", created.RequestID, id)
+	}
+}
@@ -0,0 +1,241 @@
+package web
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config configures the web server. Durations are in Go format
+// (e.g. "30m") in YAML and environment variables.
+type Config struct {
+	// Scheme is "http" or "https".
+	Scheme string `yaml:"scheme"`
+	// Host is the host and port to serve.
+	Host string `yaml:"host"`
+
+	// TLSCertFile and TLSKeyFile are the certificate and key of "https",
+	// reloaded when the files change.
+	TLSCertFile string `yaml:"tls-cert-file"`
+	TLSKeyFile  string `yaml:"tls-key-file"`
+	// TLSClientCAFile is the CA to verify client certificates, which
+	// are then required from workers and operators (mTLS). Empty to disable.
+	TLSClientCAFile string `yaml:"tls-client-ca-file"`
+
+	// FrontendDir is the directory of the built frontend to serve
+	// (e.g. "dist" of 'ng build --prod'). Empty to disable.
+	FrontendDir string `yaml:"frontend-dir"`
+
+	// ImageDir is the directory to store downloaded images.
+	ImageDir string `yaml:"image-dir"`
+	// ImageCacheSize is the number of images to cache by URL.
+	ImageCacheSize int `yaml:"image-cache-size"`
+	// ImageSizeLimit is the maximum size of an image in bytes.
+	ImageSizeLimit int64 `yaml:"image-size-limit"`
+
+	// EnqueueTTL is how long a job stays in the queue before it expires.
+	EnqueueTTL time.Duration `yaml:"enqueue-ttl"`
+	// Priority is the weight of new jobs in the queue,
+	// up to 'queue.MaxWeight'.
+	Priority uint64 `yaml:"priority"`
+	// MaxBatchSize is the maximum number of inputs in a batch.
+	MaxBatchSize int `yaml:"max-batch-size"`
+	// BatchConcurrency is the number of inputs of a batch
+	// to download at a time.
+	BatchConcurrency int `yaml:"batch-concurrency"`
+	// BatchRetention is how long to keep the results of completed batches.
+	BatchRetention time.Duration `yaml:"batch-retention"`
+	// BatchJobTimeout is how long batches wait for a job. Jobs not done
+	// by then (e.g. the worker died) are canceled, and their inputs fail.
+	BatchJobTimeout time.Duration `yaml:"batch-job-timeout"`
+	// HistoryRetention is how long to keep the job history of users
+	// (see 'WithHistory').
+	HistoryRetention time.Duration `yaml:"history-retention"`
+
+	// GCPeriod is the interval to delete requests that are never deleted
+	// by the frontend (e.g. user closed the browser).
+	GCPeriod time.Duration `yaml:"gc-period"`
+}
+
+// DefaultConfig returns the default configuration.
+func DefaultConfig() Config {
+	return Config{
+		Scheme:         "http",
+		Host:           "localhost:2200",
+		ImageDir:       filepath.Join(os.TempDir(), "dplearn-images"),
+		ImageCacheSize: 100,
+		ImageSizeLimit: 15000000, // 15 MB
+		EnqueueTTL:     30 * time.Minute,
+		Priority:       100,
+
+		MaxBatchSize:     10000,
+		BatchConcurrency: 4,
+		BatchRetention:   24 * time.Hour,
+		BatchJobTimeout:  2 * time.Hour,
+		HistoryRetention: 30 * 24 * time.Hour,
+
+		GCPeriod: 5 * time.Minute,
+	}
+}
+
+// LoadConfig reads the YAML file over the default configuration, if the
+// path is not empty, and then applies environment variable overrides
+// (see 'ApplyEnv'). It does not validate the configuration.
+func LoadConfig(p string) (Config, error) {
+	cfg := DefaultConfig()
+	if p != "" {
+		bts, err := ioutil.ReadFile(p)
+		if err != nil {
+			return Config{}, err
+		}
+		if err = yaml.UnmarshalStrict(bts, &cfg); err != nil {
+			return Config{}, fmt.Errorf("invalid config %q (%v)", p, err)
+		}
+	}
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// ApplyEnv overrides the configuration with the environment variables
+// that are set, looked up by the function (e.g. 'os.LookupEnv'):
+//
+//	DPLEARN_WEB_SCHEME
+//	DPLEARN_WEB_HOST
+//	DPLEARN_TLS_CERT_FILE
+//	DPLEARN_TLS_KEY_FILE
+//	DPLEARN_TLS_CLIENT_CA_FILE
+//	DPLEARN_FRONTEND_DIR
+//	DPLEARN_IMAGE_DIR
+//	DPLEARN_IMAGE_CACHE_SIZE
+//	DPLEARN_IMAGE_SIZE_LIMIT
+//	DPLEARN_ENQUEUE_TTL
+//	DPLEARN_PRIORITY
+//	DPLEARN_MAX_BATCH_SIZE
+//	DPLEARN_BATCH_CONCURRENCY
+//	DPLEARN_BATCH_RETENTION
+//	DPLEARN_BATCH_JOB_TIMEOUT
+//	DPLEARN_HISTORY_RETENTION
+//	DPLEARN_GC_PERIOD
+func (cfg *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	for _, e := range []struct {
+		key   string
+		parse func(string) error
+	}{
+		{"DPLEARN_WEB_SCHEME", func(s string) error { cfg.Scheme = s; return nil }},
+		{"DPLEARN_WEB_HOST", func(s string) error { cfg.Host = s; return nil }},
+		{"DPLEARN_TLS_CERT_FILE", func(s string) error { cfg.TLSCertFile = s; return nil }},
+		{"DPLEARN_TLS_KEY_FILE", func(s string) error { cfg.TLSKeyFile = s; return nil }},
+		{"DPLEARN_TLS_CLIENT_CA_FILE", func(s string) error { cfg.TLSClientCAFile = s; return nil }},
+		{"DPLEARN_FRONTEND_DIR", func(s string) error { cfg.FrontendDir = s; return nil }},
+		{"DPLEARN_IMAGE_DIR", func(s string) error { cfg.ImageDir = s; return nil }},
+		{"DPLEARN_IMAGE_CACHE_SIZE", func(s string) (err error) {
+			cfg.ImageCacheSize, err = strconv.Atoi(s)
+			return err
+		}},
+		{"DPLEARN_IMAGE_SIZE_LIMIT", func(s string) (err error) {
+			cfg.ImageSizeLimit, err = strconv.ParseInt(s, 10, 64)
+			return err
+		}},
+		{"DPLEARN_ENQUEUE_TTL", func(s string) (err error) {
+			cfg.EnqueueTTL, err = time.ParseDuration(s)
+			return err
+		}},
+		{"DPLEARN_PRIORITY", func(s string) (err error) {
+			cfg.Priority, err = strconv.ParseUint(s, 10, 64)
+			return err
+		}},
+		{"DPLEARN_MAX_BATCH_SIZE", func(s string) (err error) {
+			cfg.MaxBatchSize, err = strconv.Atoi(s)
+			return err
+		}},
+		{"DPLEARN_BATCH_CONCURRENCY", func(s string) (err error) {
+			cfg.BatchConcurrency, err = strconv.Atoi(s)
+			return err
+		}},
+		{"DPLEARN_BATCH_RETENTION", func(s string) (err error) {
+			cfg.BatchRetention, err = time.ParseDuration(s)
+			return err
+		}},
+		{"DPLEARN_BATCH_JOB_TIMEOUT", func(s string) (err error) {
+			cfg.BatchJobTimeout, err = time.ParseDuration(s)
+			return err
+		}},
+		{"DPLEARN_HISTORY_RETENTION", func(s string) (err error) {
+			cfg.HistoryRetention, err = time.ParseDuration(s)
+			return err
+		}},
+		{"DPLEARN_GC_PERIOD", func(s string) (err error) {
+			cfg.GCPeriod, err = time.ParseDuration(s)
+			return err
+		}},
+	} {
+		v, ok := lookup(e.key)
+		if !ok {
+			continue
+		}
+		if err := e.parse(v); err != nil {
+			return fmt.Errorf("invalid %s %q (%v)", e.key, v, err)
+		}
+	}
+	return nil
+}
+
+// Validate returns an error if the configuration is invalid.
+func (cfg Config) Validate() error {
+	if cfg.Scheme != "http" && cfg.Scheme != "https" {
+		return fmt.Errorf("invalid scheme %q (expected 'http' or 'https')", cfg.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(cfg.Host); err != nil {
+		return fmt.Errorf("invalid host %q (%v)", cfg.Host, err)
+	}
+	if cfg.Scheme == "https" && (cfg.TLSCertFile == "" || cfg.TLSKeyFile == "") {
+		return fmt.Errorf("scheme 'https' requires tls-cert-file and tls-key-file")
+	}
+	if cfg.Scheme == "http" && (cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" || cfg.TLSClientCAFile != "") {
+		return fmt.Errorf("TLS files are given with scheme 'http'")
+	}
+	if cfg.ImageDir == "" {
+		return fmt.Errorf("empty image-dir")
+	}
+	if cfg.ImageCacheSize <= 0 {
+		return fmt.Errorf("invalid image-cache-size %d (must be > 0)", cfg.ImageCacheSize)
+	}
+	if cfg.ImageSizeLimit <= 0 {
+		return fmt.Errorf("invalid image-size-limit %d (must be > 0)", cfg.ImageSizeLimit)
+	}
+	if cfg.EnqueueTTL <= 0 {
+		return fmt.Errorf("invalid enqueue-ttl %v (must be > 0)", cfg.EnqueueTTL)
+	}
+	if cfg.Priority > queue.MaxWeight {
+		return fmt.Errorf("invalid priority %d (must be <= %d)", cfg.Priority, queue.MaxWeight)
+	}
+	if cfg.MaxBatchSize <= 0 {
+		return fmt.Errorf("invalid max-batch-size %d (must be > 0)", cfg.MaxBatchSize)
+	}
+	if cfg.BatchConcurrency <= 0 {
+		return fmt.Errorf("invalid batch-concurrency %d (must be > 0)", cfg.BatchConcurrency)
+	}
+	if cfg.BatchRetention <= 0 {
+		return fmt.Errorf("invalid batch-retention %v (must be > 0)", cfg.BatchRetention)
+	}
+	if cfg.BatchJobTimeout <= 0 {
+		return fmt.Errorf("invalid batch-job-timeout %v (must be > 0)", cfg.BatchJobTimeout)
+	}
+	if cfg.HistoryRetention <= 0 {
+		return fmt.Errorf("invalid history-retention %v (must be > 0)", cfg.HistoryRetention)
+	}
+	if cfg.GCPeriod <= 0 {
+		return fmt.Errorf("invalid gc-period %v (must be > 0)", cfg.GCPeriod)
+	}
+	return nil
+}
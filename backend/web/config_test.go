@@ -0,0 +1,135 @@
+package web
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "web-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString(`host: 0.0.0.0:2200
+image-dir: /var/lib/dplearn/images
+enqueue-ttl: 10m
+priority: 500
+`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	os.Setenv("DPLEARN_PRIORITY", "700")
+	defer os.Unsetenv("DPLEARN_PRIORITY")
+
+	cfg, err := LoadConfig(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := DefaultConfig()
+	exp.Host = "0.0.0.0:2200"
+	exp.ImageDir = "/var/lib/dplearn/images"
+	exp.EnqueueTTL = 10 * time.Minute
+	exp.Priority = 700
+	if !reflect.DeepEqual(cfg, exp) {
+		t.Fatalf("expected %+v, got %+v", exp, cfg)
+	}
+	if err = cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(f.Name(), []byte("enqueue-tll: 10m\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadConfig(f.Name()); err == nil {
+		t.Fatal("expected error on unknown field, got nil")
+	}
+}
+
+func TestConfigApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"DPLEARN_WEB_SCHEME":        "https",
+		"DPLEARN_WEB_HOST":          "localhost:443",
+		"DPLEARN_IMAGE_DIR":         "/data/images",
+		"DPLEARN_IMAGE_CACHE_SIZE":  "10",
+		"DPLEARN_IMAGE_SIZE_LIMIT":  "1000",
+		"DPLEARN_ENQUEUE_TTL":       "1h",
+		"DPLEARN_PRIORITY":          "1",
+		"DPLEARN_MAX_BATCH_SIZE":    "50",
+		"DPLEARN_BATCH_CONCURRENCY": "2",
+		"DPLEARN_BATCH_RETENTION":   "1h",
+		"DPLEARN_BATCH_JOB_TIMEOUT": "30m",
+		"DPLEARN_HISTORY_RETENTION": "168h",
+		"DPLEARN_GC_PERIOD":         "30s",
+	}
+	lookup := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+	cfg := DefaultConfig()
+	if err := cfg.ApplyEnv(lookup); err != nil {
+		t.Fatal(err)
+	}
+	exp := Config{
+		Scheme:         "https",
+		Host:           "localhost:443",
+		ImageDir:       "/data/images",
+		ImageCacheSize: 10,
+		ImageSizeLimit: 1000,
+		EnqueueTTL:     time.Hour,
+		Priority:       1,
+
+		MaxBatchSize:     50,
+		BatchConcurrency: 2,
+		BatchRetention:   time.Hour,
+		BatchJobTimeout:  30 * time.Minute,
+		HistoryRetention: 7 * 24 * time.Hour,
+
+		GCPeriod: 30 * time.Second,
+	}
+	if !reflect.DeepEqual(cfg, exp) {
+		t.Fatalf("expected %+v, got %+v", exp, cfg)
+	}
+
+	env = map[string]string{"DPLEARN_ENQUEUE_TTL": "30"}
+	if err := cfg.ApplyEnv(lookup); err == nil {
+		t.Fatal("expected error on duration without unit, got nil")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		update func(*Config)
+		ok     bool
+	}{
+		{func(cfg *Config) {}, true},
+		{func(cfg *Config) { cfg.Scheme = "ftp" }, false},
+		{func(cfg *Config) { cfg.Host = "localhost" }, false},
+		{func(cfg *Config) { cfg.Scheme = "https" }, false},
+		{func(cfg *Config) { cfg.Scheme, cfg.TLSCertFile, cfg.TLSKeyFile = "https", "server.crt", "server.key" }, true},
+		{func(cfg *Config) { cfg.TLSClientCAFile = "ca.crt" }, false},
+		{func(cfg *Config) { cfg.ImageDir = "" }, false},
+		{func(cfg *Config) { cfg.ImageCacheSize = 0 }, false},
+		{func(cfg *Config) { cfg.ImageSizeLimit = -1 }, false},
+		{func(cfg *Config) { cfg.EnqueueTTL = 0 }, false},
+		{func(cfg *Config) { cfg.Priority = 0 }, true},
+		{func(cfg *Config) { cfg.Priority = 100000 }, false},
+		{func(cfg *Config) { cfg.MaxBatchSize = 0 }, false},
+		{func(cfg *Config) { cfg.BatchConcurrency = 0 }, false},
+		{func(cfg *Config) { cfg.BatchRetention = 0 }, false},
+		{func(cfg *Config) { cfg.BatchJobTimeout = 0 }, false},
+		{func(cfg *Config) { cfg.HistoryRetention = -time.Hour }, false},
+		{func(cfg *Config) { cfg.GCPeriod = 0 }, false},
+	}
+	for i, tt := range tests {
+		cfg := DefaultConfig()
+		tt.update(&cfg)
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Fatalf("#%d: expected ok %v, got %v", i, tt.ok, err)
+		}
+	}
+}
@@ -2,8 +2,12 @@ package web
 
 import (
 	"context"
-	"log"
 	"net/http"
+	"time"
+
+	"github.com/gyuho/dplearn/pkg/trace"
+
+	"github.com/golang/glog"
 )
 
 // ContextHandler handles ServeHTTP with context.
@@ -19,14 +23,74 @@ func (f ContextHandlerFunc) ServeHTTPContext(ctx context.Context, w http.Respons
 	return f(ctx, w, req)
 }
 
-// ContextAdapter wraps context handler.
+// ContextAdapter wraps context handler. Each request gets a trace ID
+// in the context and response header, a span, and an access log when
+// enabled.
 type ContextAdapter struct {
 	ctx     context.Context
 	handler ContextHandler
+
+	// accessLog is nil to disable access logs.
+	accessLog *accessLogger
 }
 
 func (ca *ContextAdapter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if err := ca.handler.ServeHTTPContext(ca.ctx, w, req); err != nil {
-		log.Printf("ServeHTTP (%v) [method: %q | path: %q]", err, req.Method, req.URL.Path)
+	start := time.Now()
+
+	// canceled when the client goes away (e.g. workers blocked in Pop),
+	// or when the server stops
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	if done := ca.ctx.Done(); done != nil {
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	parent, perr := trace.ParseTraceParent(req.Header.Get(trace.TraceParentHeader))
+	id := req.Header.Get(TraceIDHeader)
+	switch {
+	case validTraceID(id):
+	case perr == nil:
+		id = parent.TraceID
+	default:
+		id = trace.NewTraceID()
+	}
+	if perr == nil && parent.TraceID == id {
+		ctx = trace.WithRemoteParent(ctx, parent)
+	} else if trace.IsTraceID(id) {
+		ctx = trace.WithRemoteParent(ctx, trace.SpanContext{TraceID: id})
+	}
+	ctx, span := trace.Start(ctx, "HTTP "+req.Method)
+	span.SetAttribute("path", req.URL.Path)
+
+	w.Header().Set(TraceIDHeader, id)
+	e := &AccessLog{TraceID: id, Method: req.Method, Path: req.URL.Path}
+
+	sw := &statusWriter{ResponseWriter: w}
+	if err := ca.handler.ServeHTTPContext(context.WithValue(ctx, traceKey, e), sw, req); err != nil {
+		e.Error = err.Error()
+		span.SetError(err)
+		glog.Warningf("ServeHTTP (%v) [trace: %q | method: %q | path: %q]", err, id, req.Method, req.URL.Path)
+	}
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	span.SetAttribute("status", sw.status)
+	if e.RequestID != "" {
+		span.SetAttribute("request_id", e.RequestID)
+	}
+	span.Finish()
+
+	if ca.accessLog != nil {
+		e.Time = start.UTC()
+		e.Status = sw.status
+		e.Bytes = sw.bytes
+		e.LatencyMS = float64(time.Since(start)) / float64(time.Millisecond)
+		ca.accessLog.log(e)
 	}
 }
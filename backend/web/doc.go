@@ -1,2 +1,32 @@
 // Package web interacts with frontend.
+//
+// The v1 API is served under '/v1/', and its OpenAPI document is at
+// '/v1/openapi.json'. The legacy routes (e.g. '/cats-request') are kept
+// for the current frontend and workers, and share the same requests.
+// Workers and internal clients can also use the gRPC service defined in
+// 'webpb/web.proto', enabled with 'WithGRPC'. Batches create the jobs of
+// many inputs at once, and stream their results in JSONL. With 'WithHistory',
+// each API key or user can list its past jobs at '/v1/jobs' after they are
+// deleted from the server, and delete them all.
+//
+// The server is configured with 'Config', loaded from YAML and 'DPLEARN_*'
+// environment variables with 'LoadConfig'. With "https" scheme, it serves
+// HTTP/2 and gRPC with the certificate reloaded on change, and optionally
+// requires client certificates from workers (mTLS). The built frontend can
+// be served on the other paths (see 'Config.FrontendDir' and 'WithFrontend'),
+// for a single process without 'ng serve' and nginx.
+//
+// '/readyz' checks etcd, the image store and workers of each model, and
+// '/livez' checks that handlers are not deadlocked. Both respond JSON with
+// each check, and 503 on failures.
+//
+// Operators with API keys of "admin" scope can use '/admin/' to list queues
+// and their items, requeue (unless running), cancel or delete jobs, purge queues, inspect
+// and evict the image cache, and list live workers and recent errors,
+// without etcdctl or restarts. It is disabled without API keys.
+//
+// Every request has a trace ID in 'X-Trace-Id' header, which is stored in
+// the queue item and sent back by workers, so that one job can be followed
+// in JSON access logs (see 'WithAccessLog'). Spans of requests, image
+// downloads, the queue and workers are exported with 'pkg/trace'.
 package web
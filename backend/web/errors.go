@@ -0,0 +1,194 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/golang/glog"
+)
+
+// ErrorCode classifies the errors of backend API.
+type ErrorCode string
+
+const (
+	// CodeValidation is for malformed or unsupported requests.
+	CodeValidation ErrorCode = "validation"
+	// CodeUnauthorized is for missing or invalid API keys.
+	CodeUnauthorized ErrorCode = "unauthorized"
+	// CodeForbidden is for API keys without the required scope.
+	CodeForbidden ErrorCode = "forbidden"
+	// CodeQuotaExceeded is for API keys over their quotas.
+	CodeQuotaExceeded ErrorCode = "quota_exceeded"
+	// CodeRateLimited is for users over the rate limit.
+	CodeRateLimited ErrorCode = "rate_limited"
+	// CodeNotFound is for unknown request IDs or paths.
+	CodeNotFound ErrorCode = "not_found"
+	// CodeMethodNotAllowed is for unsupported methods on known paths.
+	CodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	// CodeTooLarge is for inputs that exceed the size limit.
+	CodeTooLarge ErrorCode = "too_large"
+	// CodeUpstreamFetch is for failures to fetch inputs from remote URLs.
+	CodeUpstreamFetch ErrorCode = "upstream_fetch_failure"
+	// CodeQueueUnavailable is for failures in the queue service.
+	CodeQueueUnavailable ErrorCode = "queue_unavailable"
+	// CodeInternal is for any other server-side failures.
+	CodeInternal ErrorCode = "internal"
+)
+
+// StatusCode returns the HTTP status code of the error code.
+func (c ErrorCode) StatusCode() int {
+	switch c {
+	case CodeValidation:
+		return http.StatusBadRequest
+	case CodeUnauthorized:
+		return http.StatusUnauthorized
+	case CodeForbidden:
+		return http.StatusForbidden
+	case CodeQuotaExceeded, CodeRateLimited:
+		return http.StatusTooManyRequests
+	case CodeNotFound:
+		return http.StatusNotFound
+	case CodeMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case CodeTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case CodeUpstreamFetch:
+		return http.StatusBadGateway
+	case CodeQueueUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Error is the typed error of backend API.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+func newError(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// toError converts any error to *Error, as internal error.
+func toError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{Code: CodeInternal, Message: err.Error()}
+}
+
+// ErrorResponse is the JSON error envelope, sent with 4xx or 5xx status.
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+// ErrorBody describes the error.
+type ErrorBody struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// maxRecentErrors is the number of recent errors to keep for operators.
+const maxRecentErrors = 100
+
+// ErrorEntry is the recent server-side error in '/admin/errors': 5xx errors
+// of HTTP and gRPC requests, and the errors of jobs reported by workers.
+type ErrorEntry struct {
+	Time time.Time `json:"time"`
+	// Source is "http", "grpc" or "worker".
+	Source    string    `json:"source"`
+	Code      ErrorCode `json:"code,omitempty"`
+	Message   string    `json:"message"`
+	Method    string    `json:"method,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	TraceID   string    `json:"trace_id,omitempty"`
+}
+
+// errorLog keeps the recent errors in a ring buffer.
+type errorLog struct {
+	mu      sync.Mutex
+	entries []ErrorEntry
+	// next is the index to overwrite once the buffer is full.
+	next int
+}
+
+func (l *errorLog) add(e ErrorEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) < maxRecentErrors {
+		l.entries = append(l.entries, e)
+		return
+	}
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % maxRecentErrors
+}
+
+// list returns the errors, newest first.
+func (l *errorLog) list() []ErrorEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	es := make([]ErrorEntry, 0, len(l.entries))
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		es = append(es, l.entries[(l.next+i)%len(l.entries)])
+	}
+	return es
+}
+
+// recordError adds the error of the request in context, if it is
+// a server-side error.
+func (srv *Server) recordError(ctx context.Context, source string, err error) {
+	e := toError(err)
+	if e.Code.StatusCode() < http.StatusInternalServerError {
+		return
+	}
+	entry := ErrorEntry{Source: source, Code: e.Code, Message: e.Message}
+	if a := traceOf(ctx); a != nil {
+		entry.Method, entry.Path = a.Method, a.Path
+		entry.RequestID, entry.TraceID = a.RequestID, a.TraceID
+	}
+	srv.recentErrors.add(entry)
+}
+
+// writeError writes the error envelope with its status code, or 200 with
+// the queue item of the error message in legacy mode.
+func writeError(ctx context.Context, w http.ResponseWriter, bucket string, err error) error {
+	if srv, ok := ctx.Value(serverKey).(*Server); ok && srv.legacyErrors {
+		e := toError(err)
+		glog.Warning(e)
+		if sw, ok := w.(*statusWriter); ok {
+			sw.err = e
+		}
+		return json.NewEncoder(w).Encode(&queue.Item{Bucket: bucket, Progress: 0, Error: e.Message})
+	}
+	return writeErrorResponse(w, err)
+}
+
+// writeErrorResponse writes the error envelope with its status code,
+// regardless of legacy mode.
+func writeErrorResponse(w http.ResponseWriter, err error) error {
+	e := toError(err)
+	glog.Warning(e)
+	if sw, ok := w.(*statusWriter); ok {
+		sw.err = e
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Code.StatusCode())
+	return json.NewEncoder(w).Encode(&ErrorResponse{Error: ErrorBody{Code: e.Code, Message: e.Message}})
+}
@@ -0,0 +1,104 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/lru"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// nopQueue is the queue without items, for handlers that fail
+// before using the queue.
+type nopQueue struct{}
+
+func (nopQueue) Add(ctx context.Context, it *queue.Item, opts ...queue.OpOption) error { return nil }
+func (nopQueue) Pop(ctx context.Context, bucket string) queue.ItemWatcher {
+	ch := make(chan *queue.Item)
+	close(ch)
+	return ch
+}
+func (nopQueue) List(ctx context.Context, bucket string) ([]*queue.Item, error) { return nil, nil }
+func (nopQueue) Delete(ctx context.Context, it *queue.Item) error               { return queue.ErrItemNotFound }
+
+func (nopQueue) Stop()                     {}
+func (nopQueue) Client() *clientv3.Client  { return nil }
+func (nopQueue) ClientEndpoints() []string { return nil }
+
+func TestErrorResponses(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		header map[string]string
+		body   string
+
+		status int
+		code   ErrorCode
+	}{
+		{http.MethodGet, "/cats-request", nil, "", 400, CodeValidation},
+		{http.MethodGet, "/cats-request", map[string]string{RequestIDHeader: "foo"}, "", 404, CodeNotFound},
+		{http.MethodPost, "/cats-request", nil, "{", 400, CodeValidation},
+		{http.MethodPost, "/cats-request", nil, `{"data_from_frontend": ""}`, 400, CodeValidation},
+		{http.MethodPost, "/cats-request", nil, `{"data_from_frontend": "https://example.com/cat.gif"}`, 400, CodeValidation},
+		{http.MethodGet, "/cats-request/queue", nil, "", 503, CodeQueueUnavailable},
+		{http.MethodPost, "/cats-request/queue", nil, `{"bucket": "/cats-request"}`, 400, CodeValidation},
+		{http.MethodPost, "/cats-request/queue", nil, `{"bucket": "/cats-request", "key": "a", "value": "b", "request_id": "c"}`, 404, CodeNotFound},
+	}
+	for i, tt := range tests {
+		for _, legacy := range []bool{false, true} {
+			srv := &Server{legacyErrors: legacy}
+			cache := lru.NewInMemory(1)
+			cache.CreateNamespace(imageCacheBucket)
+			h := clientRequestHandler
+			if strings.HasSuffix(tt.path, "/queue") {
+				h = queueHandler
+			}
+			ca := &ContextAdapter{
+				ctx:     context.Background(),
+				handler: with(ContextHandlerFunc(h), srv, nopQueue{}, cache),
+			}
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			ca.ServeHTTP(rec, req)
+
+			if legacy {
+				if rec.Code != 200 {
+					t.Fatalf("#%d: expected 200 in legacy mode, got %d", i, rec.Code)
+				}
+				if rec.Body.Len() == 0 {
+					// empty data_from_frontend is skipped in legacy mode
+					continue
+				}
+				var item queue.Item
+				if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if item.Error == "" || item.Bucket == "" {
+					t.Fatalf("#%d: expected error item, got %+v", i, item)
+				}
+				continue
+			}
+
+			if rec.Code != tt.status {
+				t.Fatalf("#%d: expected status %d, got %d (%s)", i, tt.status, rec.Code, rec.Body.String())
+			}
+			var er ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &er); err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			if er.Error.Code != tt.code || er.Error.Message == "" {
+				t.Fatalf("#%d: expected code %q, got %+v", i, tt.code, er)
+			}
+		}
+	}
+}
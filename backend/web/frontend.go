@@ -0,0 +1,119 @@
+package web
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// hashedAsset matches the file names with content hash from 'ng build --prod'
+// (e.g. "main.3f1a0c2e8b9d4f6a7c5e.bundle.js"), which never change.
+var hashedAsset = regexp.MustCompile(`\.[0-9a-f]{16,}\.`)
+
+// precompressed lists the encodings of precompressed files in preference
+// order, with their file extensions (e.g. "main.js.br").
+var precompressed = []struct {
+	encoding string
+	ext      string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// frontendHandler serves the built frontend. Unknown paths without file
+// extension serve 'index.html', so that the client-side router handles
+// them (e.g. "/cats" on reload).
+func frontendHandler(fs http.FileSystem) ContextHandler {
+	return ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			return writeErrorResponse(w, newError(CodeMethodNotAllowed, "method %s is not allowed on %q", req.Method, req.URL.Path))
+		}
+
+		p := path.Clean("/" + req.URL.Path)
+		if strings.HasSuffix(p, "/") {
+			p += "index.html"
+		}
+		f, fi, err := openFile(fs, p)
+		if err != nil {
+			if path.Ext(p) != "" {
+				return writeErrorResponse(w, newError(CodeNotFound, "unknown path %q", req.URL.Path))
+			}
+			p = "/index.html"
+			if f, fi, err = openFile(fs, p); err != nil {
+				return writeErrorResponse(w, newError(CodeNotFound, "unknown path %q", req.URL.Path))
+			}
+		}
+		defer f.Close()
+
+		switch {
+		case p == "/index.html":
+			// revalidate, to pick up new hashed assets on deploy
+			w.Header().Set("Cache-Control", "no-cache")
+		case hashedAsset.MatchString(path.Base(p)):
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		default:
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+		}
+
+		if ct := mime.TypeByExtension(path.Ext(p)); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		for _, c := range precompressed {
+			if !acceptsEncoding(req.Header.Get("Accept-Encoding"), c.encoding) {
+				continue
+			}
+			cf, cfi, err := openFile(fs, p+c.ext)
+			if err != nil {
+				continue
+			}
+			defer cf.Close()
+			w.Header().Set("Content-Encoding", c.encoding)
+			http.ServeContent(w, req, p, cfi.ModTime(), cf)
+			return nil
+		}
+		http.ServeContent(w, req, p, fi.ModTime(), f)
+		return nil
+	})
+}
+
+// openFile opens the regular file, or returns an error.
+func openFile(fs http.FileSystem, p string) (http.File, os.FileInfo, error) {
+	f, err := fs.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, nil, os.ErrNotExist
+	}
+	return f, fi, nil
+}
+
+// acceptsEncoding returns true if the 'Accept-Encoding' header accepts
+// the encoding, without "q=0".
+func acceptsEncoding(header, encoding string) bool {
+	for _, v := range strings.Split(header, ",") {
+		ss := strings.Split(v, ";")
+		if strings.TrimSpace(ss[0]) != encoding {
+			continue
+		}
+		for _, param := range ss[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if param == "q=0" || strings.HasPrefix(param, "q=0.") && strings.Trim(param[4:], "0") == "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package web
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gyuho/dplearn/pkg/lru"
+)
+
+func TestFrontend(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "dist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"index.html":                             "<app-root></app-root>",
+		"main.3f1a0c2e8b9d4f6a7c5e.bundle.js":    "main",
+		"main.3f1a0c2e8b9d4f6a7c5e.bundle.js.br": "main-br",
+		"main.3f1a0c2e8b9d4f6a7c5e.bundle.js.gz": "main-gzip",
+		"favicon.ico":                            "icon",
+		"assets/cat.png":                         "cat",
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := &Server{rootCtx: context.Background(), qu: &memQueue{}, frontend: http.Dir(dir)}
+	srv.cache = lru.NewInMemory(1)
+	srv.cache.CreateNamespace(imageCacheBucket)
+	ts := httptest.NewServer(srv.newMux(srv.cache))
+	defer ts.Close()
+
+	tests := []struct {
+		method         string
+		path           string
+		acceptEncoding string
+
+		status          int
+		body            string
+		contentType     string
+		contentEncoding string
+		cacheControl    string
+	}{
+		{http.MethodGet, "/", "", 200, files["index.html"], "text/html; charset=utf-8", "", "no-cache"},
+		{http.MethodGet, "/index.html", "", 200, files["index.html"], "text/html; charset=utf-8", "", "no-cache"},
+		// client-side routes
+		{http.MethodGet, "/cats", "", 200, files["index.html"], "text/html; charset=utf-8", "", "no-cache"},
+		{http.MethodGet, "/assets", "", 200, files["index.html"], "text/html; charset=utf-8", "", "no-cache"},
+		{http.MethodGet, "/missing.js", "", 404, "", "", "", ""},
+
+		{http.MethodGet, "/main.3f1a0c2e8b9d4f6a7c5e.bundle.js", "", 200, "main", "", "", "public, max-age=31536000, immutable"},
+		{http.MethodGet, "/main.3f1a0c2e8b9d4f6a7c5e.bundle.js", "gzip, deflate, br", 200, "main-br", "", "br", "public, max-age=31536000, immutable"},
+		{http.MethodGet, "/main.3f1a0c2e8b9d4f6a7c5e.bundle.js", "gzip, br;q=0", 200, "main-gzip", "", "gzip", "public, max-age=31536000, immutable"},
+		{http.MethodGet, "/favicon.ico", "gzip", 200, "icon", "", "", "public, max-age=3600"},
+		{http.MethodGet, "/assets/cat.png", "", 200, "cat", "image/png", "", "public, max-age=3600"},
+		{http.MethodPost, "/", "", 405, "", "", "", ""},
+
+		// API routes take precedence
+		{http.MethodGet, "/healthz", "", 200, "OK", "", "", ""},
+	}
+	for i, tt := range tests {
+		req, err := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// disable transparent decompression
+		req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Fatalf("#%d: %s expected status %d, got %d (%s)", i, tt.path, tt.status, resp.StatusCode, body)
+		}
+		if tt.status != 200 {
+			continue
+		}
+		if string(body) != tt.body {
+			t.Fatalf("#%d: %s expected body %q, got %q", i, tt.path, tt.body, body)
+		}
+		if ct := resp.Header.Get("Content-Type"); tt.contentType != "" && ct != tt.contentType {
+			t.Fatalf("#%d: %s expected Content-Type %q, got %q", i, tt.path, tt.contentType, ct)
+		}
+		if ce := resp.Header.Get("Content-Encoding"); ce != tt.contentEncoding {
+			t.Fatalf("#%d: %s expected Content-Encoding %q, got %q", i, tt.path, tt.contentEncoding, ce)
+		}
+		if cc := resp.Header.Get("Cache-Control"); cc != tt.cacheControl {
+			t.Fatalf("#%d: %s expected Cache-Control %q, got %q", i, tt.path, tt.cacheControl, cc)
+		}
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header   string
+		encoding string
+		ok       bool
+	}{
+		{"", "gzip", false},
+		{"gzip", "gzip", true},
+		{"gzip, deflate, br", "br", true},
+		{"gzip;q=0.8, br;q=1.0", "br", true},
+		{"br;q=0", "br", false},
+		{"br; q=0.000", "br", false},
+		{"br;q=0.1", "br", true},
+		{"gzipx", "gzip", false},
+	}
+	for i, tt := range tests {
+		if ok := acceptsEncoding(tt.header, tt.encoding); ok != tt.ok {
+			t.Fatalf("#%d: %q expected %v for %q, got %v", i, tt.header, tt.ok, tt.encoding, ok)
+		}
+	}
+}
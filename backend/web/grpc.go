@@ -0,0 +1,306 @@
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gyuho/dplearn/backend/web/webpb"
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer implements 'webpb.QueueServer', on the same queue
+// and requests as HTTP handlers.
+type grpcServer struct {
+	srv *Server
+}
+
+// newGRPCServer returns the gRPC server, with TLS of the configuration
+// if not nil (see 'newTLSConfig').
+func newGRPCServer(srv *Server, tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(srv.unaryAuthInterceptor),
+		grpc.StreamInterceptor(srv.streamAuthInterceptor),
+	}
+	if tlsConfig != nil {
+		// same certificate reloader and client CA as HTTP
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	gs := grpc.NewServer(opts...)
+	webpb.RegisterQueueServer(gs, &grpcServer{srv: srv})
+	return gs
+}
+
+// grpcScopes maps gRPC methods to the scopes of API key to require.
+var grpcScopes = map[string]Scope{
+	"/webpb.Queue/Enqueue":        ScopeSubmit,
+	"/webpb.Queue/WatchJob":       ScopeSubmit,
+	"/webpb.Queue/Claim":          ScopeWorker,
+	"/webpb.Queue/ReportProgress": ScopeWorker,
+	"/webpb.Queue/Complete":       ScopeWorker,
+}
+
+// authenticateGRPC authenticates the API key in 'x-api-key' or
+// 'authorization' metadata, same as HTTP headers. Worker methods require
+// the client certificate, same as HTTP worker routes.
+func (srv *Server) authenticateGRPC(ctx context.Context, method string) (context.Context, error) {
+	if err := srv.requireClientCertGRPC(ctx, method); err != nil {
+		return ctx, grpcError(err)
+	}
+	header := make(http.Header)
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for k, vs := range md {
+			for _, v := range vs {
+				header.Add(k, v)
+			}
+		}
+	}
+	ctx, err := authenticate(context.WithValue(ctx, serverKey, srv), keyFromHeader(header), grpcScopes[method])
+	if err != nil {
+		return ctx, grpcError(err)
+	}
+	return ctx, nil
+}
+
+func (srv *Server) unaryAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := srv.authenticateGRPC(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	if err = srv.rateLimitGRPC(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	resp, err := handler(ctx, req)
+	srv.recordGRPCError(info.FullMethod, err)
+	return resp, err
+}
+
+func (srv *Server) streamAuthInterceptor(s interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := srv.authenticateGRPC(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	if err = srv.rateLimitGRPC(ctx, info.FullMethod); err != nil {
+		return err
+	}
+	err = handler(s, &contextStream{ServerStream: ss, ctx: ctx})
+	srv.recordGRPCError(info.FullMethod, err)
+	return err
+}
+
+// rateLimitGRPC limits calls of each API key or peer IP with the same
+// limiter as HTTP, where limits are matched by the full method name
+// (e.g. "/webpb.Queue/Enqueue", or "/webpb.Queue/" for all methods).
+func (srv *Server) rateLimitGRPC(ctx context.Context, method string) error {
+	var ip net.IP
+	if p, ok := peer.FromContext(ctx); ok {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			host = p.Addr.String()
+		}
+		ip = net.ParseIP(host)
+	}
+	if _, err := srv.rateLimit(ctx, method, rateLimitKey(ctx, ip)); err != nil {
+		return grpcError(err)
+	}
+	return nil
+}
+
+// recordGRPCError adds the server-side error of the gRPC method
+// to the recent errors.
+func (srv *Server) recordGRPCError(method string, err error) {
+	if err == nil {
+		return
+	}
+	s, _ := status.FromError(err)
+	switch s.Code() {
+	case codes.Internal, codes.Unavailable, codes.Unknown, codes.DataLoss:
+	default:
+		return
+	}
+	srv.recentErrors.add(ErrorEntry{Source: "grpc", Message: s.Message(), Path: method})
+}
+
+// contextStream overrides the context of the stream.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context { return s.ctx }
+
+// context returns the context of request handlers, where the user is
+// identified by the peer address. The trace ID is from 'x-trace-id'
+// metadata, or generated.
+func (s *grpcServer) context(ctx context.Context) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vs := md[strings.ToLower(TraceIDHeader)]; len(vs) > 0 {
+			id = vs[0]
+		}
+	}
+	ctx = withTrace(ctx, id)
+
+	userID := "grpc-unknown"
+	if p, ok := peer.FromContext(ctx); ok {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			host = p.Addr.String()
+		}
+		userID = "grpc-" + ipReplacer.Replace(host)
+	}
+	return withValues(ctx, s.srv, s.srv.qu, s.srv.cache, userID)
+}
+
+func toJob(item *queue.Item) *webpb.Job {
+	return &webpb.Job{
+		RequestID:         item.RequestID,
+		Bucket:            item.Bucket,
+		Key:               item.Key,
+		Value:             item.Value,
+		Progress:          int32(item.Progress),
+		Error:             item.Error,
+		CreatedAtUnixNano: item.CreatedAt.UnixNano(),
+		TraceID:           item.TraceID,
+	}
+}
+
+// grpcError converts the error to gRPC status error.
+func grpcError(err error) error {
+	e := toError(err)
+	glog.Warning(e)
+
+	c := codes.Internal
+	switch e.Code {
+	case CodeValidation:
+		c = codes.InvalidArgument
+	case CodeUnauthorized:
+		c = codes.Unauthenticated
+	case CodeForbidden:
+		c = codes.PermissionDenied
+	case CodeQuotaExceeded, CodeRateLimited:
+		c = codes.ResourceExhausted
+	case CodeNotFound:
+		c = codes.NotFound
+	case CodeMethodNotAllowed:
+		c = codes.Unimplemented
+	case CodeTooLarge:
+		c = codes.ResourceExhausted
+	case CodeUpstreamFetch, CodeQueueUnavailable:
+		c = codes.Unavailable
+	}
+	return status.Error(c, e.Message)
+}
+
+func (s *grpcServer) Enqueue(ctx context.Context, req *webpb.EnqueueRequest) (*webpb.Job, error) {
+	bucket, ok := models[req.Model]
+	if !ok {
+		return nil, grpcError(newError(CodeNotFound, "unknown model %q", req.Model))
+	}
+	if req.Input == "" {
+		return nil, grpcError(newError(CodeValidation, "empty input"))
+	}
+	item, _, err := createRequest(s.context(ctx), bucket, req.Input)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toJob(item), nil
+}
+
+func (s *grpcServer) Claim(req *webpb.ClaimRequest, stream webpb.Queue_ClaimServer) error {
+	bucket, ok := models[req.Model]
+	if !ok {
+		return grpcError(newError(CodeNotFound, "unknown model %q", req.Model))
+	}
+	ctx := s.context(stream.Context())
+	for {
+		item, err := popRequest(ctx, bucket)
+		if err != nil {
+			if ctx.Err() != nil {
+				return status.Error(codes.Canceled, ctx.Err().Error())
+			}
+			return grpcError(err)
+		}
+		glog.Infof("claimed %q via gRPC", item.RequestID)
+		if err = stream.Send(toJob(item)); err != nil {
+			if uerr := s.srv.unclaimRequest(item); uerr != nil {
+				glog.Warningf("lost %q while sending claimed job (%v, %v)", item.RequestID, err, uerr)
+			} else {
+				glog.Warningf("requeued %q after failing to send claimed job (%v)", item.RequestID, err)
+			}
+			return err
+		}
+	}
+}
+
+func (s *grpcServer) ReportProgress(ctx context.Context, req *webpb.ReportProgressRequest) (*webpb.Job, error) {
+	if req.Progress < 0 || req.Progress >= queue.MaxProgress {
+		return nil, grpcError(newError(CodeValidation, "progress %d out of range [0, %d)", req.Progress, queue.MaxProgress))
+	}
+	item, err := s.srv.getRequest(req.RequestID)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	copied := *item
+	copied.Progress = int(req.Progress)
+	if err = s.srv.updateClaimed(s.context(ctx), &copied); err != nil {
+		return nil, grpcError(err)
+	}
+	return toJob(&copied), nil
+}
+
+func (s *grpcServer) Complete(ctx context.Context, req *webpb.CompleteRequest) (*webpb.Job, error) {
+	item, err := s.srv.getRequest(req.RequestID)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	copied := *item
+	copied.Progress = queue.MaxProgress
+	copied.Error = req.Error
+	if req.Value != "" {
+		copied.Value = req.Value
+	}
+	if err = s.srv.updateClaimed(s.context(ctx), &copied); err != nil {
+		return nil, grpcError(err)
+	}
+	glog.Infof("completed %q via gRPC", req.RequestID)
+	return toJob(&copied), nil
+}
+
+func (s *grpcServer) WatchJob(req *webpb.WatchJobRequest, stream webpb.Queue_WatchJobServer) error {
+	ch, cancel := s.srv.watch(req.RequestID)
+	defer cancel()
+
+	ctx := s.context(stream.Context())
+	var last *queue.Item
+	for {
+		item, err := s.srv.getOwnRequest(ctx, req.RequestID)
+		if err != nil {
+			return grpcError(err)
+		}
+		if last == nil || last.Progress != item.Progress || last.Value != item.Value || last.Error != item.Error {
+			if err = stream.Send(toJob(item)); err != nil {
+				return err
+			}
+			last = item
+		}
+		if item.Progress >= queue.MaxProgress {
+			return nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return status.Error(codes.Canceled, ctx.Err().Error())
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package web
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gyuho/dplearn/backend/web/webpb"
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestGRPC(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	defer ts.Close()
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := newGRPCServer(srv, nil)
+	go gs.Serve(ln)
+	defer gs.Stop()
+
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cli := webpb.NewQueueClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err = cli.Enqueue(ctx, &webpb.EnqueueRequest{Model: "dogs", Input: "a.jpg"}); grpc.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+	job, err := cli.Enqueue(ctx, &webpb.EnqueueRequest{Model: "cats", Input: imgServer.URL + "/cat.jpeg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.RequestID == "" || job.Bucket != "/cats-request" || job.CreatedAtUnixNano == 0 {
+		t.Fatalf("unexpected job %+v", job)
+	}
+
+	wc, err := cli.WatchJob(ctx, &webpb.WatchJobRequest{RequestID: job.RequestID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := wc.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	progressc := make(chan []int32)
+	go func() {
+		progress := []int32{first.Progress}
+		for {
+			j, err := wc.Recv()
+			if err != nil {
+				if err != io.EOF {
+					t.Error(err)
+				}
+				progressc <- progress
+				return
+			}
+			progress = append(progress, j.Progress)
+		}
+	}()
+
+	cc, err := cli.Claim(ctx, &webpb.ClaimRequest{Model: "cats"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := cc.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed.RequestID != job.RequestID || !strings.HasSuffix(claimed.Value, ".jpeg") {
+		t.Fatalf("unexpected claimed job %+v", claimed)
+	}
+
+	if _, err = cli.ReportProgress(ctx, &webpb.ReportProgressRequest{RequestID: job.RequestID, Progress: 100}); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+	if _, err = cli.ReportProgress(ctx, &webpb.ReportProgressRequest{RequestID: job.RequestID, Progress: 50}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	done, err := cli.Complete(ctx, &webpb.CompleteRequest{RequestID: job.RequestID, Value: "cat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.Progress != 100 || done.Value != "cat" {
+		t.Fatalf("unexpected job %+v", done)
+	}
+	if progress := <-progressc; len(progress) != 3 || progress[0] != 0 || progress[1] != 50 || progress[2] != 100 {
+		t.Fatalf("expected progress [0 50 100], got %v", progress)
+	}
+
+	srv.deleteRequest(job.RequestID)
+	if _, err = cli.ReportProgress(ctx, &webpb.ReportProgressRequest{RequestID: job.RequestID, Progress: 10}); grpc.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound on canceled job, got %v", err)
+	}
+}
+
+// canceledClaimStream is the claim stream whose client cancels
+// before receiving the claimed job.
+type canceledClaimStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	cancel func()
+}
+
+func (s *canceledClaimStream) Context() context.Context { return s.ctx }
+
+func (s *canceledClaimStream) Send(*webpb.Job) error {
+	s.cancel()
+	return s.ctx.Err()
+}
+
+func TestGRPCClaimCanceled(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	defer ts.Close()
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	var job Job
+	doJSON(t, http.MethodPost, ts.URL+"/v1/models/cats/jobs", `{"input": "`+imgServer.URL+`/cat.jpeg"}`, &job)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &canceledClaimStream{ctx: ctx, cancel: cancel}
+	if err := (&grpcServer{srv: srv}).Claim(&webpb.ClaimRequest{Model: "cats"}, stream); err == nil {
+		t.Fatal("expected error from canceled stream")
+	}
+	if srv.workers.claimed(job.RequestID) {
+		t.Fatalf("expected %q to be released", job.RequestID)
+	}
+
+	// the job is not lost, and claimed by the next worker
+	var item queue.Item
+	doJSON(t, http.MethodPost, ts.URL+"/v1/queues/cats-request/claim", "", &item)
+	if item.RequestID != job.RequestID {
+		t.Fatalf("expected requeued %q, got %+v", job.RequestID, item)
+	}
+}
@@ -2,11 +2,11 @@ package web
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -16,27 +16,94 @@ import (
 	"sync"
 	"time"
 
+	"github.com/gyuho/dplearn/pkg/blobstore"
 	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
-	"github.com/gyuho/dplearn/pkg/fileutil"
 	"github.com/gyuho/dplearn/pkg/lru"
+	"github.com/gyuho/dplearn/pkg/trace"
 	"github.com/gyuho/dplearn/pkg/urlutil"
 
 	humanize "github.com/dustin/go-humanize"
 	"github.com/golang/glog"
+	"google.golang.org/grpc"
 )
 
 // Server warps http.Server.
 type Server struct {
+	cfg Config
+
 	mu         sync.RWMutex
 	rootCtx    context.Context
 	rootCancel func()
 	webURL     url.URL
 	httpServer *http.Server
 	qu         queue.Queue
+	store      *blobstore.Store
+	fetcher    *urlutil.Fetcher
 
 	donec chan struct{}
 
+	// drainc is closed on shutdown, to reject new jobs
+	// and to cancel blocking Pops.
+	drainc    chan struct{}
+	drainOnce sync.Once
+	stopOnce  sync.Once
+
 	requestCache sync.Map
+
+	// requestDigests maps request ID to the digest of its image,
+	// so that the image is kept in the store until the request is deleted.
+	requestDigests sync.Map
+
+	// legacyErrors is true to respond errors with 200 and queue item.
+	legacyErrors bool
+
+	// keys is nil to disable API key authentication.
+	keys         KeyStore
+	anonymousKey *APIKey
+	quota        *quota
+
+	// rateLimiter is nil to disable rate limits.
+	rateLimiter RateLimiter
+	rateLimits  map[string]RateLimit
+
+	// trustedProxies are the proxies whose forwarded headers are trusted
+	// for the client IP (e.g. nginx).
+	trustedProxies []*net.IPNet
+
+	// accessLog is nil to disable access logs.
+	accessLog *accessLogger
+
+	// clientCerts is true to require client certificates of workers
+	// and operators.
+	clientCerts bool
+
+	// frontend is nil to not serve the frontend.
+	frontend http.FileSystem
+
+	// cache is the image cache, shared by HTTP and gRPC handlers.
+	cache lru.Cache
+
+	grpcServer *grpc.Server
+
+	// workers tracks workers polling each bucket, for readiness
+	// and the admin API.
+	workers workerRegistry
+
+	// recentErrors keeps the recent server-side errors for the admin API.
+	recentErrors errorLog
+
+	// batches tracks the jobs of batches.
+	batches batchStore
+
+	// history is nil to disable the job history of users.
+	history HistoryStore
+	// requestOwners maps request ID to its owner (see 'identity'),
+	// who can get and delete the job, and has it in history.
+	requestOwners sync.Map
+
+	// watchers maps request ID to the channels notified on its updates.
+	watchMu  sync.Mutex
+	watchers map[string]map[chan struct{}]struct{}
 }
 
 type key int
@@ -50,57 +117,217 @@ const (
 
 func with(h ContextHandler, srv *Server, qu queue.Queue, cache lru.Cache) ContextHandler {
 	return ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
-		ctx = context.WithValue(ctx, serverKey, srv)
-		ctx = context.WithValue(ctx, queueKey, qu)
-		ctx = context.WithValue(ctx, cacheKey, cache)
-		ctx = context.WithValue(ctx, userKey, generateUserID(req))
-		return h.ServeHTTPContext(ctx, w, req)
+		ctx = withValues(ctx, srv, qu, cache, generateUserID(req, srv.trustedProxies))
+		err := h.ServeHTTPContext(ctx, w, req)
+		if sw, ok := w.(*statusWriter); ok && sw.err != nil {
+			srv.recordError(ctx, "http", sw.err)
+		}
+		return err
 	})
 }
 
-const (
-	enqueueTTL = 30 * time.Minute
+func withValues(ctx context.Context, srv *Server, qu queue.Queue, cache lru.Cache, userID string) context.Context {
+	ctx = context.WithValue(ctx, serverKey, srv)
+	ctx = context.WithValue(ctx, queueKey, qu)
+	ctx = context.WithValue(ctx, cacheKey, cache)
+	if e := traceOf(ctx); e != nil {
+		e.UserID = userID
+	}
+	return context.WithValue(ctx, userKey, userID)
+}
 
+const (
 	// RequestIDHeader is the field name for request ID header.
 	RequestIDHeader = "Request-Id"
 )
 
-// StartServer starts a backend webserver with stoppable listener.
-func StartServer(scheme, hostPort string, qu queue.Queue) (*Server, error) {
+// Op configures the server.
+type Op struct {
+	legacyErrors bool
+	grpcHostPort string
+	keys         KeyStore
+	anonymousKey *APIKey
+	rateLimits   map[string]RateLimit
+	rateLimiter  RateLimiter
+
+	trustedProxies []string
+	accessLog      io.Writer
+	frontend       http.FileSystem
+	history        HistoryStore
+}
+
+// OpOption configures the server.
+type OpOption func(*Op)
+
+// WithLegacyErrors responds errors with 200 status and the queue item of
+// error message, instead of the error envelope with 4xx or 5xx status.
+// The current frontend only reads errors from the queue item.
+func WithLegacyErrors(legacy bool) OpOption {
+	return func(op *Op) { op.legacyErrors = legacy }
+}
+
+// WithGRPC serves the gRPC service of 'webpb.Queue' on the host and port,
+// for workers and internal clients.
+func WithGRPC(hostPort string) OpOption {
+	return func(op *Op) { op.grpcHostPort = hostPort }
+}
+
+// WithKeyStore requires API keys from the store, for submitting jobs
+// and for workers.
+func WithKeyStore(ks KeyStore) OpOption {
+	return func(op *Op) { op.keys = ks }
+}
+
+// WithAnonymousKey applies the key to requests without API key, so that
+// the current frontend can submit jobs with its scopes and limits.
+// Anonymous requests share the quotas of the key.
+func WithAnonymousKey(k APIKey) OpOption {
+	return func(op *Op) { op.anonymousKey = &k }
+}
+
+// WithRateLimits limits requests of each API key or client IP under the paths,
+// and gRPC calls under the method names (see 'ParseRateLimits').
+func WithRateLimits(limits map[string]RateLimit) OpOption {
+	return func(op *Op) { op.rateLimits = limits }
+}
+
+// WithRateLimiter sets the rate limiter, which defaults to the one in memory.
+// Use 'EtcdRateLimiter' to share the limits across replicas.
+func WithRateLimiter(l RateLimiter) OpOption {
+	return func(op *Op) { op.rateLimiter = l }
+}
+
+// WithTrustedProxies trusts 'Forwarded', 'X-Forwarded-For' and 'X-Real-Ip'
+// headers from the proxies of CIDRs or IPs (e.g. "127.0.0.1/32", "::1"),
+// for the client IP in user identities and rate limits. Headers are ignored
+// by default, and the client IP is the remote address.
+func WithTrustedProxies(cidrs ...string) OpOption {
+	return func(op *Op) { op.trustedProxies = append(op.trustedProxies, cidrs...) }
+}
+
+// WithAccessLog writes access logs of HTTP requests to the writer, one JSON
+// object per line (see 'AccessLog'). Access logs are disabled by default.
+func WithAccessLog(w io.Writer) OpOption {
+	return func(op *Op) { op.accessLog = w }
+}
+
+// WithFrontend serves the built frontend from the file system (e.g. assets
+// embedded in the binary), for the paths not used by the API. It takes
+// precedence over 'Config.FrontendDir'.
+func WithFrontend(fs http.FileSystem) OpOption {
+	return func(op *Op) { op.frontend = fs }
+}
+
+// WithHistory keeps the history of jobs for each API key or user in the
+// store, for 'GET /v1/jobs', until 'Config.HistoryRetention'.
+// Use 'EtcdHistory' to persist across restarts and replicas.
+func WithHistory(h HistoryStore) OpOption {
+	return func(op *Op) { op.history = h }
+}
+
+func (op *Op) applyOpts(opts []OpOption) {
+	for _, opt := range opts {
+		opt(op)
+	}
+}
+
+// StartServer starts a backend webserver with stoppable listener,
+// after validating the configuration.
+func StartServer(cfg Config, qu queue.Queue, opts ...OpOption) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	var op Op
+	op.applyOpts(opts)
+	if len(op.rateLimits) == 0 {
+		op.rateLimiter = nil
+	} else if op.rateLimiter == nil {
+		op.rateLimiter = NewMemoryRateLimiter()
+	}
+	trusted, err := parseCIDRs(op.trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies (%v)", err)
+	}
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if op.frontend == nil && cfg.FrontendDir != "" {
+		op.frontend = http.Dir(cfg.FrontendDir)
+	}
+	if op.frontend != nil {
+		f, _, err := openFile(op.frontend, "/index.html")
+		if err != nil {
+			return nil, fmt.Errorf("invalid frontend (%v)", err)
+		}
+		f.Close()
+	}
+
+	store, err := blobstore.New(cfg.ImageDir)
+	if err != nil {
+		return nil, err
+	}
+	fetcher, err := urlutil.NewFetcher()
+	if err != nil {
+		return nil, err
+	}
+
 	rootCtx, rootCancel := context.WithCancel(context.Background())
-	mux := http.NewServeMux()
-	webURL := url.URL{Scheme: scheme, Host: hostPort}
+	webURL := url.URL{Scheme: cfg.Scheme, Host: cfg.Host}
 	srv := &Server{
+		cfg:        cfg,
 		rootCtx:    rootCtx,
 		rootCancel: rootCancel,
 		webURL:     webURL,
-		httpServer: &http.Server{Addr: webURL.Host, Handler: mux},
+		httpServer: &http.Server{Addr: webURL.Host, TLSConfig: tlsConfig},
 		qu:         qu,
+		store:      store,
+		fetcher:    fetcher,
 		donec:      make(chan struct{}),
+		drainc:     make(chan struct{}),
+
+		legacyErrors: op.legacyErrors,
+		keys:         op.keys,
+		anonymousKey: op.anonymousKey,
+		quota:        newQuota(),
+		rateLimiter:  op.rateLimiter,
+		rateLimits:   op.rateLimits,
+
+		trustedProxies: trusted,
+		clientCerts:    tlsConfig != nil && tlsConfig.ClientCAs != nil,
+		frontend:       op.frontend,
+		history:        op.history,
+	}
+	if op.accessLog != nil {
+		srv.accessLog = &accessLogger{w: op.accessLog}
 	}
 
-	cache := lru.NewInMemory(imageCacheSize)
+	cache := lru.NewInMemoryWithEvict(cfg.ImageCacheSize, func(namespace string, key, value interface{}) {
+		blob := value.(blobstore.Blob)
+		if err := store.Release(blob.Digest); err != nil {
+			glog.Warningf("failed to release %q from image cache (%v)", blob.Path, err)
+		}
+	})
 	cache.CreateNamespace(imageCacheBucket)
+	srv.cache = cache
+	srv.httpServer.Handler = srv.newMux(cache)
 
-	mux.Handle("/healthz", &ContextAdapter{
-		ctx: rootCtx,
-		handler: ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
-			w.WriteHeader(200)
-			w.Write([]byte("OK"))
-			return nil
-		}),
-	})
-	mux.Handle("/cats-request", &ContextAdapter{
-		ctx:     rootCtx,
-		handler: with(ContextHandlerFunc(clientRequestHandler), srv, qu, cache),
-	})
-	mux.Handle("/cats-request/queue", &ContextAdapter{
-		ctx:     rootCtx,
-		handler: with(ContextHandlerFunc(queueHandler), srv, qu, cache),
-	})
+	if op.grpcHostPort != "" {
+		ln, err := net.Listen("tcp", op.grpcHostPort)
+		if err != nil {
+			rootCancel()
+			return nil, err
+		}
+		srv.grpcServer = newGRPCServer(srv, tlsConfig)
+		go func() {
+			glog.Infof("starting gRPC server %q", ln.Addr().String())
+			if err := srv.grpcServer.Serve(ln); err != nil {
+				glog.Warningf("gRPC server %q stopped (%v)", ln.Addr().String(), err)
+			}
+		}()
+	}
 
-	gcPeriod := 5 * time.Minute
-	go srv.gcCache(gcPeriod)
+	go srv.gcCache(cfg.GCPeriod)
 
 	go func() {
 		defer func() {
@@ -112,7 +339,14 @@ func StartServer(scheme, hostPort string, qu queue.Queue) (*Server, error) {
 		}()
 
 		glog.Infof("starting server %q", srv.webURL.String())
-		if err := srv.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if srv.httpServer.TLSConfig != nil {
+			// certificates are from 'TLSConfig.GetCertificate'
+			err = srv.httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = srv.httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			glog.Fatal(err)
 		}
 
@@ -128,6 +362,67 @@ func StartServer(scheme, hostPort string, qu queue.Queue) (*Server, error) {
 	return srv, nil
 }
 
+// newMux registers the legacy routes, the v1 API, health checks, and the
+// frontend on other paths if enabled.
+// '/healthz' only reports that the server is up, while '/readyz' and
+// '/livez' check its dependencies and state.
+func (srv *Server) newMux(cache lru.Cache) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/readyz", &ContextAdapter{
+		ctx:       srv.rootCtx,
+		accessLog: srv.accessLog,
+		handler: ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+			return writeHealth(w, srv.readyz(ctx))
+		}),
+	})
+	mux.Handle("/livez", &ContextAdapter{
+		ctx:       srv.rootCtx,
+		accessLog: srv.accessLog,
+		handler: ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+			return writeHealth(w, srv.livez())
+		}),
+	})
+	mux.Handle("/healthz", &ContextAdapter{
+		ctx:       srv.rootCtx,
+		accessLog: srv.accessLog,
+		handler: ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+			w.WriteHeader(200)
+			w.Write([]byte("OK"))
+			return nil
+		}),
+	})
+	for _, bucket := range models {
+		mux.Handle(bucket, &ContextAdapter{
+			ctx:       srv.rootCtx,
+			accessLog: srv.accessLog,
+			handler:   with(withAuth(withRateLimit(ContextHandlerFunc(clientRequestHandler)), ScopeSubmit), srv, srv.qu, cache),
+		})
+		mux.Handle(bucket+"/queue", &ContextAdapter{
+			ctx:       srv.rootCtx,
+			accessLog: srv.accessLog,
+			handler:   with(withAuth(withRateLimit(ContextHandlerFunc(queueHandler)), ScopeWorker), srv, srv.qu, cache),
+		})
+	}
+	mux.Handle("/v1/", &ContextAdapter{
+		ctx:       srv.rootCtx,
+		accessLog: srv.accessLog,
+		handler:   with(ContextHandlerFunc(v1Handler), srv, srv.qu, cache),
+	})
+	mux.Handle("/admin/", &ContextAdapter{
+		ctx:       srv.rootCtx,
+		accessLog: srv.accessLog,
+		handler:   with(ContextHandlerFunc(adminHandler), srv, srv.qu, cache),
+	})
+	if srv.frontend != nil {
+		mux.Handle("/", &ContextAdapter{
+			ctx:       srv.rootCtx,
+			accessLog: srv.accessLog,
+			handler:   frontendHandler(srv.frontend),
+		})
+	}
+	return mux
+}
+
 // gcCache garbage-collects old items in the cache.
 func (srv *Server) gcCache(period time.Duration) {
 	ticker := time.NewTicker(period)
@@ -141,47 +436,133 @@ func (srv *Server) gcCache(period time.Duration) {
 			return
 		case <-ticker.C:
 		}
+		srv.gc(time.Now(), period)
+	}
+}
 
-		srv.requestCache.Range(func(k, v interface{}) bool {
-			if k == nil || v == nil {
-				return false
-			}
-			id := k.(string)
-			item := v.(*queue.Item)
-
-			glog.Warningf("%q should have been requested to delete when user leaves browser (missed DELETE request?)", id)
-			if time.Since(item.CreatedAt) > period {
-				srv.requestCache.Delete(k)
-				if item.Progress == queue.MaxProgress {
-					glog.Infof("deleted %q because its progress is %d (created at %s)", id, queue.MaxProgress, item.CreatedAt)
-				} else {
-					glog.Warningf("deleted %q and its progress is %d (created at %s)", id, item.Progress, item.CreatedAt)
-				}
+// gc deletes the requests created before the period, except the ones
+// that batches wait for until 'Config.BatchJobTimeout'.
+func (srv *Server) gc(now time.Time, period time.Duration) {
+	srv.requestCache.Range(func(k, v interface{}) bool {
+		if k == nil || v == nil {
+			return false
+		}
+		id := k.(string)
+		item := v.(*queue.Item)
+		if srv.batches.pending(id) {
+			if now.Sub(item.CreatedAt) > srv.cfg.BatchJobTimeout && item.Progress < queue.MaxProgress {
+				// fails the inputs of batches, and deleted in next gc
+				srv.cancelRequest(item, fmt.Sprintf("job timed out after %v", srv.cfg.BatchJobTimeout))
 			}
 			return true
-		})
+		}
+
+		glog.Warningf("%q should have been requested to delete when user leaves browser (missed DELETE request?)", id)
+		if now.Sub(item.CreatedAt) > period {
+			srv.deleteRequest(id)
+			if item.Progress == queue.MaxProgress {
+				glog.Infof("deleted %q because its progress is %d (created at %s)", id, queue.MaxProgress, item.CreatedAt)
+			} else {
+				glog.Warningf("deleted %q and its progress is %d (created at %s)", id, item.Progress, item.CreatedAt)
+			}
+		}
+		return true
+	})
+	srv.batches.gc(now, srv.cfg.BatchRetention)
+	srv.expireHistory(now)
+}
+
+// deleteRequest deletes the request from the cache,
+// and releases its image from the store.
+func (srv *Server) deleteRequest(requestID string) {
+	srv.requestCache.Delete(requestID)
+	if srv.quota != nil {
+		srv.quota.release(requestID)
+	}
+	srv.notify(requestID)
+	srv.workers.release(requestID)
+	srv.batches.finish(requestID, "", "job was deleted")
+	srv.updateHistory(srv.rootCtx, requestID, func(r *JobRecord) {
+		if r.Status == JobQueued || r.Status == JobRunning {
+			now := time.Now()
+			r.Status, r.CompletedAt = JobCanceled, &now
+		}
+	})
+	srv.requestOwners.Delete(requestID)
+	if v, ok := srv.requestDigests.Load(requestID); ok {
+		srv.requestDigests.Delete(requestID)
+		if err := srv.store.Release(v.(string)); err != nil {
+			glog.Warningf("failed to release image of %q (%v)", requestID, err)
+		}
 	}
 }
 
-// Stop stops the server. Useful for testing.
-func (srv *Server) Stop() error {
-	glog.Infof("stopping server %q", srv.webURL.String())
+// draining returns true if the server is shutting down.
+func (srv *Server) draining() bool {
+	select {
+	case <-srv.drainc:
+		return true
+	default:
+		return false
+	}
+}
 
+// Shutdown gracefully stops the server, without stopping the queue. It stops
+// accepting new jobs, and cancels blocking Pops of idle workers, which retry
+// on errors. Then it waits for in-flight requests and gRPC calls until the
+// context is done, and closes the remaining connections.
+func (srv *Server) Shutdown(ctx context.Context) error {
 	srv.mu.Lock()
-	srv.qu.Stop()
+	defer srv.mu.Unlock()
+
 	if srv.httpServer == nil {
-		srv.mu.Unlock()
 		glog.Infof("already stopped %q", srv.webURL.String())
 		return nil
 	}
-	ctx, cancel := context.WithTimeout(srv.rootCtx, 5*time.Second)
+	glog.Infof("draining server %q", srv.webURL.String())
+	srv.drainOnce.Do(func() { close(srv.drainc) })
+
+	var grpcDone chan struct{}
+	if srv.grpcServer != nil {
+		gs := srv.grpcServer
+		grpcDone = make(chan struct{})
+		go func() {
+			gs.GracefulStop()
+			close(grpcDone)
+		}()
+	}
 	err := srv.httpServer.Shutdown(ctx)
+	if err != nil {
+		glog.Warningf("closing connections of %q before drained (%v)", srv.webURL.String(), err)
+		srv.httpServer.Close()
+	}
+	if grpcDone != nil {
+		select {
+		case <-grpcDone:
+		case <-ctx.Done():
+			// e.g. 'WatchJob' streams of jobs in progress
+			srv.grpcServer.Stop()
+			<-grpcDone
+		}
+		srv.grpcServer = nil
+	}
+	srv.httpServer = nil
+
+	glog.Infof("drained server %q", srv.webURL.String())
+	return err
+}
+
+// Stop stops the server and then its queue. Useful for testing.
+func (srv *Server) Stop() error {
+	glog.Infof("stopping server %q", srv.webURL.String())
+
+	ctx, cancel := context.WithTimeout(srv.rootCtx, 5*time.Second)
+	err := srv.Shutdown(ctx)
 	cancel()
 	if err != nil && err != context.DeadlineExceeded {
 		return err
 	}
-	srv.httpServer = nil
-	srv.mu.Unlock()
+	srv.stopOnce.Do(srv.qu.Stop)
 
 	glog.Infof("stopped server %q", srv.webURL.String())
 	return nil
@@ -196,16 +577,19 @@ func queueHandler(ctx context.Context, w http.ResponseWriter, req *http.Request)
 	reqPath := req.URL.Path
 	bucket := path.Dir(reqPath)
 	srv := ctx.Value(serverKey).(*Server)
-	qu := ctx.Value(queueKey).(queue.Queue)
 
 	switch req.Method {
 	case http.MethodGet:
-		return json.NewEncoder(w).Encode(<-qu.Pop(ctx, bucket))
+		item, err := popRequest(ctx, bucket)
+		if err != nil {
+			return writeError(ctx, w, bucket, err)
+		}
+		return json.NewEncoder(w).Encode(item)
 
 	case http.MethodPost:
 		rb, err := ioutil.ReadAll(req.Body)
 		if err != nil {
-			return err
+			return writeError(ctx, w, bucket, newError(CodeValidation, "failed to read body (%v)", err))
 		}
 		// TODO: python gets ('Connection aborted.', BadStatusLine("''",))
 		io.Copy(ioutil.Discard, req.Body)
@@ -213,20 +597,17 @@ func queueHandler(ctx context.Context, w http.ResponseWriter, req *http.Request)
 
 		var item queue.Item
 		if err = json.Unmarshal(rb, &item); err != nil {
-			return json.NewEncoder(w).Encode(&queue.Item{Bucket: bucket, Progress: 0, Error: err.Error()})
+			return writeError(ctx, w, bucket, newError(CodeValidation, "%s", err.Error()))
 		}
-
-		if item.Bucket == "" || item.Key == "" || item.Value == "" || item.RequestID == "" {
-			return json.NewEncoder(w).Encode(&queue.Item{Bucket: bucket, Progress: 0, Error: fmt.Sprintf("invalid item: %+v", item)})
+		traceRequest(ctx, item.RequestID)
+		if item.Progress < 0 || item.Progress > queue.MaxProgress {
+			return writeError(ctx, w, bucket, newError(CodeValidation, "progress %d out of range [0, %d]", item.Progress, queue.MaxProgress))
 		}
-
-		_, ok := srv.requestCache.Load(item.RequestID)
-		if !ok {
-			return json.NewEncoder(w).Encode(&queue.Item{Bucket: bucket, Progress: 0, Error: fmt.Sprintf("unknown request ID %q", item.RequestID)})
+		if err = srv.updateClaimed(ctx, &item); err != nil {
+			return writeError(ctx, w, bucket, err)
 		}
-		srv.requestCache.Store(item.RequestID, item)
 
-		glog.Infof("queue received POST on %q", item.RequestID)
+		glog.Infof("queue received POST on %q (trace %q)", item.RequestID, traceID(ctx))
 		return json.NewEncoder(w).Encode(&item)
 
 	default:
@@ -241,33 +622,29 @@ type Request struct {
 	CreateRequest    bool   `json:"create_request"`
 }
 
+// clientRequestHandler serves the legacy client API, where POST either
+// creates or deletes the request depending on 'create_request'.
 func clientRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
 	reqPath := req.URL.Path
 	srv := ctx.Value(serverKey).(*Server)
-	qu := ctx.Value(queueKey).(queue.Queue)
-	cache := ctx.Value(cacheKey).(lru.Cache)
-	userID := ctx.Value(userKey).(string)
 
 	switch req.Method {
 	case http.MethodGet: // item status fetch
 		requestID := req.Header.Get(RequestIDHeader)
 		if requestID == "" {
-			err := fmt.Errorf("expected %q from header (got %+v)", RequestIDHeader, req.Header)
-			glog.Warning(err)
-			return json.NewEncoder(w).Encode(&queue.Item{Bucket: reqPath, Progress: 0, Error: err.Error()})
+			return writeError(ctx, w, reqPath, newError(CodeValidation, "expected %q from header (got %+v)", RequestIDHeader, req.Header))
 		}
-		vi, ok := srv.requestCache.Load(requestID)
-		if !ok {
-			err := fmt.Errorf("cannot find request ID %q", requestID)
-			glog.Warning(err)
-			return json.NewEncoder(w).Encode(&queue.Item{Bucket: reqPath, Progress: 0, Error: err.Error()})
+		traceRequest(ctx, requestID)
+		item, err := srv.getOwnRequest(ctx, requestID)
+		if err != nil {
+			return writeError(ctx, w, reqPath, err)
 		}
-		return json.NewEncoder(w).Encode(vi)
+		return json.NewEncoder(w).Encode(item)
 
 	case http.MethodPost: // item creation/cancel
 		rb, err := ioutil.ReadAll(req.Body)
 		if err != nil {
-			return err
+			return writeError(ctx, w, reqPath, newError(CodeValidation, "failed to read body (%v)", err))
 		}
 		// TODO: python gets ('Connection aborted.', BadStatusLine("''",))
 		io.Copy(ioutil.Discard, req.Body)
@@ -275,60 +652,41 @@ func clientRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.
 
 		creq := Request{}
 		if err = json.Unmarshal(rb, &creq); err != nil {
-			err = fmt.Errorf("JSON parse error %q", err.Error())
-			glog.Warning(err)
-			return json.NewEncoder(w).Encode(&queue.Item{Bucket: reqPath, Progress: 0, Error: err.Error()})
+			return writeError(ctx, w, reqPath, newError(CodeValidation, "JSON parse error %q", err.Error()))
 		}
 		if creq.DataFromFrontend == "" {
-			glog.Warning("TODO: skipping empty request... bug in frontend ngOnDestroy?")
-			return nil
-		}
-
-		switch reqPath {
-		case "/cats-request":
-			var imgFilePath string
-			imgFilePath, err = cacheImage(cache, creq.DataFromFrontend)
-			if err != nil {
-				err = fmt.Errorf("error %q while fetching %q", err.Error(), creq.DataFromFrontend)
-				glog.Warning(err)
-				return json.NewEncoder(w).Encode(&queue.Item{Bucket: reqPath, Progress: 0, Error: err.Error()})
+			if srv.legacyErrors {
+				glog.Warning("TODO: skipping empty request... bug in frontend ngOnDestroy?")
+				return nil
 			}
-			creq.DataFromFrontend = imgFilePath
-
-		default:
-			err = fmt.Errorf("unknown request %q", reqPath)
-			glog.Warning(err)
-			return json.NewEncoder(w).Encode(&queue.Item{Bucket: reqPath, Progress: 0, Error: err.Error()})
+			return writeError(ctx, w, reqPath, newError(CodeValidation, "empty data_from_frontend"))
 		}
 
-		requestID := generateRequestID(reqPath, userID, creq.DataFromFrontend)
-
 		switch creq.CreateRequest {
 		case true:
-			glog.Infof("fetching %q before creating item", requestID)
-			v, ok := srv.requestCache.Load(requestID)
-			if ok {
-				glog.Infof("fetched %q before creating item, no need to create", requestID)
-				return json.NewEncoder(w).Encode(v)
+			item, created, err := createRequest(ctx, reqPath, creq.DataFromFrontend)
+			if err != nil {
+				return writeError(ctx, w, reqPath, err)
 			}
-
-			item := queue.CreateItem(reqPath, 100, creq.DataFromFrontend)
-			item.RequestID = requestID
-
-			if err = qu.Add(ctx, item, queue.WithTTL(enqueueTTL)); err != nil {
-				glog.Warning(err)
-				return json.NewEncoder(w).Encode(&queue.Item{Bucket: reqPath, Progress: 0, Error: err.Error()})
+			w.Header().Set(RequestIDHeader, item.RequestID)
+			if !created {
+				return json.NewEncoder(w).Encode(item)
 			}
-			srv.requestCache.Store(requestID, item)
-
-			glog.Infof("created an item with request ID %s", requestID)
 			copied := *item
-			copied.Value = fmt.Sprintf("[BACKEND - ACK] Requested %q (request ID: %s)", copied.Value, requestID)
+			copied.Value = fmt.Sprintf("[BACKEND - ACK] Requested %q (request ID: %s)", copied.Value, copied.RequestID)
 			return json.NewEncoder(w).Encode(&copied)
 
 		case false:
+			requestID, blob, err := requestInput(ctx, reqPath, creq.DataFromFrontend)
+			if err != nil {
+				return writeError(ctx, w, reqPath, err)
+			}
+			srv.store.Release(blob.Digest)
+			if _, err = srv.getOwnRequest(ctx, requestID); err != nil {
+				return writeError(ctx, w, reqPath, err)
+			}
 			glog.Infof("deleting %q", requestID)
-			srv.requestCache.Delete(requestID)
+			srv.deleteRequest(requestID)
 		}
 
 	default:
@@ -337,66 +695,119 @@ func clientRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.
 	return nil
 }
 
-const (
-	imageCacheSize      = 100
-	imageCacheBucket    = "image-cache"
-	imageCacheSizeLimit = 15000000 // 15 MB
-)
+const imageCacheBucket = "image-cache"
+
+// cacheImage downloads the image into the store, or returns the one from cache.
+// The returned blob holds a reference for the caller, which must be released.
+// Images larger than 'limit' bytes are rejected.
+func cacheImage(ctx context.Context, fetcher *urlutil.Fetcher, cache lru.Cache, store *blobstore.Store, ep string, limit int64) (blobstore.Blob, error) {
+	ctx, span := trace.Start(ctx, "image.Fetch")
+	blob, err := fetchImage(ctx, span, fetcher, cache, store, ep, limit)
+	span.SetError(err)
+	span.Finish()
+	return blob, err
+}
 
-func cacheImage(cache lru.Cache, ep string) (string, error) {
+func fetchImage(ctx context.Context, span *trace.Span, fetcher *urlutil.Fetcher, cache lru.Cache, store *blobstore.Store, ep string, limit int64) (blobstore.Blob, error) {
 	originURL := urlutil.TrimQuery(ep)
+	span.SetAttribute("url", originURL)
 
 	vi, err := cache.Get(imageCacheBucket, originURL)
 	if err != nil && err != lru.ErrKeyNotFound {
-		return "", err
+		return blobstore.Blob{}, err
 	}
 
-	var imgFilePath string
 	if err != lru.ErrKeyNotFound { // exist in cache, just use the one from cache
 		glog.Infof("fetching %q from cache", originURL)
-		var ok bool
-		imgFilePath, ok = vi.(string)
+		blob, ok := vi.(blobstore.Blob)
 		if !ok {
-			return imgFilePath, fmt.Errorf("expected bytes type in 'image-cache' bucket, got %v", reflect.TypeOf(vi))
+			return blobstore.Blob{}, fmt.Errorf("expected blobstore.Blob type in 'image-cache' bucket, got %v", reflect.TypeOf(vi))
 		}
-		glog.Infof("fetched %q from cache", originURL)
-	} else { // not exist in cache, download, and cache it!
-		switch filepath.Ext(originURL) {
-		case ".jpg", ".jpeg":
-		case ".png":
-		default:
-			return "", fmt.Errorf("not support %q in %q (must be jpg, jpeg, png)", filepath.Ext(originURL), originURL)
+		if err = store.Acquire(blob.Digest); err == nil {
+			span.SetAttribute("cache", "hit")
+			glog.Infof("fetched %q from cache", originURL)
+			return blob, nil
 		}
+		// evicted in between, download again
+		glog.Warningf("%q was evicted while fetching from cache (%v)", originURL, err)
+	}
 
-		size, sizet, err := urlutil.GetContentLength(originURL)
-		if err != nil {
-			return "", fmt.Errorf("error when fetching %q", originURL)
-		}
-		if size > imageCacheSizeLimit {
-			return "", fmt.Errorf("%q is too big; %s > %s(limit)", originURL, sizet, humanize.Bytes(uint64(imageCacheSizeLimit)))
-		}
+	// not exist in cache, download, and cache it!
+	span.SetAttribute("cache", "miss")
+	switch filepath.Ext(originURL) {
+	case ".jpg", ".jpeg":
+	case ".png":
+	default:
+		return blobstore.Blob{}, newError(CodeValidation, "not support %q in %q (must be jpg, jpeg, png)", filepath.Ext(originURL), originURL)
+	}
 
-		glog.Infof("downloading %q", originURL)
-		var data []byte
-		data, err = urlutil.Get(originURL)
-		if err != nil {
-			return "", err
+	// Content-Length is only for early rejection, Download enforces the real size
+	_, head := trace.Start(ctx, "image.HEAD")
+	size, sizet, err := fetcher.GetContentLength(ctx, originURL)
+	if err != urlutil.ErrUnknownContentLength {
+		head.SetError(err)
+	}
+	head.SetAttribute("size", size)
+	head.Finish()
+	switch err {
+	case nil:
+		if size > uint64(limit) {
+			return blobstore.Blob{}, newError(CodeTooLarge, "%q is too big; %s > %s(limit)", originURL, sizet, humanize.Bytes(uint64(limit)))
 		}
-		glog.Infof("downloaded %q (%s)", originURL, humanize.Bytes(uint64(len(data))))
+	case urlutil.ErrUnknownContentLength:
+		glog.Warningf("%q has unknown size", originURL)
+	default:
+		return blobstore.Blob{}, newError(CodeUpstreamFetch, "error when fetching %q (%v)", originURL, err)
+	}
 
-		imgFilePath = filepath.Join("/tmp", base64.StdEncoding.EncodeToString([]byte(originURL))+filepath.Ext(originURL))
-		glog.Infof("saving %q to %q", originURL, imgFilePath)
-		if err = fileutil.WriteToFile(imgFilePath, data); err != nil {
-			return imgFilePath, err
+	glog.Infof("downloading %q to %q", originURL, store.Dir())
+	pr, pw := io.Pipe()
+	_, get := trace.Start(ctx, "image.GET")
+	go func() {
+		var written int64
+		_, derr := fetcher.Download(ctx, originURL, pw, limit, urlutil.WithProgress(func(n, _ int64) { written = n }))
+		// before Finish, which exports the span
+		get.SetAttribute("size", written)
+		get.SetError(derr)
+		get.Finish()
+		if derr != nil {
+			derr = &fetchError{err: derr}
 		}
-		glog.Infof("saved %q to %q", originURL, imgFilePath)
-
-		glog.Infof("storing %q into cache", originURL)
-		if err = cache.Put(imageCacheBucket, originURL, imgFilePath); err != nil {
-			return "", err
+		pw.CloseWithError(derr)
+	}()
+	blob, err := store.Put(pr, filepath.Ext(originURL))
+	pr.CloseWithError(err)
+	if fe, ok := err.(*fetchError); ok {
+		if fe.err == urlutil.ErrTooLarge {
+			return blobstore.Blob{}, newError(CodeTooLarge, "%q is too big; > %s(limit)", originURL, humanize.Bytes(uint64(limit)))
 		}
-		glog.Infof("stored %q into cache", originURL)
+		return blobstore.Blob{}, newError(CodeUpstreamFetch, "error when fetching %q (%v)", originURL, fe.err)
+	}
+	if err != nil {
+		return blobstore.Blob{}, err
+	}
+	glog.Infof("downloaded %q to %q (%s)", originURL, blob.Path, humanize.Bytes(blob.Size))
+
+	// one reference for the cache, the other for the caller
+	if err = store.Acquire(blob.Digest); err != nil {
+		return blobstore.Blob{}, err
 	}
 
-	return imgFilePath, nil
+	glog.Infof("storing %q into cache", originURL)
+	if err = cache.Put(imageCacheBucket, originURL, blob); err != nil {
+		store.Release(blob.Digest)
+		store.Release(blob.Digest)
+		return blobstore.Blob{}, err
+	}
+	glog.Infof("stored %q into cache", originURL)
+
+	return blob, nil
 }
+
+// fetchError distinguishes download failures from store failures,
+// when the download is piped to the store.
+type fetchError struct {
+	err error
+}
+
+func (e *fetchError) Error() string { return e.err.Error() }
@@ -4,16 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/gyuho/dplearn/pkg/blobstore"
 	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/lru"
+	"github.com/gyuho/dplearn/pkg/urlutil"
 
 	"github.com/golang/glog"
 )
@@ -38,7 +41,15 @@ func TestServer(t *testing.T) {
 	}
 	defer qu.Stop()
 
-	srv, err := StartServer("http", "localhost:42200", qu)
+	imageDir, err := ioutil.TempDir(os.TempDir(), "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(imageDir)
+
+	cfg := DefaultConfig()
+	cfg.Host, cfg.ImageDir = "localhost:42200", imageDir
+	srv, err := StartServer(cfg, qu)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -54,16 +65,7 @@ func TestServer(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	rb, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.Fatal(err)
-	}
-	io.Copy(ioutil.Discard, resp.Body)
-	resp.Body.Close()
-	var item queue.Item
-	if err = json.Unmarshal(rb, &item); err != nil {
-		t.Fatal(err)
-	}
+	item := readItem(t, resp)
 	if item.Error != "" {
 		t.Fatalf("got non-empty error: %+v", item)
 	}
@@ -87,16 +89,7 @@ func TestServer(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	rb, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.Fatal(err)
-	}
-	io.Copy(ioutil.Discard, resp.Body)
-	resp.Body.Close()
-	var itemFromQueueFetch queue.Item
-	if err = json.Unmarshal(rb, &itemFromQueueFetch); err != nil {
-		t.Fatal(err)
-	}
+	itemFromQueueFetch := readItem(t, resp)
 	if itemFromQueueFetch.Bucket != item.Bucket {
 		t.Fatalf("unexpected Bucket (%+v), expected %+v", itemFromQueueFetch, item)
 	}
@@ -116,7 +109,7 @@ func TestServer(t *testing.T) {
 	itemDone := itemFromQueueFetch
 	itemDone.Progress = 100
 	itemDone.Value = "done!"
-	rb, err = json.Marshal(itemDone)
+	rb, err := json.Marshal(itemDone)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -127,12 +120,7 @@ func TestServer(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	io.Copy(ioutil.Discard, resp.Body)
-	resp.Body.Close()
-	var itemFromQueuePost queue.Item
-	if err = json.Unmarshal(rb, &itemFromQueuePost); err != nil {
-		t.Fatal(err)
-	}
+	itemFromQueuePost := readItem(t, resp)
 	if itemDone.Equal(&itemFromQueuePost) != nil {
 		t.Fatalf("item expected %+v, got %+v", itemDone, itemFromQueuePost)
 	}
@@ -153,16 +141,7 @@ func TestServer(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	rb, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.Fatal(err)
-	}
-	io.Copy(ioutil.Discard, resp.Body)
-	resp.Body.Close()
-	var itemFromClientRequestFetch queue.Item
-	if err = json.Unmarshal(rb, &itemFromClientRequestFetch); err != nil {
-		t.Fatal(err)
-	}
+	itemFromClientRequestFetch := readItem(t, resp)
 	if itemDone.Equal(&itemFromClientRequestFetch) != nil {
 		t.Fatalf("item expected %+v, got %+v", itemDone, itemFromClientRequestFetch)
 	}
@@ -178,3 +157,98 @@ func TestServer(t *testing.T) {
 		t.Fatal("took too long to shut down")
 	}
 }
+
+// readItem reads the item in the response, and fails with the error
+// in the envelope on failure.
+func readItem(t *testing.T, resp *http.Response) queue.Item {
+	defer resp.Body.Close()
+	rb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var er ErrorResponse
+		if err = json.Unmarshal(rb, &er); err != nil {
+			t.Fatalf("%s %q: unexpected status %d (%q)", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, rb)
+		}
+		t.Fatalf("%s %q: unexpected status %d (%+v)", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, er.Error)
+	}
+	var item queue.Item
+	if err = json.Unmarshal(rb, &item); err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+func TestCacheImage(t *testing.T) {
+	img, err := ioutil.ReadFile("../../datasets/gray-cat.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(img)
+	}))
+	defer ts.Close()
+
+	imageDir, err := ioutil.TempDir(os.TempDir(), "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(imageDir)
+
+	store, err := blobstore.New(imageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher, err := urlutil.NewFetcher(urlutil.WithAllowedCIDRs("127.0.0.0/8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := lru.NewInMemoryWithEvict(1, func(namespace string, key, value interface{}) {
+		store.Release(value.(blobstore.Blob).Digest)
+	})
+	cache.CreateNamespace(imageCacheBucket)
+	limit := DefaultConfig().ImageSizeLimit
+
+	blob1, err := cacheImage(context.Background(), fetcher, cache, store, ts.URL+"/cat.jpeg?w=100", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob1.Size != uint64(len(img)) {
+		t.Fatalf("expected %d bytes, got %+v", len(img), blob1)
+	}
+	blob2, err := cacheImage(context.Background(), fetcher, cache, store, ts.URL+"/cat.jpeg", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob1 != blob2 {
+		t.Fatalf("expected %+v from cache, got %+v", blob1, blob2)
+	}
+	// one for the cache, two for the callers
+	if n := store.Refs(blob1.Digest); n != 3 {
+		t.Fatalf("expected 3 references, got %d", n)
+	}
+	store.Release(blob1.Digest)
+	store.Release(blob2.Digest)
+
+	// same contents from a different URL evicts the first URL
+	blob3, err := cacheImage(context.Background(), fetcher, cache, store, ts.URL+"/same-cat.jpeg", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob3.Digest != blob1.Digest {
+		t.Fatalf("expected digest %q, got %q", blob1.Digest, blob3.Digest)
+	}
+	store.Release(blob3.Digest)
+	if n := store.Refs(blob1.Digest); n != 1 {
+		t.Fatalf("expected 1 reference, got %d", n)
+	}
+
+	if _, err = cacheImage(context.Background(), fetcher, cache, store, ts.URL+"/cat.gif", limit); err == nil {
+		t.Fatal("expected unsupported extension error, got nil")
+	}
+	_, err = cacheImage(context.Background(), fetcher, cache, store, ts.URL+"/big-cat.jpeg", int64(len(img)-1))
+	if e, ok := err.(*Error); !ok || e.Code != CodeTooLarge {
+		t.Fatalf("expected %q, got %v", CodeTooLarge, err)
+	}
+}
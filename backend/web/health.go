@@ -0,0 +1,351 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gyuho/dplearn/pkg/fileutil"
+)
+
+const (
+	// workerTimeout is how long a worker stays registered after its last
+	// poll or report, while processing a job.
+	workerTimeout = 2 * time.Minute
+
+	checkTimeout = 2 * time.Second
+)
+
+// Check is the result of a health check.
+type Check struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// Health is the body of '/readyz' and '/livez', with the result of each
+// check. The status is "ok" if all checks pass, or "unavailable" with 503.
+type Health struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks"`
+}
+
+func newHealth(checks map[string]Check) *Health {
+	h := &Health{Status: "ok", Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			h.Status = "unavailable"
+		}
+	}
+	return h
+}
+
+// workerRegistry tracks workers of each bucket. Workers register by
+// polling the queue, and stay registered while processing jobs.
+type workerRegistry struct {
+	mu sync.Mutex
+	// polling is the number of workers blocked in Pop.
+	polling map[string]int
+	// seen is when a worker last polled or reported.
+	seen map[string]time.Time
+
+	// workers tracks each worker by its identity and bucket.
+	workers map[workerKey]*workerState
+	// claims maps request ID to the worker that claimed it.
+	claims map[string]workerKey
+}
+
+type workerKey struct {
+	id     string
+	bucket string
+}
+
+type workerState struct {
+	polling   int
+	claimed   int
+	completed int
+	seen      time.Time
+	jobs      map[string]struct{}
+}
+
+// WorkerStatus describes a live worker, identified by its API key name
+// or user ID, in '/admin/workers'.
+type WorkerStatus struct {
+	ID     string `json:"id"`
+	Bucket string `json:"bucket"`
+	// Polling is the number of its requests blocked to claim jobs.
+	Polling int `json:"polling"`
+	// Jobs are the IDs of the claimed jobs in progress.
+	Jobs      []string  `json:"jobs"`
+	Claimed   int       `json:"claimed"`
+	Completed int       `json:"completed"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// worker returns the state of the worker. It must be called
+// with the lock held.
+func (r *workerRegistry) worker(k workerKey) *workerState {
+	if r.workers == nil {
+		r.workers = make(map[workerKey]*workerState)
+	}
+	w, ok := r.workers[k]
+	if !ok {
+		w = &workerState{jobs: make(map[string]struct{})}
+		r.workers[k] = w
+	}
+	return w
+}
+
+// poll registers the worker waiting for the bucket,
+// and returns the function to call when it returns.
+func (r *workerRegistry) poll(bucket, id string) func() {
+	k := workerKey{id: id, bucket: bucket}
+	r.mu.Lock()
+	if r.polling == nil {
+		r.polling = make(map[string]int)
+	}
+	r.polling[bucket]++
+	w := r.worker(k)
+	w.polling++
+	w.seen = time.Now()
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		r.polling[bucket]--
+		w := r.worker(k)
+		w.polling--
+		w.seen = time.Now()
+		r.mu.Unlock()
+		r.report(bucket)
+	}
+}
+
+// claim records the job claimed by the worker.
+func (r *workerRegistry) claim(bucket, id, requestID string) {
+	k := workerKey{id: id, bucket: bucket}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.claims == nil {
+		r.claims = make(map[string]workerKey)
+	}
+	r.forget(requestID)
+	w := r.worker(k)
+	w.claimed++
+	w.jobs[requestID] = struct{}{}
+	w.seen = time.Now()
+	r.claims[requestID] = k
+}
+
+// update marks the worker of the job as active, and counts the job
+// as completed when done.
+func (r *workerRegistry) update(requestID string, done bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k, ok := r.claims[requestID]
+	if !ok {
+		return
+	}
+	w := r.worker(k)
+	w.seen = time.Now()
+	if done {
+		w.completed++
+		r.forget(requestID)
+	}
+}
+
+// claimed returns true if a worker is processing the job.
+func (r *workerRegistry) claimed(requestID string) bool {
+	r.mu.Lock()
+	_, ok := r.claims[requestID]
+	r.mu.Unlock()
+	return ok
+}
+
+// claimedBy returns true if the worker is processing the job.
+func (r *workerRegistry) claimedBy(requestID, id string) bool {
+	r.mu.Lock()
+	k, ok := r.claims[requestID]
+	r.mu.Unlock()
+	return ok && k.id == id
+}
+
+// release forgets the job without completion (e.g. deleted or requeued).
+func (r *workerRegistry) release(requestID string) {
+	r.mu.Lock()
+	r.forget(requestID)
+	r.mu.Unlock()
+}
+
+// forget removes the job from its worker. It must be called
+// with the lock held.
+func (r *workerRegistry) forget(requestID string) {
+	k, ok := r.claims[requestID]
+	if !ok {
+		return
+	}
+	delete(r.claims, requestID)
+	delete(r.workers[k].jobs, requestID)
+}
+
+// list returns the live workers, which are polling, processing jobs,
+// or seen within 'workerTimeout'. Others are removed.
+func (r *workerRegistry) list(now time.Time) []WorkerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ws := []WorkerStatus{}
+	for k, w := range r.workers {
+		if w.polling == 0 && len(w.jobs) == 0 && now.Sub(w.seen) > workerTimeout {
+			delete(r.workers, k)
+			continue
+		}
+		s := WorkerStatus{
+			ID:        k.id,
+			Bucket:    k.bucket,
+			Polling:   w.polling,
+			Jobs:      []string{},
+			Claimed:   w.claimed,
+			Completed: w.completed,
+			LastSeen:  w.seen,
+		}
+		for requestID := range w.jobs {
+			s.Jobs = append(s.Jobs, jobID(requestID))
+		}
+		sort.Strings(s.Jobs)
+		ws = append(ws, s)
+	}
+	sort.Slice(ws, func(i, j int) bool {
+		if ws[i].ID != ws[j].ID {
+			return ws[i].ID < ws[j].ID
+		}
+		return ws[i].Bucket < ws[j].Bucket
+	})
+	return ws
+}
+
+// report marks the worker of the bucket as active.
+func (r *workerRegistry) report(bucket string) {
+	r.mu.Lock()
+	if r.seen == nil {
+		r.seen = make(map[string]time.Time)
+	}
+	r.seen[bucket] = time.Now()
+	r.mu.Unlock()
+}
+
+func (r *workerRegistry) check(bucket string, now time.Time) Check {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if n := r.polling[bucket]; n > 0 {
+		return Check{OK: true, Message: fmt.Sprintf("%d worker(s) waiting for jobs", n)}
+	}
+	seen, ok := r.seen[bucket]
+	if !ok {
+		return Check{Message: "no worker has polled " + bucket}
+	}
+	if d := now.Sub(seen); d > workerTimeout {
+		return Check{Message: fmt.Sprintf("no worker of %s for %v", bucket, d)}
+	}
+	return Check{OK: true, Message: "worker active at " + seen.UTC().Format(time.RFC3339)}
+}
+
+// readyz checks the dependencies to serve jobs: etcd with a leader,
+// the image store, and workers of each model.
+func (srv *Server) readyz(ctx context.Context) *Health {
+	checks := make(map[string]Check)
+	if srv.draining() {
+		checks["server"] = Check{Message: "server is shutting down"}
+	} else {
+		checks["server"] = Check{OK: true}
+	}
+	checks["etcd"] = srv.checkEtcd(ctx)
+	if err := fileutil.IsDirWriteable(srv.store.Dir()); err != nil {
+		checks["store"] = Check{Message: err.Error()}
+	} else {
+		checks["store"] = Check{OK: true}
+	}
+	now := time.Now()
+	for model, bucket := range models {
+		checks["worker:"+model] = srv.workers.check(bucket, now)
+	}
+	return newHealth(checks)
+}
+
+// checkEtcd checks that etcd of the queue is reachable and has a leader,
+// with a linearizable read as 'etcdctl endpoint health'.
+func (srv *Server) checkEtcd(ctx context.Context) Check {
+	cli := srv.qu.Client()
+	if cli == nil {
+		return Check{OK: true, Message: "queue has no etcd client"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	// linearizable read fails without leader
+	if _, err := cli.Get(ctx, "health"); err != nil {
+		return Check{Message: fmt.Sprintf("%v (%v)", err, srv.qu.ClientEndpoints())}
+	}
+	return Check{OK: true}
+}
+
+// livez checks that the shared state of handlers is not deadlocked,
+// which leaves the server running but wedged.
+func (srv *Server) livez() *Health {
+	probes := map[string]func(){
+		"watchers": func() {
+			srv.watchMu.Lock()
+			srv.watchMu.Unlock()
+		},
+		"workers": func() {
+			srv.workers.mu.Lock()
+			srv.workers.mu.Unlock()
+		},
+	}
+	if srv.quota != nil {
+		probes["quota"] = func() {
+			srv.quota.mu.Lock()
+			srv.quota.mu.Unlock()
+		}
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		checks = make(map[string]Check, len(probes))
+	)
+	wg.Add(len(probes))
+	for name, probe := range probes {
+		go func(name string, probe func()) {
+			defer wg.Done()
+			donec := make(chan struct{})
+			go func() {
+				probe()
+				close(donec)
+			}()
+			c := Check{OK: true}
+			select {
+			case <-donec:
+			case <-time.After(checkTimeout):
+				c = Check{Message: fmt.Sprintf("blocked for %v", checkTimeout)}
+			}
+			mu.Lock()
+			checks[name] = c
+			mu.Unlock()
+		}(name, probe)
+	}
+	wg.Wait()
+	return newHealth(checks)
+}
+
+func writeHealth(w http.ResponseWriter, h *Health) error {
+	status := http.StatusOK
+	if h.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeJSON(w, status, h)
+}
@@ -0,0 +1,111 @@
+package web
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func TestHealth(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	defer ts.Close()
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	var h Health
+	if resp := doJSON(t, http.MethodGet, ts.URL+"/livez", "", &h); resp.StatusCode != http.StatusOK || h.Status != "ok" {
+		t.Fatalf("expected live, got %d %+v", resp.StatusCode, h)
+	}
+
+	// no worker yet
+	h = Health{}
+	if resp := doJSON(t, http.MethodGet, ts.URL+"/readyz", "", &h); resp.StatusCode != http.StatusServiceUnavailable || h.Status != "unavailable" {
+		t.Fatalf("expected not ready, got %d %+v", resp.StatusCode, h)
+	}
+	if h.Checks["worker:cats"].OK || !h.Checks["store"].OK || !h.Checks["etcd"].OK || !h.Checks["server"].OK {
+		t.Fatalf("unexpected checks %+v", h.Checks)
+	}
+
+	// worker waiting for jobs
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/cats-request/queue", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.DefaultClient.Do(req.WithContext(ctx))
+	for i := 0; ; i++ {
+		h = Health{}
+		resp := doJSON(t, http.MethodGet, ts.URL+"/readyz", "", &h)
+		if resp.StatusCode == http.StatusOK && h.Status == "ok" {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("expected ready, got %d %+v", resp.StatusCode, h)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// worker is registered while processing, until timeout
+	cancel()
+	for i := 0; ; i++ {
+		srv.workers.mu.Lock()
+		n := srv.workers.polling["/cats-request"]
+		srv.workers.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("expected no polling worker, got %d", n)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if c := srv.workers.check("/cats-request", time.Now()); !c.OK {
+		t.Fatalf("expected active worker, got %+v", c)
+	}
+	if c := srv.workers.check("/cats-request", time.Now().Add(workerTimeout+time.Second)); c.OK {
+		t.Fatalf("expected expired worker, got %+v", c)
+	}
+
+	// wedged handlers
+	srv.watchMu.Lock()
+	h = Health{}
+	resp := doJSON(t, http.MethodGet, ts.URL+"/livez", "", &h)
+	srv.watchMu.Unlock()
+	if resp.StatusCode != http.StatusServiceUnavailable || h.Checks["watchers"].OK || !h.Checks["workers"].OK {
+		t.Fatalf("expected wedged watchers, got %d %+v", resp.StatusCode, h)
+	}
+
+	// draining
+	srv.drainc = make(chan struct{})
+	close(srv.drainc)
+	if h := srv.readyz(context.Background()); h.Status == "ok" || h.Checks["server"].OK {
+		t.Fatalf("expected not ready on shutdown, got %+v", h)
+	}
+}
+
+func TestHealthEtcd(t *testing.T) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "health-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	qu, err := queue.NewEmbeddedQueue(ctx, 5595, 5596, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	srv := &Server{qu: qu}
+	if c := srv.checkEtcd(ctx); !c.OK {
+		t.Fatalf("expected etcd with leader, got %+v", c)
+	}
+}
@@ -0,0 +1,596 @@
+package web
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// JobStatus is the status of the job in history.
+type JobStatus string
+
+const (
+	// JobQueued is the job waiting in the queue.
+	JobQueued JobStatus = "queued"
+	// JobRunning is the job claimed by a worker.
+	JobRunning JobStatus = "running"
+	// JobDone is the job completed with the result.
+	JobDone JobStatus = "done"
+	// JobFailed is the job completed with the error.
+	JobFailed JobStatus = "failed"
+	// JobCanceled is the job deleted before completed.
+	JobCanceled JobStatus = "canceled"
+)
+
+// JobRecord is the job in the history of its owner, which is kept
+// after the job is deleted from the server (see 'WithHistory').
+type JobRecord struct {
+	// ID is the same ID in '/v1/jobs/{id}'.
+	ID        string `json:"id"`
+	RequestID string `json:"request_id"`
+	Model     string `json:"model"`
+	// Input is the input of the model (e.g. image URL).
+	Input  string    `json:"input"`
+	Status JobStatus `json:"status"`
+	// Result is the output of the worker, once the job is done.
+	Result string `json:"result,omitempty"`
+	// Error is the error from the worker, if the job has failed.
+	Error string `json:"error,omitempty"`
+	// Worker identifies the worker that claimed the job,
+	// by its API key name or user ID.
+	Worker      string     `json:"worker,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ClaimedAt   *time.Time `json:"claimed_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	TraceID     string     `json:"trace_id,omitempty"`
+}
+
+// JobHistory is the response of 'GET /v1/jobs'.
+type JobHistory struct {
+	Jobs []JobRecord `json:"jobs"`
+	// NextPageToken is the 'page_token' of the next page,
+	// empty on the last page.
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+// DeleteJobsResponse is the response of 'DELETE /v1/jobs'.
+type DeleteJobsResponse struct {
+	// Deleted is the number of deleted records.
+	Deleted int `json:"deleted"`
+	// Canceled is the number of canceled jobs that were in progress.
+	Canceled int `json:"canceled"`
+}
+
+// ErrRecordNotFound is returned when the job is not in the history.
+var ErrRecordNotFound = fmt.Errorf("web: job record not found")
+
+// HistoryStore stores the job records of each owner, which is either
+// "key:" with the name of API key, or "user:" with the user ID.
+type HistoryStore interface {
+	// Put creates or replaces the record of the owner.
+	Put(ctx context.Context, owner string, r JobRecord) error
+	// Get returns the record of the owner, or ErrRecordNotFound.
+	Get(ctx context.Context, owner, id string) (JobRecord, error)
+	// Owner returns the owner of the record, or ErrRecordNotFound.
+	Owner(ctx context.Context, id string) (string, error)
+	// List returns the records of the owner, newest first.
+	List(ctx context.Context, owner string) ([]JobRecord, error)
+	// Delete deletes the records of the owner,
+	// and returns the number of deleted records.
+	Delete(ctx context.Context, owner string) (int, error)
+	// Expire deletes the records of all owners created before the time,
+	// and returns the number of deleted records.
+	Expire(ctx context.Context, before time.Time) (int, error)
+}
+
+// sortRecords sorts the records newest first, in the order of pages.
+func sortRecords(rs []JobRecord) {
+	sort.Slice(rs, func(i, j int) bool {
+		if !rs[i].CreatedAt.Equal(rs[j].CreatedAt) {
+			return rs[i].CreatedAt.After(rs[j].CreatedAt)
+		}
+		return rs[i].ID > rs[j].ID
+	})
+}
+
+type memoryHistory struct {
+	mu      sync.Mutex
+	records map[string]map[string]JobRecord
+	// owners maps record IDs to their owners.
+	owners map[string]string
+}
+
+// NewMemoryHistory returns the history store in memory,
+// which is lost on restart.
+func NewMemoryHistory() HistoryStore {
+	return &memoryHistory{
+		records: make(map[string]map[string]JobRecord),
+		owners:  make(map[string]string),
+	}
+}
+
+func (h *memoryHistory) Put(ctx context.Context, owner string, r JobRecord) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.records[owner] == nil {
+		h.records[owner] = make(map[string]JobRecord)
+	}
+	h.records[owner][r.ID] = r
+	h.owners[r.ID] = owner
+	return nil
+}
+
+func (h *memoryHistory) Owner(ctx context.Context, id string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	owner, ok := h.owners[id]
+	if !ok {
+		return "", ErrRecordNotFound
+	}
+	return owner, nil
+}
+
+func (h *memoryHistory) Get(ctx context.Context, owner, id string) (JobRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.records[owner][id]
+	if !ok {
+		return JobRecord{}, ErrRecordNotFound
+	}
+	return r, nil
+}
+
+func (h *memoryHistory) List(ctx context.Context, owner string) ([]JobRecord, error) {
+	h.mu.Lock()
+	rs := make([]JobRecord, 0, len(h.records[owner]))
+	for _, r := range h.records[owner] {
+		rs = append(rs, r)
+	}
+	h.mu.Unlock()
+	sortRecords(rs)
+	return rs, nil
+}
+
+func (h *memoryHistory) Delete(ctx context.Context, owner string) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := len(h.records[owner])
+	for id := range h.records[owner] {
+		delete(h.owners, id)
+	}
+	delete(h.records, owner)
+	return n, nil
+}
+
+func (h *memoryHistory) Expire(ctx context.Context, before time.Time) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for owner, rs := range h.records {
+		for id, r := range rs {
+			if r.CreatedAt.Before(before) {
+				delete(rs, id)
+				delete(h.owners, id)
+				n++
+			}
+		}
+		if len(rs) == 0 {
+			delete(h.records, owner)
+		}
+	}
+	return n, nil
+}
+
+// expirePageSize is the number of records to read at a time on Expire.
+var expirePageSize int64 = 500
+
+// EtcdHistory stores job records in etcd, under the prefix
+// with the encoded owner and the job ID. The owner of each job ID
+// is stored under the prefix with "-owners" suffix.
+type EtcdHistory struct {
+	cli    *clientv3.Client
+	prefix string
+}
+
+// NewEtcdHistory returns the history store of the etcd client
+// (e.g. 'queue.Client()').
+func NewEtcdHistory(cli *clientv3.Client, prefix string) *EtcdHistory {
+	return &EtcdHistory{cli: cli, prefix: prefix}
+}
+
+// ownerPrefix returns the prefix of the owner's records, ending with '/'
+// so that it does not match other owners.
+func (h *EtcdHistory) ownerPrefix(owner string) string {
+	return path.Join(h.prefix, base64.RawURLEncoding.EncodeToString([]byte(owner))) + "/"
+}
+
+// ownerKey returns the key of the owner of the job, to find the record
+// from the job ID only (e.g. after restart).
+func (h *EtcdHistory) ownerKey(id string) string {
+	return path.Join(h.prefix+"-owners", id)
+}
+
+// Put creates or replaces the record of the owner.
+func (h *EtcdHistory) Put(ctx context.Context, owner string, r JobRecord) error {
+	bts, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = h.cli.Txn(ctx).
+		Then(clientv3.OpPut(h.ownerPrefix(owner)+r.ID, string(bts)), clientv3.OpPut(h.ownerKey(r.ID), owner)).
+		Commit()
+	return err
+}
+
+// Owner returns the owner of the record, or ErrRecordNotFound.
+func (h *EtcdHistory) Owner(ctx context.Context, id string) (string, error) {
+	resp, err := h.cli.Get(ctx, h.ownerKey(id))
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", ErrRecordNotFound
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+// Get returns the record of the owner, or ErrRecordNotFound.
+func (h *EtcdHistory) Get(ctx context.Context, owner, id string) (JobRecord, error) {
+	resp, err := h.cli.Get(ctx, h.ownerPrefix(owner)+id)
+	if err != nil {
+		return JobRecord{}, err
+	}
+	if len(resp.Kvs) == 0 {
+		return JobRecord{}, ErrRecordNotFound
+	}
+	var r JobRecord
+	err = json.Unmarshal(resp.Kvs[0].Value, &r)
+	return r, err
+}
+
+// List returns the records of the owner, newest first.
+func (h *EtcdHistory) List(ctx context.Context, owner string) ([]JobRecord, error) {
+	resp, err := h.cli.Get(ctx, h.ownerPrefix(owner), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	rs := make([]JobRecord, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		if err = json.Unmarshal(kv.Value, &rs[i]); err != nil {
+			return nil, fmt.Errorf("invalid record %q (%v)", kv.Key, err)
+		}
+	}
+	sortRecords(rs)
+	return rs, nil
+}
+
+// Delete deletes the records of the owner,
+// and returns the number of deleted records.
+func (h *EtcdHistory) Delete(ctx context.Context, owner string) (int, error) {
+	resp, err := h.cli.Delete(ctx, h.ownerPrefix(owner), clientv3.WithPrefix(), clientv3.WithPrevKV())
+	if err != nil {
+		return 0, err
+	}
+	for _, kv := range resp.PrevKvs {
+		if _, err = h.cli.Delete(ctx, h.ownerKey(path.Base(string(kv.Key)))); err != nil {
+			return int(resp.Deleted), err
+		}
+	}
+	return int(resp.Deleted), nil
+}
+
+// Expire deletes the records of all owners created before the time,
+// and returns the number of deleted records. Records that fail to
+// parse are deleted as well. It reads 'expirePageSize' records at a time.
+func (h *EtcdHistory) Expire(ctx context.Context, before time.Time) (int, error) {
+	pfx := path.Join(h.prefix) + "/"
+	key, end := pfx, clientv3.GetPrefixRangeEnd(pfx)
+	n := 0
+	for {
+		resp, err := h.cli.Get(ctx, key, clientv3.WithRange(end), clientv3.WithLimit(expirePageSize))
+		if err != nil {
+			return n, err
+		}
+		for _, kv := range resp.Kvs {
+			var r JobRecord
+			if err = json.Unmarshal(kv.Value, &r); err == nil && !r.CreatedAt.Before(before) {
+				continue
+			}
+			// not to delete the record updated in between
+			tresp, err := h.cli.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision)).
+				Then(clientv3.OpDelete(string(kv.Key)), clientv3.OpDelete(h.ownerKey(path.Base(string(kv.Key))))).
+				Commit()
+			if err != nil {
+				return n, err
+			}
+			if tresp.Succeeded {
+				n++
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return n, nil
+		}
+		// next key of the last one
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// recordJob records the owner of the new job, and adds the job to
+// the history of the owner.
+func (srv *Server) recordJob(ctx context.Context, item *queue.Item, input string) {
+	owner := identity(ctx)
+	srv.requestOwners.Store(item.RequestID, owner)
+	if srv.history == nil {
+		return
+	}
+
+	model, _ := modelOf(item.Bucket)
+	r := JobRecord{
+		ID:        jobID(item.RequestID),
+		RequestID: item.RequestID,
+		Model:     model,
+		Input:     input,
+		Status:    JobQueued,
+		CreatedAt: item.CreatedAt,
+		TraceID:   item.TraceID,
+	}
+	if err := srv.history.Put(ctx, owner, r); err != nil {
+		glog.Warningf("failed to record %q in history of %q (%v)", item.RequestID, owner, err)
+	}
+}
+
+// jobOwner returns the owner of the request, from the history if the
+// server does not have the request (e.g. after restart).
+func (srv *Server) jobOwner(ctx context.Context, requestID string) (string, error) {
+	if v, ok := srv.requestOwners.Load(requestID); ok {
+		return v.(string), nil
+	}
+	return srv.history.Owner(ctx, jobID(requestID))
+}
+
+// updateHistory updates the record of the request in the history of its
+// owner. It is no-op if the owner has deleted the history.
+func (srv *Server) updateHistory(ctx context.Context, requestID string, update func(r *JobRecord)) {
+	if srv.history == nil {
+		return
+	}
+	owner, err := srv.jobOwner(ctx, requestID)
+	if err != nil {
+		if err != ErrRecordNotFound {
+			glog.Warningf("failed to find owner of %q (%v)", requestID, err)
+		}
+		return
+	}
+	r, err := srv.history.Get(ctx, owner, jobID(requestID))
+	if err == nil {
+		update(&r)
+		err = srv.history.Put(ctx, owner, r)
+	}
+	if err != nil && err != ErrRecordNotFound {
+		glog.Warningf("failed to update %q in history of %q (%v)", requestID, owner, err)
+	}
+}
+
+// expireHistory deletes the records older than 'Config.HistoryRetention'.
+func (srv *Server) expireHistory(now time.Time) {
+	if srv.history == nil {
+		return
+	}
+	n, err := srv.history.Expire(srv.rootCtx, now.Add(-srv.cfg.HistoryRetention))
+	if err != nil {
+		glog.Warningf("failed to expire job history (%v)", err)
+		return
+	}
+	if n > 0 {
+		glog.Infof("expired %d records of job history (retention %v)", n, srv.cfg.HistoryRetention)
+	}
+}
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// historyQuery filters and paginates the records of 'GET /v1/jobs'.
+type historyQuery struct {
+	model  string
+	status JobStatus
+	since  time.Time
+	until  time.Time
+	limit  int
+
+	// after is the last record of the previous page, nil on the first page.
+	after *JobRecord
+}
+
+func parseHistoryQuery(q url.Values) (historyQuery, error) {
+	hq := historyQuery{model: q.Get("model"), status: JobStatus(q.Get("status")), limit: defaultHistoryLimit}
+	switch hq.status {
+	case "", JobQueued, JobRunning, JobDone, JobFailed, JobCanceled:
+	default:
+		return hq, newError(CodeValidation, "unknown status %q", hq.status)
+	}
+	for _, t := range []struct {
+		name string
+		v    *time.Time
+	}{
+		{"since", &hq.since},
+		{"until", &hq.until},
+	} {
+		s := q.Get(t.name)
+		if s == "" {
+			continue
+		}
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return hq, newError(CodeValidation, "invalid %s %q (expected RFC 3339)", t.name, s)
+		}
+		*t.v = v
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxHistoryLimit {
+			return hq, newError(CodeValidation, "invalid limit %q (must be in [1, %d])", s, maxHistoryLimit)
+		}
+		hq.limit = n
+	}
+	if s := q.Get("page_token"); s != "" {
+		after, err := parsePageToken(s)
+		if err != nil {
+			return hq, err
+		}
+		hq.after = &after
+	}
+	return hq, nil
+}
+
+// pageToken encodes the position of the record, so that the next page
+// is stable when new jobs are added.
+func pageToken(r JobRecord) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d/%s", r.CreatedAt.UnixNano(), r.ID)))
+}
+
+func parsePageToken(s string) (JobRecord, error) {
+	bts, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		ss := strings.SplitN(string(bts), "/", 2)
+		if len(ss) == 2 {
+			var ns int64
+			if ns, err = strconv.ParseInt(ss[0], 10, 64); err == nil {
+				return JobRecord{ID: ss[1], CreatedAt: time.Unix(0, ns)}, nil
+			}
+		}
+	}
+	return JobRecord{}, newError(CodeValidation, "invalid page_token %q", s)
+}
+
+func (hq historyQuery) match(r JobRecord) bool {
+	switch {
+	case hq.model != "" && r.Model != hq.model:
+		return false
+	case hq.status != "" && r.Status != hq.status:
+		return false
+	case !hq.since.IsZero() && r.CreatedAt.Before(hq.since):
+		return false
+	case !hq.until.IsZero() && !r.CreatedAt.Before(hq.until):
+		return false
+	}
+	return true
+}
+
+// page returns the page of the records, sorted newest first.
+func (hq historyQuery) page(rs []JobRecord) JobHistory {
+	resp := JobHistory{Jobs: []JobRecord{}}
+	for _, r := range rs {
+		if hq.after != nil {
+			// skip the records up to the last one of the previous page
+			if r.CreatedAt.After(hq.after.CreatedAt) || r.CreatedAt.Equal(hq.after.CreatedAt) && r.ID >= hq.after.ID {
+				continue
+			}
+		}
+		if !hq.match(r) {
+			continue
+		}
+		if len(resp.Jobs) == hq.limit {
+			resp.NextPageToken = pageToken(resp.Jobs[len(resp.Jobs)-1])
+			break
+		}
+		resp.Jobs = append(resp.Jobs, r)
+	}
+	return resp
+}
+
+var errHistoryDisabled = newError(CodeNotFound, "job history is not enabled")
+
+func listJobsHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	if srv.history == nil {
+		return writeErrorResponse(w, errHistoryDisabled)
+	}
+	hq, err := parseHistoryQuery(req.URL.Query())
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	rs, err := srv.history.List(ctx, identity(ctx))
+	if err != nil {
+		return writeErrorResponse(w, newError(CodeInternal, "failed to list jobs (%v)", err))
+	}
+	return writeJSON(w, http.StatusOK, hq.page(rs))
+}
+
+// deleteJobsHandler deletes the data of the caller: the jobs in progress
+// with their images, and then the history. The jobs in progress are
+// found from the history as well, to dequeue the jobs created before
+// restart.
+func deleteJobsHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	if srv.history == nil {
+		return writeErrorResponse(w, errHistoryDisabled)
+	}
+	owner := identity(ctx)
+
+	var requestIDs []string
+	srv.requestOwners.Range(func(k, v interface{}) bool {
+		if v.(string) == owner {
+			requestIDs = append(requestIDs, k.(string))
+		}
+		return true
+	})
+	records, err := srv.history.List(ctx, owner)
+	if err != nil {
+		return writeErrorResponse(w, newError(CodeInternal, "failed to list history (%v)", err))
+	}
+	inProgress := make(map[string]bool)
+	for _, r := range records {
+		if r.Status == JobQueued || r.Status == JobRunning {
+			inProgress[r.RequestID] = true
+		}
+	}
+	for _, requestID := range requestIDs {
+		delete(inProgress, requestID)
+	}
+	for requestID := range inProgress {
+		requestIDs = append(requestIDs, requestID)
+	}
+
+	var resp DeleteJobsResponse
+	for _, requestID := range requestIDs {
+		item, err := srv.getRequest(requestID)
+		canceled := err == nil && item.Progress < queue.MaxProgress
+		if err != nil || canceled {
+			n, derr := srv.dequeue(ctx, requestID)
+			if derr != nil {
+				glog.Warningf("failed to dequeue %q (%v)", requestID, derr)
+			}
+			// queued before restart
+			canceled = canceled || n > 0
+		}
+		if canceled {
+			resp.Canceled++
+		}
+		srv.deleteRequest(requestID)
+	}
+
+	n, err := srv.history.Delete(ctx, owner)
+	if err != nil {
+		return writeErrorResponse(w, newError(CodeInternal, "failed to delete history (%v)", err))
+	}
+	resp.Deleted = n
+	glog.Infof("deleted data of %q (%d records, %d canceled jobs)", owner, resp.Deleted, resp.Canceled)
+	return writeJSON(w, http.StatusOK, &resp)
+}
@@ -0,0 +1,264 @@
+package web
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func testHistory(t *testing.T, h HistoryStore) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, r := range []struct {
+		owner string
+		id    string
+		age   time.Duration
+	}{
+		{"key:a", "job1", 3 * time.Hour},
+		{"key:a", "job2", 2 * time.Hour},
+		{"key:a", "job3", time.Hour},
+		{"user:b", "job4", 3 * time.Hour},
+	} {
+		if err := h.Put(ctx, r.owner, JobRecord{ID: r.id, Status: JobQueued, CreatedAt: now.Add(-r.age)}); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if err := h.Put(ctx, "key:a", JobRecord{ID: "job2", Status: JobDone, Result: "cat", CreatedAt: now.Add(-2 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := h.Get(ctx, "key:a", "job2")
+	if err != nil || r.Status != JobDone || r.Result != "cat" {
+		t.Fatalf("unexpected record %+v (%v)", r, err)
+	}
+	if _, err = h.Get(ctx, "user:b", "job2"); err != ErrRecordNotFound {
+		t.Fatalf("expected %v, got %v", ErrRecordNotFound, err)
+	}
+	if owner, err := h.Owner(ctx, "job4"); err != nil || owner != "user:b" {
+		t.Fatalf("expected owner %q, got %q (%v)", "user:b", owner, err)
+	}
+	if _, err = h.Owner(ctx, "job5"); err != ErrRecordNotFound {
+		t.Fatalf("expected %v, got %v", ErrRecordNotFound, err)
+	}
+
+	rs, err := h.List(ctx, "key:a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 3 || rs[0].ID != "job3" || rs[1].ID != "job2" || rs[2].ID != "job1" {
+		t.Fatalf("expected newest first, got %+v", rs)
+	}
+	if !rs[0].CreatedAt.Equal(now.Add(-time.Hour)) {
+		t.Fatalf("expected created at %v, got %v", now.Add(-time.Hour), rs[0].CreatedAt)
+	}
+
+	n, err := h.Expire(ctx, now.Add(-150*time.Minute))
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 expired records, got %d (%v)", n, err)
+	}
+	if rs, err = h.List(ctx, "user:b"); err != nil || len(rs) != 0 {
+		t.Fatalf("expected no records, got %+v (%v)", rs, err)
+	}
+	if _, err = h.Owner(ctx, "job4"); err != ErrRecordNotFound {
+		t.Fatalf("expected %v after expiry, got %v", ErrRecordNotFound, err)
+	}
+
+	if n, err = h.Delete(ctx, "key:a"); err != nil || n != 2 {
+		t.Fatalf("expected 2 deleted records, got %d (%v)", n, err)
+	}
+	if rs, err = h.List(ctx, "key:a"); err != nil || len(rs) != 0 {
+		t.Fatalf("expected no records, got %+v (%v)", rs, err)
+	}
+	if _, err = h.Owner(ctx, "job3"); err != ErrRecordNotFound {
+		t.Fatalf("expected %v after delete, got %v", ErrRecordNotFound, err)
+	}
+}
+
+func TestMemoryHistory(t *testing.T) {
+	testHistory(t, NewMemoryHistory())
+}
+
+func TestEtcdHistory(t *testing.T) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	qu, err := queue.NewEmbeddedQueue(ctx, 5565, 5566, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	// expires in pages
+	defer func(n int64) { expirePageSize = n }(expirePageSize)
+	expirePageSize = 1
+
+	testHistory(t, NewEtcdHistory(qu.Client(), "_history"))
+}
+
+func TestHistoryHandler(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	defer ts.Close()
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	var er ErrorResponse
+	if resp := doJSON(t, http.MethodGet, ts.URL+"/v1/jobs", "", &er); resp.StatusCode != 404 {
+		t.Fatalf("expected 404 without history, got %d %+v", resp.StatusCode, er)
+	}
+	srv.history = NewMemoryHistory()
+
+	// another user, untouched by the requests below
+	other := JobRecord{ID: "other", Status: JobDone, CreatedAt: time.Now()}
+	if err := srv.history.Put(context.Background(), "user:other", other); err != nil {
+		t.Fatal(err)
+	}
+
+	var jobs [4]Job
+	for i := range jobs {
+		input := imgServer.URL + "/cat" + strconv.Itoa(i+1) + ".jpeg"
+		doJSON(t, http.MethodPost, ts.URL+"/v1/models/cats/jobs", `{"input": "`+input+`"}`, &jobs[i])
+	}
+	for i, update := range []string{`{"progress": 100, "result": "cat"}`, `{"progress": 100, "error": "bad image"}`} {
+		var item queue.Item
+		doJSON(t, http.MethodPost, ts.URL+"/v1/queues/cats-request/claim", "", &item)
+		if item.RequestID != jobs[i].RequestID {
+			t.Fatalf("#%d: expected %q, got %q", i, jobs[i].RequestID, item.RequestID)
+		}
+		doJSON(t, http.MethodPatch, ts.URL+"/v1/jobs/"+jobs[i].ID, update, nil)
+	}
+	if resp := doJSON(t, http.MethodDelete, ts.URL+"/v1/jobs/"+jobs[3].ID, "", nil); resp.StatusCode != 204 {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+
+	var h JobHistory
+	if resp := doJSON(t, http.MethodGet, ts.URL+"/v1/jobs", "", &h); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if len(h.Jobs) != 4 || h.NextPageToken != "" {
+		t.Fatalf("expected 4 jobs in a page, got %+v", h)
+	}
+	for i, exp := range []struct {
+		status JobStatus
+		result string
+		err    string
+	}{
+		{JobCanceled, "", ""},
+		{JobQueued, "", ""},
+		{JobFailed, "", "bad image"},
+		{JobDone, "cat", ""},
+	} {
+		r, job := h.Jobs[i], jobs[len(jobs)-1-i]
+		if r.ID != job.ID || r.Model != "cats" || !strings.HasSuffix(r.Input, ".jpeg") {
+			t.Fatalf("#%d: expected job %q, got %+v", i, job.ID, r)
+		}
+		if r.Status != exp.status || r.Result != exp.result || r.Error != exp.err {
+			t.Fatalf("#%d: expected %+v, got %+v", i, exp, r)
+		}
+		claimed := exp.status == JobDone || exp.status == JobFailed
+		if claimed != (r.ClaimedAt != nil && strings.HasPrefix(r.Worker, "user:")) {
+			t.Fatalf("#%d: unexpected worker %+v", i, r)
+		}
+		if (exp.status == JobQueued) != (r.CompletedAt == nil) {
+			t.Fatalf("#%d: unexpected completed time %+v", i, r)
+		}
+	}
+
+	// filters and pages
+	doJSON(t, http.MethodGet, ts.URL+"/v1/jobs?status=done&model=cats", "", &h)
+	if len(h.Jobs) != 1 || h.Jobs[0].ID != jobs[0].ID {
+		t.Fatalf("expected the done job, got %+v", h)
+	}
+	doJSON(t, http.MethodGet, ts.URL+"/v1/jobs?since="+time.Now().Add(time.Hour).Format(time.RFC3339), "", &h)
+	if len(h.Jobs) != 0 {
+		t.Fatalf("expected no jobs, got %+v", h)
+	}
+	var ids []string
+	token := ""
+	for page := 0; page < 3; page++ {
+		h = JobHistory{}
+		doJSON(t, http.MethodGet, ts.URL+"/v1/jobs?limit=3&page_token="+token, "", &h)
+		for _, r := range h.Jobs {
+			ids = append(ids, r.ID)
+		}
+		if token = h.NextPageToken; token == "" {
+			break
+		}
+	}
+	if len(ids) != 4 || ids[0] != jobs[3].ID || ids[3] != jobs[0].ID {
+		t.Fatalf("expected 4 jobs in 2 pages, got %q", ids)
+	}
+	for _, q := range []string{"status=unknown", "limit=0", "since=yesterday", "page_token=abc"} {
+		if resp := doJSON(t, http.MethodGet, ts.URL+"/v1/jobs?"+q, "", &er); resp.StatusCode != 400 || er.Error.Code != CodeValidation {
+			t.Fatalf("%q: expected validation error, got %d %+v", q, resp.StatusCode, er)
+		}
+	}
+
+	// jobs created before restart are found from the history
+	var lost Job
+	if resp := doJSON(t, http.MethodPost, ts.URL+"/v1/models/cats/jobs", `{"input": "`+imgServer.URL+`/cat5.jpeg"}`, &lost); resp.StatusCode != 201 {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	for _, requestID := range []string{jobs[2].RequestID, lost.RequestID} {
+		srv.requestCache.Delete(requestID)
+		srv.requestOwners.Delete(requestID)
+	}
+	var item queue.Item
+	doJSON(t, http.MethodPost, ts.URL+"/v1/queues/cats-request/claim", "", &item)
+	if item.RequestID != jobs[2].RequestID {
+		t.Fatalf("expected %q, got %q", jobs[2].RequestID, item.RequestID)
+	}
+	owner, err := srv.history.Owner(context.Background(), jobs[2].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := srv.history.Get(context.Background(), owner, jobs[2].ID)
+	if err != nil || r.Status != JobFailed || r.Error != "job was lost on server restart" {
+		t.Fatalf("expected lost job to fail, got %+v (%v)", r, err)
+	}
+
+	// delete my data
+	var dresp DeleteJobsResponse
+	if resp := doJSON(t, http.MethodDelete, ts.URL+"/v1/jobs", "", &dresp); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if dresp.Deleted != 5 || dresp.Canceled != 1 {
+		t.Fatalf("expected 5 deleted and 1 canceled, got %+v", dresp)
+	}
+	items, err := srv.qu.List(context.Background(), "/cats-request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, it := range items {
+		if it.RequestID == lost.RequestID {
+			t.Fatalf("expected the job queued before restart to be dequeued, got %+v", it)
+		}
+	}
+	if _, err := srv.getRequest(jobs[2].RequestID); err == nil {
+		t.Fatalf("expected %q to be deleted", jobs[2].RequestID)
+	}
+	doJSON(t, http.MethodGet, ts.URL+"/v1/jobs", "", &h)
+	if len(h.Jobs) != 0 {
+		t.Fatalf("expected no jobs, got %+v", h)
+	}
+	if _, err := srv.history.Get(context.Background(), "user:other", other.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// retention
+	srv.expireHistory(time.Now().Add(srv.cfg.HistoryRetention + time.Minute))
+	if _, err := srv.history.Get(context.Background(), "user:other", other.ID); err != ErrRecordNotFound {
+		t.Fatalf("expected %v after retention, got %v", ErrRecordNotFound, err)
+	}
+}
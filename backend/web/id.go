@@ -4,32 +4,136 @@ import (
 	"crypto/sha512"
 	"encoding/base64"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 )
 
-func generateUserID(req *http.Request) string {
-	ip := getRealIP(req)
-	if ip == "" {
-		ip = strings.Split(req.RemoteAddr, ":")[0]
+func generateUserID(req *http.Request, trusted []*net.IPNet) string {
+	ip := ""
+	if v := getRealIP(req, trusted); v != nil {
+		ip = v.String()
 	}
-	ip = strings.TrimSpace(strings.Replace(ip, ".", "", -1))
 	ua := req.UserAgent()
-	return fmt.Sprintf("%s%s%s", ip, classifyUA(ua), hashSha512(ip + ua)[:30])
+	return fmt.Sprintf("%s%s%s", ipReplacer.Replace(ip), classifyUA(ua), hashSha512(ip + ua)[:30])
 }
 
-func generateRequestID(urlPath, userID, data string) string {
-	return fmt.Sprintf("%s-%s-%s", urlPath, userID[:5], hashSha512(data)[:7])
+// ipReplacer removes separators of IPv4 and IPv6 addresses in user IDs.
+var ipReplacer = strings.NewReplacer(".", "", ":", "")
+
+// generateRequestID returns the ID of the request of the owner (see
+// 'identity') and the user, so that callers with the same input do not
+// share requests.
+func generateRequestID(urlPath, owner, userID, data string) string {
+	return fmt.Sprintf("%s-%s-%s", urlPath, userID[:5], hashSha512(owner + "\n" + userID + "\n" + data)[:16])
+}
+
+// parseCIDRs parses the CIDRs or IP addresses (e.g. "10.0.0.0/8", "::1").
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", c)
+			}
+			if ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getRealIP returns the client IP. Proxy headers are only trusted when the
+// request comes from the trusted proxies, in which case the forwarded chain
+// is walked from the right, skipping trusted proxies. 'Forwarded' (RFC 7239)
+// takes precedence over 'X-Forwarded-For', then 'X-Real-Ip'. It returns
+// nil if the remote address is unknown, without trusting the headers.
+func getRealIP(req *http.Request, trusted []*net.IPNet) net.IP {
+	remote := parseHostIP(req.RemoteAddr)
+	if remote == nil || !containsIP(trusted, remote) {
+		return remote
+	}
+
+	var chain []string
+	if vs := req.Header["Forwarded"]; len(vs) > 0 {
+		chain = parseForwarded(vs)
+	} else if vs := req.Header["X-Forwarded-For"]; len(vs) > 0 {
+		for _, v := range vs {
+			for _, f := range strings.Split(v, ",") {
+				chain = append(chain, strings.TrimSpace(f))
+			}
+		}
+	} else if v := req.Header.Get("X-Real-Ip"); v != "" {
+		chain = []string{strings.TrimSpace(v)}
+	}
+
+	ip := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := parseHostIP(chain[i])
+		if hop == nil {
+			// obfuscated or malformed, the last hop is the best known
+			break
+		}
+		ip = hop
+		if !containsIP(trusted, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// parseHostIP parses the IP with optional port, where IPv6 with port
+// is in brackets (e.g. "1.2.3.4", "1.2.3.4:80", "::1", "[::1]:80").
+func parseHostIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if i := strings.Index(s, "%"); i >= 0 { // IPv6 zone
+		s = s[:i]
+	}
+	return net.ParseIP(s)
 }
 
-func getRealIP(req *http.Request) string {
-	ts := []string{"X-Forwarded-For", "x-forwarded-for", "X-FORWARDED-FOR"}
-	for _, k := range ts {
-		if v := req.Header.Get(k); v != "" {
-			return v
+// parseForwarded returns the 'for' parameters of 'Forwarded' headers,
+// from the client to the last proxy (e.g. 'for=192.0.2.43, for="[2001:db8::1]:4711"').
+func parseForwarded(vs []string) []string {
+	var chain []string
+	for _, v := range vs {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+				chain = append(chain, strings.Trim(kv[1], `"`))
+			}
 		}
 	}
-	return ""
+	return chain
 }
 
 func hashSha512(s string) string {
@@ -1,8 +1,8 @@
 package web
 
 import (
-	"fmt"
 	"net/http"
+	"strings"
 	"testing"
 )
 
@@ -12,10 +12,102 @@ go test -v -run TestID -logtostderr=true
 
 func TestID(t *testing.T) {
 	req := &http.Request{
+		RemoteAddr: "127.0.0.1:52000",
 		Header: map[string][]string{
-			"X-Forwarded-For": {"127.0.0.1"},
+			"X-Forwarded-For": {"10.0.0.1"},
 			"User-Agent":      {"linux chrome/"},
 		},
 	}
-	fmt.Println(generateUserID(req))
+	trusted, err := parseCIDRs([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := generateUserID(req, trusted)
+	if !strings.HasPrefix(id, "10001") {
+		t.Fatalf("user ID expected prefix '10001', got %q", id)
+	}
+	if generateUserID(req, nil) == id {
+		t.Fatalf("user ID expected to ignore headers from untrusted proxy, got %q", id)
+	}
+
+	req.RemoteAddr = "[2001:db8::1]:443"
+	if id = generateUserID(req, trusted); !strings.HasPrefix(id, "2001db81") {
+		t.Fatalf("user ID expected prefix '2001db81', got %q", id)
+	}
+	rid := generateRequestID("/cats-request", "key:a", id, "data")
+	if rid == generateRequestID("/cats-request", "key:b", id, "data") {
+		t.Fatalf("request ID expected to differ by owner, got %q", rid)
+	}
+	if rid == generateRequestID("/cats-request", "key:a", id[:5]+"other", "data") {
+		t.Fatalf("request ID expected to differ by user ID, got %q", rid)
+	}
+}
+
+func TestGetRealIP(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"127.0.0.1/32", "::1", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remote string
+		header http.Header
+		ip     string
+	}{
+		// no proxy
+		{"203.0.113.1:1234", nil, "203.0.113.1"},
+		{"[2001:db8::1]:1234", nil, "2001:db8::1"},
+
+		// headers from untrusted remote are ignored
+		{"203.0.113.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.1"},
+		{"203.0.113.1:1234", http.Header{"X-Real-Ip": {"198.51.100.1"}}, "203.0.113.1"},
+
+		{"127.0.0.1:1234", http.Header{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		{"[::1]:1234", http.Header{"X-Forwarded-For": {"2001:db8::2"}}, "2001:db8::2"},
+
+		// spoofed entries before the last untrusted hop are ignored
+		{"127.0.0.1:1234", http.Header{"X-Forwarded-For": {"1.1.1.1, 198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"127.0.0.1:1234", http.Header{"X-Forwarded-For": {"1.1.1.1", "198.51.100.1"}}, "198.51.100.1"},
+
+		// all trusted hops
+		{"127.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		// malformed hop
+		{"127.0.0.1:1234", http.Header{"X-Forwarded-For": {"bad, 10.0.0.2"}}, "10.0.0.2"},
+		{"127.0.0.1:1234", http.Header{"X-Forwarded-For": {"bad"}}, "127.0.0.1"},
+
+		// 'Forwarded' takes precedence
+		{"127.0.0.1:1234", http.Header{
+			"Forwarded":       {`for=192.0.2.43;proto=https, for="[2001:db8:cafe::17]:4711"`},
+			"X-Forwarded-For": {"198.51.100.1"},
+		}, "2001:db8:cafe::17"},
+		{"127.0.0.1:1234", http.Header{"Forwarded": {`For="192.0.2.43:80";by=10.0.0.1`}}, "192.0.2.43"},
+		{"127.0.0.1:1234", http.Header{"Forwarded": {"for=192.0.2.43, for=unknown"}}, "127.0.0.1"},
+		{"127.0.0.1:1234", http.Header{"Forwarded": {"for=192.0.2.43, for=_hidden, for=10.0.0.2"}}, "10.0.0.2"},
+	}
+	for i, tt := range tests {
+		req := &http.Request{RemoteAddr: tt.remote, Header: tt.header}
+		if req.Header == nil {
+			req.Header = make(http.Header)
+		}
+		ip := getRealIP(req, trusted)
+		if ip == nil || ip.String() != tt.ip {
+			t.Errorf("#%d: IP expected %q, got %v", i, tt.ip, ip)
+		}
+	}
+
+	// headers are not trusted from unknown remote address
+	req := &http.Request{RemoteAddr: "@", Header: http.Header{"X-Forwarded-For": {"198.51.100.1"}}}
+	if ip := getRealIP(req, trusted); ip != nil {
+		t.Fatalf("expected no IP from unknown remote address, got %v", ip)
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	if _, err := parseCIDRs([]string{"10.0.0.0/8", " ::1 ", "", "fd00::/8"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{"bad", "10.0.0.0/33"} {
+		if _, err := parseCIDRs([]string{c}); err == nil {
+			t.Fatalf("%q expected error", c)
+		}
+	}
 }
@@ -0,0 +1,128 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// ErrKeyNotFound is returned when the API key does not exist.
+var ErrKeyNotFound = fmt.Errorf("web: API key not found")
+
+// KeyStore looks up API keys.
+type KeyStore interface {
+	// Get returns the key, or ErrKeyNotFound.
+	Get(ctx context.Context, key string) (*APIKey, error)
+}
+
+// hashKey returns the digest of the key, so that stores
+// do not keep the keys in plain text.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type fileKeyStore struct {
+	keys map[string]*APIKey
+}
+
+// fileKey is the entry of key file.
+type fileKey struct {
+	APIKey
+	// Key is the API key in plain text.
+	Key string `json:"key,omitempty"`
+	// SHA256 is the hex-encoded SHA-256 digest of the key,
+	// instead of the key in plain text.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// NewFileKeyStore loads API keys from the JSON file of the list of
+// 'APIKey' objects, each with either 'key' or its 'sha256' digest.
+// For example:
+//
+//	[{"name": "frontend", "key": "...", "scopes": ["submit"], "daily_quota": 1000}]
+func NewFileKeyStore(fpath string) (KeyStore, error) {
+	bts, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	var fks []fileKey
+	if err = json.Unmarshal(bts, &fks); err != nil {
+		return nil, fmt.Errorf("failed to parse %q (%v)", fpath, err)
+	}
+	ks := &fileKeyStore{keys: make(map[string]*APIKey, len(fks))}
+	for i := range fks {
+		digest := fks[i].SHA256
+		if fks[i].Key != "" {
+			digest = hashKey(fks[i].Key)
+		}
+		if digest == "" || fks[i].Name == "" {
+			return nil, fmt.Errorf("%q has key without name or key (#%d)", fpath, i)
+		}
+		k := fks[i].APIKey
+		ks.keys[digest] = &k
+	}
+	return ks, nil
+}
+
+func (ks *fileKeyStore) Get(ctx context.Context, key string) (*APIKey, error) {
+	k, ok := ks.keys[hashKey(key)]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return k, nil
+}
+
+// EtcdKeyStore stores API keys in etcd, under the prefix
+// with the digest of each key.
+type EtcdKeyStore struct {
+	cli    *clientv3.Client
+	prefix string
+}
+
+// NewEtcdKeyStore returns the key store of the etcd client
+// (e.g. 'queue.Client()').
+func NewEtcdKeyStore(cli *clientv3.Client, prefix string) *EtcdKeyStore {
+	return &EtcdKeyStore{cli: cli, prefix: prefix}
+}
+
+// Get returns the key, or ErrKeyNotFound.
+func (ks *EtcdKeyStore) Get(ctx context.Context, key string) (*APIKey, error) {
+	resp, err := ks.cli.Get(ctx, path.Join(ks.prefix, hashKey(key)))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	var k APIKey
+	if err = json.Unmarshal(resp.Kvs[0].Value, &k); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// Put adds or updates the key.
+func (ks *EtcdKeyStore) Put(ctx context.Context, key string, k APIKey) error {
+	if key == "" || k.Name == "" {
+		return fmt.Errorf("web: empty key or name")
+	}
+	bts, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	_, err = ks.cli.Put(ctx, path.Join(ks.prefix, hashKey(key)), string(bts))
+	return err
+}
+
+// Delete revokes the key.
+func (ks *EtcdKeyStore) Delete(ctx context.Context, key string) error {
+	_, err := ks.cli.Delete(ctx, path.Join(ks.prefix, hashKey(key)))
+	return err
+}
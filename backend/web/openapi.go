@@ -0,0 +1,196 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenAPI returns the OpenAPI 3.0 document of v1 API,
+// with schemas generated from the Go types.
+func OpenAPI() map[string]interface{} {
+	g := &schemaGen{schemas: make(map[string]interface{})}
+	errResp := map[string]interface{}{
+		"description": "Error",
+		"content":     jsonContent(g.schema(reflect.TypeOf(ErrorResponse{}))),
+	}
+
+	paths := make(map[string]interface{})
+	for _, rt := range v1Routes {
+		op := map[string]interface{}{
+			"summary": rt.summary,
+			"responses": map[string]interface{}{
+				strconv.Itoa(rt.status): g.response(rt.status, rt.response, rt.contentType),
+				"default":               errResp,
+			},
+		}
+		var params []interface{}
+		for _, seg := range strings.Split(rt.pattern, "/") {
+			if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+				params = append(params, map[string]interface{}{
+					"name":     seg[1 : len(seg)-1],
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		for _, name := range rt.query {
+			params = append(params, map[string]interface{}{
+				"name":   name,
+				"in":     "query",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if rt.scope != "" {
+			op["description"] = "Requires API key of '" + string(rt.scope) + "' scope, if the server has API keys."
+			op["security"] = []interface{}{
+				map[string]interface{}{"apiKey": []string{}},
+				map[string]interface{}{"bearer": []string{}},
+			}
+		}
+		if rt.request != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(g.schema(reflect.TypeOf(rt.request))),
+			}
+		}
+
+		item, ok := paths[rt.pattern].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[rt.pattern] = item
+		}
+		item[strings.ToLower(rt.method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "dplearn backend",
+			"version": "v1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": APIKeyHeader},
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func openAPIHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	return writeJSON(w, http.StatusOK, OpenAPI())
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return content("application/json", schema)
+}
+
+func content(contentType string, schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		contentType: map[string]interface{}{"schema": schema},
+	}
+}
+
+// schemaGen generates JSON schemas of Go types, following encoding/json
+// rules. Named struct types are registered as components.
+type schemaGen struct {
+	schemas map[string]interface{}
+}
+
+// response returns the response of the type, in JSON if the content
+// type is empty.
+func (g *schemaGen) response(status int, v interface{}, contentType string) map[string]interface{} {
+	resp := map[string]interface{}{"description": http.StatusText(status)}
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	if v != nil {
+		resp["content"] = content(contentType, g.schema(reflect.TypeOf(v)))
+	}
+	return resp
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (g *schemaGen) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			g.schemas[t.Name()] = nil // placeholder for recursive types
+			g.schemas[t.Name()] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func (g *schemaGen) structSchema(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		name, opts := f.Name, ""
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if idx := strings.Index(tag, ","); idx >= 0 {
+				name, opts = tag[:idx], tag[idx:]
+			} else {
+				name = tag
+			}
+			if name == "" {
+				name = f.Name
+			}
+		}
+		props[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	s := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
@@ -0,0 +1,275 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is the token bucket of each API key or client IP on an endpoint.
+type RateLimit struct {
+	// Rate is the number of requests per second.
+	Rate float64
+	// Burst is the maximum number of requests at once.
+	Burst int
+}
+
+// ParseRateLimits parses the comma-separated list of 'path=rate:burst'
+// (e.g. "/cats-request=2:10,/v1/=5:20"). Each limit applies to the
+// requests under the path, with the longest matching path. gRPC calls
+// are matched by the full method name (e.g. "/webpb.Queue/Enqueue").
+func ParseRateLimits(s string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		ss := strings.SplitN(f, "=", 2)
+		if len(ss) != 2 || !strings.HasPrefix(ss[0], "/") {
+			return nil, fmt.Errorf("invalid rate limit %q (expected 'path=rate:burst')", f)
+		}
+		rs := strings.SplitN(ss[1], ":", 2)
+		if len(rs) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %q (expected 'path=rate:burst')", f)
+		}
+		r, err := strconv.ParseFloat(rs[0], 64)
+		if err != nil || r <= 0 {
+			return nil, fmt.Errorf("invalid rate in %q", f)
+		}
+		b, err := strconv.Atoi(rs[1])
+		if err != nil || b <= 0 {
+			return nil, fmt.Errorf("invalid burst in %q", f)
+		}
+		limits[ss[0]] = RateLimit{Rate: r, Burst: b}
+	}
+	return limits, nil
+}
+
+// matchRateLimit returns the limit of the longest path that matches.
+func matchRateLimit(limits map[string]RateLimit, p string) (string, RateLimit, bool) {
+	var (
+		matched string
+		limit   RateLimit
+	)
+	for prefix, l := range limits {
+		if strings.HasPrefix(p, prefix) && len(prefix) > len(matched) {
+			matched, limit = prefix, l
+		}
+	}
+	return matched, limit, matched != ""
+}
+
+// RateLimiter limits requests of each key with token buckets.
+type RateLimiter interface {
+	// Allow takes a token from the bucket of the key. It returns zero if
+	// allowed, or how long to wait before a token is available.
+	Allow(ctx context.Context, key string, limit RateLimit) (time.Duration, error)
+}
+
+// rateLimitKey identifies the caller for rate limits: the name of its
+// API key resolved by 'authenticate', or the client IP without a key
+// (or with the anonymous key). User IDs are not used, since they change
+// with the user agent.
+func rateLimitKey(ctx context.Context, ip net.IP) string {
+	srv := ctx.Value(serverKey).(*Server)
+	if k, ok := ctx.Value(apiKeyKey).(*APIKey); ok && k != srv.anonymousKey {
+		return "key:" + k.Name
+	}
+	if ip == nil {
+		return "ip:unknown"
+	}
+	return "ip:" + ip.String()
+}
+
+// rateLimit takes a token of the caller on the path, and returns
+// CodeRateLimited with how long to wait if there is none. It fails open
+// on limiter errors, since the limiter is not critical.
+func (srv *Server) rateLimit(ctx context.Context, p, key string) (time.Duration, error) {
+	if srv.rateLimiter == nil {
+		return 0, nil
+	}
+	prefix, limit, ok := matchRateLimit(srv.rateLimits, p)
+	if !ok {
+		return 0, nil
+	}
+	wait, err := srv.rateLimiter.Allow(ctx, prefix+"/"+key, limit)
+	if err != nil {
+		glog.Warningf("failed to rate limit %q (%v)", key, err)
+		return 0, nil
+	}
+	if wait > 0 {
+		return wait, newError(CodeRateLimited, "too many requests on %q, retry after %v", prefix, wait)
+	}
+	return 0, nil
+}
+
+// withRateLimit limits requests of each API key or client IP, on the
+// endpoints with limits. It runs after 'authenticate', so that the key
+// is looked up once. Limited requests get 429 with 'Retry-After',
+// regardless of legacy mode.
+func withRateLimit(h ContextHandler) ContextHandler {
+	return ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+		srv := ctx.Value(serverKey).(*Server)
+		wait, err := srv.rateLimit(ctx, req.URL.Path, rateLimitKey(ctx, getRealIP(req, srv.trustedProxies)))
+		if err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return writeErrorResponse(w, err)
+		}
+		return h.ServeHTTPContext(ctx, w, req)
+	})
+}
+
+const rateLimitIdle = 10 * time.Minute
+
+type memoryLimiter struct {
+	mu        sync.Mutex
+	limiters  map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	lim  *rate.Limiter
+	last time.Time
+}
+
+// NewMemoryRateLimiter returns the rate limiter of a single server.
+func NewMemoryRateLimiter() RateLimiter {
+	return &memoryLimiter{limiters: make(map[string]*memoryBucket)}
+}
+
+func (l *memoryLimiter) Allow(ctx context.Context, key string, limit RateLimit) (time.Duration, error) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, b := range l.limiters {
+			if now.Sub(b.last) > rateLimitIdle {
+				delete(l.limiters, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.limiters[key]
+	if !ok || b.lim.Limit() != rate.Limit(limit.Rate) || b.lim.Burst() != limit.Burst {
+		b = &memoryBucket{lim: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)}
+		l.limiters[key] = b
+	}
+	b.last = now
+
+	r := b.lim.ReserveN(now, 1)
+	if !r.OK() {
+		return 0, fmt.Errorf("burst %d cannot allow any request", limit.Burst)
+	}
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return d, nil
+	}
+	return 0, nil
+}
+
+// EtcdRateLimiter shares token buckets through etcd, across web replicas.
+type EtcdRateLimiter struct {
+	cli    *clientv3.Client
+	prefix string
+
+	mu        sync.Mutex
+	lease     clientv3.LeaseID
+	leaseTime time.Time
+}
+
+// NewEtcdRateLimiter returns the rate limiter of the etcd client
+// (e.g. 'queue.Client()'), storing buckets under the prefix.
+func NewEtcdRateLimiter(cli *clientv3.Client, prefix string) *EtcdRateLimiter {
+	return &EtcdRateLimiter{cli: cli, prefix: prefix}
+}
+
+// etcdBucket is the state of token bucket in etcd.
+type etcdBucket struct {
+	Tokens float64 `json:"tokens"`
+	// Last is the time of last update, in unix nanoseconds.
+	Last int64 `json:"last"`
+}
+
+// currentLease returns the lease for buckets, so that idle buckets expire.
+// Lease is renewed every half of its TTL, and active buckets move to the
+// new lease on their next update.
+func (l *EtcdRateLimiter) currentLease(ctx context.Context) (clientv3.LeaseID, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.lease != 0 && time.Since(l.leaseTime) < rateLimitIdle/2 {
+		return l.lease, nil
+	}
+	resp, err := l.cli.Grant(ctx, int64(rateLimitIdle.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	l.lease, l.leaseTime = resp.ID, time.Now()
+	return l.lease, nil
+}
+
+// Allow takes a token from the bucket of the key, with transactions
+// that retry on conflicts with other replicas.
+func (l *EtcdRateLimiter) Allow(ctx context.Context, key string, limit RateLimit) (time.Duration, error) {
+	k := path.Join(l.prefix, key)
+	for i := 0; i < 5; i++ {
+		resp, err := l.cli.Get(ctx, k)
+		if err != nil {
+			return 0, err
+		}
+		now := time.Now()
+		b := etcdBucket{Tokens: float64(limit.Burst), Last: now.UnixNano()}
+		var modRev int64
+		if len(resp.Kvs) == 1 {
+			if err = json.Unmarshal(resp.Kvs[0].Value, &b); err != nil {
+				return 0, err
+			}
+			modRev = resp.Kvs[0].ModRevision
+			elapsed := now.Sub(time.Unix(0, b.Last))
+			if elapsed > 0 {
+				b.Tokens = math.Min(float64(limit.Burst), b.Tokens+elapsed.Seconds()*limit.Rate)
+			}
+			b.Last = now.UnixNano()
+		}
+		if b.Tokens < 1 {
+			return time.Duration((1 - b.Tokens) / limit.Rate * float64(time.Second)), nil
+		}
+		b.Tokens--
+
+		bts, err := json.Marshal(b)
+		if err != nil {
+			return 0, err
+		}
+		lease, err := l.currentLease(ctx)
+		if err != nil {
+			return 0, err
+		}
+		tresp, err := l.cli.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(k), "=", modRev)).
+			Then(clientv3.OpPut(k, string(bts), clientv3.WithLease(lease))).
+			Commit()
+		if err != nil {
+			return 0, err
+		}
+		if tresp.Succeeded {
+			return 0, nil
+		}
+	}
+	return 0, fmt.Errorf("too many conflicts on %q", k)
+}
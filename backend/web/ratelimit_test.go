@@ -0,0 +1,221 @@
+package web
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gyuho/dplearn/backend/web/webpb"
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits("/cats-request=2:10, /v1/=0.5:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]RateLimit{
+		"/cats-request": {Rate: 2, Burst: 10},
+		"/v1/":          {Rate: 0.5, Burst: 1},
+	}
+	if !reflect.DeepEqual(limits, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, limits)
+	}
+	for _, s := range []string{"cats-request=1:1", "/a=1", "/a=x:1", "/a=1:0", "/a=-1:1"} {
+		if _, err = ParseRateLimits(s); err == nil {
+			t.Fatalf("%q: expected error", s)
+		}
+	}
+
+	limits["/v1/models"] = RateLimit{Rate: 1, Burst: 1}
+	if p, _, ok := matchRateLimit(limits, "/v1/models/cats/jobs"); !ok || p != "/v1/models" {
+		t.Fatalf("expected longest match, got %q", p)
+	}
+	if _, _, ok := matchRateLimit(limits, "/healthz"); ok {
+		t.Fatal("expected no match")
+	}
+}
+
+func testRateLimiter(t *testing.T, l1, l2 RateLimiter) {
+	ctx := context.Background()
+	limit := RateLimit{Rate: 10, Burst: 2}
+	for i, l := range []RateLimiter{l1, l2} {
+		if wait, err := l.Allow(ctx, "/a/user", limit); err != nil || wait != 0 {
+			t.Fatalf("#%d: expected allowed, got %v (%v)", i, wait, err)
+		}
+	}
+	wait, err := l2.Allow(ctx, "/a/user", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("expected to wait up to 100ms, got %v", wait)
+	}
+	if wait, err = l1.Allow(ctx, "/a/other", limit); err != nil || wait != 0 {
+		t.Fatalf("expected other user allowed, got %v (%v)", wait, err)
+	}
+	time.Sleep(110 * time.Millisecond)
+	if wait, err = l1.Allow(ctx, "/a/user", limit); err != nil || wait != 0 {
+		t.Fatalf("expected allowed after refill, got %v (%v)", wait, err)
+	}
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	l := NewMemoryRateLimiter()
+	testRateLimiter(t, l, l)
+}
+
+func TestEtcdRateLimiter(t *testing.T) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-ratelimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	qu, err := queue.NewEmbeddedQueue(ctx, 5585, 5586, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	// two replicas share the buckets
+	testRateLimiter(t, NewEtcdRateLimiter(qu.Client(), "_ratelimit"), NewEtcdRateLimiter(qu.Client(), "_ratelimit"))
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	defer ts.Close()
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	srv.rateLimiter = NewMemoryRateLimiter()
+	srv.rateLimits = map[string]RateLimit{"/v1/models": {Rate: 0.1, Burst: 1}}
+
+	if resp := doJSON(t, http.MethodGet, ts.URL+"/v1/models", "", nil); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var er ErrorResponse
+	resp := doJSON(t, http.MethodGet, ts.URL+"/v1/models", "", &er)
+	if resp.StatusCode != 429 || er.Error.Code != CodeRateLimited {
+		t.Fatalf("expected 429, got %d %+v", resp.StatusCode, er)
+	}
+	if ra := resp.Header.Get("Retry-After"); ra != "10" {
+		t.Fatalf("expected Retry-After 10, got %q", ra)
+	}
+	if resp = doJSON(t, http.MethodGet, ts.URL+"/v1/openapi.json", "", nil); resp.StatusCode != 200 {
+		t.Fatalf("expected 200 without limit, got %d", resp.StatusCode)
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "keys.json")
+	if err = ioutil.WriteFile(keyPath, []byte(`[{"name": "client", "key": "submit-key", "scopes": ["submit"]}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if srv.keys, err = NewFileKeyStore(keyPath); err != nil {
+		t.Fatal(err)
+	}
+	srv.anonymousKey = &APIKey{Name: "anonymous", Scopes: []Scope{ScopeSubmit}}
+	get := func(header http.Header) int {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/models", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// anonymous callers are limited by IP, regardless of the user agent
+	if code := get(http.Header{"User-Agent": {"other"}}); code != 429 {
+		t.Fatalf("expected 429 with another user agent, got %d", code)
+	}
+	// invalid keys are rejected before the limit
+	if code := get(http.Header{APIKeyHeader: {"invalid-key"}}); code != 401 {
+		t.Fatalf("expected 401 with invalid API key, got %d", code)
+	}
+	// API keys have their own buckets
+	if code := get(http.Header{APIKeyHeader: {"submit-key"}}); code != 200 {
+		t.Fatalf("expected 200 with API key, got %d", code)
+	}
+	if code := get(http.Header{APIKeyHeader: {"submit-key"}, "User-Agent": {"other"}}); code != 429 {
+		t.Fatalf("expected 429 with API key, got %d", code)
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	srv := &Server{anonymousKey: &APIKey{Name: "anonymous"}}
+	ctx := context.WithValue(context.Background(), serverKey, srv)
+	for i, tt := range []struct {
+		ctx context.Context
+		ip  net.IP
+		key string
+	}{
+		{ctx, net.ParseIP("203.0.113.1"), "ip:203.0.113.1"},
+		{ctx, nil, "ip:unknown"},
+		{context.WithValue(ctx, apiKeyKey, &APIKey{Name: "client"}), net.ParseIP("203.0.113.1"), "key:client"},
+		{context.WithValue(ctx, apiKeyKey, srv.anonymousKey), net.ParseIP("203.0.113.1"), "ip:203.0.113.1"},
+	} {
+		if key := rateLimitKey(tt.ctx, tt.ip); key != tt.key {
+			t.Fatalf("#%d: expected %q, got %q", i, tt.key, key)
+		}
+	}
+}
+
+func TestRateLimitGRPC(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	defer ts.Close()
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	srv.rateLimiter = NewMemoryRateLimiter()
+	srv.rateLimits = map[string]RateLimit{"/webpb.Queue/Enqueue": {Rate: 0.1, Burst: 1}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := newGRPCServer(srv, nil)
+	go gs.Serve(ln)
+	defer gs.Stop()
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cli := webpb.NewQueueClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err = cli.Enqueue(ctx, &webpb.EnqueueRequest{Model: "cats", Input: imgServer.URL + "/1.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.Enqueue(ctx, &webpb.EnqueueRequest{Model: "cats", Input: imgServer.URL + "/2.jpg"}); grpc.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+	// other methods have no limit
+	cc, err := cli.Claim(ctx, &webpb.ClaimRequest{Model: "cats"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cc.Recv(); err != nil {
+		t.Fatalf("expected claim without limit, got %v", err)
+	}
+}
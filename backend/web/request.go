@@ -0,0 +1,295 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gyuho/dplearn/pkg/blobstore"
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/lru"
+	"github.com/gyuho/dplearn/pkg/trace"
+
+	"github.com/golang/glog"
+)
+
+// models maps model names to the queue buckets of their requests.
+var models = map[string]string{
+	"cats": "/cats-request",
+}
+
+// modelOf returns the model name of the bucket.
+func modelOf(bucket string) (string, bool) {
+	for model, b := range models {
+		if b == bucket {
+			return model, true
+		}
+	}
+	return "", false
+}
+
+// requestInput prepares the input of the bucket (e.g. downloads the image),
+// and returns its request ID. The returned blob holds a reference for the
+// caller, which must be released.
+func requestInput(ctx context.Context, bucket, input string) (string, blobstore.Blob, error) {
+	srv := ctx.Value(serverKey).(*Server)
+	cache := ctx.Value(cacheKey).(lru.Cache)
+	userID := ctx.Value(userKey).(string)
+
+	switch bucket {
+	case "/cats-request":
+		blob, err := cacheImage(ctx, srv.fetcher, cache, srv.store, input, srv.cfg.ImageSizeLimit)
+		if err != nil {
+			e := toError(err)
+			e.Message = fmt.Sprintf("error %q while fetching %q", e.Message, input)
+			return "", blobstore.Blob{}, e
+		}
+		requestID := generateRequestID(bucket, identity(ctx), userID, blob.Path)
+		traceRequest(ctx, requestID)
+		return requestID, blob, nil
+
+	default:
+		return "", blobstore.Blob{}, newError(CodeNotFound, "unknown request %q", bucket)
+	}
+}
+
+// createRequest schedules the input in the bucket. If the same input has
+// been requested, it returns the existing item with false.
+func createRequest(ctx context.Context, bucket, input string) (*queue.Item, bool, error) {
+	srv := ctx.Value(serverKey).(*Server)
+	qu := ctx.Value(queueKey).(queue.Queue)
+
+	if srv.draining() {
+		return nil, false, errShuttingDown
+	}
+	requestID, blob, err := requestInput(ctx, bucket, input)
+	if err != nil {
+		return nil, false, err
+	}
+	defer srv.store.Release(blob.Digest)
+
+	glog.Infof("fetching %q before creating item", requestID)
+	if _, ok := srv.requestCache.Load(requestID); ok {
+		item, err := srv.getOwnRequest(ctx, requestID)
+		if err != nil {
+			return nil, false, err
+		}
+		glog.Infof("fetched %q before creating item, no need to create", requestID)
+		return item, false, nil
+	}
+
+	if k, ok := ctx.Value(apiKeyKey).(*APIKey); ok && srv.quota != nil {
+		if err = srv.quota.acquire(k, requestID, time.Now()); err != nil {
+			return nil, false, err
+		}
+	}
+
+	item := queue.CreateItem(bucket, srv.cfg.Priority, blob.Path)
+	item.RequestID = requestID
+	item.TraceID = traceID(ctx)
+	if err = qu.Add(ctx, item, queue.WithTTL(srv.cfg.EnqueueTTL)); err != nil {
+		if srv.quota != nil {
+			srv.quota.release(requestID)
+		}
+		return nil, false, newError(CodeQueueUnavailable, "%s", err.Error())
+	}
+	if srv.store.Acquire(blob.Digest) == nil {
+		srv.requestDigests.Store(requestID, blob.Digest)
+	}
+	srv.requestCache.Store(requestID, item)
+	srv.recordJob(ctx, item, input)
+
+	glog.Infof("created an item with request ID %s (trace %q)", requestID, item.TraceID)
+	return item, true, nil
+}
+
+// getRequest returns the current item of the request.
+func (srv *Server) getRequest(requestID string) (*queue.Item, error) {
+	v, ok := srv.requestCache.Load(requestID)
+	if !ok {
+		return nil, newError(CodeNotFound, "cannot find request ID %q", requestID)
+	}
+	return v.(*queue.Item), nil
+}
+
+// getOwnRequest returns the current item of the request created by
+// the caller. Requests of others are not found, not to reveal them from
+// the predictable request IDs.
+func (srv *Server) getOwnRequest(ctx context.Context, requestID string) (*queue.Item, error) {
+	item, err := srv.getRequest(requestID)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := srv.requestOwners.Load(requestID); ok && v.(string) != identity(ctx) {
+		return nil, newError(CodeNotFound, "cannot find request ID %q", requestID)
+	}
+	return item, nil
+}
+
+// updateClaimed stores the progress or result from the worker, only if
+// the worker has claimed the request. Others are rejected, not to
+// overwrite the jobs of other workers.
+func (srv *Server) updateClaimed(ctx context.Context, item *queue.Item) error {
+	worker := identity(ctx)
+	if cur, err := srv.getRequest(item.RequestID); err == nil && !cur.Canceled && !srv.workers.claimedBy(item.RequestID, worker) {
+		return newError(CodeForbidden, "request ID %q is not claimed by %q", item.RequestID, worker)
+	}
+	return srv.updateRequest(item)
+}
+
+// updateRequest stores the progress or result from the worker.
+func (srv *Server) updateRequest(item *queue.Item) error {
+	if item.Bucket == "" || item.Key == "" || item.Value == "" || item.RequestID == "" {
+		return newError(CodeValidation, "invalid item: %+v", *item)
+	}
+	v, ok := srv.requestCache.Load(item.RequestID)
+	if !ok {
+		return newError(CodeNotFound, "unknown request ID %q", item.RequestID)
+	}
+	if v.(*queue.Item).Canceled {
+		return newError(CodeNotFound, "request ID %q was canceled", item.RequestID)
+	}
+	if item.TraceID == "" {
+		// workers may drop unknown fields
+		item.TraceID = v.(*queue.Item).TraceID
+	}
+	if item.TraceParent == "" {
+		item.TraceParent = v.(*queue.Item).TraceParent
+	}
+
+	// in the trace of the item, regardless of the worker request
+	_, span := trace.Start(trace.Extract(context.Background(), item.TraceParent), "request.Update")
+	span.SetAttribute("request_id", item.RequestID)
+	span.SetAttribute("progress", item.Progress)
+	srv.requestCache.Store(item.RequestID, item)
+	srv.workers.report(item.Bucket)
+	srv.workers.update(item.RequestID, item.Progress >= queue.MaxProgress)
+	if item.Progress >= queue.MaxProgress && item.Error != "" && !item.Canceled {
+		srv.recentErrors.add(ErrorEntry{Source: "worker", Message: item.Error, RequestID: item.RequestID, TraceID: item.TraceID})
+	}
+	if item.Progress >= queue.MaxProgress && srv.quota != nil {
+		srv.quota.release(item.RequestID)
+	}
+	srv.notify(item.RequestID)
+	srv.batches.report(item)
+	if item.Progress >= queue.MaxProgress {
+		srv.updateHistory(srv.rootCtx, item.RequestID, func(r *JobRecord) {
+			now := time.Now()
+			r.Status, r.Result, r.Error, r.CompletedAt = JobDone, item.Value, item.Error, &now
+			switch {
+			case item.Canceled:
+				r.Status, r.Result = JobCanceled, ""
+			case item.Error != "":
+				r.Status, r.Result = JobFailed, ""
+			}
+		})
+	}
+	span.Finish()
+	return nil
+}
+
+// watch returns the channel notified when the request is updated
+// or deleted, and the function to stop watching.
+func (srv *Server) watch(requestID string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	srv.watchMu.Lock()
+	if srv.watchers == nil {
+		srv.watchers = make(map[string]map[chan struct{}]struct{})
+	}
+	if srv.watchers[requestID] == nil {
+		srv.watchers[requestID] = make(map[chan struct{}]struct{})
+	}
+	srv.watchers[requestID][ch] = struct{}{}
+	srv.watchMu.Unlock()
+
+	return ch, func() {
+		srv.watchMu.Lock()
+		delete(srv.watchers[requestID], ch)
+		if len(srv.watchers[requestID]) == 0 {
+			delete(srv.watchers, requestID)
+		}
+		srv.watchMu.Unlock()
+	}
+}
+
+func (srv *Server) notify(requestID string) {
+	srv.watchMu.Lock()
+	for ch := range srv.watchers[requestID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	srv.watchMu.Unlock()
+}
+
+// errShuttingDown is returned to new jobs and Pops during shutdown.
+var errShuttingDown = newError(CodeQueueUnavailable, "server is shutting down")
+
+// popRequest blocks until an item is available in the bucket,
+// and removes it from the queue. It returns errShuttingDown when the
+// server shuts down while waiting.
+func popRequest(ctx context.Context, bucket string) (*queue.Item, error) {
+	srv := ctx.Value(serverKey).(*Server)
+	qu := ctx.Value(queueKey).(queue.Queue)
+	if srv.draining() {
+		return nil, errShuttingDown
+	}
+
+	worker := identity(ctx)
+	defer srv.workers.poll(bucket, worker)()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-srv.drainc:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	item := <-qu.Pop(ctx, bucket)
+	if item == nil {
+		return nil, newError(CodeQueueUnavailable, "queue %q is closed", bucket)
+	}
+	if item.Error != "" {
+		if srv.draining() {
+			return nil, errShuttingDown
+		}
+		return nil, newError(CodeQueueUnavailable, "%s", item.Error)
+	}
+	traceRequest(ctx, item.RequestID)
+	srv.workers.claim(bucket, worker, item.RequestID)
+	_, ok := srv.requestCache.Load(item.RequestID)
+	srv.updateHistory(ctx, item.RequestID, func(r *JobRecord) {
+		now := time.Now()
+		switch {
+		case ok:
+			r.Status, r.Worker, r.ClaimedAt = JobRunning, worker, &now
+		case r.Status == JobQueued || r.Status == JobRunning:
+			// enqueued before restart, its updates are rejected
+			r.Status, r.Error, r.CompletedAt = JobFailed, "job was lost on server restart", &now
+		}
+	})
+	return item, nil
+}
+
+// unclaimRequest puts the claimed item back to the queue, when it cannot
+// be delivered to the worker (e.g. the worker disconnected). It is no-op
+// if the request has been deleted or completed in between.
+func (srv *Server) unclaimRequest(item *queue.Item) error {
+	srv.workers.release(item.RequestID)
+	cur, err := srv.getRequest(item.RequestID)
+	if err != nil || cur.Progress >= queue.MaxProgress {
+		return nil
+	}
+	// the stream context may have been canceled
+	if err = srv.qu.Add(srv.rootCtx, item, queue.WithTTL(srv.cfg.EnqueueTTL)); err != nil {
+		return err
+	}
+	srv.updateHistory(srv.rootCtx, item.RequestID, func(r *JobRecord) {
+		r.Status, r.Worker, r.ClaimedAt = JobQueued, "", nil
+	})
+	return nil
+}
@@ -0,0 +1,162 @@
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// certCheckInterval is how often to check the certificate files
+// for changes, on TLS handshakes.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate of the files, and reloads it when
+// the files change (e.g. renewed by cert-manager), without restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, interval: certCheckInterval}
+	modTime, err := r.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	r.cert, r.modTime, r.checked = &cert, modTime, time.Now()
+	return r, nil
+}
+
+// lastModified returns the latest modification time of the files.
+func (r *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, p := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate implements 'tls.Config.GetCertificate'. It keeps serving
+// the current certificate if the new files are invalid (e.g. only the
+// certificate is replaced yet).
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.checked) < r.interval {
+		return r.cert, nil
+	}
+	r.checked = now
+
+	modTime, err := r.lastModified()
+	if err != nil {
+		glog.Warningf("failed to check certificate %q (%v)", r.certFile, err)
+		return r.cert, nil
+	}
+	if modTime.Equal(r.modTime) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		glog.Warningf("failed to reload certificate %q (%v)", r.certFile, err)
+		return r.cert, nil
+	}
+	r.cert, r.modTime = &cert, modTime
+	glog.Infof("reloaded certificate %q", r.certFile)
+	return r.cert, nil
+}
+
+// newTLSConfig returns the TLS configuration of the server with HTTP/2,
+// or nil if TLS is disabled. With the client CA, client certificates are
+// verified if given, and required on worker routes and gRPC methods
+// (see 'requireClientCert'). The gRPC server shares the configuration.
+func newTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" {
+		return nil, nil
+	}
+	r, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate (%v)", err)
+	}
+	tc := &tls.Config{
+		GetCertificate: r.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}
+	if cfg.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %q", cfg.TLSClientCAFile)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tc, nil
+}
+
+// needsClientCert returns true if the scope requires a verified client
+// certificate, when the server has the client CA.
+func (srv *Server) needsClientCert(scope Scope) bool {
+	return srv.clientCerts && (scope == ScopeWorker || scope == ScopeAdmin)
+}
+
+// requireClientCert rejects requests of worker and admin scopes without
+// a verified client certificate, when the server has the client CA.
+func requireClientCert(ctx context.Context, req *http.Request, scope Scope) error {
+	srv, ok := ctx.Value(serverKey).(*Server)
+	if !ok || !srv.needsClientCert(scope) {
+		return nil
+	}
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return newError(CodeUnauthorized, "client certificate is required for %q", req.URL.Path)
+	}
+	return nil
+}
+
+// requireClientCertGRPC is 'requireClientCert' for gRPC methods, with the
+// TLS state of the peer.
+func (srv *Server) requireClientCertGRPC(ctx context.Context, method string) error {
+	if !srv.needsClientCert(grpcScopes[method]) {
+		return nil
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return newError(CodeUnauthorized, "client certificate is required for %q", method)
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return newError(CodeUnauthorized, "client certificate is required for %q", method)
+	}
+	return nil
+}
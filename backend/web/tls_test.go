@@ -0,0 +1,288 @@
+package web
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gyuho/dplearn/backend/web/webpb"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+)
+
+// testCert is the generated certificate and key in PEM.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert generates the certificate signed by the parent,
+// or self-signed CA if the parent is nil.
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// write writes the certificate and key files, modified at the time.
+func (c *testCert) write(t *testing.T, certFile, keyFile string, modTime time.Time) {
+	if err := ioutil.WriteFile(certFile, c.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, c.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{certFile, keyFile} {
+		if err := os.Chtimes(p, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (c *testCert) tlsCert(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+
+	now := time.Now()
+	c1 := newTestCert(t, "server-1", nil)
+	c1.write(t, certFile, keyFile, now.Add(-time.Minute))
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.interval = 0
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf, _ := x509.ParseCertificate(cert.Certificate[0]); leaf.Subject.CommonName != "server-1" {
+		t.Fatalf("expected 'server-1', got %q", leaf.Subject.CommonName)
+	}
+
+	c2 := newTestCert(t, "server-2", nil)
+	c2.write(t, certFile, keyFile, now)
+	if cert, err = r.GetCertificate(nil); err != nil {
+		t.Fatal(err)
+	}
+	if leaf, _ := x509.ParseCertificate(cert.Certificate[0]); leaf.Subject.CommonName != "server-2" {
+		t.Fatalf("expected reloaded 'server-2', got %q", leaf.Subject.CommonName)
+	}
+
+	// keeps the current certificate with mismatched key
+	if err = ioutil.WriteFile(certFile, c1.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, now.Add(time.Minute), now.Add(time.Minute))
+	if cert, err = r.GetCertificate(nil); err != nil {
+		t.Fatal(err)
+	}
+	if leaf, _ := x509.ParseCertificate(cert.Certificate[0]); leaf.Subject.CommonName != "server-2" {
+		t.Fatalf("expected 'server-2' on invalid files, got %q", leaf.Subject.CommonName)
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "server", ca)
+	worker := newTestCert(t, "worker", ca)
+
+	cfg := DefaultConfig()
+	cfg.Scheme, cfg.Host = "https", "127.0.0.1:42210"
+	cfg.ImageDir = filepath.Join(dir, "images")
+	cfg.TLSCertFile, cfg.TLSKeyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	cfg.TLSClientCAFile = filepath.Join(dir, "ca.crt")
+	server.write(t, cfg.TLSCertFile, cfg.TLSKeyFile, time.Now())
+	if err = ioutil.WriteFile(cfg.TLSClientCAFile, ca.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	grpcAddr := "127.0.0.1:42211"
+	srv, err := StartServer(cfg, &memQueue{}, WithGRPC(grpcAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		tr := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}
+		if err := http2.ConfigureTransport(tr); err != nil {
+			t.Fatal(err)
+		}
+		return &http.Client{Transport: tr, Timeout: 5 * time.Second}
+	}
+	cli, workerCli := newClient(), newClient(worker.tlsCert(t))
+
+	ep := "https://" + cfg.Host
+	var resp *http.Response
+	for i := 0; ; i++ {
+		if resp, err = cli.Get(ep + "/healthz"); err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("expected 200 over HTTP/2, got %d %s", resp.StatusCode, resp.Proto)
+	}
+
+	// worker routes require the client certificate
+	for _, path := range []string{"/cats-request/queue", "/v1/jobs/" + jobID("unknown")} {
+		req, err := http.NewRequest(http.MethodPatch, ep+path, strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err = cli.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body ErrorResponse
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusUnauthorized || body.Error.Code != CodeUnauthorized {
+			t.Fatalf("%s: expected 401 without client certificate, got %d %+v", path, resp.StatusCode, body)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPatch, ep+"/v1/jobs/"+jobID("unknown"), strings.NewReader(`{"progress": 50}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = workerCli.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 with client certificate, got %d", resp.StatusCode)
+	}
+
+	// certificate from other CA is rejected in handshake
+	otherCert := newTestCert(t, "other", newTestCert(t, "other-ca", nil)).tlsCert(t)
+	otherCli := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs: roots,
+		// client sends the certificate even if the server does not accept its CA
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &otherCert, nil },
+	}}, Timeout: 5 * time.Second}
+	if resp, err = otherCli.Get(ep + "/healthz"); err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected handshake error with unknown client CA, got %d", resp.StatusCode)
+	}
+
+	// gRPC is served with the same certificate, and worker methods
+	// require the client certificate
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	claim := func(model string, certs ...tls.Certificate) error {
+		conn, err := grpc.Dial(grpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: roots, Certificates: certs})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		cc, err := webpb.NewQueueClient(conn).Claim(ctx, &webpb.ClaimRequest{Model: model})
+		if err != nil {
+			return err
+		}
+		_, err = cc.Recv()
+		return err
+	}
+	if err = claim("cats"); grpc.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected Unauthenticated gRPC claim without client certificate, got %v", err)
+	}
+	if err = claim("dogs", worker.tlsCert(t)); grpc.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound gRPC claim with client certificate, got %v", err)
+	}
+	conn, err := grpc.Dial(grpcAddr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = webpb.NewQueueClient(conn).Enqueue(ctx, &webpb.EnqueueRequest{Model: "cats", Input: "a.jpg"}); err == nil {
+		t.Fatal("expected error on plaintext gRPC")
+	}
+}
@@ -0,0 +1,140 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gyuho/dplearn/pkg/trace"
+
+	"github.com/golang/glog"
+)
+
+// TraceIDHeader is the header field for trace ID. Requests with the header
+// (e.g. from workers) keep the trace ID, otherwise it is from 'traceparent'
+// header or generated. Every response has the trace ID in the header.
+// Trace IDs of 32 hex characters are also the trace IDs of spans.
+const TraceIDHeader = "X-Trace-Id"
+
+// validTraceID returns true if the trace ID from clients is safe to log.
+func validTraceID(s string) bool {
+	if len(s) == 0 || len(s) > 64 {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// AccessLog is the JSON access log of a request.
+type AccessLog struct {
+	Time      time.Time `json:"time"`
+	TraceID   string    `json:"trace_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Bytes     int       `json:"bytes"`
+	LatencyMS float64   `json:"latency_ms"`
+	UserID    string    `json:"user_id,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type traceKeyType struct{}
+
+var traceKey traceKeyType
+
+// traceOf returns the access log of the request in context, where handlers
+// add the user and request IDs. It returns nil if the context has no trace.
+func traceOf(ctx context.Context) *AccessLog {
+	e, _ := ctx.Value(traceKey).(*AccessLog)
+	return e
+}
+
+// traceID returns the trace ID in context, or empty string.
+func traceID(ctx context.Context) string {
+	if e := traceOf(ctx); e != nil {
+		return e.TraceID
+	}
+	return ""
+}
+
+// traceRequest adds the request ID to the access log in context.
+func traceRequest(ctx context.Context, requestID string) {
+	if e := traceOf(ctx); e != nil {
+		e.RequestID = requestID
+	}
+}
+
+// withTrace returns the context with trace ID for gRPC requests,
+// which have no access logs.
+func withTrace(ctx context.Context, id string) context.Context {
+	if !validTraceID(id) {
+		id = trace.NewTraceID()
+	}
+	if trace.IsTraceID(id) {
+		ctx = trace.WithRemoteParent(ctx, trace.SpanContext{TraceID: id})
+	}
+	return context.WithValue(ctx, traceKey, &AccessLog{TraceID: id})
+}
+
+// statusWriter records the status and size of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+
+	// err is the error written by 'writeError', if any.
+	err *Error
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Flush implements http.Flusher, for streaming responses.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// accessLogger writes access logs, one JSON object per line.
+type accessLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *accessLogger) log(e *AccessLog) {
+	bts, err := json.Marshal(e)
+	if err != nil {
+		glog.Warningf("failed to encode access log (%v)", err)
+		return
+	}
+	l.mu.Lock()
+	_, err = l.w.Write(append(bts, '\n'))
+	l.mu.Unlock()
+	if err != nil {
+		glog.Warningf("failed to write access log (%v)", err)
+	}
+}
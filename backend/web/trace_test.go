@@ -0,0 +1,211 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/trace"
+)
+
+func TestTrace(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	ts.Close()
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	var buf bytes.Buffer
+	srv.accessLog = &accessLogger{w: &buf}
+	ts = httptest.NewServer(srv.newMux(srv.cache))
+
+	// trace ID from client is kept
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/models/cats/jobs", bytes.NewReader([]byte(fmt.Sprintf(`{"input": "%s/a.jpg"}`, imgServer.URL))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(TraceIDHeader, "trace-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job Job
+	err = json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := resp.Header.Get(TraceIDHeader); v != "trace-1" {
+		t.Fatalf("trace ID header expected 'trace-1', got %q", v)
+	}
+	if job.TraceID != "trace-1" {
+		t.Fatalf("job trace ID expected 'trace-1', got %q", job.TraceID)
+	}
+	item, err := srv.getRequest(job.RequestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.TraceID != "trace-1" {
+		t.Fatalf("item trace ID expected 'trace-1', got %q", item.TraceID)
+	}
+
+	// worker drops the trace ID, which is kept from the created item
+	if resp := doJSON(t, http.MethodPost, ts.URL+"/v1/queues/cats-request/claim", "", nil); resp.StatusCode != 200 {
+		t.Fatalf("expected 200 on claim, got %d", resp.StatusCode)
+	}
+	done := *item
+	done.TraceID, done.Progress, done.Value = "", queue.MaxProgress, "done"
+	bts, err := json.Marshal(done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = http.NewRequest(http.MethodPost, ts.URL+"/cats-request/queue", bytes.NewReader(bts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(TraceIDHeader, "trace-1")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if item, err = srv.getRequest(job.RequestID); err != nil {
+		t.Fatal(err)
+	}
+	if item.TraceID != "trace-1" || item.Value != "done" {
+		t.Fatalf("unexpected item %+v", item)
+	}
+
+	// invalid trace ID is replaced
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/v1/jobs/"+jobID("unknown"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(TraceIDHeader, "bad trace")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	generated := resp.Header.Get(TraceIDHeader)
+	if len(generated) != 32 {
+		t.Fatalf("trace ID expected 32 hex characters, got %q", generated)
+	}
+
+	// wait for handlers to write access logs
+	ts.Close()
+
+	var logs []AccessLog
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var e AccessLog
+		if err = json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("invalid access log %q (%v)", sc.Text(), err)
+		}
+		logs = append(logs, e)
+	}
+	if len(logs) != 4 {
+		t.Fatalf("expected 4 access logs, got %+v", logs)
+	}
+	for i, exp := range []AccessLog{
+		{TraceID: "trace-1", Method: http.MethodPost, Path: "/v1/models/cats/jobs", Status: http.StatusCreated, RequestID: job.RequestID},
+		// claim has the trace of its own
+		{TraceID: logs[1].TraceID, Method: http.MethodPost, Path: "/v1/queues/cats-request/claim", Status: http.StatusOK, RequestID: job.RequestID},
+		{TraceID: "trace-1", Method: http.MethodPost, Path: "/cats-request/queue", Status: http.StatusOK, RequestID: job.RequestID},
+		{TraceID: generated, Method: http.MethodGet, Path: "/v1/jobs/" + jobID("unknown"), Status: http.StatusNotFound, RequestID: "unknown"},
+	} {
+		e := logs[i]
+		if e.TraceID != exp.TraceID || e.Method != exp.Method || e.Path != exp.Path || e.Status != exp.Status || e.RequestID != exp.RequestID {
+			t.Fatalf("#%d: access log expected %+v, got %+v", i, exp, e)
+		}
+		if e.UserID == "" || e.Bytes == 0 || e.LatencyMS <= 0 || e.Time.IsZero() {
+			t.Fatalf("#%d: incomplete access log %+v", i, e)
+		}
+	}
+}
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans map[string]*trace.Span
+}
+
+// ExportSpan records the copy of the span, so that changes
+// after export are not recorded.
+func (r *spanRecorder) ExportSpan(s *trace.Span) {
+	copied := &trace.Span{
+		Name:       s.Name,
+		TraceID:    s.TraceID,
+		SpanID:     s.SpanID,
+		ParentID:   s.ParentID,
+		Attributes: make(map[string]string, len(s.Attributes)),
+		Error:      s.Error,
+	}
+	for k, v := range s.Attributes {
+		copied.Attributes[k] = v
+	}
+	r.mu.Lock()
+	r.spans[s.Name] = copied
+	r.mu.Unlock()
+}
+
+func TestSpans(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	r := &spanRecorder{spans: make(map[string]*trace.Span)}
+	trace.SetExporter(r)
+	defer trace.SetExporter(nil)
+
+	parent := trace.SpanContext{TraceID: trace.NewTraceID(), SpanID: "00f067aa0ba902b7"}
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/models/cats/jobs", bytes.NewReader([]byte(fmt.Sprintf(`{"input": "%s/a.jpg"}`, imgServer.URL))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(trace.TraceParentHeader, parent.TraceParent())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if v := resp.Header.Get(TraceIDHeader); v != parent.TraceID {
+		t.Fatalf("trace ID expected %q from traceparent, got %q", parent.TraceID, v)
+	}
+
+	// wait for the handler to finish its span
+	ts.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, parentName := range map[string]string{
+		"HTTP POST":   "",
+		"image.Fetch": "HTTP POST",
+		"image.HEAD":  "image.Fetch",
+		"image.GET":   "image.Fetch",
+	} {
+		s, ok := r.spans[name]
+		if !ok {
+			t.Fatalf("span %q not found in %+v", name, r.spans)
+		}
+		parentID := parent.SpanID
+		if parentName != "" {
+			parentID = r.spans[parentName].SpanID
+		}
+		if s.TraceID != parent.TraceID || s.ParentID != parentID {
+			t.Fatalf("span %q expected parent %q in %q, got %+v", name, parentID, parent.TraceID, s)
+		}
+	}
+	if v := r.spans["image.Fetch"].Attributes["cache"]; v != "miss" {
+		t.Fatalf("expected cache miss, got %q", v)
+	}
+	if v := r.spans["image.GET"].Attributes["size"]; v == "" || v == "0" {
+		t.Fatalf("expected downloaded size, got %q", v)
+	}
+	if v := r.spans["HTTP POST"].Attributes["status"]; v != "201" {
+		t.Fatalf("expected status 201, got %q", v)
+	}
+}
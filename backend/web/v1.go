@@ -0,0 +1,418 @@
+package web
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/golang/glog"
+)
+
+// Job is the v1 representation of a request.
+type Job struct {
+	// ID identifies the job in v1 paths (e.g. '/v1/jobs/{id}').
+	ID string `json:"id"`
+	// RequestID is the same ID in legacy 'Request-Id' header.
+	RequestID string `json:"request_id"`
+	// Model is the name of the model (e.g. "cats").
+	Model string `json:"model"`
+	// Progress ranges from 0 to 100.
+	Progress int `json:"progress"`
+	// Done is true if the worker has finished the job.
+	Done bool `json:"done"`
+	// Result is the output of the worker, once the job is done.
+	Result string `json:"result,omitempty"`
+	// Error is the error from the worker, if the job has failed.
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// TraceID is the trace ID of the request that created the job.
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// CreateJobRequest is the body of 'POST /v1/models/{model}/jobs'.
+type CreateJobRequest struct {
+	// Input is the input of the model (e.g. image URL).
+	Input string `json:"input"`
+}
+
+// UpdateJobRequest is the body of 'PATCH /v1/jobs/{id}', from workers.
+type UpdateJobRequest struct {
+	Progress int    `json:"progress"`
+	Result   string `json:"result,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ModelList is the response of 'GET /v1/models'.
+type ModelList struct {
+	Models []Model `json:"models"`
+}
+
+// Model describes the model served by backend.
+type Model struct {
+	Name string `json:"name"`
+	// Queue is the bucket of its jobs, in '/v1/queues/{bucket}/claim'.
+	Queue string `json:"queue"`
+}
+
+// jobID encodes the request ID to be safe in URL path,
+// since request IDs contain '/' and '+'.
+func jobID(requestID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(requestID))
+}
+
+func parseJobID(id string) (string, error) {
+	bts, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil || len(bts) == 0 {
+		return "", newError(CodeNotFound, "cannot find job %q", id)
+	}
+	return string(bts), nil
+}
+
+func newJob(item *queue.Item) *Job {
+	model, _ := modelOf(item.Bucket)
+	job := &Job{
+		ID:        jobID(item.RequestID),
+		RequestID: item.RequestID,
+		Model:     model,
+		Progress:  item.Progress,
+		Done:      item.Progress >= queue.MaxProgress,
+		Error:     item.Error,
+		CreatedAt: item.CreatedAt,
+		TraceID:   item.TraceID,
+	}
+	if job.Done && job.Error == "" {
+		job.Result = item.Value
+	}
+	return job
+}
+
+// route is the v1 endpoint. Patterns match path segments,
+// where '{name}' matches any segment.
+type route struct {
+	method  string
+	pattern string
+	summary string
+	// scope is the scope of API key to require, empty for public.
+	scope Scope
+
+	// request is the type of request body, nil without body.
+	request interface{}
+	// response is the type of response body, nil without body.
+	response interface{}
+	// contentType is the media type of response, defaults to JSON.
+	contentType string
+	// query is the names of optional query parameters.
+	query  []string
+	status int
+
+	handle func(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error
+}
+
+var v1Routes []route
+
+func init() {
+	// initialized in init, since 'openAPIHandler' refers to 'v1Routes'
+	v1Routes = []route{
+		{
+			method:   http.MethodGet,
+			pattern:  "/v1/models",
+			summary:  "List models.",
+			response: ModelList{},
+			status:   http.StatusOK,
+			scope:    ScopeSubmit,
+			handle:   listModelsHandler,
+		},
+		{
+			method:   http.MethodPost,
+			pattern:  "/v1/models/{model}/jobs",
+			summary:  "Create a job of the model, or return the existing one of the same input.",
+			request:  CreateJobRequest{},
+			response: Job{},
+			status:   http.StatusCreated,
+			scope:    ScopeSubmit,
+			handle:   createJobHandler,
+		},
+		{
+			method:   http.MethodPost,
+			pattern:  "/v1/models/{model}/batches",
+			summary:  "Create the jobs of many inputs, in JSON, or JSONL or CSV in the body or uploaded 'file'.",
+			request:  CreateBatchRequest{},
+			response: Batch{},
+			status:   http.StatusAccepted,
+			scope:    ScopeSubmit,
+			handle:   createBatchHandler,
+		},
+		{
+			method:   http.MethodGet,
+			pattern:  "/v1/batches/{id}",
+			summary:  "Get the aggregate progress of the batch.",
+			response: Batch{},
+			status:   http.StatusOK,
+			scope:    ScopeSubmit,
+			handle:   getBatchHandler,
+		},
+		{
+			method:      http.MethodGet,
+			pattern:     "/v1/batches/{id}/results",
+			summary:     "Stream the results of the batch in JSONL, in the order of inputs, as they complete.",
+			response:    BatchResult{},
+			contentType: "application/x-ndjson",
+			status:      http.StatusOK,
+			scope:       ScopeSubmit,
+			handle:      batchResultsHandler,
+		},
+		{
+			method:   http.MethodGet,
+			pattern:  "/v1/jobs",
+			summary:  "List the job history of the API key or user, newest first.",
+			query:    []string{"model", "status", "since", "until", "limit", "page_token"},
+			response: JobHistory{},
+			status:   http.StatusOK,
+			scope:    ScopeSubmit,
+			handle:   listJobsHandler,
+		},
+		{
+			method:   http.MethodDelete,
+			pattern:  "/v1/jobs",
+			summary:  "Delete the job history of the API key or user, and cancel its jobs in progress.",
+			response: DeleteJobsResponse{},
+			status:   http.StatusOK,
+			scope:    ScopeSubmit,
+			handle:   deleteJobsHandler,
+		},
+		{
+			method:   http.MethodGet,
+			pattern:  "/v1/jobs/{id}",
+			summary:  "Get the status of the job.",
+			response: Job{},
+			status:   http.StatusOK,
+			scope:    ScopeSubmit,
+			handle:   getJobHandler,
+		},
+		{
+			method:  http.MethodDelete,
+			pattern: "/v1/jobs/{id}",
+			summary: "Cancel and delete the job.",
+			status:  http.StatusNoContent,
+			scope:   ScopeSubmit,
+			handle:  deleteJobHandler,
+		},
+		{
+			method:   http.MethodPatch,
+			pattern:  "/v1/jobs/{id}",
+			summary:  "Report the progress or result of the claimed job, from workers.",
+			request:  UpdateJobRequest{},
+			response: Job{},
+			status:   http.StatusOK,
+			scope:    ScopeWorker,
+			handle:   updateJobHandler,
+		},
+		{
+			method:   http.MethodPost,
+			pattern:  "/v1/queues/{bucket}/claim",
+			summary:  "Block until a job is available in the queue, and claim it, from workers.",
+			response: queue.Item{},
+			status:   http.StatusOK,
+			scope:    ScopeWorker,
+			handle:   claimHandler,
+		},
+		{
+			method:  http.MethodGet,
+			pattern: "/v1/openapi.json",
+			summary: "Get the OpenAPI document of v1 API.",
+			status:  http.StatusOK,
+			handle:  openAPIHandler,
+		},
+	}
+}
+
+// matchPath returns the path parameters, or false if the path does not match.
+func matchPath(pattern, p string) (map[string]string, bool) {
+	ps, ss := strings.Split(pattern, "/"), strings.Split(p, "/")
+	if len(ps) != len(ss) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i := range ps {
+		if strings.HasPrefix(ps[i], "{") && strings.HasSuffix(ps[i], "}") {
+			if ss[i] == "" {
+				return nil, false
+			}
+			params[ps[i][1:len(ps[i])-1]] = ss[i]
+			continue
+		}
+		if ps[i] != ss[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// v1Handler routes v1 API. Errors are always sent with the error envelope.
+func v1Handler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	return serveRoutes(ctx, w, req, v1Routes)
+}
+
+// serveRoutes calls the handler of the matching route, after checking
+// its scope and rate limit.
+func serveRoutes(ctx context.Context, w http.ResponseWriter, req *http.Request, routes []route) error {
+	matched := false
+	for _, rt := range routes {
+		params, ok := matchPath(rt.pattern, req.URL.Path)
+		if !ok {
+			continue
+		}
+		matched = true
+		if rt.method == req.Method {
+			if err := requireClientCert(ctx, req, rt.scope); err != nil {
+				return writeErrorResponse(w, err)
+			}
+			ctx, err := authenticate(ctx, keyFromHeader(req.Header), rt.scope)
+			if err != nil {
+				return writeErrorResponse(w, err)
+			}
+			return withRateLimit(ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+				return rt.handle(ctx, w, req, params)
+			})).ServeHTTPContext(ctx, w, req)
+		}
+	}
+	if matched {
+		return writeErrorResponse(w, newError(CodeMethodNotAllowed, "method %s is not allowed on %q", req.Method, req.URL.Path))
+	}
+	return writeErrorResponse(w, newError(CodeNotFound, "unknown path %q", req.URL.Path))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+func readJSON(req *http.Request, v interface{}) error {
+	rb, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return newError(CodeValidation, "failed to read body (%v)", err)
+	}
+	io.Copy(ioutil.Discard, req.Body)
+	req.Body.Close()
+	if err = json.Unmarshal(rb, v); err != nil {
+		return newError(CodeValidation, "JSON parse error %q", err.Error())
+	}
+	return nil
+}
+
+func listModelsHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	var resp ModelList
+	for model, bucket := range models {
+		resp.Models = append(resp.Models, Model{Name: model, Queue: strings.TrimPrefix(bucket, "/")})
+	}
+	sort.Slice(resp.Models, func(i, j int) bool { return resp.Models[i].Name < resp.Models[j].Name })
+	return writeJSON(w, http.StatusOK, &resp)
+}
+
+func createJobHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	bucket, ok := models[params["model"]]
+	if !ok {
+		return writeErrorResponse(w, newError(CodeNotFound, "unknown model %q", params["model"]))
+	}
+	var creq CreateJobRequest
+	if err := readJSON(req, &creq); err != nil {
+		return writeErrorResponse(w, err)
+	}
+	if creq.Input == "" {
+		return writeErrorResponse(w, newError(CodeValidation, "empty input"))
+	}
+
+	item, created, err := createRequest(ctx, bucket, creq.Input)
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	status := http.StatusCreated
+	if !created {
+		status = http.StatusOK
+	}
+	w.Header().Set("Location", "/v1/jobs/"+jobID(item.RequestID))
+	return writeJSON(w, status, newJob(item))
+}
+
+func getJobHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	requestID, err := parseJobID(params["id"])
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	traceRequest(ctx, requestID)
+	item, err := srv.getOwnRequest(ctx, requestID)
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	return writeJSON(w, http.StatusOK, newJob(item))
+}
+
+func deleteJobHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	requestID, err := parseJobID(params["id"])
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	traceRequest(ctx, requestID)
+	if _, err = srv.getOwnRequest(ctx, requestID); err != nil {
+		return writeErrorResponse(w, err)
+	}
+	glog.Infof("deleting %q", requestID)
+	srv.deleteRequest(requestID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func updateJobHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	srv := ctx.Value(serverKey).(*Server)
+	requestID, err := parseJobID(params["id"])
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	traceRequest(ctx, requestID)
+	var ureq UpdateJobRequest
+	if err = readJSON(req, &ureq); err != nil {
+		return writeErrorResponse(w, err)
+	}
+	if ureq.Progress < 0 || ureq.Progress > queue.MaxProgress {
+		return writeErrorResponse(w, newError(CodeValidation, "progress %d out of range [0, %d]", ureq.Progress, queue.MaxProgress))
+	}
+	item, err := srv.getRequest(requestID)
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+
+	copied := *item
+	copied.Progress = ureq.Progress
+	copied.Error = ureq.Error
+	if ureq.Result != "" {
+		copied.Value = ureq.Result
+	}
+	if err = srv.updateClaimed(ctx, &copied); err != nil {
+		return writeErrorResponse(w, err)
+	}
+	glog.Infof("updated %q (progress %d)", requestID, copied.Progress)
+	return writeJSON(w, http.StatusOK, newJob(&copied))
+}
+
+func claimHandler(ctx context.Context, w http.ResponseWriter, req *http.Request, params map[string]string) error {
+	bucket := "/" + params["bucket"]
+	if _, ok := modelOf(bucket); !ok {
+		return writeErrorResponse(w, newError(CodeNotFound, "unknown queue %q", params["bucket"]))
+	}
+	item, err := popRequest(ctx, bucket)
+	if err != nil {
+		return writeErrorResponse(w, err)
+	}
+	return writeJSON(w, http.StatusOK, item)
+}
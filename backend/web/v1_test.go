@@ -0,0 +1,305 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gyuho/dplearn/pkg/blobstore"
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/lru"
+	"github.com/gyuho/dplearn/pkg/urlutil"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// memQueue is the in-memory queue without etcd.
+type memQueue struct {
+	mu      sync.Mutex
+	buckets map[string][]*queue.Item
+	// added is closed and replaced on every Add, to wake up Pops.
+	added chan struct{}
+}
+
+// addedc returns the channel closed on the next Add. It must be called
+// with the lock held.
+func (q *memQueue) addedc() chan struct{} {
+	if q.added == nil {
+		q.added = make(chan struct{})
+	}
+	return q.added
+}
+
+func (q *memQueue) Add(ctx context.Context, it *queue.Item, opts ...queue.OpOption) error {
+	q.mu.Lock()
+	if q.buckets == nil {
+		q.buckets = make(map[string][]*queue.Item)
+	}
+	q.buckets[it.Bucket] = append(q.buckets[it.Bucket], it)
+	close(q.addedc())
+	q.added = nil
+	q.mu.Unlock()
+	return nil
+}
+
+func (q *memQueue) Pop(ctx context.Context, bucket string) queue.ItemWatcher {
+	ch := make(chan *queue.Item, 1)
+	go func() {
+		for {
+			q.mu.Lock()
+			if items := q.buckets[bucket]; len(items) > 0 {
+				q.buckets[bucket] = items[1:]
+				q.mu.Unlock()
+				ch <- items[0]
+				return
+			}
+			added := q.addedc()
+			q.mu.Unlock()
+
+			select {
+			case <-added:
+			case <-ctx.Done():
+				close(ch)
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func (q *memQueue) List(ctx context.Context, bucket string) ([]*queue.Item, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]*queue.Item{}, q.buckets[bucket]...), nil
+}
+
+func (q *memQueue) Delete(ctx context.Context, it *queue.Item) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := q.buckets[it.Bucket]
+	for i := range items {
+		if items[i].Key == it.Key {
+			q.buckets[it.Bucket] = append(items[:i:i], items[i+1:]...)
+			return nil
+		}
+	}
+	return queue.ErrItemNotFound
+}
+
+func (q *memQueue) Stop()                     {}
+func (q *memQueue) Client() *clientv3.Client  { return nil }
+func (q *memQueue) ClientEndpoints() []string { return nil }
+
+// newTestServer returns the server with in-memory queue, and the server
+// of 'gray-cat.jpeg', whose contents differ by the path.
+func newTestServer(t *testing.T) (*Server, *httptest.Server, *httptest.Server) {
+	img, err := ioutil.ReadFile("../../datasets/gray-cat.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(img)
+		w.Write([]byte(req.URL.Path))
+	}))
+
+	imageDir, err := ioutil.TempDir(os.TempDir(), "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := blobstore.New(imageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher, err := urlutil.NewFetcher(urlutil.WithAllowedCIDRs("127.0.0.0/8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		cfg:     DefaultConfig(),
+		rootCtx: context.Background(),
+		qu:      &memQueue{},
+		store:   store,
+		fetcher: fetcher,
+	}
+	srv.cache = lru.NewInMemory(srv.cfg.ImageCacheSize)
+	srv.cache.CreateNamespace(imageCacheBucket)
+	ts := httptest.NewServer(srv.newMux(srv.cache))
+	return srv, ts, imgServer
+}
+
+func doJSON(t *testing.T, method, ep string, body string, v interface{}) *http.Response {
+	req, err := http.NewRequest(method, ep, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %q: %v", method, ep, err)
+		}
+	}
+	return resp
+}
+
+func TestV1(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	defer ts.Close()
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	var models ModelList
+	doJSON(t, http.MethodGet, ts.URL+"/v1/models", "", &models)
+	if len(models.Models) != 1 || models.Models[0].Name != "cats" || models.Models[0].Queue != "cats-request" {
+		t.Fatalf("unexpected models %+v", models)
+	}
+
+	var er ErrorResponse
+	if resp := doJSON(t, http.MethodPost, ts.URL+"/v1/models/dogs/jobs", `{"input": "a.jpg"}`, &er); resp.StatusCode != 404 || er.Error.Code != CodeNotFound {
+		t.Fatalf("expected not found, got %d %+v", resp.StatusCode, er)
+	}
+	if resp := doJSON(t, http.MethodPost, ts.URL+"/v1/models/cats/jobs", `{}`, &er); resp.StatusCode != 400 || er.Error.Code != CodeValidation {
+		t.Fatalf("expected validation error, got %d %+v", resp.StatusCode, er)
+	}
+	if resp := doJSON(t, http.MethodPut, ts.URL+"/v1/models/cats/jobs", `{}`, &er); resp.StatusCode != 405 {
+		t.Fatalf("expected 405, got %d %+v", resp.StatusCode, er)
+	}
+
+	var job Job
+	resp := doJSON(t, http.MethodPost, ts.URL+"/v1/models/cats/jobs", `{"input": "`+imgServer.URL+`/cat.jpeg"}`, &job)
+	if resp.StatusCode != 201 || job.ID == "" || job.Model != "cats" || job.Done {
+		t.Fatalf("unexpected job %d %+v", resp.StatusCode, job)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/v1/jobs/"+job.ID {
+		t.Fatalf("unexpected location %q", loc)
+	}
+	var job2 Job
+	if resp = doJSON(t, http.MethodPost, ts.URL+"/v1/models/cats/jobs", `{"input": "`+imgServer.URL+`/cat.jpeg"}`, &job2); resp.StatusCode != 200 || job2.ID != job.ID {
+		t.Fatalf("expected existing job %+v, got %d %+v", job, resp.StatusCode, job2)
+	}
+
+	var item queue.Item
+	doJSON(t, http.MethodPost, ts.URL+"/v1/queues/cats-request/claim", "", &item)
+	if item.RequestID != job.RequestID || !strings.HasSuffix(item.Value, ".jpeg") {
+		t.Fatalf("unexpected item %+v", item)
+	}
+	if resp = doJSON(t, http.MethodPost, ts.URL+"/v1/queues/dogs-request/claim", "", &er); resp.StatusCode != 404 {
+		t.Fatalf("expected 404, got %d %+v", resp.StatusCode, er)
+	}
+
+	if resp = doJSON(t, http.MethodPatch, ts.URL+"/v1/jobs/"+job.ID, `{"progress": 101}`, &er); resp.StatusCode != 400 {
+		t.Fatalf("expected 400, got %d %+v", resp.StatusCode, er)
+	}
+	doJSON(t, http.MethodPatch, ts.URL+"/v1/jobs/"+job.ID, `{"progress": 100, "result": "cat"}`, &job)
+	if !job.Done || job.Result != "cat" {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	doJSON(t, http.MethodGet, ts.URL+"/v1/jobs/"+job.ID, "", &job2)
+	if job2 != job {
+		t.Fatalf("expected %+v, got %+v", job, job2)
+	}
+
+	// legacy route shares the same request
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/cats-request", nil)
+	req.Header.Set(RequestIDHeader, job.RequestID)
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else {
+		json.NewDecoder(resp.Body).Decode(&item)
+		resp.Body.Close()
+	}
+	if item.Value != "cat" || item.Progress != 100 {
+		t.Fatalf("unexpected item %+v", item)
+	}
+
+	if resp = doJSON(t, http.MethodDelete, ts.URL+"/v1/jobs/"+job.ID, "", nil); resp.StatusCode != 204 {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		if resp = doJSON(t, method, ts.URL+"/v1/jobs/"+job.ID, "", &er); resp.StatusCode != 404 {
+			t.Fatalf("expected 404, got %d", resp.StatusCode)
+		}
+	}
+	if resp = doJSON(t, http.MethodGet, ts.URL+"/v1/jobs/!!", "", &er); resp.StatusCode != 404 {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	defer ts.Close()
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	var doc struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+				Required   []string                          `json:"required"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	doJSON(t, http.MethodGet, ts.URL+"/v1/openapi.json", "", &doc)
+	if doc.OpenAPI != "3.0.0" {
+		t.Fatalf("unexpected version %q", doc.OpenAPI)
+	}
+	for _, method := range []string{"get", "delete", "patch"} {
+		if _, ok := doc.Paths["/v1/jobs/{id}"][method]; !ok {
+			t.Fatalf("expected %s on '/v1/jobs/{id}', got %+v", method, doc.Paths["/v1/jobs/{id}"])
+		}
+	}
+	if _, ok := doc.Paths["/v1/models/{model}/jobs"]["post"]["requestBody"]; !ok {
+		t.Fatal("expected request body")
+	}
+	results, _ := json.Marshal(doc.Paths["/v1/batches/{id}/results"]["get"]["responses"])
+	if !strings.Contains(string(results), `"application/x-ndjson"`) {
+		t.Fatalf("expected JSONL results, got %s", results)
+	}
+
+	job := doc.Components.Schemas["Job"]
+	if job.Properties["id"]["type"] != "string" || job.Properties["created_at"]["format"] != "date-time" {
+		t.Fatalf("unexpected Job schema %+v", job)
+	}
+	for _, name := range job.Required {
+		if name == "result" || name == "error" {
+			t.Fatalf("expected %q to be optional", name)
+		}
+	}
+	if ref := doc.Components.Schemas["ModelList"].Properties["models"]["items"]; ref == nil {
+		t.Fatal("expected items of models")
+	}
+	if _, ok := doc.Components.Schemas["ErrorResponse"]; !ok {
+		t.Fatal("expected ErrorResponse schema")
+	}
+}
+
+func TestV1Draining(t *testing.T) {
+	srv, ts, imgServer := newTestServer(t)
+	defer ts.Close()
+	defer imgServer.Close()
+	defer os.RemoveAll(srv.store.Dir())
+
+	srv.drainc = make(chan struct{})
+	close(srv.drainc)
+
+	var er ErrorResponse
+	resp := doJSON(t, http.MethodPost, ts.URL+"/v1/models/cats/jobs", `{"input": "`+imgServer.URL+`/a.jpg"}`, &er)
+	if resp.StatusCode != http.StatusServiceUnavailable || er.Error.Code != CodeQueueUnavailable {
+		t.Fatalf("expected 503 on new job, got %d %+v", resp.StatusCode, er)
+	}
+	resp = doJSON(t, http.MethodPost, ts.URL+"/v1/queues/cats-request/claim", "", &er)
+	if resp.StatusCode != http.StatusServiceUnavailable || er.Error.Code != CodeQueueUnavailable {
+		t.Fatalf("expected 503 on claim, got %d %+v", resp.StatusCode, er)
+	}
+}
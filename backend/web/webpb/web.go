@@ -0,0 +1,341 @@
+// Package webpb defines the messages and the gRPC service in 'web.proto'.
+//
+// The types are written by hand, in the same layout as protoc-gen-go,
+// so that the protobuf struct tags drive the wire encoding.
+package webpb
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// Job is the queue item of the request.
+type Job struct {
+	RequestID         string `protobuf:"bytes,1,opt,name=request_id,json=requestId" json:"request_id,omitempty"`
+	Bucket            string `protobuf:"bytes,2,opt,name=bucket" json:"bucket,omitempty"`
+	Key               string `protobuf:"bytes,3,opt,name=key" json:"key,omitempty"`
+	Value             string `protobuf:"bytes,4,opt,name=value" json:"value,omitempty"`
+	Progress          int32  `protobuf:"varint,5,opt,name=progress" json:"progress,omitempty"`
+	Error             string `protobuf:"bytes,6,opt,name=error" json:"error,omitempty"`
+	CreatedAtUnixNano int64  `protobuf:"varint,7,opt,name=created_at_unix_nano,json=createdAtUnixNano" json:"created_at_unix_nano,omitempty"`
+	TraceID           string `protobuf:"bytes,8,opt,name=trace_id,json=traceId" json:"trace_id,omitempty"`
+}
+
+func (m *Job) Reset()         { *m = Job{} }
+func (m *Job) String() string { return proto.CompactTextString(m) }
+func (*Job) ProtoMessage()    {}
+
+// EnqueueRequest is the request of Enqueue.
+type EnqueueRequest struct {
+	Model string `protobuf:"bytes,1,opt,name=model" json:"model,omitempty"`
+	Input string `protobuf:"bytes,2,opt,name=input" json:"input,omitempty"`
+}
+
+func (m *EnqueueRequest) Reset()         { *m = EnqueueRequest{} }
+func (m *EnqueueRequest) String() string { return proto.CompactTextString(m) }
+func (*EnqueueRequest) ProtoMessage()    {}
+
+// ClaimRequest is the request of Claim.
+type ClaimRequest struct {
+	Model string `protobuf:"bytes,1,opt,name=model" json:"model,omitempty"`
+}
+
+func (m *ClaimRequest) Reset()         { *m = ClaimRequest{} }
+func (m *ClaimRequest) String() string { return proto.CompactTextString(m) }
+func (*ClaimRequest) ProtoMessage()    {}
+
+// ReportProgressRequest is the request of ReportProgress.
+type ReportProgressRequest struct {
+	RequestID string `protobuf:"bytes,1,opt,name=request_id,json=requestId" json:"request_id,omitempty"`
+	Progress  int32  `protobuf:"varint,2,opt,name=progress" json:"progress,omitempty"`
+}
+
+func (m *ReportProgressRequest) Reset()         { *m = ReportProgressRequest{} }
+func (m *ReportProgressRequest) String() string { return proto.CompactTextString(m) }
+func (*ReportProgressRequest) ProtoMessage()    {}
+
+// CompleteRequest is the request of Complete.
+type CompleteRequest struct {
+	RequestID string `protobuf:"bytes,1,opt,name=request_id,json=requestId" json:"request_id,omitempty"`
+	Value     string `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+	Error     string `protobuf:"bytes,3,opt,name=error" json:"error,omitempty"`
+}
+
+func (m *CompleteRequest) Reset()         { *m = CompleteRequest{} }
+func (m *CompleteRequest) String() string { return proto.CompactTextString(m) }
+func (*CompleteRequest) ProtoMessage()    {}
+
+// WatchJobRequest is the request of WatchJob.
+type WatchJobRequest struct {
+	RequestID string `protobuf:"bytes,1,opt,name=request_id,json=requestId" json:"request_id,omitempty"`
+}
+
+func (m *WatchJobRequest) Reset()         { *m = WatchJobRequest{} }
+func (m *WatchJobRequest) String() string { return proto.CompactTextString(m) }
+func (*WatchJobRequest) ProtoMessage()    {}
+
+func init() {
+	proto.RegisterType((*Job)(nil), "webpb.Job")
+	proto.RegisterType((*EnqueueRequest)(nil), "webpb.EnqueueRequest")
+	proto.RegisterType((*ClaimRequest)(nil), "webpb.ClaimRequest")
+	proto.RegisterType((*ReportProgressRequest)(nil), "webpb.ReportProgressRequest")
+	proto.RegisterType((*CompleteRequest)(nil), "webpb.CompleteRequest")
+	proto.RegisterType((*WatchJobRequest)(nil), "webpb.WatchJobRequest")
+}
+
+// QueueClient is the client API for Queue service.
+type QueueClient interface {
+	Enqueue(ctx context.Context, in *EnqueueRequest, opts ...grpc.CallOption) (*Job, error)
+	Claim(ctx context.Context, in *ClaimRequest, opts ...grpc.CallOption) (Queue_ClaimClient, error)
+	ReportProgress(ctx context.Context, in *ReportProgressRequest, opts ...grpc.CallOption) (*Job, error)
+	Complete(ctx context.Context, in *CompleteRequest, opts ...grpc.CallOption) (*Job, error)
+	WatchJob(ctx context.Context, in *WatchJobRequest, opts ...grpc.CallOption) (Queue_WatchJobClient, error)
+}
+
+type queueClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewQueueClient returns the client of Queue service.
+func NewQueueClient(cc *grpc.ClientConn) QueueClient {
+	return &queueClient{cc}
+}
+
+func (c *queueClient) Enqueue(ctx context.Context, in *EnqueueRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := grpc.Invoke(ctx, "/webpb.Queue/Enqueue", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *queueClient) Claim(ctx context.Context, in *ClaimRequest, opts ...grpc.CallOption) (Queue_ClaimClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Queue_serviceDesc.Streams[0], c.cc, "/webpb.Queue/Claim", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &queueClaimClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// Queue_ClaimClient receives claimed jobs.
+type Queue_ClaimClient interface {
+	Recv() (*Job, error)
+	grpc.ClientStream
+}
+
+type queueClaimClient struct {
+	grpc.ClientStream
+}
+
+func (x *queueClaimClient) Recv() (*Job, error) {
+	m := new(Job)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *queueClient) ReportProgress(ctx context.Context, in *ReportProgressRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := grpc.Invoke(ctx, "/webpb.Queue/ReportProgress", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *queueClient) Complete(ctx context.Context, in *CompleteRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := grpc.Invoke(ctx, "/webpb.Queue/Complete", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *queueClient) WatchJob(ctx context.Context, in *WatchJobRequest, opts ...grpc.CallOption) (Queue_WatchJobClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Queue_serviceDesc.Streams[1], c.cc, "/webpb.Queue/WatchJob", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &queueWatchJobClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// Queue_WatchJobClient receives job updates.
+type Queue_WatchJobClient interface {
+	Recv() (*Job, error)
+	grpc.ClientStream
+}
+
+type queueWatchJobClient struct {
+	grpc.ClientStream
+}
+
+func (x *queueWatchJobClient) Recv() (*Job, error) {
+	m := new(Job)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// QueueServer is the server API for Queue service.
+type QueueServer interface {
+	Enqueue(context.Context, *EnqueueRequest) (*Job, error)
+	Claim(*ClaimRequest, Queue_ClaimServer) error
+	ReportProgress(context.Context, *ReportProgressRequest) (*Job, error)
+	Complete(context.Context, *CompleteRequest) (*Job, error)
+	WatchJob(*WatchJobRequest, Queue_WatchJobServer) error
+}
+
+// RegisterQueueServer registers the Queue service.
+func RegisterQueueServer(s *grpc.Server, srv QueueServer) {
+	s.RegisterService(&_Queue_serviceDesc, srv)
+}
+
+func _Queue_Enqueue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EnqueueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QueueServer).Enqueue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/webpb.Queue/Enqueue",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QueueServer).Enqueue(ctx, req.(*EnqueueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Queue_Claim_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ClaimRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(QueueServer).Claim(m, &queueClaimServer{stream})
+}
+
+// Queue_ClaimServer sends claimed jobs.
+type Queue_ClaimServer interface {
+	Send(*Job) error
+	grpc.ServerStream
+}
+
+type queueClaimServer struct {
+	grpc.ServerStream
+}
+
+func (x *queueClaimServer) Send(m *Job) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Queue_ReportProgress_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReportProgressRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QueueServer).ReportProgress(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/webpb.Queue/ReportProgress",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QueueServer).ReportProgress(ctx, req.(*ReportProgressRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Queue_Complete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CompleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QueueServer).Complete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/webpb.Queue/Complete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QueueServer).Complete(ctx, req.(*CompleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Queue_WatchJob_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchJobRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(QueueServer).WatchJob(m, &queueWatchJobServer{stream})
+}
+
+// Queue_WatchJobServer sends job updates.
+type Queue_WatchJobServer interface {
+	Send(*Job) error
+	grpc.ServerStream
+}
+
+type queueWatchJobServer struct {
+	grpc.ServerStream
+}
+
+func (x *queueWatchJobServer) Send(m *Job) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Queue_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "webpb.Queue",
+	HandlerType: (*QueueServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Enqueue",
+			Handler:    _Queue_Enqueue_Handler,
+		},
+		{
+			MethodName: "ReportProgress",
+			Handler:    _Queue_ReportProgress_Handler,
+		},
+		{
+			MethodName: "Complete",
+			Handler:    _Queue_Complete_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Claim",
+			Handler:       _Queue_Claim_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchJob",
+			Handler:       _Queue_WatchJob_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "web.proto",
+}
@@ -21,6 +21,16 @@ ITEM_KEYS = ['bucket', 'key', 'value', 'progress', 'canceled', 'error',
              'request_id']
 
 
+def auth_headers():
+    """auth_headers returns the API key header of 'worker' scope,
+    when backend requires API keys.
+    """
+    api_key = os.environ.get('DPLEARN_API_KEY', '')
+    if api_key == '':
+        return {}
+    return {'Authorization': 'Bearer {0}'.format(api_key)}
+
+
 def fetch_item(endpoint, timeout=None):
     """fetch_item fetches a scheduled job from queue service.
     """
@@ -28,7 +38,8 @@ def fetch_item(endpoint, timeout=None):
         try:
             # blocks until first item is available
             log.info('fetching item from {0}'.format(endpoint))
-            rresp = requests.get(endpoint, timeout=timeout)
+            rresp = requests.get(endpoint, timeout=timeout,
+                                 headers=auth_headers())
             log.info('fetched item from {0}'.format(endpoint))
 
             # even empty, Go backend should encode every field
@@ -53,13 +64,22 @@ def post_item(endpoint, item):
     """post posts the processed job to the queue service.
     """
     headers = {'Content-Type': 'application/json'}
+    headers.update(auth_headers())
+    trace_id = item.get('trace_id', '')
+    if trace_id != '':
+        # same trace as the request that created the item
+        headers['X-Trace-Id'] = trace_id
+    trace_parent = item.get('trace_parent', '')
+    if trace_parent != '':
+        # continue the trace of the item in backend spans
+        headers['Traceparent'] = trace_parent
     while True:
         try:
             req_id = item['request_id']
-            log.info('posting item to {0} with request ID {1}'.format(endpoint, req_id))
+            log.info('posting item to {0} with request ID {1} (trace {2})'.format(endpoint, req_id, trace_id))
             rresp = requests.post(endpoint, data=json.dumps(item),
                                   headers=headers)
-            log.info('posted item to {0} with request ID {1}'.format(endpoint, req_id))
+            log.info('posted item to {0} with request ID {1} (trace {2})'.format(endpoint, req_id, trace_id))
 
             item = json.loads(rresp.text)
             # even empty, Go backend should encode every field
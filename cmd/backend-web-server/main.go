@@ -4,22 +4,84 @@ import (
 	"context"
 	"flag"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gyuho/dplearn/backend/web"
 	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/trace"
 
 	"github.com/golang/glog"
 )
 
 func main() {
-	webScheme := flag.String("web-scheme", "http", "Specify scheme for backend.")
-	hostPort := flag.String("web-host", "localhost:2200", "Specify host and port for backend.")
+	defaultCfg := web.DefaultConfig()
+	configPath := flag.String("config", "", "Specify the YAML config file (see 'web.Config'), overridden by 'DPLEARN_*' environment variables and then by flags.")
+	webScheme := flag.String("web-scheme", defaultCfg.Scheme, "Specify scheme for backend.")
+	hostPort := flag.String("web-host", defaultCfg.Host, "Specify host and port for backend.")
+	tlsCertFile := flag.String("tls-cert-file", "", "Specify the TLS certificate file for 'https' scheme (reloaded on change).")
+	tlsKeyFile := flag.String("tls-key-file", "", "Specify the TLS key file for 'https' scheme.")
+	tlsClientCAFile := flag.String("tls-client-ca-file", "", "Specify the CA file to require client certificates from workers and operators (empty to disable mTLS).")
+	grpcHostPort := flag.String("grpc-host", "", "Specify host and port for gRPC service of workers (empty to disable).")
 	queuePortClient := flag.Int("queue-port-client", 22000, "Specify the client port for queue service.")
 	queuePortPeer := flag.Int("queue-port-peer", 22001, "Specify the peer port for queue service.")
 	dataDir := flag.String("data-dir", filepath.Join(os.TempDir(), "etcd-data"), "Specify the etcd data directory.")
+	frontendDir := flag.String("frontend-dir", "", "Specify the built frontend directory to serve (e.g. 'dist'), instead of 'ng serve' and nginx.")
+	imageDir := flag.String("image-dir", defaultCfg.ImageDir, "Specify the directory to store downloaded images.")
+	legacyErrors := flag.Bool("legacy-errors", true, "'true' to report errors in the 200 response item, as the current frontend expects.")
+	apiKeyFile := flag.String("api-key-file", "", "Specify the JSON file of API keys (see 'web.NewFileKeyStore').")
+	apiKeyEtcdPrefix := flag.String("api-key-etcd-prefix", "", "Specify the etcd prefix of API keys in queue service (e.g. '_auth/keys').")
+	anonymousSubmit := flag.Bool("anonymous-submit", true, "'true' to allow submitting jobs without API key, for the current frontend.")
+	anonymousDailyQuota := flag.Int("anonymous-daily-quota", 0, "Specify the daily quota of jobs without API key (0 for no limit).")
+	anonymousMaxConcurrent := flag.Int("anonymous-max-concurrent", 0, "Specify the maximum number of jobs in progress without API key (0 for no limit).")
+	rateLimits := flag.String("rate-limits", "", "Specify the rate limits of each API key or client IP as 'path=rate:burst' list, where gRPC methods are paths (e.g. '/cats-request=2:10,/v1/=5:20,/webpb.Queue/=5:20').")
+	rateLimitEtcdPrefix := flag.String("rate-limit-etcd-prefix", "", "Specify the etcd prefix to share rate limits across replicas (e.g. '_ratelimit').")
+	historyEtcdPrefix := flag.String("history-etcd-prefix", "", "Specify the etcd prefix to keep the job history of each user or API key (e.g. '_history', empty to disable).")
+	trustedProxies := flag.String("trusted-proxies", "", "Specify the comma-separated CIDRs of proxies to trust 'Forwarded' and 'X-Forwarded-For' headers from (e.g. '127.0.0.1/32,::1/128' for local nginx, empty to ignore the headers).")
+	accessLog := flag.String("access-log", "stdout", "Specify the file to write JSON access logs ('stdout', or empty to disable).")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 20*time.Second, "Specify how long to wait for in-flight requests on SIGINT or SIGTERM.")
+	traceSpans := flag.String("trace-spans", "", "Specify the file to write JSON trace spans ('stdout', or empty to disable).")
 	flag.Parse()
 
+	cfg, err := web.LoadConfig(*configPath)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	// flags set in command-line take precedence
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "web-scheme":
+			cfg.Scheme = *webScheme
+		case "web-host":
+			cfg.Host = *hostPort
+		case "tls-cert-file":
+			cfg.TLSCertFile = *tlsCertFile
+		case "tls-key-file":
+			cfg.TLSKeyFile = *tlsKeyFile
+		case "tls-client-ca-file":
+			cfg.TLSClientCAFile = *tlsClientCAFile
+		case "frontend-dir":
+			cfg.FrontendDir = *frontendDir
+		case "image-dir":
+			cfg.ImageDir = *imageDir
+		}
+	})
+	if err = cfg.Validate(); err != nil {
+		glog.Fatalf("invalid config (%v)", err)
+	}
+
+	if *traceSpans != "" {
+		e, closeFunc, err := trace.OpenJSONExporter(*traceSpans)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer closeFunc()
+		trace.SetExporter(e)
+	}
+
 	rootCtx, rootCancel := context.WithCancel(context.Background())
 	defer rootCancel()
 
@@ -29,13 +91,76 @@ func main() {
 	}
 	defer qu.Stop()
 
-	glog.Infof("starting web server with %q (queue :%d/:%d, data-dir %q)", *hostPort, *queuePortClient, *queuePortPeer, *dataDir)
-	srv, err := web.StartServer(*webScheme, *hostPort, qu)
+	glog.Infof("starting web server with %+v (queue :%d/:%d, data-dir %q)", cfg, *queuePortClient, *queuePortPeer, *dataDir)
+	opts := []web.OpOption{web.WithLegacyErrors(*legacyErrors), web.WithGRPC(*grpcHostPort)}
+	switch {
+	case *apiKeyFile != "" && *apiKeyEtcdPrefix != "":
+		glog.Fatal("got both -api-key-file and -api-key-etcd-prefix")
+	case *apiKeyFile != "":
+		ks, err := web.NewFileKeyStore(*apiKeyFile)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		opts = append(opts, web.WithKeyStore(ks))
+	case *apiKeyEtcdPrefix != "":
+		opts = append(opts, web.WithKeyStore(web.NewEtcdKeyStore(qu.Client(), *apiKeyEtcdPrefix)))
+	}
+	if *anonymousSubmit {
+		opts = append(opts, web.WithAnonymousKey(web.APIKey{
+			Name:          "anonymous",
+			Scopes:        []web.Scope{web.ScopeSubmit},
+			DailyQuota:    *anonymousDailyQuota,
+			MaxConcurrent: *anonymousMaxConcurrent,
+		}))
+	}
+	if *rateLimits != "" {
+		limits, err := web.ParseRateLimits(*rateLimits)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		opts = append(opts, web.WithRateLimits(limits))
+		if *rateLimitEtcdPrefix != "" {
+			opts = append(opts, web.WithRateLimiter(web.NewEtcdRateLimiter(qu.Client(), *rateLimitEtcdPrefix)))
+		}
+	}
+	if *historyEtcdPrefix != "" {
+		opts = append(opts, web.WithHistory(web.NewEtcdHistory(qu.Client(), *historyEtcdPrefix)))
+	}
+	if *trustedProxies != "" {
+		opts = append(opts, web.WithTrustedProxies(strings.Split(*trustedProxies, ",")...))
+	}
+	switch *accessLog {
+	case "":
+	case "stdout":
+		opts = append(opts, web.WithAccessLog(os.Stdout))
+	default:
+		f, err := os.OpenFile(*accessLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer f.Close()
+		opts = append(opts, web.WithAccessLog(f))
+	}
+	srv, err := web.StartServer(cfg, qu, opts...)
 	if err != nil {
 		glog.Fatal(err)
 	}
 
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
 	select {
+	case sig := <-sigc:
+		// stop the server before the deferred 'qu.Stop', so that no request
+		// uses the queue while its embedded etcd is being stopped
+		glog.Infof("received %v, shutting down (timeout %v)", sig, *shutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		err = srv.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			glog.Warningf("shut down web server before drained (%v)", err)
+		} else {
+			glog.Info("shut down web server")
+		}
 	case <-srv.StopNotify():
 		glog.Warning("stopped web server")
 	}
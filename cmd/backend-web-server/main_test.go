@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gyuho/dplearn/backend/web"
+)
+
+// TestMain runs 'main' in the subprocess of the test binary.
+func TestMain(m *testing.M) {
+	if os.Getenv("BACKEND_WEB_SERVER_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+/*
+go test -v -run TestSignal
+*/
+
+func TestSignal(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "backend-web-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostPort := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	cmd := exec.Command(os.Args[0],
+		"-web-host", hostPort,
+		"-queue-port-client", fmt.Sprint(freePort(t)),
+		"-queue-port-peer", fmt.Sprint(freePort(t)),
+		"-data-dir", filepath.Join(dir, "etcd"),
+		"-image-dir", filepath.Join(dir, "images"),
+		"-legacy-errors=false",
+		"-access-log", "",
+		"-shutdown-timeout", "10s",
+		"-logtostderr",
+	)
+	cmd.Env = append(os.Environ(), "BACKEND_WEB_SERVER_MAIN=1")
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exitc := make(chan error, 1)
+	go func() { exitc <- cmd.Wait() }()
+	defer func() {
+		if cmd.ProcessState == nil {
+			cmd.Process.Kill()
+			<-exitc
+		}
+	}()
+
+	ep := "http://" + hostPort
+	for i := 0; ; i++ {
+		resp, err := http.Get(ep + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if i == 100 {
+			t.Fatalf("server did not start (%v)\n%s", err, out.String())
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	// worker waiting for jobs, blocked in Pop
+	type result struct {
+		status int
+		body   web.ErrorResponse
+		err    error
+	}
+	popc := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(ep + "/cats-request/queue")
+		if err != nil {
+			popc <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		var r result
+		r.status, r.err = resp.StatusCode, json.NewDecoder(resp.Body).Decode(&r.body)
+		popc <- r
+	}()
+	time.Sleep(time.Second)
+	select {
+	case r := <-popc:
+		t.Fatalf("expected blocking Pop, got %+v", r)
+	default:
+	}
+
+	if err = cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-popc:
+		if r.err != nil {
+			t.Fatalf("blocking Pop failed (%v)", r.err)
+		}
+		if r.status != http.StatusServiceUnavailable || r.body.Error.Code != web.CodeQueueUnavailable {
+			t.Fatalf("expected 503 on shutdown, got %d %+v", r.status, r.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocking Pop was not canceled on shutdown")
+	}
+
+	select {
+	case err = <-exitc:
+		if err != nil {
+			t.Fatalf("server exited with %v\n%s", err, out.String())
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatalf("server did not exit\n%s", out.String())
+	}
+
+	// web server is stopped before the queue
+	logs := out.String()
+	shut, stopped := strings.Index(logs, "shut down web server"), strings.Index(logs, "stopped queue with an embedded etcd server")
+	if shut < 0 || stopped < 0 || shut > stopped {
+		t.Fatalf("expected web server to shut down before queue stops\n%s", logs)
+	}
+}
@@ -0,0 +1,133 @@
+// cats-worker processes '/cats-request' jobs from backend/web,
+// with the same protocol as 'backend/worker/worker.py', in pure Go.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gyuho/dplearn/pkg/cats"
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/trace"
+	"github.com/gyuho/dplearn/pkg/worker"
+
+	"github.com/golang/glog"
+)
+
+func main() {
+	endpoint := flag.String("endpoint", "http://localhost:2200/cats-request/queue", "Specify the queue endpoint of backend.")
+	paramPath := flag.String("param-path", os.Getenv("CATS_PARAM_PATH"), "Specify the parameters file path (default $CATS_PARAM_PATH).")
+	concurrency := flag.Int("concurrency", 1, "Specify the number of jobs to process concurrently.")
+	retries := flag.Int("retries", 0, "Specify the number of retries on failed jobs.")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "Specify how long to wait for in-flight jobs on shutdown.")
+	apiKey := flag.String("api-key", os.Getenv("DPLEARN_API_KEY"), "Specify the API key of 'worker' scope (default $DPLEARN_API_KEY).")
+	tlsCertFile := flag.String("tls-cert-file", "", "Specify the client certificate file, for backend with mTLS.")
+	tlsKeyFile := flag.String("tls-key-file", "", "Specify the client key file, for backend with mTLS.")
+	tlsCAFile := flag.String("tls-ca-file", "", "Specify the CA file to verify 'https' backend (empty to use system roots).")
+	traceSpans := flag.String("trace-spans", "", "Specify the file to write JSON trace spans ('stdout', or empty to disable).")
+	flag.Parse()
+
+	if *traceSpans != "" {
+		e, closeFunc, err := trace.OpenJSONExporter(*traceSpans)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer closeFunc()
+		trace.SetExporter(e)
+	}
+
+	if *paramPath == "" {
+		glog.Fatal("got empty -param-path")
+	}
+	glog.Infof("loading 'cats' parameters on %q", *paramPath)
+	params, err := cats.LoadParameters(*paramPath)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("loaded 'cats' parameters on %q (%d layers)", *paramPath, params.Layers())
+
+	cli, err := newHTTPClient(*tlsCertFile, *tlsKeyFile, *tlsCAFile)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	w, err := worker.New(*endpoint, &handler{params: params},
+		worker.WithConcurrency(*concurrency),
+		worker.WithRetries(*retries),
+		worker.WithShutdownTimeout(*shutdownTimeout),
+		worker.WithAPIKey(*apiKey),
+		worker.WithHTTPClient(cli),
+	)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		glog.Infof("received %v, shutting down", <-sigc)
+		cancel()
+	}()
+
+	if err = w.Run(ctx); err != nil {
+		glog.Fatal(err)
+	}
+}
+
+// newHTTPClient returns the client with the client certificate and CA,
+// or the default client if none is given.
+func newHTTPClient(certFile, keyFile, caFile string) (*http.Client, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return http.DefaultClient, nil
+	}
+	tc := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %q", caFile)
+		}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}, nil
+}
+
+type handler struct {
+	params *cats.Parameters
+}
+
+// Process classifies the image of the item path.
+func (h *handler) Process(ctx context.Context, item *etcdqueue.Item) (string, error) {
+	imagePath := item.Value
+	if _, err := os.Stat(imagePath); err != nil {
+		glog.Warningf("cannot find image %q", imagePath)
+		return "", fmt.Errorf("cannot find image %s", imagePath)
+	}
+	_, span := trace.Start(ctx, "cats.Classify")
+	class, err := h.params.ClassifyFile(imagePath)
+	span.SetError(err)
+	span.Finish()
+	if err != nil {
+		return "", err
+	}
+	glog.Infof("classified %q as %q (request ID %q)", imagePath, class, item.RequestID)
+	return fmt.Sprintf("[WORKER - ACK] it's a '%s'!", class), nil
+}
@@ -0,0 +1,68 @@
+// convert-npy prints arrays in '.npy' or '.npz' files, and converts
+// pickled dictionaries of arrays (e.g. 'datasets/parameters-cats.npy')
+// to '.npz' that does not require pickle to load.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/gyuho/dplearn/pkg/npy"
+
+	"github.com/golang/glog"
+)
+
+func main() {
+	inputPath := flag.String("input", "", "Specify the '.npy' or '.npz' file path to read.")
+	outputPath := flag.String("output", "", "Specify the '.npz' file path to write (empty to only print arrays).")
+	flag.Parse()
+
+	if *inputPath == "" {
+		glog.Fatal("got empty -input")
+	}
+	arrays, err := readArrays(*inputPath)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	names := make([]string, 0, len(arrays))
+	for name := range arrays {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a := arrays[name]
+		fmt.Fprintf(os.Stdout, "%s\t%s\t%v\t(fortran_order %v)\n", name, a.Descr, a.Shape, a.FortranOrder)
+	}
+
+	if *outputPath == "" {
+		return
+	}
+	if filepath.Ext(*outputPath) != ".npz" {
+		glog.Fatalf("expected '.npz' output path, got %q", *outputPath)
+	}
+	if err = npy.WriteNPZ(*outputPath, arrays); err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("wrote %d arrays to %q", len(arrays), *outputPath)
+}
+
+// readArrays reads arrays keyed by names. A single array is keyed by
+// its file name, and a pickled dictionary of arrays by its keys.
+func readArrays(fpath string) (map[string]*npy.Array, error) {
+	if filepath.Ext(fpath) == ".npz" {
+		return npy.ReadNPZ(fpath)
+	}
+	a, err := npy.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if a.Descr == "|O" {
+		return a.Dict()
+	}
+	name := filepath.Base(fpath)
+	return map[string]*npy.Array{name[:len(name)-len(filepath.Ext(name))]: a}, nil
+}
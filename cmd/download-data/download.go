@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gyuho/dplearn/pkg/fileutil"
+	"github.com/gyuho/dplearn/pkg/urlutil"
+
+	"github.com/golang/glog"
+)
+
+// checksum is the expected digest of the downloaded file.
+type checksum struct {
+	algo   string
+	digest string
+}
+
+func (c checksum) String() string {
+	if c.digest == "" {
+		return ""
+	}
+	return c.algo + ":" + c.digest
+}
+
+// parseChecksum parses "sha256:<hex>" or "md5:<hex>".
+// The algorithm can be omitted, then it is decided by the digest length.
+func parseChecksum(s string) (checksum, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return checksum{}, nil
+	}
+	c := checksum{digest: s}
+	if i := strings.Index(s, ":"); i != -1 {
+		c.algo, c.digest = s[:i], s[i+1:]
+	}
+	if c.algo == "" {
+		switch len(c.digest) {
+		case sha256.Size * 2:
+			c.algo = "sha256"
+		case md5.Size * 2:
+			c.algo = "md5"
+		}
+	}
+	h, err := newHash(c.algo)
+	if err != nil {
+		return checksum{}, err
+	}
+	if _, err = hex.DecodeString(c.digest); err != nil || len(c.digest) != h.Size()*2 {
+		return checksum{}, fmt.Errorf("invalid %s digest %q", c.algo, c.digest)
+	}
+	return c, nil
+}
+
+func newHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case "sha256":
+		return sha256.New(), nil
+	case "md5":
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown checksum algorithm %q (must be sha256, md5)", algo)
+	}
+}
+
+// fileDigest returns the hex-encoded digest of the file.
+func fileDigest(fpath, algo string) (string, error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verify returns an error if the file does not match the checksum.
+func verify(fpath string, sum checksum) error {
+	digest, err := fileDigest(fpath, sum.algo)
+	if err != nil {
+		return err
+	}
+	if digest != sum.digest {
+		return fmt.Errorf("%q has %s %s, expected %s", fpath, sum.algo, digest, sum.digest)
+	}
+	return nil
+}
+
+// upToDate returns true if the target file exists and matches the source.
+// It compares the checksum if given, otherwise the file size.
+func upToDate(sourcePath, targetPath string, sum checksum) bool {
+	if !fileutil.Exist(targetPath) {
+		return false
+	}
+	if sum.digest != "" {
+		glog.Infof("%q exists, comparing the checksum", targetPath)
+		if err := verify(targetPath, sum); err != nil {
+			glog.Warning(err)
+			return false
+		}
+		glog.Infof("%q matches %s (no need to download)", targetPath, sum)
+		return true
+	}
+
+	glog.Infof("%q exists, comparing the size", targetPath)
+	size, sizet, err := urlutil.GetContentLength(sourcePath)
+	if err != nil {
+		glog.Warningf("cannot get the size of %q (%v)", sourcePath, err)
+		return false
+	}
+	fi, err := fileutil.GetFileInfo(targetPath)
+	if err != nil {
+		glog.Warning(err)
+		return false
+	}
+	if fi.Size != size {
+		glog.Warningf("target file %q has %d, source %q has %d", targetPath, fi.Size, sourcePath, size)
+		return false
+	}
+	glog.Infof("%q(%s) == %q(%s) (no need to download)", sourcePath, sizet, targetPath, fi.SizeTxt)
+	return true
+}
+
+const (
+	partialSuffix = ".partial"
+
+	retryBackoffBase = time.Second
+	retryBackoffMax  = time.Minute
+)
+
+// retryable returns true if the download error may be transient:
+// network errors, and 5xx or 429 responses.
+func retryable(err error) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	switch e := err.(type) {
+	case *urlutil.StatusError:
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	case net.Error:
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// download downloads the source to the target path, resuming from the
+// ".partial" file of the previous attempt. It retries transient errors
+// with exponential backoff (see 'retryable'), and verifies the checksum
+// before renaming to the target path.
+func download(ctx context.Context, sourcePath, targetPath string, sum checksum, retries int, progress urlutil.ProgressFunc) error {
+	if !fileutil.Exist(filepath.Dir(targetPath)) {
+		if err := fileutil.TouchDirAll(filepath.Dir(targetPath)); err != nil {
+			return err
+		}
+	}
+	partialPath := targetPath + partialSuffix
+
+	var err error
+	for i := 0; i <= retries; i++ {
+		if i > 0 {
+			backoff := retryBackoffBase << uint(i-1)
+			if backoff > retryBackoffMax {
+				backoff = retryBackoffMax
+			}
+			glog.Warningf("retrying %q in %v (%d/%d, %v)", sourcePath, backoff, i, retries, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		err = downloadPartial(ctx, sourcePath, partialPath, progress)
+		if err == urlutil.ErrRangeNotSupported {
+			glog.Warningf("%q does not support range requests, downloading from scratch", sourcePath)
+			if err = os.Remove(partialPath); err != nil {
+				return err
+			}
+			err = downloadPartial(ctx, sourcePath, partialPath, progress)
+		}
+		if err == nil || ctx.Err() != nil || !retryable(err) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if sum.digest != "" {
+		if err = verify(partialPath, sum); err != nil {
+			// corrupted, never resume from it
+			os.Remove(partialPath)
+			return err
+		}
+		glog.Infof("verified %q with %s", partialPath, sum)
+	}
+	return os.Rename(partialPath, targetPath)
+}
+
+// downloadPartial appends the rest of the source to the partial file.
+func downloadPartial(ctx context.Context, sourcePath, partialPath string, progress urlutil.ProgressFunc) error {
+	f, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, fileutil.PrivateFileMode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := fi.Size()
+	if offset > 0 {
+		glog.Infof("resuming %q from %d bytes in %q", sourcePath, offset, partialPath)
+	} else {
+		glog.Infof("downloading %q to %q", sourcePath, partialPath)
+	}
+
+	var opts []urlutil.DownloadOption
+	if offset > 0 {
+		opts = append(opts, urlutil.WithOffset(offset))
+	}
+	if progress != nil {
+		opts = append(opts, urlutil.WithProgress(progress))
+	}
+	_, err = urlutil.Download(ctx, urlutil.TrimQuery(sourcePath), f, 0, opts...)
+	if err == urlutil.ErrRangeNotSatisfiable {
+		// already downloaded everything in the previous attempt
+		glog.Infof("%q has already been downloaded to %q", sourcePath, partialPath)
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
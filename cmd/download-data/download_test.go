@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gyuho/dplearn/pkg/urlutil"
+)
+
+func TestParseChecksum(t *testing.T) {
+	sha := sha256Hex([]byte("hello"))
+	h := md5.Sum([]byte("hello"))
+	md := hex.EncodeToString(h[:])
+
+	tests := []struct {
+		s   string
+		exp checksum
+		ok  bool
+	}{
+		{"", checksum{}, true},
+		{"sha256:" + sha, checksum{"sha256", sha}, true},
+		{" SHA256:" + strings.ToUpper(sha) + " ", checksum{"sha256", sha}, true},
+		{sha, checksum{"sha256", sha}, true},
+		{"md5:" + md, checksum{"md5", md}, true},
+		{md, checksum{"md5", md}, true},
+		{"sha256:" + md, checksum{}, false},
+		{"sha1:" + sha, checksum{}, false},
+		{"sha256:" + strings.Repeat("z", 64), checksum{}, false},
+		{"1234", checksum{}, false},
+	}
+	for i, tt := range tests {
+		c, err := parseChecksum(tt.s)
+		if (err == nil) != tt.ok {
+			t.Fatalf("#%d: expected ok %v, got %v", i, tt.ok, err)
+		}
+		if c != tt.exp {
+			t.Fatalf("#%d: expected %+v, got %+v", i, tt.exp, c)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err error
+		exp bool
+	}{
+		{&urlutil.StatusError{StatusCode: http.StatusNotFound}, false},
+		{&urlutil.StatusError{StatusCode: http.StatusForbidden}, false},
+		{&urlutil.StatusError{StatusCode: http.StatusInternalServerError}, true},
+		{&urlutil.StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&urlutil.StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&url.Error{Op: "Get", URL: "http://localhost", Err: &net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}}, true},
+		{&url.Error{Op: "Get", URL: "ftp://localhost", Err: fmt.Errorf("unsupported protocol scheme")}, false},
+		{io.ErrUnexpectedEOF, true},
+		{fmt.Errorf("checksum mismatch"), false},
+		{&os.PathError{Op: "open", Path: "/a", Err: os.ErrPermission}, false},
+	}
+	for i, tt := range tests {
+		if got := retryable(tt.err); got != tt.exp {
+			t.Fatalf("#%d: %v expected retryable %v, got %v", i, tt.err, tt.exp, got)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	var (
+		mu       sync.Mutex
+		ranges   []string
+		failures int32
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, req.Header.Get("Range"))
+		mu.Unlock()
+		switch req.URL.Path {
+		case "/missing":
+			http.NotFound(w, req)
+			return
+		case "/flaky":
+			if atomic.AddInt32(&failures, 1) == 1 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		http.ServeContent(w, req, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+	requests := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		rs := ranges
+		ranges = nil
+		return rs
+	}
+	sum := checksum{"sha256", sha256Hex(data)}
+	ctx := context.Background()
+
+	// resumes from the partial file of the previous attempt
+	target := filepath.Join(dir, "resume", "data.bin")
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(target+partialSuffix, data[:4000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = download(ctx, ts.URL+"/data", target, sum, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rs := requests(); len(rs) != 1 || rs[0] != "bytes=4000-" {
+		t.Fatalf("expected a range request from 4000, got %q", rs)
+	}
+	got, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected %d bytes of the source, got %d", len(data), len(got))
+	}
+	if _, err = os.Stat(target + partialSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected partial file to be renamed, got %v", err)
+	}
+
+	// corrupted partial file is removed on checksum mismatch
+	target = filepath.Join(dir, "corrupted.bin")
+	if err = ioutil.WriteFile(target+partialSuffix, bytes.Repeat([]byte("x"), 4000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = download(ctx, ts.URL+"/data", target, sum, 3, nil); err == nil {
+		t.Fatal("expected checksum mismatch")
+	}
+	if rs := requests(); len(rs) != 1 {
+		t.Fatalf("expected no retries on checksum mismatch, got %q", rs)
+	}
+	if _, err = os.Stat(target + partialSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected corrupted partial file to be removed, got %v", err)
+	}
+
+	// permanent errors are not retried
+	err = download(ctx, ts.URL+"/missing", filepath.Join(dir, "missing.bin"), checksum{}, 3, nil)
+	if se, ok := err.(*urlutil.StatusError); !ok || se.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %v", err)
+	}
+	if rs := requests(); len(rs) != 1 {
+		t.Fatalf("expected no retries on 404, got %q", rs)
+	}
+
+	// transient errors are retried
+	target = filepath.Join(dir, "flaky.bin")
+	if err = download(ctx, ts.URL+"/flaky", target, sum, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rs := requests(); len(rs) != 2 {
+		t.Fatalf("expected a retry on 503, got %q", rs)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -20,142 +21,190 @@ func main() {
 	outputDirOverwrite := flag.Bool("output-dir-overwrite", false, "'true' to delete output directory before unarchive.")
 	smartRename := flag.Bool("smart-rename", false, "'true' to update redundant directory hierarchy.")
 	verbose := flag.Bool("verbose", false, "'true' to run with 'verbose' mode.")
+	checksumFlag := flag.String("checksum", "", "Specify the expected checksum of the target file (e.g. 'sha256:<hex>', 'md5:<hex>').")
+	retries := flag.Int("retries", 5, "Specify the number of retries on transient download failures (network errors, 5xx and 429).")
+	showProgress := flag.Bool("progress", true, "'true' to show the download progress bar.")
+	manifestPath := flag.String("manifest", "", "Specify the dataset manifest file path (overrides single dataset flags).")
+	lockPath := flag.String("lock-path", "", "Specify the lock file path to record resolved checksums (default: manifest path + '.lock').")
+	parallel := flag.Int("parallel", 0, "Specify the maximum number of concurrent downloads (overrides the manifest).")
 	flag.Parse()
 
-	size, sizet, err := urlutil.GetContentLength(*sourcePath)
-	if err != nil {
-		glog.Fatal(err)
+	opts := options{
+		retries:  *retries,
+		verbose:  *verbose,
+		progress: *showProgress,
 	}
-	glog.Infof("%q size is %s", *sourcePath, sizet)
 
-	needDownload := true
-	if fileutil.Exist(*targetPath) {
-		glog.Infof("%q exists, comparing the size", *targetPath)
-		fi, err := fileutil.GetFileInfo(*targetPath)
-		if err != nil {
-			glog.Fatal(err)
+	if *manifestPath != "" {
+		if *lockPath == "" {
+			*lockPath = *manifestPath + ".lock"
 		}
-		if fi.Size == size {
-			needDownload = false
-			glog.Infof("%q(%s) == %q(%s) (no need to download)", *sourcePath, sizet, *targetPath, fi.SizeTxt)
-		} else {
-			glog.Warningf("target file %q expected %d, source %q has %d", *targetPath, fi.Size, *sourcePath, size)
+		if err := runManifest(context.Background(), *manifestPath, *lockPath, *parallel, opts); err != nil {
+			glog.Fatal(err)
 		}
+		glog.Info("success!")
+		return
 	}
 
-	if needDownload {
-		glog.Infof("downloading %q to %q", *sourcePath, *targetPath)
-		data, err := urlutil.Get(urlutil.TrimQuery(*sourcePath))
-		if err != nil {
-			glog.Fatal(err)
+	d := dataset{
+		SourcePath:         *sourcePath,
+		TargetPath:         *targetPath,
+		Checksum:           *checksumFlag,
+		OutputDir:          *outputDir,
+		OutputDirOverwrite: *outputDirOverwrite,
+		SmartRename:        *smartRename,
+	}
+	if _, err := fetchDataset(context.Background(), d, checksum{}, opts); err != nil {
+		glog.Fatal(err)
+	}
+	glog.Info("success!")
+}
+
+type options struct {
+	retries  int
+	verbose  bool
+	progress bool
+}
+
+// fetchDataset downloads the dataset if not up-to-date, and unarchives it.
+// 'locked' is the checksum from the lock file, used when the dataset has no checksum.
+// It returns the verified checksum of the target file, if any.
+func fetchDataset(ctx context.Context, d dataset, locked checksum, opts options) (checksum, error) {
+	sum, err := parseChecksum(d.Checksum)
+	if err != nil {
+		return checksum{}, err
+	}
+	// the locked checksum only tells if the existing file is up-to-date,
+	// since the source may have changed since then
+	check := sum
+	if check.digest == "" {
+		check = locked
+	}
+
+	if upToDate(d.SourcePath, d.TargetPath, check) {
+		sum = check
+	} else {
+		var progress urlutil.ProgressFunc
+		var pb *progressBar
+		if opts.progress {
+			pb = newProgressBar(os.Stderr, filepath.Base(d.TargetPath))
+			progress = pb.update
 		}
-		if !fileutil.Exist(filepath.Dir(*targetPath)) {
-			if err = fileutil.TouchDirAll(filepath.Dir(*targetPath)); err != nil {
-				glog.Fatal(err)
-			}
+		err = download(ctx, d.SourcePath, d.TargetPath, sum, opts.retries, progress)
+		if pb != nil {
+			pb.done()
 		}
-		if err = fileutil.WriteToFile(*targetPath, data); err != nil {
-			glog.Fatal(err)
+		if err != nil {
+			return checksum{}, err
 		}
-		glog.Infof("downloaded %q to %q", *sourcePath, *targetPath)
+		glog.Infof("downloaded %q to %q", d.SourcePath, d.TargetPath)
 	}
 
+	if err = unarchive(d.TargetPath, d.OutputDir, d.OutputDirOverwrite, d.SmartRename, opts.verbose); err != nil {
+		return checksum{}, err
+	}
+	return sum, nil
+}
+
+func unarchive(targetPath, outputDir string, outputDirOverwrite, smartRename, verbose bool) error {
 	var ff archiver.Archiver
 	for _, format := range archiver.SupportedFormats {
-		if format.Match(*targetPath) {
+		if format.Match(targetPath) {
 			ff = format
 			break
 		}
 	}
+	if ff == nil {
+		glog.Infof("no need to unarchive %q", targetPath)
+		return nil
+	}
 
-	if ff != nil {
-		parentDir := filepath.Dir(*outputDir)
-		if !fileutil.Exist(parentDir) {
-			glog.Infof("creating %q", parentDir)
-			if err := fileutil.TouchDirAll(parentDir); err != nil {
-				glog.Fatal(err)
-			}
-			glog.Infof("created %q", parentDir)
+	parentDir := filepath.Dir(outputDir)
+	if !fileutil.Exist(parentDir) {
+		glog.Infof("creating %q", parentDir)
+		if err := fileutil.TouchDirAll(parentDir); err != nil {
+			return err
 		}
+		glog.Infof("created %q", parentDir)
+	}
 
-		if *outputDirOverwrite && fileutil.Exist(*outputDir) {
-			glog.Infof("deleting %q", *outputDir)
-			os.RemoveAll(*outputDir)
-			glog.Infof("deleted %q", *outputDir)
-		}
+	if outputDirOverwrite && fileutil.Exist(outputDir) {
+		glog.Infof("deleting %q", outputDir)
+		os.RemoveAll(outputDir)
+		glog.Infof("deleted %q", outputDir)
+	}
+
+	if fileutil.Exist(outputDir) {
+		return nil
+	}
 
-		if !fileutil.Exist(*outputDir) {
-			glog.Infof("unarchiving %q", *targetPath)
-			var opts []archiver.OpOption
-			if *verbose {
-				opts = append(opts, archiver.WithVerbose())
+	glog.Infof("unarchiving %q", targetPath)
+	var opts []archiver.OpOption
+	if verbose {
+		opts = append(opts, archiver.WithVerbose())
+	}
+	if err := ff.Open(targetPath, outputDir, opts...); err != nil {
+		return err
+	}
+	glog.Infof("unarchived %q", targetPath)
+
+	if smartRename {
+		glog.Infof("parent directory: %q (base %s)", parentDir, filepath.Base(parentDir))
+		glog.Infof("output directory: %q (base %s)", outputDir, filepath.Base(outputDir))
+		dirs, err := fileutil.WalkDirectories(outputDir)
+		if err != nil {
+			return err
+		}
+		if len(dirs) == 0 {
+			return fmt.Errorf("got no contents in %q (%v)", outputDir, dirs)
+		}
+		lvl1Cnt := 0
+		var lvl1 fileutil.FileInfo
+		for _, d := range dirs {
+			if d.Level == 0 {
+				continue
 			}
-			if err := ff.Open(*targetPath, *outputDir, opts...); err != nil {
-				glog.Fatal(err)
+			if d.Level == 1 {
+				lvl1Cnt++
+				lvl1 = d
 			}
-			glog.Infof("unarchived %q", *targetPath)
-
-			if *smartRename {
-				glog.Infof("parent directory: %q (base %s)", parentDir, filepath.Base(parentDir))
-				glog.Infof("output directory: %q (base %s)", *outputDir, filepath.Base(*outputDir))
-				dirs, err := fileutil.WalkDirectories(*outputDir)
-				if err != nil {
-					glog.Fatal(err)
-				}
-				if len(dirs) == 0 {
-					glog.Fatalf("got no contents in %q (%v)", *outputDir, dirs)
-				}
-				lvl1Cnt := 0
-				var lvl1 fileutil.FileInfo
-				for _, d := range dirs {
-					if d.Level == 0 {
-						continue
-					}
-					if d.Level == 1 {
-						lvl1Cnt++
-						lvl1 = d
-					}
-				}
-				if lvl1Cnt == 1 {
-					glog.Infof("found redundancy... cleaning up... %+v", lvl1)
-
-					tmpPath := *outputDir + ".tmp"
-					glog.Infof("renaming %q to %q", lvl1.Path, tmpPath)
-					if err = os.Rename(lvl1.Path, tmpPath); err != nil {
-						glog.Fatal(err)
-					}
-					glog.Infof("renamed %q to %q", lvl1.Path, tmpPath)
-
-					glog.Infof("removing %q", *outputDir)
-					if err = os.RemoveAll(*outputDir); err != nil {
-						glog.Fatal(err)
-					}
-					glog.Infof("removed %q", *outputDir)
-
-					glog.Infof("renaming %q to %q", tmpPath, *outputDir)
-					if err = os.Rename(tmpPath, *outputDir); err != nil {
-						glog.Fatal(err)
-					}
-					glog.Infof("renamed %q to %q", tmpPath, *outputDir)
-
-					glog.Infof("updated to %q", *outputDir)
-				}
+		}
+		if lvl1Cnt == 1 {
+			glog.Infof("found redundancy... cleaning up... %+v", lvl1)
+
+			tmpPath := outputDir + ".tmp"
+			glog.Infof("renaming %q to %q", lvl1.Path, tmpPath)
+			if err = os.Rename(lvl1.Path, tmpPath); err != nil {
+				return err
+			}
+			glog.Infof("renamed %q to %q", lvl1.Path, tmpPath)
+
+			glog.Infof("removing %q", outputDir)
+			if err = os.RemoveAll(outputDir); err != nil {
+				return err
 			}
-			if *verbose {
-				glog.Infof("%q:", *outputDir)
-				fis, err := fileutil.WalkFiles(*outputDir)
-				if err != nil {
-					glog.Fatal(err)
-				}
-				for _, v := range fis {
-					fmt.Printf("%q : %s\n", v.Path, v.SizeTxt)
-				}
+			glog.Infof("removed %q", outputDir)
+
+			glog.Infof("renaming %q to %q", tmpPath, outputDir)
+			if err = os.Rename(tmpPath, outputDir); err != nil {
+				return err
 			}
+			glog.Infof("renamed %q to %q", tmpPath, outputDir)
+
+			glog.Infof("updated to %q", outputDir)
 		}
-	} else {
-		glog.Infof("no need to unarchive %q", *targetPath)
 	}
-	glog.Info("success!")
+	if verbose {
+		glog.Infof("%q:", outputDir)
+		fis, err := fileutil.WalkFiles(outputDir)
+		if err != nil {
+			return err
+		}
+		for _, v := range fis {
+			fmt.Printf("%q : %s\n", v.Path, v.SizeTxt)
+		}
+	}
+	return nil
 }
 
 /*
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gyuho/dplearn/pkg/fileutil"
+
+	"github.com/golang/glog"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// manifest lists the datasets to download.
+type manifest struct {
+	// Parallel is the maximum number of concurrent downloads.
+	Parallel int       `yaml:"parallel"`
+	Datasets []dataset `yaml:"datasets"`
+}
+
+// dataset defines a single dataset, equivalent to the command-line flags.
+type dataset struct {
+	SourcePath         string `yaml:"source-path"`
+	TargetPath         string `yaml:"target-path"`
+	Checksum           string `yaml:"checksum"`
+	OutputDir          string `yaml:"output-dir"`
+	OutputDirOverwrite bool   `yaml:"output-dir-overwrite"`
+	SmartRename        bool   `yaml:"smart-rename"`
+}
+
+// readManifest reads the manifest, expanding environment variables in paths.
+func readManifest(p string) (manifest, error) {
+	bts, err := ioutil.ReadFile(p)
+	if err != nil {
+		return manifest{}, err
+	}
+	var m manifest
+	if err = yaml.Unmarshal(bts, &m); err != nil {
+		return manifest{}, err
+	}
+
+	targets := make(map[string]struct{})
+	for i := range m.Datasets {
+		d := &m.Datasets[i]
+		d.SourcePath = os.ExpandEnv(d.SourcePath)
+		d.TargetPath = os.ExpandEnv(d.TargetPath)
+		d.OutputDir = os.ExpandEnv(d.OutputDir)
+		if d.SourcePath == "" || d.TargetPath == "" {
+			return manifest{}, fmt.Errorf("dataset #%d has empty source-path or target-path", i)
+		}
+		if _, ok := targets[d.TargetPath]; ok {
+			return manifest{}, fmt.Errorf("duplicate target-path %q", d.TargetPath)
+		}
+		targets[d.TargetPath] = struct{}{}
+		if _, err = parseChecksum(d.Checksum); err != nil {
+			return manifest{}, fmt.Errorf("dataset %q has invalid checksum (%v)", d.TargetPath, err)
+		}
+	}
+	return m, nil
+}
+
+// lockFile records the resolved checksums of downloaded datasets.
+type lockFile struct {
+	Updated  string         `yaml:"updated"`
+	Datasets []lockedObject `yaml:"datasets"`
+}
+
+type lockedObject struct {
+	SourcePath string `yaml:"source-path"`
+	TargetPath string `yaml:"target-path"`
+	Checksum   string `yaml:"checksum"`
+	Size       uint64 `yaml:"size"`
+	// ModTime is the modification time of the target file in RFC3339,
+	// to tell if the file has changed without hashing it.
+	ModTime string `yaml:"mod-time,omitempty"`
+}
+
+// unchanged returns true if the target file has the same size and
+// modification time as when it was locked.
+func (lo lockedObject) unchanged() bool {
+	if lo.ModTime == "" {
+		return false
+	}
+	fi, err := os.Stat(lo.TargetPath)
+	if err != nil {
+		return false
+	}
+	return uint64(fi.Size()) == lo.Size && fi.ModTime().UTC().Format(time.RFC3339Nano) == lo.ModTime
+}
+
+func readLockFile(p string) (lockFile, error) {
+	var lf lockFile
+	if !fileutil.Exist(p) {
+		return lf, nil
+	}
+	bts, err := ioutil.ReadFile(p)
+	if err != nil {
+		return lf, err
+	}
+	err = yaml.Unmarshal(bts, &lf)
+	return lf, err
+}
+
+func writeLockFile(p string, lf lockFile) error {
+	sort.Slice(lf.Datasets, func(i, j int) bool {
+		return lf.Datasets[i].TargetPath < lf.Datasets[j].TargetPath
+	})
+	bts, err := yaml.Marshal(lf)
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteToFile(p, bts)
+}
+
+// runManifest downloads datasets in the manifest concurrently, and records
+// their checksums in the lock file. A target file unchanged since locked
+// is not hashed again. Otherwise, an entry without checksum is verified
+// against the checksum in the lock file, if its source has not changed.
+func runManifest(ctx context.Context, manifestPath, lockPath string, parallel int, opts options) error {
+	m, err := readManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	lf, err := readLockFile(lockPath)
+	if err != nil {
+		return err
+	}
+	locked := make(map[string]lockedObject, len(lf.Datasets))
+	for _, lo := range lf.Datasets {
+		locked[lo.TargetPath] = lo
+	}
+
+	if parallel <= 0 {
+		parallel = m.Parallel
+	}
+	if parallel <= 0 {
+		parallel = 1
+	}
+	if parallel > 1 {
+		// concurrent progress bars would overwrite each other
+		opts.progress = false
+	}
+	glog.Infof("downloading %d datasets in %q (parallel %d)", len(m.Datasets), manifestPath, parallel)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+		sema = make(chan struct{}, parallel)
+	)
+	for _, d := range m.Datasets {
+		wg.Add(1)
+		go func(d dataset) {
+			defer wg.Done()
+			sema <- struct{}{}
+			defer func() { <-sema }()
+
+			var prev *lockedObject
+			mu.Lock()
+			if lo, ok := locked[d.TargetPath]; ok && lo.SourcePath == d.SourcePath {
+				prev = &lo
+			}
+			mu.Unlock()
+			lo, err := fetchLocked(ctx, d, prev, opts)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				glog.Warningf("failed to fetch %q (%v)", d.SourcePath, err)
+				errs = append(errs, fmt.Sprintf("%q: %v", d.TargetPath, err))
+				return
+			}
+			locked[d.TargetPath] = lo
+		}(d)
+	}
+	wg.Wait()
+
+	// keep the previous entries of failed datasets
+	lf = lockFile{Updated: time.Now().UTC().Format(time.RFC3339)}
+	for _, d := range m.Datasets {
+		if lo, ok := locked[d.TargetPath]; ok {
+			lf.Datasets = append(lf.Datasets, lo)
+		}
+	}
+	if err = writeLockFile(lockPath, lf); err != nil {
+		return err
+	}
+	glog.Infof("wrote %q", lockPath)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to fetch %d dataset(s): %v", len(errs), errs)
+	}
+	return nil
+}
+
+// fetchLocked fetches the dataset, and resolves its SHA-256 checksum.
+// 'prev' is the entry of the same source in the lock file, or nil.
+func fetchLocked(ctx context.Context, d dataset, prev *lockedObject, opts options) (lockedObject, error) {
+	var lockedSum checksum
+	if prev != nil {
+		lockedSum, _ = parseChecksum(prev.Checksum)
+		if sum, err := parseChecksum(d.Checksum); err == nil && (sum.digest == "" || sum == lockedSum) && prev.unchanged() {
+			glog.Infof("%q is unchanged since locked (no need to download)", d.TargetPath)
+			if err = unarchive(d.TargetPath, d.OutputDir, d.OutputDirOverwrite, d.SmartRename, opts.verbose); err != nil {
+				return lockedObject{}, err
+			}
+			return *prev, nil
+		}
+	}
+
+	sum, err := fetchDataset(ctx, d, lockedSum, opts)
+	if err != nil {
+		return lockedObject{}, err
+	}
+	if sum.algo != "sha256" {
+		sum.algo = "sha256"
+		if sum.digest, err = fileDigest(d.TargetPath, sum.algo); err != nil {
+			return lockedObject{}, err
+		}
+	}
+	fi, err := os.Stat(d.TargetPath)
+	if err != nil {
+		return lockedObject{}, err
+	}
+	return lockedObject{
+		SourcePath: d.SourcePath,
+		TargetPath: d.TargetPath,
+		Checksum:   sum.String(),
+		Size:       uint64(fi.Size()),
+		ModTime:    fi.ModTime().UTC().Format(time.RFC3339Nano),
+	}, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func TestReadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("DOWNLOAD_DATA_TEST_DIR", dir)
+	defer os.Unsetenv("DOWNLOAD_DATA_TEST_DIR")
+
+	sum := sha256Hex([]byte("hello"))
+	tests := []struct {
+		data string
+		ok   bool
+	}{
+		{`parallel: 2
+datasets:
+- source-path: https://example.com/a.tar.gz
+  target-path: ${DOWNLOAD_DATA_TEST_DIR}/a.tar.gz
+  output-dir: ${DOWNLOAD_DATA_TEST_DIR}/a
+  checksum: sha256:` + sum + `
+- source-path: https://example.com/b.zip
+  target-path: ${DOWNLOAD_DATA_TEST_DIR}/b.zip
+`, true},
+		{`datasets:
+- source-path: https://example.com/a.tar.gz
+  target-path: /tmp/a.tar.gz
+- source-path: https://example.com/b.tar.gz
+  target-path: /tmp/a.tar.gz
+`, false},
+		{`datasets:
+- source-path: https://example.com/a.tar.gz
+  target-path: /tmp/a.tar.gz
+  checksum: sha256:1234
+`, false},
+		{`datasets:
+- source-path: https://example.com/a.tar.gz
+  target-path: /tmp/a.tar.gz
+  checksum: sha1:` + sum + `
+`, false},
+		{`datasets:
+- source-path: https://example.com/a.tar.gz
+`, false},
+		{`datasets: [`, false},
+	}
+	for i, tt := range tests {
+		p := filepath.Join(dir, "manifest.yaml")
+		if err = ioutil.WriteFile(p, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := readManifest(p)
+		if (err == nil) != tt.ok {
+			t.Fatalf("#%d: expected ok %v, got %v", i, tt.ok, err)
+		}
+		if !tt.ok {
+			continue
+		}
+		exp := manifest{
+			Parallel: 2,
+			Datasets: []dataset{
+				{SourcePath: "https://example.com/a.tar.gz", TargetPath: dir + "/a.tar.gz", OutputDir: dir + "/a", Checksum: "sha256:" + sum},
+				{SourcePath: "https://example.com/b.zip", TargetPath: dir + "/b.zip"},
+			},
+		}
+		if !reflect.DeepEqual(m, exp) {
+			t.Fatalf("#%d: expected %+v, got %+v", i, exp, m)
+		}
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "manifest.yaml.lock")
+
+	lf, err := readLockFile(p)
+	if err != nil || len(lf.Datasets) != 0 {
+		t.Fatalf("expected empty lock file, got %+v (%v)", lf, err)
+	}
+	lf = lockFile{
+		Updated: "2017-11-01T00:00:00Z",
+		Datasets: []lockedObject{
+			{SourcePath: "https://example.com/b", TargetPath: "/tmp/b", Checksum: "sha256:" + sha256Hex(nil), Size: 2},
+			{SourcePath: "https://example.com/a", TargetPath: "/tmp/a", Checksum: "sha256:" + sha256Hex(nil), Size: 1, ModTime: "2017-11-01T00:00:00.5Z"},
+		},
+	}
+	if err = writeLockFile(p, lf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readLockFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Datasets[0].TargetPath != "/tmp/a" {
+		t.Fatalf("expected datasets sorted by target path, got %+v", got)
+	}
+	if !reflect.DeepEqual(got, lf) {
+		t.Fatalf("expected %+v, got %+v", lf, got)
+	}
+}
+
+func TestRunManifest(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "run-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		"/a.txt": bytes.Repeat([]byte("a"), 1000),
+		"/b.txt": bytes.Repeat([]byte("b"), 2000),
+	}
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		data, ok := files[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		http.ServeContent(w, req, req.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+
+	manifestPath, lockPath := filepath.Join(dir, "manifest.yaml"), filepath.Join(dir, "manifest.yaml.lock")
+	targetA, targetB := filepath.Join(dir, "data", "a.txt"), filepath.Join(dir, "data", "b.txt")
+	if err = ioutil.WriteFile(manifestPath, []byte(`parallel: 2
+datasets:
+- source-path: `+ts.URL+`/a.txt
+  target-path: `+targetA+`
+  checksum: sha256:`+sha256Hex(files["/a.txt"])+`
+- source-path: `+ts.URL+`/b.txt
+  target-path: `+targetB+`
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run := func() (lockFile, int32) {
+		atomic.StoreInt32(&requests, 0)
+		if err := runManifest(context.Background(), manifestPath, lockPath, 0, options{}); err != nil {
+			t.Fatal(err)
+		}
+		lf, err := readLockFile(lockPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lf, atomic.LoadInt32(&requests)
+	}
+
+	lf, n := run()
+	if n == 0 || len(lf.Datasets) != 2 {
+		t.Fatalf("expected downloads and 2 locked datasets, got %d requests %+v", n, lf)
+	}
+	for i, path := range []string{"/a.txt", "/b.txt"} {
+		lo := lf.Datasets[i]
+		if lo.Checksum != "sha256:"+sha256Hex(files[path]) || lo.Size != uint64(len(files[path])) || lo.ModTime == "" {
+			t.Fatalf("#%d: unexpected locked dataset %+v", i, lo)
+		}
+	}
+
+	// unchanged targets are neither downloaded nor hashed
+	if _, n = run(); n != 0 {
+		t.Fatalf("expected no requests for unchanged targets, got %d", n)
+	}
+	fi, err := os.Stat(targetB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(targetB, bytes.Repeat([]byte("x"), 2000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(targetB, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if _, n = run(); n != 0 {
+		t.Fatalf("expected no requests with the same size and modification time, got %d", n)
+	}
+
+	// modified target is verified against the locked checksum, and downloaded again
+	later := fi.ModTime().Add(time.Minute)
+	if err = os.Chtimes(targetB, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if lf, n = run(); n == 0 {
+		t.Fatal("expected download of modified target")
+	}
+	data, err := ioutil.ReadFile(targetB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, files["/b.txt"]) {
+		t.Fatalf("expected the source contents, got %q...", data[:10])
+	}
+	if lf.Datasets[1].Checksum != "sha256:"+sha256Hex(files["/b.txt"]) {
+		t.Fatalf("unexpected locked dataset %+v", lf.Datasets[1])
+	}
+
+	// failed dataset keeps its previous entry
+	if err = ioutil.WriteFile(manifestPath, []byte(`datasets:
+- source-path: `+ts.URL+`/a.txt
+  target-path: `+targetA+`
+- source-path: `+ts.URL+`/missing.txt
+  target-path: `+filepath.Join(dir, "data", "missing.txt")+`
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = runManifest(context.Background(), manifestPath, lockPath, 1, options{})
+	if err == nil || !strings.Contains(err.Error(), "missing.txt") {
+		t.Fatalf("expected error of missing dataset, got %v", err)
+	}
+	if lf, err = readLockFile(lockPath); err != nil || len(lf.Datasets) != 1 {
+		t.Fatalf("expected the locked dataset of a.txt, got %+v (%v)", lf, err)
+	}
+}
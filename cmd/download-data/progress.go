@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// progressBar renders download progress in a single terminal line.
+type progressBar struct {
+	mu       sync.Mutex
+	w        io.Writer
+	name     string
+	width    int
+	interval time.Duration
+	last     time.Time
+	started  time.Time
+}
+
+func newProgressBar(w io.Writer, name string) *progressBar {
+	return &progressBar{
+		w:        w,
+		name:     name,
+		width:    40,
+		interval: 200 * time.Millisecond,
+		started:  time.Now(),
+	}
+}
+
+// update implements 'urlutil.ProgressFunc'.
+func (pb *progressBar) update(written, total int64) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(pb.last) < pb.interval && written != total {
+		return
+	}
+	pb.last = now
+
+	rate := ""
+	if sec := now.Sub(pb.started).Seconds(); sec > 0 {
+		rate = humanize.Bytes(uint64(float64(written)/sec)) + "/s"
+	}
+
+	if total <= 0 {
+		fmt.Fprintf(pb.w, "\r%s %s %s", pb.name, humanize.Bytes(uint64(written)), rate)
+		return
+	}
+	filled := int(float64(pb.width) * float64(written) / float64(total))
+	if filled > pb.width {
+		filled = pb.width
+	}
+	fmt.Fprintf(pb.w, "\r%s [%s%s] %3d%% %s / %s %s",
+		pb.name,
+		strings.Repeat("=", filled),
+		strings.Repeat(" ", pb.width-filled),
+		100*written/total,
+		humanize.Bytes(uint64(written)),
+		humanize.Bytes(uint64(total)),
+		rate,
+	)
+}
+
+// done ends the progress line.
+func (pb *progressBar) done() {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	fmt.Fprintln(pb.w)
+}
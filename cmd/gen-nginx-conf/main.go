@@ -17,11 +17,13 @@ import (
 func main() {
 	outputPath := flag.String("output", "nginx.conf", "Specify nginx.conf output file path.")
 	targetPort := flag.Int("target-port", 4200, "Specify target host port to proxy requests to.")
+	backendPort := flag.Int("backend-port", 2200, "Specify backend host port to proxy '/readyz' and '/livez' checks to.")
 	flag.Parse()
 
 	cfg := configuration{
-		ServerName: "dplearn.com",
-		TargetPort: *targetPort,
+		ServerName:  "dplearn.com",
+		TargetPort:  *targetPort,
+		BackendPort: *backendPort,
 	}
 
 	bts, err := gcp.GetComputeMetadata("instance/network-interfaces/0/access-configs/0/external-ip", 3, 300*time.Millisecond)
@@ -61,8 +63,9 @@ func main() {
 }
 
 type configuration struct {
-	ServerName string
-	TargetPort int
+	ServerName  string
+	TargetPort  int
+	BackendPort int
 }
 
 const tmplNginxConf = `server {
@@ -83,5 +86,13 @@ const tmplNginxConf = `server {
 		proxy_set_header X-Forwarded-For $remote_addr;
 		proxy_pass http://127.0.0.1:{{.TargetPort}};
 	}
+
+	# health checks of load balancers, answered by backend
+	location ~ ^/(readyz|livez)$ {
+		access_log off;
+		proxy_connect_timeout 2s;
+		proxy_read_timeout 5s;
+		proxy_pass http://127.0.0.1:{{.BackendPort}};
+	}
 }
 `
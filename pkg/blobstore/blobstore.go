@@ -0,0 +1,252 @@
+// Package blobstore implements content-addressed on-disk file store.
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gyuho/dplearn/pkg/fileutil"
+
+	"github.com/golang/glog"
+)
+
+// ErrBlobNotFound is returned when the digest is not found in the store.
+var ErrBlobNotFound = fmt.Errorf("blobstore: blob not found")
+
+// Blob represents a file stored in the store.
+type Blob struct {
+	// Digest is the hex-encoded SHA-256 digest of the file contents.
+	Digest string
+	// Path is the file path on disk.
+	Path string
+	// Size is the file size in bytes.
+	Size uint64
+}
+
+type entry struct {
+	blob Blob
+	refs int
+}
+
+// Store stores files by the SHA-256 digest of their contents, under
+// sharded subdirectories (e.g. "<dir>/ab/abcdef....jpeg"). The same
+// contents are stored only once, and reference-counted. A file is removed
+// when its last reference is released. Reference counts are kept in memory,
+// so files of the previous process are removed on 'New'.
+type Store struct {
+	mu      sync.Mutex
+	dir     string
+	entries map[string]*entry
+}
+
+const tmpDir = ".tmp"
+
+// New creates a store under the directory 'dir', creating one if not exists.
+// Blobs left in the directory are removed, since their references are lost
+// on restart and they would never be released.
+func New(dir string) (*Store, error) {
+	if err := fileutil.TouchDirAll(filepath.Join(dir, tmpDir)); err != nil {
+		return nil, err
+	}
+	if err := sweep(dir); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, entries: make(map[string]*entry)}, nil
+}
+
+// sweep removes temporary files and blobs under the directory. Files
+// not named by their digest are kept, in case the directory is shared.
+func sweep(dir string) error {
+	tmps, err := ioutil.ReadDir(filepath.Join(dir, tmpDir))
+	if err != nil {
+		return err
+	}
+	for _, fi := range tmps {
+		if err = os.RemoveAll(filepath.Join(dir, tmpDir, fi.Name())); err != nil {
+			return err
+		}
+	}
+
+	shards, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, shard := range shards {
+		if !shard.IsDir() || len(shard.Name()) != 2 || !isHex(shard.Name()) {
+			continue
+		}
+		shardDir := filepath.Join(dir, shard.Name())
+		fs, err := ioutil.ReadDir(shardDir)
+		if err != nil {
+			return err
+		}
+		left := len(fs)
+		for _, fi := range fs {
+			digest := strings.TrimSuffix(fi.Name(), filepath.Ext(fi.Name()))
+			if fi.IsDir() || len(digest) != 2*sha256.Size || !isHex(digest) || !strings.HasPrefix(digest, shard.Name()) {
+				continue
+			}
+			if err = os.Remove(filepath.Join(shardDir, fi.Name())); err != nil {
+				return err
+			}
+			left--
+			removed++
+		}
+		if left == 0 {
+			os.Remove(shardDir)
+		}
+	}
+	if removed > 0 {
+		glog.Infof("blobstore: removed %d blobs left in %q", removed, dir)
+	}
+	return nil
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Dir returns the root directory of the store.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Put writes the contents of 'r' to the store, with the file extension
+// 'ext' (e.g. ".jpeg"). If the same contents already exist, it increments the
+// reference count and returns the existing blob.
+func (s *Store) Put(r io.Reader, ext string) (Blob, error) {
+	f, err := ioutil.TempFile(filepath.Join(s.dir, tmpDir), "blob")
+	if err != nil {
+		return Blob{}, err
+	}
+	tmpPath := f.Name()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return Blob{}, err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if et, ok := s.entries[digest]; ok {
+		os.Remove(tmpPath)
+		et.refs++
+		return et.blob, nil
+	}
+
+	shardDir := filepath.Join(s.dir, digest[:2])
+	if err = fileutil.TouchDirAll(shardDir); err != nil {
+		os.Remove(tmpPath)
+		return Blob{}, err
+	}
+	blob := Blob{
+		Digest: digest,
+		Path:   filepath.Join(shardDir, digest+cleanExt(ext)),
+		Size:   uint64(n),
+	}
+	if err = os.Rename(tmpPath, blob.Path); err != nil {
+		os.Remove(tmpPath)
+		return Blob{}, err
+	}
+	s.entries[digest] = &entry{blob: blob, refs: 1}
+	glog.Infof("blobstore: stored %q", blob.Path)
+	return blob, nil
+}
+
+// Get returns the blob of the digest, or 'ErrBlobNotFound'.
+func (s *Store) Get(digest string) (Blob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	et, ok := s.entries[digest]
+	if !ok {
+		return Blob{}, ErrBlobNotFound
+	}
+	return et.blob, nil
+}
+
+// Acquire increments the reference count of the digest.
+func (s *Store) Acquire(digest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	et, ok := s.entries[digest]
+	if !ok {
+		return ErrBlobNotFound
+	}
+	et.refs++
+	return nil
+}
+
+// Release decrements the reference count of the digest,
+// and removes the file when there is no reference left.
+func (s *Store) Release(digest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	et, ok := s.entries[digest]
+	if !ok {
+		return ErrBlobNotFound
+	}
+	et.refs--
+	if et.refs > 0 {
+		return nil
+	}
+
+	delete(s.entries, digest)
+	if err := os.Remove(et.blob.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	glog.Infof("blobstore: removed %q", et.blob.Path)
+	return nil
+}
+
+// Refs returns the reference count of the digest.
+func (s *Store) Refs(digest string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	et, ok := s.entries[digest]
+	if !ok {
+		return 0
+	}
+	return et.refs
+}
+
+// cleanExt returns the extension only if it is short and alphanumeric,
+// so that user-supplied names never end up in the file path.
+func cleanExt(ext string) string {
+	ext = strings.ToLower(ext)
+	if len(ext) < 2 || len(ext) > 8 || ext[0] != '.' {
+		return ""
+	}
+	for _, c := range ext[1:] {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return ""
+		}
+	}
+	return ext
+}
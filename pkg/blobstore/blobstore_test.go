@@ -0,0 +1,140 @@
+package blobstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gyuho/dplearn/pkg/fileutil"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b1, err := s.Put(strings.NewReader("hello"), ".jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if b1.Digest != exp {
+		t.Fatalf("expected digest %q, got %q", exp, b1.Digest)
+	}
+	if b1.Path != filepath.Join(dir, "2c", exp+".jpeg") {
+		t.Fatalf("unexpected path %q", b1.Path)
+	}
+	if b1.Size != 5 {
+		t.Fatalf("expected size 5, got %d", b1.Size)
+	}
+
+	// same contents from a different source
+	b2, err := s.Put(strings.NewReader("hello"), ".png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b1 != b2 {
+		t.Fatalf("expected %+v, got %+v", b1, b2)
+	}
+	if n := s.Refs(b1.Digest); n != 2 {
+		t.Fatalf("expected 2 references, got %d", n)
+	}
+
+	if err = s.Release(b1.Digest); err != nil {
+		t.Fatal(err)
+	}
+	if !fileutil.Exist(b1.Path) {
+		t.Fatalf("%q should exist with 1 reference left", b1.Path)
+	}
+	if err = s.Release(b1.Digest); err != nil {
+		t.Fatal(err)
+	}
+	if fileutil.Exist(b1.Path) {
+		t.Fatalf("%q should have been removed", b1.Path)
+	}
+	if _, err = s.Get(b1.Digest); err != ErrBlobNotFound {
+		t.Fatalf("expected %v, got %v", ErrBlobNotFound, err)
+	}
+	if err = s.Release(b1.Digest); err != ErrBlobNotFound {
+		t.Fatalf("expected %v, got %v", ErrBlobNotFound, err)
+	}
+
+	names, err := fileutil.ReadDir(filepath.Join(dir, tmpDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Fatalf("expected no temporary files, got %v", names)
+	}
+}
+
+func TestStoreRestart(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Put(strings.NewReader("hello"), ".jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "2c", "other.txt")
+	if err = ioutil.WriteFile(other, []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, tmpDir, "blob123"), []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// references of the previous store are lost
+	if _, err = New(dir); err != nil {
+		t.Fatal(err)
+	}
+	if fileutil.Exist(b.Path) {
+		t.Fatalf("%q should have been removed on restart", b.Path)
+	}
+	if !fileutil.Exist(other) {
+		t.Fatalf("%q should be kept", other)
+	}
+	names, err := fileutil.ReadDir(filepath.Join(dir, tmpDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Fatalf("expected no temporary files, got %v", names)
+	}
+}
+
+func Test_cleanExt(t *testing.T) {
+	tests := []struct {
+		ext string
+		exp string
+	}{
+		{".jpeg", ".jpeg"},
+		{".PNG", ".png"},
+		{"", ""},
+		{".", ""},
+		{"jpeg", ""},
+		{".jp/../eg", ""},
+		{".toolongext", ""},
+	}
+	for i, tt := range tests {
+		if v := cleanExt(tt.ext); v != tt.exp {
+			t.Fatalf("#%d: expected %q, got %q", i, tt.exp, v)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Package cats implements the forward propagation of the L-layer cat
+// classifier trained by 'backend/worker/cats', in pure Go.
+package cats
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+
+	"github.com/gyuho/dplearn/pkg/npy"
+
+	// register image decoders for 'image.Decode'
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// NumPx is the width and height of input images.
+const NumPx = 64
+
+// InputSize is the size of input vectors (64x64 RGB pixels).
+const InputSize = NumPx * NumPx * 3
+
+// Classes are the labels of the predictions 0 and 1.
+var Classes = [2]string{"non-cat", "cat"}
+
+// matrix is a row-major 2-dimensional array.
+type matrix struct {
+	rows, cols int
+	data       []float64
+}
+
+// Parameters are the weights and biases of the L-layer network:
+// [LINEAR->RELU]*(L-1)->LINEAR->SIGMOID.
+type Parameters struct {
+	w []matrix // W1, W2, ..., WL
+	b []matrix // b1, b2, ..., bL
+}
+
+// Layers returns the number of layers.
+func (p *Parameters) Layers() int { return len(p.w) }
+
+// LoadParameters loads the parameters from the '.npy' file, saved by
+// 'np.save(path, parameters)' with keys "W1", "b1", ..., "WL", "bL",
+// or from the '.npz' file of the same keys.
+func LoadParameters(fpath string) (*Parameters, error) {
+	if filepath.Ext(fpath) == ".npz" {
+		d, err := npy.ReadNPZ(fpath)
+		if err != nil {
+			return nil, err
+		}
+		return NewParameters(d)
+	}
+	arr, err := npy.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	d, err := arr.Dict()
+	if err != nil {
+		return nil, err
+	}
+	return NewParameters(d)
+}
+
+// NewParameters returns the parameters of the arrays
+// with keys "W1", "b1", ..., "WL", "bL".
+func NewParameters(d map[string]*npy.Array) (*Parameters, error) {
+	p := &Parameters{}
+	for l := 1; ; l++ {
+		wa, wok := d[fmt.Sprintf("W%d", l)]
+		ba, bok := d[fmt.Sprintf("b%d", l)]
+		if !wok && !bok {
+			break
+		}
+		if !wok || !bok {
+			return nil, fmt.Errorf("cats: layer %d has no weights or bias", l)
+		}
+		w, err := toMatrix(wa)
+		if err != nil {
+			return nil, fmt.Errorf("cats: W%d %v", l, err)
+		}
+		b, err := toMatrix(ba)
+		if err != nil {
+			return nil, fmt.Errorf("cats: b%d %v", l, err)
+		}
+		p.w, p.b = append(p.w, w), append(p.b, b)
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Parameters) validate() error {
+	if len(p.w) == 0 {
+		return fmt.Errorf("cats: no layer found")
+	}
+	prev := InputSize
+	for i := range p.w {
+		w, b := p.w[i], p.b[i]
+		if w.cols != prev || b.rows != w.rows || b.cols != 1 {
+			return fmt.Errorf("cats: layer %d has unexpected shape W %dx%d, b %dx%d (input %d)", i+1, w.rows, w.cols, b.rows, b.cols, prev)
+		}
+		prev = w.rows
+	}
+	if prev != 1 {
+		return fmt.Errorf("cats: output layer has %d units, expected 1", prev)
+	}
+	return nil
+}
+
+func toMatrix(a *npy.Array) (matrix, error) {
+	if len(a.Shape) != 2 {
+		return matrix{}, fmt.Errorf("expected 2-d array, got shape %v", a.Shape)
+	}
+	vs, err := a.Float64s()
+	if err != nil {
+		return matrix{}, err
+	}
+	return matrix{rows: a.Shape[0], cols: a.Shape[1], data: vs}, nil
+}
+
+// Forward returns the probability that the input vector is a cat.
+// The input is 64x64x3 pixels, flattened in (row, column, channel) order.
+func (p *Parameters) Forward(x []float64) (float64, error) {
+	if len(x) != InputSize {
+		return 0, fmt.Errorf("cats: expected input size %d, got %d", InputSize, len(x))
+	}
+	a := x
+	for l := range p.w {
+		w, b := p.w[l], p.b[l]
+		z := make([]float64, w.rows)
+		for i := 0; i < w.rows; i++ {
+			row := w.data[i*w.cols : (i+1)*w.cols]
+			s := b.data[i]
+			for j, v := range row {
+				s += v * a[j]
+			}
+			if l == len(p.w)-1 {
+				z[i] = sigmoid(s)
+			} else {
+				z[i] = relu(s)
+			}
+		}
+		a = z
+	}
+	return a[0], nil
+}
+
+func relu(z float64) float64 {
+	if z > 0 {
+		return z
+	}
+	return 0
+}
+
+func sigmoid(z float64) float64 {
+	return 1 / (1 + math.Exp(-z))
+}
+
+// Predict returns 1 if the input is a cat, 0 otherwise.
+func (p *Parameters) Predict(x []float64) (int, error) {
+	prob, err := p.Forward(x)
+	if err != nil {
+		return 0, err
+	}
+	if prob > 0.5 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Classify classifies the image as "cat" or "non-cat".
+// The image is resized to 64x64, and its pixel values are
+// in [0, 255] (not normalized) as 'cats.model.classify'.
+func (p *Parameters) Classify(img image.Image) (string, error) {
+	pred, err := p.Predict(ImageVector(img))
+	if err != nil {
+		return "", err
+	}
+	return Classes[pred], nil
+}
+
+// ClassifyFile decodes the image file and classifies it.
+func (p *Parameters) ClassifyFile(fpath string) (string, error) {
+	bts, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return "", err
+	}
+	img, _, err := image.Decode(bytes.NewReader(bts))
+	if err != nil {
+		return "", err
+	}
+	return p.Classify(img)
+}
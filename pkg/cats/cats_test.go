@@ -0,0 +1,71 @@
+package cats
+
+import "testing"
+
+/*
+go test -v -run TestParameters -logtostderr=true
+*/
+
+func TestParameters(t *testing.T) {
+	p, err := LoadParameters("../../datasets/parameters-cats.npy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Layers() != 4 {
+		t.Fatalf("expected 4 layers, got %d", p.Layers())
+	}
+
+	// same as 'backend/worker/cats/model_test.py'
+	tests := []struct {
+		prefix string
+		fpath  string
+		total  int
+		expect int
+	}{
+		{"test_set", "../../datasets/test_catvnoncat.h5", 50, 40},
+		{"train_set", "../../datasets/train_catvnoncat.h5", 209, 206},
+	}
+	for _, tt := range tests {
+		ds, err := LoadDataset(tt.fpath, tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ds.X) != tt.total {
+			t.Fatalf("%s: expected %d images, got %d", tt.prefix, tt.total, len(ds.X))
+		}
+		correct, err := p.Accuracy(ds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if correct != tt.expect {
+			t.Fatalf("%s: expected %d/%d correct, got %d", tt.prefix, tt.expect, tt.total, correct)
+		}
+	}
+
+	class, err := p.ClassifyFile("../../datasets/gray-cat.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if class != "cat" {
+		t.Fatalf("expected 'cat', got %q", class)
+	}
+
+	if _, err = p.Forward(make([]float64, 10)); err == nil {
+		t.Fatal("expected error on wrong input size")
+	}
+}
+
+func TestResampleCoeffs(t *testing.T) {
+	// downscale by 2 averages neighbors with widened triangle filter
+	cs := resampleCoeffs(4, 2)
+	if len(cs) != 2 || cs[0].start != 0 || len(cs[0].weights) != 3 {
+		t.Fatalf("unexpected coefficients %+v", cs)
+	}
+	var sum float64
+	for _, w := range cs[0].weights {
+		sum += w
+	}
+	if sum < 0.999999 || sum > 1.000001 {
+		t.Fatalf("expected normalized weights, got sum %v", sum)
+	}
+}
@@ -0,0 +1,76 @@
+package cats
+
+import (
+	"fmt"
+
+	"github.com/gyuho/dplearn/pkg/h5"
+)
+
+// Dataset is the labeled images in 'datasets/*_catvnoncat.h5'.
+type Dataset struct {
+	// X is the input vectors of 64x64x3 pixels.
+	X [][]float64
+	// Y is the labels, 1 for cat and 0 for non-cat.
+	Y []int
+}
+
+// LoadDataset loads the dataset from the HDF5 file, with the dataset
+// names of prefix (e.g. "test_set" for "test_set_x" and "test_set_y").
+func LoadDataset(fpath, prefix string) (Dataset, error) {
+	f, err := h5.Open(fpath)
+	if err != nil {
+		return Dataset{}, err
+	}
+	defer f.Close()
+
+	x, err := f.Dataset(prefix + "_x")
+	if err != nil {
+		return Dataset{}, err
+	}
+	if len(x.Shape) != 4 || x.Shape[1] != NumPx || x.Shape[2] != NumPx || x.Shape[3] != 3 {
+		return Dataset{}, fmt.Errorf("cats: unexpected %q shape %v", x.Name, x.Shape)
+	}
+	xs, err := x.Float64s()
+	if err != nil {
+		return Dataset{}, err
+	}
+
+	y, err := f.Dataset(prefix + "_y")
+	if err != nil {
+		return Dataset{}, err
+	}
+	ys, err := y.Float64s()
+	if err != nil {
+		return Dataset{}, err
+	}
+	if len(ys) != x.Shape[0] {
+		return Dataset{}, fmt.Errorf("cats: %d labels for %d images", len(ys), x.Shape[0])
+	}
+
+	ds := Dataset{X: make([][]float64, len(ys)), Y: make([]int, len(ys))}
+	for i := range ys {
+		ds.X[i] = xs[i*InputSize : (i+1)*InputSize]
+		ds.Y[i] = int(ys[i])
+	}
+	return ds, nil
+}
+
+// Accuracy returns the number of correct predictions on the dataset,
+// with pixel values divided by 255 as the training does.
+func (p *Parameters) Accuracy(ds Dataset) (int, error) {
+	correct := 0
+	x := make([]float64, InputSize)
+	for i := range ds.X {
+		for j, v := range ds.X[i] {
+			x[j] = v / 255
+		}
+		pred, err := p.Predict(x)
+		if err != nil {
+			return 0, err
+		}
+		if pred == ds.Y[i] {
+			correct++
+		}
+	}
+	return correct, nil
+}
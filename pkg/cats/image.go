@@ -0,0 +1,106 @@
+package cats
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// ImageVector resizes the image to 64x64 and returns its RGB values
+// flattened in (row, column, channel) order.
+//
+// It resamples with bilinear (triangle) filter, as 'scipy.misc.imresize'
+// with PIL, which widens the filter support when downscaling and rounds
+// to 8-bit after each horizontal and vertical pass.
+func ImageVector(img image.Image) []float64 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	src := make([]float64, w*h*3)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			i := (y*w + x) * 3
+			src[i], src[i+1], src[i+2] = float64(c.R), float64(c.G), float64(c.B)
+		}
+	}
+
+	// horizontal pass: h x NumPx
+	tmp := make([]float64, h*NumPx*3)
+	for x, k := range resampleCoeffs(w, NumPx) {
+		for y := 0; y < h; y++ {
+			for ch := 0; ch < 3; ch++ {
+				var s float64
+				for j, wt := range k.weights {
+					s += wt * src[(y*w+k.start+j)*3+ch]
+				}
+				tmp[(y*NumPx+x)*3+ch] = clip8(s)
+			}
+		}
+	}
+
+	// vertical pass: NumPx x NumPx
+	dst := make([]float64, InputSize)
+	for y, k := range resampleCoeffs(h, NumPx) {
+		for x := 0; x < NumPx; x++ {
+			for ch := 0; ch < 3; ch++ {
+				var s float64
+				for j, wt := range k.weights {
+					s += wt * tmp[((k.start+j)*NumPx+x)*3+ch]
+				}
+				dst[(y*NumPx+x)*3+ch] = clip8(s)
+			}
+		}
+	}
+	return dst
+}
+
+type coeffs struct {
+	start   int
+	weights []float64
+}
+
+// resampleCoeffs computes the normalized triangle filter weights of
+// each output pixel.
+func resampleCoeffs(in, out int) []coeffs {
+	scale := float64(in) / float64(out)
+	filterScale := math.Max(scale, 1)
+	support := filterScale // triangle filter has support 1
+
+	cs := make([]coeffs, out)
+	for i := range cs {
+		center := (float64(i) + 0.5) * scale
+		start := int(math.Max(0, math.Floor(center-support+0.5)))
+		end := int(math.Min(float64(in), math.Floor(center+support+0.5)))
+
+		var total float64
+		ws := make([]float64, 0, end-start)
+		for x := start; x < end; x++ {
+			t := math.Abs((float64(x) - center + 0.5) / filterScale)
+			wt := 0.0
+			if t < 1 {
+				wt = 1 - t
+			}
+			ws = append(ws, wt)
+			total += wt
+		}
+		if total != 0 {
+			for j := range ws {
+				ws[j] /= total
+			}
+		}
+		cs[i] = coeffs{start: start, weights: ws}
+	}
+	return cs
+}
+
+func clip8(v float64) float64 {
+	v = math.Floor(v + 0.5)
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return v
+}
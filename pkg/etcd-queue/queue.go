@@ -9,6 +9,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/gyuho/dplearn/pkg/trace"
+
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/golang/glog"
@@ -22,6 +24,10 @@ const (
 	MaxProgress = 100
 )
 
+// ErrItemNotFound is returned when the item is not in the queue
+// (e.g. already popped).
+var ErrItemNotFound = fmt.Errorf("etcdqueue: item not found")
+
 // Item represents a job item in the queue. Key is stored as a key,
 // with serialized JSON data as a value.
 type Item struct {
@@ -52,6 +58,14 @@ type Item struct {
 	// RequestID is used/generated by external service,
 	// to help identify each item.
 	RequestID string `json:"request_id"`
+
+	// TraceID identifies the client request that created the item,
+	// to follow the job across services in logs.
+	TraceID string `json:"trace_id,omitempty"`
+
+	// TraceParent is the span context of the item in W3C 'traceparent'
+	// format, set by 'Queue.Add', so that workers continue the trace.
+	TraceParent string `json:"trace_parent,omitempty"`
 }
 
 // CreateItem creates an item with auto-generated ID of unix nano seconds.
@@ -137,6 +151,12 @@ type Queue interface {
 	// It blocks until there is at least one item to return.
 	Pop(ctx context.Context, bucket string) ItemWatcher
 
+	// List returns the items in the bucket, in the order to pop.
+	List(ctx context.Context, bucket string) ([]*Item, error)
+
+	// Delete removes the item from the queue, or returns 'ErrItemNotFound'.
+	Delete(ctx context.Context, item *Item) error
+
 	// Stop stops the queue service and any embedded clients.
 	Stop()
 
@@ -176,10 +196,19 @@ func NewQueue(cli *clientv3.Client) (Queue, error) {
 
 const pfxQueue = "_queue"
 
-func (qu *queue) Add(ctx context.Context, item *Item, opts ...OpOption) error {
+func (qu *queue) Add(ctx context.Context, item *Item, opts ...OpOption) (err error) {
 	if item == nil {
 		return fmt.Errorf("received <nil> Item")
 	}
+	ctx, span := trace.Start(ctx, "queue.Add")
+	span.SetAttribute("key", item.Key)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+	if item.TraceParent == "" {
+		item.TraceParent = span.Context().TraceParent()
+	}
 
 	ret := Op{}
 	ret.applyOpts(opts)
@@ -194,7 +223,7 @@ func (qu *queue) Add(ctx context.Context, item *Item, opts ...OpOption) error {
 	qu.writemu.Lock()
 	defer qu.writemu.Unlock()
 
-	if err := qu.put(ctx, queueKey, queueVal, ret.ttl); err != nil {
+	if err = qu.put(ctx, queueKey, queueVal, ret.ttl); err != nil {
 		return err
 	}
 	glog.Infof("queue: wrote %q with TTL %d", item.Key, ret.ttl)
@@ -202,6 +231,52 @@ func (qu *queue) Add(ctx context.Context, item *Item, opts ...OpOption) error {
 }
 
 func (qu *queue) Pop(ctx context.Context, bucket string) ItemWatcher {
+	ctx, span := trace.Start(ctx, "queue.Pop")
+	span.SetAttribute("bucket", bucket)
+	finish := func(item *Item) {
+		if item == nil {
+			span.Finish()
+			return
+		}
+		if item.Error != "" {
+			span.SetError(fmt.Errorf("%s", item.Error))
+		} else {
+			span.SetAttribute("key", item.Key)
+			// time in queue, as part of the trace of the item
+			_, wait := trace.StartAt(trace.Extract(context.Background(), item.TraceParent), "queue.Wait", item.CreatedAt)
+			wait.SetAttribute("key", item.Key)
+			wait.Finish()
+		}
+		span.Finish()
+	}
+
+	inner := qu.pop(ctx, bucket)
+	select {
+	case item := <-inner:
+		// returned without watch
+		finish(item)
+		ch := make(chan *Item, 1)
+		if item != nil {
+			ch <- item
+		}
+		close(ch)
+		return ch
+	default:
+	}
+
+	ch := make(chan *Item, 1)
+	go func() {
+		defer close(ch)
+		item := <-inner
+		finish(item)
+		if item != nil {
+			ch <- item
+		}
+	}()
+	return ch
+}
+
+func (qu *queue) pop(ctx context.Context, bucket string) ItemWatcher {
 	ch := make(chan *Item, 1)
 
 	pfxQueueBucket := path.Join(pfxQueue, bucket)
@@ -285,6 +360,44 @@ func (qu *queue) Pop(ctx context.Context, bucket string) ItemWatcher {
 	return ch
 }
 
+func (qu *queue) List(ctx context.Context, bucket string) ([]*Item, error) {
+	// trailing slash not to match other buckets of the same prefix
+	pfxQueueBucket := path.Join(pfxQueue, bucket) + "/"
+	resp, err := qu.cli.Get(ctx, pfxQueueBucket, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*Item, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var item Item
+		if err = json.Unmarshal(kv.Value, &item); err != nil {
+			return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", kv.Key, string(kv.Value), err)
+		}
+		items = append(items, &item)
+	}
+	return items, nil
+}
+
+func (qu *queue) Delete(ctx context.Context, item *Item) error {
+	if item == nil {
+		return fmt.Errorf("received <nil> Item")
+	}
+	queueKey := path.Join(pfxQueue, item.Key)
+
+	qu.writemu.Lock()
+	defer qu.writemu.Unlock()
+
+	resp, err := qu.cli.Delete(ctx, queueKey)
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return ErrItemNotFound
+	}
+	glog.Infof("queue: deleted %q", item.Key)
+	return nil
+}
+
 func (qu *queue) Stop() {
 	qu.writemu.Lock()
 	defer qu.writemu.Unlock()
@@ -57,6 +57,9 @@ func TestQueue(t *testing.T) {
 		if err = item1.Equal(item); err != nil {
 			t.Fatalf("expected %+v, got %+v (%v)", item1, item, err)
 		}
+		if item.TraceParent == "" || item.TraceParent != item1.TraceParent {
+			t.Fatalf("expected trace parent %q, got %q", item1.TraceParent, item.TraceParent)
+		}
 	case <-time.After(3 * time.Second):
 		t.Fatal("expected events, but got none")
 	}
@@ -131,3 +134,61 @@ func TestQueue(t *testing.T) {
 	default:
 	}
 }
+
+func TestQueueListDelete(t *testing.T) {
+	cport := int(atomic.AddInt32(&basePort, 2)) - 2
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	item1 := CreateItem("test-bucket", 1000, "test-data-1")
+	item2 := CreateItem("test-bucket", 9000, "test-data-2")
+	item3 := CreateItem("other-bucket", 1000, "test-data-3")
+	for _, item := range []*Item{item1, item2, item3} {
+		if err = qu.Add(context.Background(), item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, err := qu.List(context.Background(), "test-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("expected 2 items, got %+v", items)
+	}
+	// higher weight comes first
+	if err = item2.Equal(items[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err = item1.Equal(items[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = qu.Delete(context.Background(), item2); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Delete(context.Background(), item2); err != ErrItemNotFound {
+		t.Fatalf("expected %v, got %v", ErrItemNotFound, err)
+	}
+	select {
+	case item := <-qu.Pop(context.Background(), "test-bucket"):
+		if err = item1.Equal(item); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected events, but got none")
+	}
+	if items, err = qu.List(context.Background(), "test-bucket"); err != nil || len(items) != 0 {
+		t.Fatalf("expected no items, got %+v (%v)", items, err)
+	}
+}
@@ -0,0 +1,557 @@
+// Package h5 implements a minimal read-only HDF5 reader.
+//
+// It supports superblock version 0 and 1, groups with symbol tables,
+// version 1 object headers, and contiguous or compact datasets of
+// fixed-point, floating-point and fixed-length string types. That covers
+// files written by h5py with default options (e.g. 'datasets/*.h5').
+package h5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+var signature = []byte("\x89HDF\r\n\x1a\n")
+
+// File is an HDF5 file opened for reading.
+type File struct {
+	r io.ReaderAt
+	c io.Closer
+
+	base       uint64
+	offsetSize int
+	lengthSize int
+	root       uint64
+}
+
+// Open opens an HDF5 file.
+func Open(fpath string) (*File, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	h, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	h.c = f
+	return h, nil
+}
+
+// NewReader reads HDF5 from the reader.
+func NewReader(r io.ReaderAt) (*File, error) {
+	f := &File{r: r}
+
+	// superblock may be at 0, 512, 1024, 2048...
+	var sb []byte
+	for off := int64(0); off < 1<<20; off = max64(512, off*2) {
+		buf := make([]byte, 8)
+		if _, err := r.ReadAt(buf, off); err != nil {
+			return nil, fmt.Errorf("h5: cannot find superblock (%v)", err)
+		}
+		if bytes.Equal(buf, signature) {
+			sb = make([]byte, 96)
+			if _, err := r.ReadAt(sb, off); err != nil && err != io.EOF {
+				return nil, err
+			}
+			break
+		}
+	}
+	if sb == nil {
+		return nil, fmt.Errorf("h5: cannot find superblock")
+	}
+
+	version := sb[8]
+	if version > 1 {
+		return nil, fmt.Errorf("h5: superblock version %d not supported", version)
+	}
+	f.offsetSize, f.lengthSize = int(sb[13]), int(sb[14])
+	if f.offsetSize != 8 || f.lengthSize != 8 {
+		return nil, fmt.Errorf("h5: offset size %d, length size %d not supported", f.offsetSize, f.lengthSize)
+	}
+	pos := 24
+	if version == 1 {
+		pos += 4 // indexed storage internal node K, reserved
+	}
+	f.base = binary.LittleEndian.Uint64(sb[pos:])
+	pos += 4 * f.offsetSize // base, free-space, end-of-file, driver info addresses
+
+	// root group symbol table entry: link name offset, object header address
+	f.root = binary.LittleEndian.Uint64(sb[pos+f.offsetSize:])
+	return f, nil
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	if f.c == nil {
+		return nil
+	}
+	return f.c.Close()
+}
+
+func (f *File) readAt(addr uint64, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := f.r.ReadAt(buf, int64(f.base+addr))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf, err
+}
+
+const undefinedAddress = math.MaxUint64
+
+// message types of object headers
+const (
+	msgDataspace    = 0x0001
+	msgDatatype     = 0x0003
+	msgLayout       = 0x0008
+	msgFilter       = 0x000B
+	msgContinuation = 0x0010
+	msgSymbolTable  = 0x0011
+)
+
+type message struct {
+	typ  uint16
+	data []byte
+}
+
+// readObjectHeader reads the messages of a version 1 object header,
+// following continuation messages.
+func (f *File) readObjectHeader(addr uint64) ([]message, error) {
+	prefix, err := f.readAt(addr, 16)
+	if err != nil {
+		return nil, err
+	}
+	if prefix[0] != 1 {
+		return nil, fmt.Errorf("h5: object header version %d not supported", prefix[0])
+	}
+	total := int(binary.LittleEndian.Uint16(prefix[2:]))
+	size := binary.LittleEndian.Uint32(prefix[8:])
+
+	type block struct {
+		addr uint64
+		size uint64
+	}
+	blocks := []block{{addr + 16, uint64(size)}}
+
+	var msgs []message
+	for len(blocks) > 0 && len(msgs) < total {
+		b := blocks[0]
+		blocks = blocks[1:]
+		data, err := f.readAt(b.addr, int(b.size))
+		if err != nil {
+			return nil, err
+		}
+		for pos := 0; pos+8 <= len(data) && len(msgs) < total; {
+			typ := binary.LittleEndian.Uint16(data[pos:])
+			n := int(binary.LittleEndian.Uint16(data[pos+2:]))
+			pos += 8
+			if pos+n > len(data) {
+				return nil, fmt.Errorf("h5: message at %d overflows object header", b.addr+uint64(pos))
+			}
+			m := message{typ: typ, data: data[pos : pos+n]}
+			pos += n
+			msgs = append(msgs, m)
+			if typ == msgContinuation {
+				blocks = append(blocks, block{
+					addr: binary.LittleEndian.Uint64(m.data),
+					size: binary.LittleEndian.Uint64(m.data[8:]),
+				})
+			}
+		}
+	}
+	return msgs, nil
+}
+
+// lookup returns the object header address of the path, from the root group.
+func (f *File) lookup(p string) (uint64, error) {
+	addr := f.root
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		links, err := f.links(addr)
+		if err != nil {
+			return 0, err
+		}
+		child, ok := links[name]
+		if !ok {
+			return 0, fmt.Errorf("h5: %q not found", p)
+		}
+		addr = child
+	}
+	return addr, nil
+}
+
+// links returns the names and object header addresses in the group.
+func (f *File) links(addr uint64) (map[string]uint64, error) {
+	msgs, err := f.readObjectHeader(addr)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		if m.typ != msgSymbolTable {
+			continue
+		}
+		btree := binary.LittleEndian.Uint64(m.data)
+		heap := binary.LittleEndian.Uint64(m.data[8:])
+
+		hd, err := f.readAt(heap, 32)
+		if err != nil {
+			return nil, err
+		}
+		if string(hd[:4]) != "HEAP" {
+			return nil, fmt.Errorf("h5: invalid local heap at %d", heap)
+		}
+		heapData := binary.LittleEndian.Uint64(hd[24:])
+
+		links := make(map[string]uint64)
+		if err = f.walkGroupBTree(btree, heapData, links); err != nil {
+			return nil, err
+		}
+		return links, nil
+	}
+	return nil, fmt.Errorf("h5: object at %d is not a group", addr)
+}
+
+func (f *File) walkGroupBTree(addr, heapData uint64, links map[string]uint64) error {
+	hd, err := f.readAt(addr, 24)
+	if err != nil {
+		return err
+	}
+	if string(hd[:4]) != "TREE" || hd[4] != 0 {
+		return fmt.Errorf("h5: invalid group B-tree node at %d", addr)
+	}
+	level := hd[5]
+	entries := int(binary.LittleEndian.Uint16(hd[6:]))
+
+	// keys and children are interleaved, starting with key
+	kc, err := f.readAt(addr+24, (2*entries+1)*8)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < entries; i++ {
+		child := binary.LittleEndian.Uint64(kc[8+16*i:])
+		if level > 0 {
+			if err = f.walkGroupBTree(child, heapData, links); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = f.readSymbolTableNode(child, heapData, links); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *File) readSymbolTableNode(addr, heapData uint64, links map[string]uint64) error {
+	hd, err := f.readAt(addr, 8)
+	if err != nil {
+		return err
+	}
+	if string(hd[:4]) != "SNOD" {
+		return fmt.Errorf("h5: invalid symbol table node at %d", addr)
+	}
+	n := int(binary.LittleEndian.Uint16(hd[6:]))
+	const entrySize = 40
+	data, err := f.readAt(addr+8, n*entrySize)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		e := data[i*entrySize:]
+		nameOffset := binary.LittleEndian.Uint64(e)
+		header := binary.LittleEndian.Uint64(e[8:])
+		name, err := f.readString(heapData + nameOffset)
+		if err != nil {
+			return err
+		}
+		links[name] = header
+	}
+	return nil
+}
+
+// readString reads a null-terminated string.
+func (f *File) readString(addr uint64) (string, error) {
+	var buf []byte
+	for {
+		chunk, err := f.readAt(addr+uint64(len(buf)), 64)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return "", err
+		}
+		if i := bytes.IndexByte(chunk, 0); i != -1 {
+			return string(append(buf, chunk[:i]...)), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		buf = append(buf, chunk...)
+	}
+}
+
+// Names returns the names of the objects in the group.
+func (f *File) Names(group string) ([]string, error) {
+	addr, err := f.lookup(group)
+	if err != nil {
+		return nil, err
+	}
+	links, err := f.links(addr)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(links))
+	for name := range links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Class is the datatype class.
+type Class int
+
+// Supported datatype classes.
+const (
+	ClassFixedPoint    Class = 0
+	ClassFloatingPoint Class = 1
+	ClassString        Class = 3
+)
+
+func (c Class) String() string {
+	switch c {
+	case ClassFixedPoint:
+		return "fixed-point"
+	case ClassFloatingPoint:
+		return "floating-point"
+	case ClassString:
+		return "string"
+	default:
+		return fmt.Sprintf("class(%d)", int(c))
+	}
+}
+
+// Dataset is an n-dimensional array read from the file.
+type Dataset struct {
+	Name  string
+	Shape []int
+
+	Class     Class
+	ElemSize  int
+	Signed    bool
+	BigEndian bool
+
+	// Data is the raw data in row-major order.
+	Data []byte
+}
+
+// Dataset reads the dataset of the path (e.g. "test_set_x").
+func (f *File) Dataset(p string) (*Dataset, error) {
+	addr, err := f.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := f.readObjectHeader(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ds := &Dataset{Name: p}
+	var layout []byte
+	for _, m := range msgs {
+		switch m.typ {
+		case msgDataspace:
+			if ds.Shape, err = parseDataspace(m.data); err != nil {
+				return nil, err
+			}
+		case msgDatatype:
+			if err = ds.parseDatatype(m.data); err != nil {
+				return nil, err
+			}
+		case msgLayout:
+			layout = m.data
+		case msgFilter:
+			return nil, fmt.Errorf("h5: %q has filters (compression not supported)", p)
+		}
+	}
+	if ds.ElemSize == 0 || layout == nil {
+		return nil, fmt.Errorf("h5: %q is not a dataset", p)
+	}
+
+	n := ds.ElemSize
+	for _, d := range ds.Shape {
+		n *= d
+	}
+	if ds.Data, err = f.readLayout(layout, n); err != nil {
+		return nil, fmt.Errorf("h5: %q %v", p, err)
+	}
+	return ds, nil
+}
+
+func parseDataspace(b []byte) ([]int, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("h5: invalid dataspace message")
+	}
+	version, rank := b[0], int(b[1])
+	pos := 8
+	switch version {
+	case 1:
+	case 2:
+		pos = 4
+	default:
+		return nil, fmt.Errorf("h5: dataspace version %d not supported", version)
+	}
+	if len(b) < pos+rank*8 {
+		return nil, fmt.Errorf("h5: invalid dataspace message")
+	}
+	shape := make([]int, rank)
+	for i := range shape {
+		shape[i] = int(binary.LittleEndian.Uint64(b[pos+i*8:]))
+	}
+	return shape, nil
+}
+
+func (ds *Dataset) parseDatatype(b []byte) error {
+	if len(b) < 8 {
+		return fmt.Errorf("h5: invalid datatype message")
+	}
+	ds.Class = Class(b[0] & 0x0f)
+	ds.ElemSize = int(binary.LittleEndian.Uint32(b[4:]))
+	switch ds.Class {
+	case ClassFixedPoint:
+		ds.BigEndian = b[1]&0x01 != 0
+		ds.Signed = b[1]&0x08 != 0
+	case ClassFloatingPoint:
+		ds.BigEndian = b[1]&0x01 != 0
+		ds.Signed = true
+		if ds.ElemSize != 4 && ds.ElemSize != 8 {
+			return fmt.Errorf("h5: %d-byte floating-point not supported", ds.ElemSize)
+		}
+	case ClassString:
+	default:
+		return fmt.Errorf("h5: datatype %v not supported", ds.Class)
+	}
+	return nil
+}
+
+func (f *File) readLayout(b []byte, n int) ([]byte, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("invalid layout message")
+	}
+	switch version := b[0]; version {
+	case 1, 2:
+		rank, class := int(b[1]), b[2]
+		switch class {
+		case 0: // compact
+			pos := 8 + rank*4
+			size := int(binary.LittleEndian.Uint32(b[pos:]))
+			return b[pos+4 : pos+4+size], nil
+		case 1: // contiguous
+			return f.readContiguous(binary.LittleEndian.Uint64(b[8:]), n)
+		}
+		return nil, fmt.Errorf("layout class %d not supported", class)
+
+	case 3:
+		switch class := b[1]; class {
+		case 0: // compact
+			size := int(binary.LittleEndian.Uint16(b[2:]))
+			return b[4 : 4+size], nil
+		case 1: // contiguous
+			return f.readContiguous(binary.LittleEndian.Uint64(b[2:]), n)
+		default:
+			return nil, fmt.Errorf("layout class %d not supported", class)
+		}
+
+	default:
+		return nil, fmt.Errorf("layout version %d not supported", version)
+	}
+}
+
+func (f *File) readContiguous(addr uint64, n int) ([]byte, error) {
+	if addr == undefinedAddress {
+		// never written, filled with zero values
+		return make([]byte, n), nil
+	}
+	return f.readAt(addr, n)
+}
+
+// Len returns the number of elements.
+func (ds *Dataset) Len() int {
+	if ds.ElemSize == 0 {
+		return 0
+	}
+	return len(ds.Data) / ds.ElemSize
+}
+
+// Float64s converts fixed-point or floating-point data to float64s.
+func (ds *Dataset) Float64s() ([]float64, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if ds.BigEndian {
+		order = binary.BigEndian
+	}
+
+	vs := make([]float64, ds.Len())
+	for i := range vs {
+		b := ds.Data[i*ds.ElemSize : (i+1)*ds.ElemSize]
+		switch {
+		case ds.Class == ClassFloatingPoint && ds.ElemSize == 4:
+			vs[i] = float64(math.Float32frombits(order.Uint32(b)))
+		case ds.Class == ClassFloatingPoint && ds.ElemSize == 8:
+			vs[i] = math.Float64frombits(order.Uint64(b))
+		case ds.Class == ClassFixedPoint && ds.ElemSize == 1:
+			if ds.Signed {
+				vs[i] = float64(int8(b[0]))
+			} else {
+				vs[i] = float64(b[0])
+			}
+		case ds.Class == ClassFixedPoint && ds.ElemSize == 2:
+			if ds.Signed {
+				vs[i] = float64(int16(order.Uint16(b)))
+			} else {
+				vs[i] = float64(order.Uint16(b))
+			}
+		case ds.Class == ClassFixedPoint && ds.ElemSize == 4:
+			if ds.Signed {
+				vs[i] = float64(int32(order.Uint32(b)))
+			} else {
+				vs[i] = float64(order.Uint32(b))
+			}
+		case ds.Class == ClassFixedPoint && ds.ElemSize == 8:
+			if ds.Signed {
+				vs[i] = float64(int64(order.Uint64(b)))
+			} else {
+				vs[i] = float64(order.Uint64(b))
+			}
+		default:
+			return nil, fmt.Errorf("h5: cannot convert %d-byte %v to float64", ds.ElemSize, ds.Class)
+		}
+	}
+	return vs, nil
+}
+
+// Strings returns fixed-length string data, trimming null paddings.
+func (ds *Dataset) Strings() ([]string, error) {
+	if ds.Class != ClassString {
+		return nil, fmt.Errorf("h5: cannot convert %v to string", ds.Class)
+	}
+	ss := make([]string, ds.Len())
+	for i := range ss {
+		b := ds.Data[i*ds.ElemSize : (i+1)*ds.ElemSize]
+		ss[i] = strings.TrimRight(string(b), "\x00 ")
+	}
+	return ss, nil
+}
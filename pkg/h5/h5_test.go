@@ -0,0 +1,74 @@
+package h5
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	f, err := Open("../../datasets/test_catvnoncat.h5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	names, err := f.Names("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"list_classes", "test_set_x", "test_set_y"}) {
+		t.Fatalf("unexpected names %v", names)
+	}
+
+	x, err := f.Dataset("test_set_x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(x.Shape, []int{50, 64, 64, 3}) {
+		t.Fatalf("unexpected shape %v", x.Shape)
+	}
+	if x.Class != ClassFixedPoint || x.ElemSize != 1 || x.Signed {
+		t.Fatalf("expected uint8, got %v (size %d, signed %v)", x.Class, x.ElemSize, x.Signed)
+	}
+	if x.Len() != 50*64*64*3 {
+		t.Fatalf("unexpected length %d", x.Len())
+	}
+
+	y, err := f.Dataset("/test_set_y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ys, err := y.Float64s()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ys) != 50 {
+		t.Fatalf("expected 50 labels, got %d", len(ys))
+	}
+	cats := 0
+	for _, v := range ys {
+		if v != 0 && v != 1 {
+			t.Fatalf("unexpected label %v", v)
+		}
+		cats += int(v)
+	}
+	if cats != 33 {
+		t.Fatalf("expected 33 cats, got %d", cats)
+	}
+
+	cl, err := f.Dataset("list_classes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	classes, err := cl.Strings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(classes, []string{"non-cat", "cat"}) {
+		t.Fatalf("unexpected classes %q", classes)
+	}
+
+	if _, err = f.Dataset("not-exist"); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -13,6 +13,10 @@ var (
 	ErrKeyNotFound = fmt.Errorf("lru: key not found")
 )
 
+// EvictFunc is called with the evicted key-value pair, when the oldest key is
+// evicted or when the value of an existing key is replaced by 'Put'.
+type EvictFunc func(namespace string, key, value interface{})
+
 // Cache defines LRU cache store.
 type Cache interface {
 	// CreateNamespace creates a new bucket in cache.
@@ -23,4 +27,13 @@ type Cache interface {
 
 	// Get returns the value, or 'ErrKeyNotFound'. If the namespace is not found, returns 'ErrNamespaceNotFound'.
 	Get(namespace string, key interface{}) (interface{}, error)
+
+	// Range calls 'f' for each key-value pair, most recently used first,
+	// without updating recency, until 'f' returns false. 'f' must not
+	// access the cache. If the namespace is not found, returns 'ErrNamespaceNotFound'.
+	Range(namespace string, f func(key, value interface{}) bool) error
+
+	// Delete evicts the key, calling the evict function with its value.
+	// Returns 'ErrKeyNotFound' or 'ErrNamespaceNotFound'.
+	Delete(namespace string, key interface{}) error
 }
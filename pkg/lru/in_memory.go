@@ -9,9 +9,17 @@ import (
 
 // NewInMemory returns a new in-memory LRU cache.
 func NewInMemory(size int) Cache {
+	return NewInMemoryWithEvict(size, nil)
+}
+
+// NewInMemoryWithEvict returns a new in-memory LRU cache that calls 'onEvict'
+// for every evicted or replaced value. 'onEvict' is called without holding
+// the cache lock, so it is safe to access the cache from the callback.
+func NewInMemoryWithEvict(size int, onEvict EvictFunc) Cache {
 	return &inMemory{
 		cap:     size,
 		buckets: make(map[string]*bucket),
+		onEvict: onEvict,
 	}
 }
 
@@ -37,6 +45,7 @@ type inMemory struct {
 	mu      sync.Mutex
 	cap     int
 	buckets map[string]*bucket
+	onEvict EvictFunc
 }
 
 func (c *inMemory) CreateNamespace(namespace string) {
@@ -50,34 +59,46 @@ func (c *inMemory) CreateNamespace(namespace string) {
 
 func (c *inMemory) Put(namespace string, key, value interface{}) error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	evicted, err := c.put(namespace, key, value)
+	c.mu.Unlock()
 
+	if evicted != nil && c.onEvict != nil {
+		c.onEvict(namespace, evicted.key, evicted.value)
+	}
+	return err
+}
+
+// put writes a key-value pair, and returns the evicted or replaced pair if any.
+func (c *inMemory) put(namespace string, key, value interface{}) (*pair, error) {
 	b, ok := c.buckets[namespace]
 	if !ok {
 		b = newBucket(c.cap)
 		c.buckets[namespace] = b
 	}
 	if b.k2it == nil {
-		return ErrStopped
+		return nil, ErrStopped
 	}
 
 	if v, ok := b.k2it[key]; ok {
 		b.kvs.MoveToFront(v)
-		b.k2it[key].Value.(*pair).value = value
-		return nil
+		p := v.Value.(*pair)
+		replaced := &pair{key: p.key, value: p.value}
+		p.value = value
+		return replaced, nil
 	}
 
+	var evicted *pair
 	if c.cap > 0 && len(b.k2it) == c.cap {
 		oldest := b.kvs.Back()
-		oldestkey := oldest.Value.(*pair).key
+		evicted = oldest.Value.(*pair)
 		b.kvs.Remove(oldest)
-		delete(b.k2it, oldestkey)
-		glog.Infof("lru: evicted %q", oldestkey)
+		delete(b.k2it, evicted.key)
+		glog.Infof("lru: evicted %q", evicted.key)
 	}
 
 	b.kvs.PushFront(&pair{key, value})
 	b.k2it[key] = b.kvs.Front()
-	return nil
+	return evicted, nil
 }
 
 func (c *inMemory) Get(namespace string, key interface{}) (interface{}, error) {
@@ -97,3 +118,44 @@ func (c *inMemory) Get(namespace string, key interface{}) (interface{}, error) {
 	b.kvs.MoveToFront(v)
 	return v.Value.(*pair).value, nil
 }
+
+func (c *inMemory) Range(namespace string, f func(key, value interface{}) bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.buckets[namespace]
+	if !ok {
+		return ErrNamespaceNotFound
+	}
+	for e := b.kvs.Front(); e != nil; e = e.Next() {
+		p := e.Value.(*pair)
+		if !f(p.key, p.value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *inMemory) Delete(namespace string, key interface{}) error {
+	c.mu.Lock()
+	b, ok := c.buckets[namespace]
+	if !ok {
+		c.mu.Unlock()
+		return ErrNamespaceNotFound
+	}
+	v, ok := b.k2it[key]
+	if !ok {
+		c.mu.Unlock()
+		return ErrKeyNotFound
+	}
+	p := v.Value.(*pair)
+	b.kvs.Remove(v)
+	delete(b.k2it, key)
+	c.mu.Unlock()
+
+	glog.Infof("lru: deleted %q", key)
+	if c.onEvict != nil {
+		c.onEvict(namespace, p.key, p.value)
+	}
+	return nil
+}
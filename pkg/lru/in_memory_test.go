@@ -29,3 +29,83 @@ func TestNewInMemory(t *testing.T) {
 		t.Fatalf("expected eviction with %v, got %v", ErrKeyNotFound, err)
 	}
 }
+
+func TestNewInMemoryWithEvict(t *testing.T) {
+	evicted := make(map[interface{}]interface{})
+	c := NewInMemoryWithEvict(2, func(namespace string, key, value interface{}) {
+		if namespace != "test-bucket" {
+			t.Fatalf("unexpected namespace %q", namespace)
+		}
+		evicted[key] = value
+	})
+	if err := c.Put("test-bucket", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("test-bucket", "foo", "bar2"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := evicted["foo"]; !ok || fmt.Sprint(v) != "bar" {
+		t.Fatalf("expected replaced 'bar', got %v", evicted)
+	}
+	if err := c.Put("test-bucket", "foo1", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("test-bucket", "foo2", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := evicted["foo"]; !ok || fmt.Sprint(v) != "bar2" {
+		t.Fatalf("expected evicted 'bar2', got %v", evicted)
+	}
+	if len(evicted) != 1 {
+		t.Fatalf("expected 1 evicted key, got %v", evicted)
+	}
+}
+
+func TestInMemoryRangeDelete(t *testing.T) {
+	evicted := make(map[interface{}]interface{})
+	c := NewInMemoryWithEvict(3, func(namespace string, key, value interface{}) {
+		evicted[key] = value
+	})
+	for _, k := range []string{"foo1", "foo2", "foo3"} {
+		if err := c.Put("test-bucket", k, "bar-"+k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Get("test-bucket", "foo1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []interface{}
+	if err := c.Range("test-bucket", func(k, v interface{}) bool {
+		keys = append(keys, k)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != "[foo1 foo3 foo2]" {
+		t.Fatalf("expected most recently used first, got %v", keys)
+	}
+	if err := c.Range("wrong-bucket", func(k, v interface{}) bool { return true }); err != ErrNamespaceNotFound {
+		t.Fatalf("expected %v, got %v", ErrNamespaceNotFound, err)
+	}
+
+	if err := c.Delete("test-bucket", "foo3"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := evicted["foo3"]; !ok || fmt.Sprint(v) != "bar-foo3" {
+		t.Fatalf("expected evicted 'bar-foo3', got %v", evicted)
+	}
+	if err := c.Delete("test-bucket", "foo3"); err != ErrKeyNotFound {
+		t.Fatalf("expected %v, got %v", ErrKeyNotFound, err)
+	}
+	if _, err := c.Get("test-bucket", "foo3"); err != ErrKeyNotFound {
+		t.Fatalf("expected %v, got %v", ErrKeyNotFound, err)
+	}
+	// the deleted key makes room without eviction
+	if err := c.Put("test-bucket", "foo4", "bar-foo4"); err != nil {
+		t.Fatal(err)
+	}
+	if len(evicted) != 1 {
+		t.Fatalf("expected 1 evicted key, got %v", evicted)
+	}
+}
@@ -0,0 +1,492 @@
+// Package npy implements NumPy '.npy' and '.npz' file formats.
+// See https://docs.scipy.org/doc/numpy/neps/npy-format.html.
+package npy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gyuho/dplearn/pkg/fileutil"
+)
+
+var magic = []byte("\x93NUMPY")
+
+// Array is an n-dimensional array.
+type Array struct {
+	// Descr is the array protocol type string (e.g. "<f8", "|u1", "|O").
+	Descr string
+	// Shape is the array shape, empty for 0-dimensional (scalar) arrays.
+	Shape []int
+	// FortranOrder is true if Data is in column-major order.
+	FortranOrder bool
+
+	// Data is the raw data of numeric arrays.
+	Data []byte
+	// Objects are the elements of object arrays ("|O"), such as pickled
+	// dictionaries by 'np.save(path, dict)'. See 'unpickle' for Go types.
+	Objects []interface{}
+}
+
+// NewFloat64 returns a "<f8" array of the values in row-major order.
+func NewFloat64(shape []int, vs []float64) (*Array, error) {
+	if err := checkShape(shape, len(vs)); err != nil {
+		return nil, err
+	}
+	a := &Array{Descr: "<f8", Shape: shape, Data: make([]byte, 8*len(vs))}
+	for i, v := range vs {
+		binary.LittleEndian.PutUint64(a.Data[i*8:], math.Float64bits(v))
+	}
+	return a, nil
+}
+
+// NewFloat32 returns a "<f4" array of the values in row-major order.
+func NewFloat32(shape []int, vs []float32) (*Array, error) {
+	if err := checkShape(shape, len(vs)); err != nil {
+		return nil, err
+	}
+	a := &Array{Descr: "<f4", Shape: shape, Data: make([]byte, 4*len(vs))}
+	for i, v := range vs {
+		binary.LittleEndian.PutUint32(a.Data[i*4:], math.Float32bits(v))
+	}
+	return a, nil
+}
+
+// NewInt64 returns a "<i8" array of the values in row-major order.
+func NewInt64(shape []int, vs []int64) (*Array, error) {
+	if err := checkShape(shape, len(vs)); err != nil {
+		return nil, err
+	}
+	a := &Array{Descr: "<i8", Shape: shape, Data: make([]byte, 8*len(vs))}
+	for i, v := range vs {
+		binary.LittleEndian.PutUint64(a.Data[i*8:], uint64(v))
+	}
+	return a, nil
+}
+
+func checkShape(shape []int, n int) error {
+	if size(shape) != n {
+		return fmt.Errorf("npy: shape %v does not match %d elements", shape, n)
+	}
+	return nil
+}
+
+func size(shape []int) int {
+	n := 1
+	for _, d := range shape {
+		n *= d
+	}
+	return n
+}
+
+// Len returns the number of elements.
+func (a *Array) Len() int { return size(a.Shape) }
+
+// dtype is the parsed array protocol type string.
+type dtype struct {
+	order binary.ByteOrder
+	kind  byte // 'f', 'i', 'u', 'b', 'O'
+	size  int
+}
+
+func parseDescr(descr string) (dtype, error) {
+	if len(descr) < 2 {
+		return dtype{}, fmt.Errorf("npy: invalid descr %q", descr)
+	}
+	dt := dtype{order: binary.LittleEndian, kind: descr[1]}
+	switch descr[0] {
+	case '<', '|', '=':
+	case '>':
+		dt.order = binary.BigEndian
+	default:
+		return dtype{}, fmt.Errorf("npy: invalid byte order in descr %q", descr)
+	}
+	if dt.kind == 'O' {
+		return dt, nil
+	}
+	n, err := strconv.Atoi(descr[2:])
+	if err != nil {
+		return dtype{}, fmt.Errorf("npy: invalid size in descr %q", descr)
+	}
+	dt.size = n
+	switch {
+	case dt.kind == 'f' && (n == 4 || n == 8):
+	case (dt.kind == 'i' || dt.kind == 'u') && (n == 1 || n == 2 || n == 4 || n == 8):
+	case dt.kind == 'b' && n == 1:
+	default:
+		return dtype{}, fmt.Errorf("npy: descr %q not supported", descr)
+	}
+	return dt, nil
+}
+
+// elements returns the raw elements in row-major order.
+func (a *Array) elements() (dtype, [][]byte, error) {
+	dt, err := parseDescr(a.Descr)
+	if err != nil {
+		return dtype{}, nil, err
+	}
+	if dt.kind == 'O' {
+		return dtype{}, nil, fmt.Errorf("npy: cannot convert object array")
+	}
+	n := a.Len()
+	if len(a.Data) != n*dt.size {
+		return dtype{}, nil, fmt.Errorf("npy: expected %d bytes for shape %v, got %d", n*dt.size, a.Shape, len(a.Data))
+	}
+	es := make([][]byte, n)
+	for i := range es {
+		j := i
+		if a.FortranOrder {
+			j = fortranIndex(a.Shape, i)
+		}
+		es[i] = a.Data[j*dt.size : (j+1)*dt.size]
+	}
+	return dt, es, nil
+}
+
+// fortranIndex converts the row-major index to column-major index.
+func fortranIndex(shape []int, i int) int {
+	j, stride := 0, 1
+	idx := make([]int, len(shape))
+	for k := len(shape) - 1; k >= 0; k-- {
+		idx[k] = i % shape[k]
+		i /= shape[k]
+	}
+	for k := range shape {
+		j += idx[k] * stride
+		stride *= shape[k]
+	}
+	return j
+}
+
+func (dt dtype) float64(b []byte) float64 {
+	switch dt.kind {
+	case 'f':
+		if dt.size == 4 {
+			return float64(math.Float32frombits(dt.order.Uint32(b)))
+		}
+		return math.Float64frombits(dt.order.Uint64(b))
+	case 'u', 'b':
+		return float64(dt.uint64(b))
+	default:
+		return float64(dt.int64(b))
+	}
+}
+
+func (dt dtype) uint64(b []byte) uint64 {
+	switch dt.size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(dt.order.Uint16(b))
+	case 4:
+		return uint64(dt.order.Uint32(b))
+	default:
+		return dt.order.Uint64(b)
+	}
+}
+
+func (dt dtype) int64(b []byte) int64 {
+	if dt.kind != 'i' {
+		return int64(dt.uint64(b))
+	}
+	switch dt.size {
+	case 1:
+		return int64(int8(b[0]))
+	case 2:
+		return int64(int16(dt.order.Uint16(b)))
+	case 4:
+		return int64(int32(dt.order.Uint32(b)))
+	default:
+		return int64(dt.order.Uint64(b))
+	}
+}
+
+// Float64s returns the values of numeric arrays in row-major order.
+func (a *Array) Float64s() ([]float64, error) {
+	dt, es, err := a.elements()
+	if err != nil {
+		return nil, err
+	}
+	vs := make([]float64, len(es))
+	for i, b := range es {
+		vs[i] = dt.float64(b)
+	}
+	return vs, nil
+}
+
+// Float32s returns the values of numeric arrays in row-major order.
+func (a *Array) Float32s() ([]float32, error) {
+	dt, es, err := a.elements()
+	if err != nil {
+		return nil, err
+	}
+	vs := make([]float32, len(es))
+	for i, b := range es {
+		vs[i] = float32(dt.float64(b))
+	}
+	return vs, nil
+}
+
+// Int64s returns the values of integer or boolean arrays in row-major order.
+func (a *Array) Int64s() ([]int64, error) {
+	dt, es, err := a.elements()
+	if err != nil {
+		return nil, err
+	}
+	if dt.kind == 'f' {
+		return nil, fmt.Errorf("npy: cannot convert %q to integers", a.Descr)
+	}
+	vs := make([]int64, len(es))
+	for i, b := range es {
+		vs[i] = dt.int64(b)
+	}
+	return vs, nil
+}
+
+// Dict returns the arrays in the pickled dictionary of 0-dimensional
+// object array (e.g. 'np.save(path, {"W1": W1, "b1": b1})').
+func (a *Array) Dict() (map[string]*Array, error) {
+	if a.Descr != "|O" || len(a.Objects) != 1 {
+		return nil, fmt.Errorf("npy: expected 0-d object array, got %q with shape %v", a.Descr, a.Shape)
+	}
+	d, ok := a.Objects[0].(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("npy: expected dictionary, got %T", a.Objects[0])
+	}
+	m := make(map[string]*Array, len(d))
+	for k, v := range d {
+		ks, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("npy: expected string key, got %T", k)
+		}
+		va, ok := v.(*Array)
+		if !ok {
+			return nil, fmt.Errorf("npy: expected ndarray of %q, got %T", ks, v)
+		}
+		m[ks] = va
+	}
+	return m, nil
+}
+
+// ReadFile reads the '.npy' file.
+func ReadFile(fpath string) (*Array, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(bufio.NewReader(f))
+}
+
+// Read reads an array in '.npy' format.
+func Read(r io.Reader) (*Array, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	a := &Array{Descr: h.descr, Shape: h.shape, FortranOrder: h.fortranOrder}
+
+	dt, err := parseDescr(h.descr)
+	if err != nil {
+		return nil, err
+	}
+	if dt.kind == 'O' {
+		v, err := unpickle(r)
+		if err != nil {
+			return nil, err
+		}
+		// numpy pickles the object array itself
+		pa, ok := v.(*Array)
+		if !ok {
+			return nil, fmt.Errorf("npy: expected pickled ndarray, got %T", v)
+		}
+		if len(pa.Objects) != a.Len() {
+			return nil, fmt.Errorf("npy: expected %d objects, got %d", a.Len(), len(pa.Objects))
+		}
+		a.Objects = pa.Objects
+		return a, nil
+	}
+
+	a.Data = make([]byte, a.Len()*dt.size)
+	if _, err = io.ReadFull(r, a.Data); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+type header struct {
+	descr        string
+	fortranOrder bool
+	shape        []int
+}
+
+func readHeader(r io.Reader) (header, error) {
+	prefix := make([]byte, 8)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return header{}, err
+	}
+	if !bytes.Equal(prefix[:6], magic) {
+		return header{}, fmt.Errorf("npy: invalid magic %q", prefix[:6])
+	}
+	var n int
+	switch prefix[6] {
+	case 1:
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return header{}, err
+		}
+		n = int(binary.LittleEndian.Uint16(b))
+	case 2, 3:
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return header{}, err
+		}
+		n = int(binary.LittleEndian.Uint32(b))
+	default:
+		return header{}, fmt.Errorf("npy: version %d.%d not supported", prefix[6], prefix[7])
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return header{}, err
+	}
+	return parseHeader(string(b))
+}
+
+// parseHeader parses the header dictionary literal,
+// e.g. {'descr': '<f8', 'fortran_order': False, 'shape': (20, 12288), }.
+func parseHeader(s string) (header, error) {
+	var h header
+	descr, ok := headerValue(s, "descr")
+	if !ok || len(descr) < 2 || descr[0] != '\'' || descr[len(descr)-1] != '\'' {
+		return header{}, fmt.Errorf("npy: invalid descr in header %q", s)
+	}
+	h.descr = descr[1 : len(descr)-1]
+
+	fo, ok := headerValue(s, "fortran_order")
+	switch {
+	case ok && fo == "True":
+		h.fortranOrder = true
+	case ok && fo == "False":
+	default:
+		return header{}, fmt.Errorf("npy: invalid fortran_order in header %q", s)
+	}
+
+	shape, ok := headerValue(s, "shape")
+	if !ok || !strings.HasPrefix(shape, "(") || !strings.HasSuffix(shape, ")") {
+		return header{}, fmt.Errorf("npy: invalid shape in header %q", s)
+	}
+	h.shape = []int{}
+	for _, d := range strings.Split(shape[1:len(shape)-1], ",") {
+		d = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(d), "L"))
+		if d == "" {
+			continue
+		}
+		n, err := strconv.Atoi(d)
+		if err != nil || n < 0 {
+			return header{}, fmt.Errorf("npy: invalid shape in header %q", s)
+		}
+		h.shape = append(h.shape, n)
+	}
+	return h, nil
+}
+
+// headerValue returns the literal value of the key in the header.
+func headerValue(s, key string) (string, bool) {
+	k := "'" + key + "':"
+	i := strings.Index(s, k)
+	if i == -1 {
+		return "", false
+	}
+	s = strings.TrimSpace(s[i+len(k):])
+	switch {
+	case strings.HasPrefix(s, "("):
+		j := strings.Index(s, ")")
+		if j == -1 {
+			return "", false
+		}
+		return s[:j+1], true
+	case strings.HasPrefix(s, "'"):
+		j := strings.Index(s[1:], "'")
+		if j == -1 {
+			return "", false
+		}
+		return s[:j+2], true
+	}
+	j := strings.IndexAny(s, ",}")
+	if j == -1 {
+		return "", false
+	}
+	return strings.TrimSpace(s[:j]), true
+}
+
+// WriteFile writes the array to the '.npy' file.
+func WriteFile(fpath string, a *Array) error {
+	f, err := os.OpenFile(fpath, os.O_RDWR|os.O_TRUNC|os.O_CREATE, fileutil.PrivateFileMode)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err = Write(w, a); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Write writes the numeric array in '.npy' format version 1.0.
+// Object arrays are not supported.
+func Write(w io.Writer, a *Array) error {
+	dt, err := parseDescr(a.Descr)
+	if err != nil {
+		return err
+	}
+	if dt.kind == 'O' {
+		return fmt.Errorf("npy: cannot write object array")
+	}
+	if len(a.Data) != a.Len()*dt.size {
+		return fmt.Errorf("npy: expected %d bytes for shape %v, got %d", a.Len()*dt.size, a.Shape, len(a.Data))
+	}
+
+	ds := make([]string, len(a.Shape))
+	for i, d := range a.Shape {
+		ds[i] = strconv.Itoa(d)
+	}
+	shape := "(" + strings.Join(ds, ", ") + ")"
+	if len(ds) == 1 {
+		shape = "(" + ds[0] + ",)"
+	}
+	fo := "False"
+	if a.FortranOrder {
+		fo = "True"
+	}
+	h := fmt.Sprintf("{'descr': '%s', 'fortran_order': %s, 'shape': %s, }", a.Descr, fo, shape)
+
+	// pad with spaces, so that the data is 64-byte aligned
+	total := len(magic) + 4 + len(h) + 1
+	if rem := total % 64; rem != 0 {
+		h += strings.Repeat(" ", 64-rem)
+	}
+	h += "\n"
+	if len(h) > math.MaxUint16 {
+		return fmt.Errorf("npy: header too large (%d bytes)", len(h))
+	}
+
+	buf := make([]byte, 0, len(magic)+4+len(h))
+	buf = append(buf, magic...)
+	buf = append(buf, 1, 0, byte(len(h)), byte(len(h)>>8))
+	buf = append(buf, h...)
+	if _, err = w.Write(buf); err != nil {
+		return err
+	}
+	_, err = w.Write(a.Data)
+	return err
+}
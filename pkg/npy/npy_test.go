@@ -0,0 +1,152 @@
+package npy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadPickledDict(t *testing.T) {
+	arr, err := ReadFile("../../datasets/parameters-cats.npy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arr.Descr != "|O" || len(arr.Shape) != 0 {
+		t.Fatalf("unexpected descr %q, shape %v", arr.Descr, arr.Shape)
+	}
+	d, err := arr.Dict()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shapes := map[string][]int{
+		"W1": {20, 12288}, "b1": {20, 1},
+		"W2": {7, 20}, "b2": {7, 1},
+		"W3": {5, 7}, "b3": {5, 1},
+		"W4": {1, 5}, "b4": {1, 1},
+	}
+	if len(d) != len(shapes) {
+		t.Fatalf("expected %d arrays, got %d", len(shapes), len(d))
+	}
+	for k, shape := range shapes {
+		a, ok := d[k]
+		if !ok {
+			t.Fatalf("%q not found", k)
+		}
+		if a.Descr != "<f8" || !reflect.DeepEqual(a.Shape, shape) {
+			t.Fatalf("%q: expected <f8 %v, got %q %v", k, shape, a.Descr, a.Shape)
+		}
+		vs, err := a.Float64s()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vs) != a.Len() {
+			t.Fatalf("%q: expected %d values, got %d", k, a.Len(), len(vs))
+		}
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	a, err := NewFloat64([]int{2, 3}, []float64{1, 2, 3, 4, 5, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = Write(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len()%64 != 48 || (buf.Len()-48)%64 != 0 {
+		t.Fatalf("expected 64-byte aligned header, got %d bytes", buf.Len())
+	}
+	b, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("expected %+v, got %+v", a, b)
+	}
+
+	if _, err = NewFloat32([]int{2}, []float32{1, 2, 3}); err == nil {
+		t.Fatal("expected shape mismatch error")
+	}
+	if err = Write(&buf, &Array{Descr: "|O", Objects: []interface{}{1}}); err == nil {
+		t.Fatal("expected error on object array")
+	}
+}
+
+func TestFortranOrder(t *testing.T) {
+	// [[1, 2, 3], [4, 5, 6]] in column-major order
+	a, err := NewInt64([]int{6}, []int64{1, 4, 2, 5, 3, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Shape, a.FortranOrder = []int{2, 3}, true
+	vs, err := a.Int64s()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vs, []int64{1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("unexpected values %v", vs)
+	}
+	fs, err := a.Float32s()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fs, []float32{1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("unexpected values %v", fs)
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		s   string
+		exp header
+		err bool
+	}{
+		{"{'descr': '<f8', 'fortran_order': False, 'shape': (20, 12288), }", header{"<f8", false, []int{20, 12288}}, false},
+		{"{'descr': '|u1', 'fortran_order': True, 'shape': (3,), }", header{"|u1", true, []int{3}}, false},
+		{"{'descr': '|O', 'fortran_order': False, 'shape': (), }", header{"|O", false, []int{}}, false},
+		{"{'shape': (2L, 3L), 'fortran_order': False, 'descr': '>i4'}", header{">i4", false, []int{2, 3}}, false},
+		{"{'descr': '<f8', 'shape': (2,), }", header{}, true},
+		{"{'descr': '<f8', 'fortran_order': False, 'shape': (a,), }", header{}, true},
+	}
+	for i, tt := range tests {
+		h, err := parseHeader(tt.s)
+		if (err != nil) != tt.err {
+			t.Fatalf("#%d: expected error %v, got %v", i, tt.err, err)
+		}
+		if err == nil && !reflect.DeepEqual(h, tt.exp) {
+			t.Fatalf("#%d: expected %+v, got %+v", i, tt.exp, h)
+		}
+	}
+}
+
+func TestNPZ(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "npy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewFloat32([]int{2, 2}, []float32{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewInt64([]int{2}, []int64{-1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fpath := filepath.Join(dir, "params.npz")
+	if err = WriteNPZ(fpath, map[string]*Array{"W1": w, "b1": b}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadNPZ(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, map[string]*Array{"W1": w, "b1": b}) {
+		t.Fatalf("unexpected arrays %+v", m)
+	}
+}
@@ -0,0 +1,67 @@
+package npy
+
+import (
+	"archive/zip"
+	"bufio"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gyuho/dplearn/pkg/fileutil"
+)
+
+// ReadNPZ reads the arrays in the '.npz' file, keyed by their names
+// without ".npy" extension (e.g. 'np.savez(path, W1=W1)' to "W1").
+func ReadNPZ(fpath string) (map[string]*Array, error) {
+	zr, err := zip.OpenReader(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	m := make(map[string]*Array, len(zr.File))
+	for _, zf := range zr.File {
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		a, err := Read(bufio.NewReader(rc))
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		m[strings.TrimSuffix(zf.Name, ".npy")] = a
+	}
+	return m, nil
+}
+
+// WriteNPZ writes the arrays to the '.npz' file, as 'np.savez'.
+func WriteNPZ(fpath string, arrays map[string]*Array) error {
+	f, err := os.OpenFile(fpath, os.O_RDWR|os.O_TRUNC|os.O_CREATE, fileutil.PrivateFileMode)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+
+	names := make([]string, 0, len(arrays))
+	for name := range arrays {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w, err := zw.Create(name + ".npy")
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if err = Write(w, arrays[name]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
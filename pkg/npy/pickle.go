@@ -0,0 +1,531 @@
+package npy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// pickle opcodes, used by numpy to save object arrays
+// (e.g. 'np.save(path, parameters)' of a Python dictionary).
+const (
+	opMark            = '('
+	opStop            = '.'
+	opBinFloat        = 'G'
+	opBinInt          = 'J'
+	opBinInt1         = 'K'
+	opBinInt2         = 'M'
+	opNone            = 'N'
+	opBinUnicode      = 'X'
+	opAppend          = 'a'
+	opBuild           = 'b'
+	opGlobal          = 'c'
+	opAppends         = 'e'
+	opBinGet          = 'h'
+	opLongBinGet      = 'j'
+	opEmptyList       = ']'
+	opBinPut          = 'q'
+	opLongBinPut      = 'r'
+	opSetItem         = 's'
+	opTuple           = 't'
+	opEmptyTuple      = ')'
+	opSetItems        = 'u'
+	opEmptyDict       = '}'
+	opReduce          = 'R'
+	opBinString       = 'T'
+	opShortBinString  = 'U'
+	opBinBytes        = 'B'
+	opShortBinBytes   = 'C'
+	opProto           = 0x80
+	opTuple1          = 0x85
+	opTuple2          = 0x86
+	opTuple3          = 0x87
+	opNewTrue         = 0x88
+	opNewFalse        = 0x89
+	opShortBinUnicode = 0x8c
+	opMemoize         = 0x94
+	opFrame           = 0x95
+)
+
+type pyGlobal struct {
+	module string
+	name   string
+}
+
+type pyList struct {
+	items []interface{}
+}
+
+type pyTuple []interface{}
+
+type pyDict map[interface{}]interface{}
+
+type markObject struct{}
+
+// pyDtype is 'numpy.dtype'.
+type pyDtype struct {
+	descr string // e.g. "f8"
+	order byte   // '<', '>', '|' or '='
+}
+
+// unpickle decodes protocol 2-4 pickle data with numpy arrays.
+// It only supports the subset of opcodes and globals that numpy uses.
+//
+// Python values are decoded as: ndarray to *Array, dict to
+// map[interface{}]interface{}, list and tuple to []interface{}, str to
+// string, bytes to []byte, int to int, float to float64, bool to bool,
+// and None to nil.
+func unpickle(r io.Reader) (interface{}, error) {
+	br := bufio.NewReader(r)
+
+	var (
+		stack []interface{}
+		memo  = make(map[int]interface{})
+	)
+	pop := func() (interface{}, error) {
+		if len(stack) == 0 {
+			return nil, fmt.Errorf("pickle: stack underflow")
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v, nil
+	}
+	popMark := func() ([]interface{}, error) {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if _, ok := stack[i].(markObject); ok {
+				vs := append([]interface{}{}, stack[i+1:]...)
+				stack = stack[:i]
+				return vs, nil
+			}
+		}
+		return nil, fmt.Errorf("pickle: mark not found")
+	}
+	top := func() (interface{}, error) {
+		if len(stack) == 0 {
+			return nil, fmt.Errorf("pickle: stack underflow")
+		}
+		return stack[len(stack)-1], nil
+	}
+	readN := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		_, err := io.ReadFull(br, b)
+		return b, err
+	}
+	readUint := func(n int) (int, error) {
+		b, err := readN(n)
+		if err != nil {
+			return 0, err
+		}
+		var v uint64
+		for i := n - 1; i >= 0; i-- {
+			v = v<<8 | uint64(b[i])
+		}
+		return int(v), nil
+	}
+	readLine := func() (string, error) {
+		s, err := br.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		return s[:len(s)-1], nil
+	}
+
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case opProto:
+			if _, err = br.ReadByte(); err != nil {
+				return nil, err
+			}
+
+		case opFrame:
+			if _, err = readN(8); err != nil {
+				return nil, err
+			}
+
+		case opStop:
+			v, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			return toGo(v), nil
+
+		case opMark:
+			stack = append(stack, markObject{})
+
+		case opNone:
+			stack = append(stack, nil)
+		case opNewTrue:
+			stack = append(stack, true)
+		case opNewFalse:
+			stack = append(stack, false)
+
+		case opBinInt1, opBinInt2:
+			n := 1
+			if op == opBinInt2 {
+				n = 2
+			}
+			v, err := readUint(n)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, v)
+
+		case opBinInt:
+			v, err := readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, int(int32(v)))
+
+		case opBinFloat:
+			b, err := readN(8)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(b)))
+
+		case opBinUnicode, opShortBinUnicode, opBinString, opShortBinString:
+			// Python 2 str is also decoded as string
+			n := 4
+			if op == opShortBinUnicode || op == opShortBinString {
+				n = 1
+			}
+			size, err := readUint(n)
+			if err != nil {
+				return nil, err
+			}
+			b, err := readN(size)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, string(b))
+
+		case opBinBytes, opShortBinBytes:
+			n := 4
+			if op == opShortBinBytes {
+				n = 1
+			}
+			size, err := readUint(n)
+			if err != nil {
+				return nil, err
+			}
+			b, err := readN(size)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, b)
+
+		case opGlobal:
+			module, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			name, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, &pyGlobal{module: module, name: name})
+
+		case opBinPut, opLongBinPut:
+			n := 1
+			if op == opLongBinPut {
+				n = 4
+			}
+			idx, err := readUint(n)
+			if err != nil {
+				return nil, err
+			}
+			v, err := top()
+			if err != nil {
+				return nil, err
+			}
+			memo[idx] = v
+
+		case opMemoize:
+			v, err := top()
+			if err != nil {
+				return nil, err
+			}
+			memo[len(memo)] = v
+
+		case opBinGet, opLongBinGet:
+			n := 1
+			if op == opLongBinGet {
+				n = 4
+			}
+			idx, err := readUint(n)
+			if err != nil {
+				return nil, err
+			}
+			v, ok := memo[idx]
+			if !ok {
+				return nil, fmt.Errorf("pickle: memo %d not found", idx)
+			}
+			stack = append(stack, v)
+
+		case opEmptyTuple:
+			stack = append(stack, pyTuple{})
+		case opTuple1, opTuple2, opTuple3:
+			n := int(op-opTuple1) + 1
+			if len(stack) < n {
+				return nil, fmt.Errorf("pickle: stack underflow")
+			}
+			t := append(pyTuple{}, stack[len(stack)-n:]...)
+			stack = append(stack[:len(stack)-n], t)
+		case opTuple:
+			vs, err := popMark()
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, pyTuple(vs))
+
+		case opEmptyList:
+			stack = append(stack, &pyList{})
+		case opAppend:
+			v, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			t, err := top()
+			if err != nil {
+				return nil, err
+			}
+			l, ok := t.(*pyList)
+			if !ok {
+				return nil, fmt.Errorf("pickle: cannot append to %T", t)
+			}
+			l.items = append(l.items, v)
+		case opAppends:
+			vs, err := popMark()
+			if err != nil {
+				return nil, err
+			}
+			t, err := top()
+			if err != nil {
+				return nil, err
+			}
+			l, ok := t.(*pyList)
+			if !ok {
+				return nil, fmt.Errorf("pickle: cannot append to %T", t)
+			}
+			l.items = append(l.items, vs...)
+
+		case opEmptyDict:
+			stack = append(stack, pyDict{})
+		case opSetItem, opSetItems:
+			var vs []interface{}
+			if op == opSetItems {
+				vs, err = popMark()
+			} else {
+				var k, v interface{}
+				if v, err = pop(); err == nil {
+					k, err = pop()
+				}
+				vs = []interface{}{k, v}
+			}
+			if err != nil {
+				return nil, err
+			}
+			t, err := top()
+			if err != nil {
+				return nil, err
+			}
+			d, ok := t.(pyDict)
+			if !ok || len(vs)%2 != 0 {
+				return nil, fmt.Errorf("pickle: cannot set items to %T", t)
+			}
+			for i := 0; i < len(vs); i += 2 {
+				switch vs[i].(type) {
+				case pyTuple, *pyList, pyDict, []byte:
+					return nil, fmt.Errorf("pickle: dictionary key %T not supported", vs[i])
+				}
+				d[vs[i]] = vs[i+1]
+			}
+
+		case opReduce:
+			args, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			fn, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			v, err := reduce(fn, args)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, v)
+
+		case opBuild:
+			state, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			v, err := top()
+			if err != nil {
+				return nil, err
+			}
+			if err = build(v, state); err != nil {
+				return nil, err
+			}
+
+		default:
+			return nil, fmt.Errorf("pickle: opcode 0x%02x not supported", op)
+		}
+	}
+}
+
+// reduce calls the global with the arguments.
+func reduce(fn, args interface{}) (interface{}, error) {
+	g, ok := fn.(*pyGlobal)
+	if !ok {
+		return nil, fmt.Errorf("pickle: cannot call %T", fn)
+	}
+	t, ok := args.(pyTuple)
+	if !ok {
+		return nil, fmt.Errorf("pickle: invalid arguments %T to %s.%s", args, g.module, g.name)
+	}
+
+	switch g.module + "." + g.name {
+	case "numpy.core.multiarray._reconstruct":
+		return &Array{}, nil
+
+	case "numpy.dtype":
+		if len(t) == 0 {
+			return nil, fmt.Errorf("pickle: numpy.dtype without arguments")
+		}
+		descr, ok := t[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("pickle: invalid numpy.dtype %v", t[0])
+		}
+		return &pyDtype{descr: descr, order: '|'}, nil
+
+	case "_codecs.encode":
+		// Python 3 encodes bytes as latin1 unicode
+		if len(t) != 2 {
+			return nil, fmt.Errorf("pickle: invalid _codecs.encode arguments %v", t)
+		}
+		s, ok := t[0].(string)
+		if !ok || t[1] != "latin1" {
+			return nil, fmt.Errorf("pickle: invalid _codecs.encode arguments %v", t)
+		}
+		b := make([]byte, 0, len(s))
+		for _, r := range s {
+			if r > 0xff {
+				return nil, fmt.Errorf("pickle: invalid latin1 rune %q", r)
+			}
+			b = append(b, byte(r))
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("pickle: global %s.%s not supported", g.module, g.name)
+}
+
+// String returns the array protocol type string (e.g. "<f8").
+func (dt *pyDtype) String() string {
+	if strings.HasPrefix(dt.descr, "O") {
+		return "|O"
+	}
+	order := dt.order
+	if order == '=' {
+		order = '<'
+	}
+	return string(order) + dt.descr
+}
+
+// toGo converts the decoded Python objects to Go values.
+func toGo(v interface{}) interface{} {
+	switch o := v.(type) {
+	case *pyList:
+		return toGoSlice(o.items)
+	case pyTuple:
+		return toGoSlice(o)
+	case pyDict:
+		m := make(map[interface{}]interface{}, len(o))
+		for k, v := range o {
+			m[toGo(k)] = toGo(v)
+		}
+		return m
+	case *Array:
+		if o.Objects != nil {
+			o.Objects = toGoSlice(o.Objects)
+		}
+		return o
+	}
+	return v
+}
+
+func toGoSlice(vs []interface{}) []interface{} {
+	out := make([]interface{}, len(vs))
+	for i, v := range vs {
+		out[i] = toGo(v)
+	}
+	return out
+}
+
+// build sets the state of the object.
+func build(v, state interface{}) error {
+	t, ok := state.(pyTuple)
+	if !ok {
+		return fmt.Errorf("pickle: invalid state %T", state)
+	}
+
+	switch o := v.(type) {
+	case *pyDtype:
+		// (version, byte order, subarray, names, fields, itemsize, alignment, flags)
+		if len(t) < 2 {
+			return fmt.Errorf("pickle: invalid dtype state %v", t)
+		}
+		order, ok := t[1].(string)
+		if !ok || len(order) != 1 {
+			return fmt.Errorf("pickle: invalid dtype byte order %v", t[1])
+		}
+		o.order = order[0]
+		return nil
+
+	case *Array:
+		// (version, shape, dtype, is Fortran, data)
+		if len(t) != 5 {
+			return fmt.Errorf("pickle: invalid ndarray state %v", t)
+		}
+		shape, ok := t[1].(pyTuple)
+		if !ok {
+			return fmt.Errorf("pickle: invalid ndarray shape %v", t[1])
+		}
+		o.Shape = []int{}
+		for _, d := range shape {
+			n, ok := d.(int)
+			if !ok {
+				return fmt.Errorf("pickle: invalid ndarray shape %v", t[1])
+			}
+			o.Shape = append(o.Shape, n)
+		}
+		dt, ok := t[2].(*pyDtype)
+		if !ok {
+			return fmt.Errorf("pickle: invalid ndarray dtype %v", t[2])
+		}
+		o.Descr = dt.String()
+		o.FortranOrder, _ = t[3].(bool)
+		switch data := t[4].(type) {
+		case []byte:
+			o.Data = data
+		case string:
+			o.Data = []byte(data)
+		case *pyList:
+			o.Objects = data.items
+		default:
+			return fmt.Errorf("pickle: invalid ndarray data %T", t[4])
+		}
+		return nil
+	}
+	return fmt.Errorf("pickle: cannot build %T", v)
+}
@@ -0,0 +1,79 @@
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Exporter sends finished spans to a backend.
+type Exporter interface {
+	// ExportSpan exports the span. It must not block for long,
+	// since spans are exported on the request path.
+	ExportSpan(s *Span)
+}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   Exporter
+)
+
+// SetExporter sets the exporter of all spans in the process.
+// Spans are not exported by default, or when the exporter is nil.
+func SetExporter(e Exporter) {
+	exporterMu.Lock()
+	exporter = e
+	exporterMu.Unlock()
+}
+
+func getExporter() Exporter {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+	return exporter
+}
+
+type jsonExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONExporter returns the exporter that writes spans to the writer,
+// one JSON object per line (e.g. to stdout, for offline analysis).
+func NewJSONExporter(w io.Writer) Exporter {
+	return &jsonExporter{w: w}
+}
+
+func (e *jsonExporter) ExportSpan(s *Span) {
+	s.mu.Lock()
+	bts, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		glog.Warningf("failed to encode span %q (%v)", s.Name, err)
+		return
+	}
+	e.mu.Lock()
+	_, err = e.w.Write(append(bts, '\n'))
+	e.mu.Unlock()
+	if err != nil {
+		glog.Warningf("failed to export span %q (%v)", s.Name, err)
+	}
+}
+
+// OpenJSONExporter returns the JSON exporter to "stdout", "stderr", or the
+// file to append, and the function to close the file.
+func OpenJSONExporter(dest string) (Exporter, func() error, error) {
+	switch dest {
+	case "stdout":
+		return NewJSONExporter(os.Stdout), func() error { return nil }, nil
+	case "stderr":
+		return NewJSONExporter(os.Stderr), func() error { return nil }, nil
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewJSONExporter(f), f.Close, nil
+}
@@ -0,0 +1,201 @@
+// Package trace implements spans to measure latencies across the web
+// server, queue and workers. Trace context is propagated in W3C
+// 'traceparent' format (e.g. in HTTP headers or queue items), and finished
+// spans are sent to the exporter (see 'SetExporter').
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceParentHeader is the header field of W3C trace context.
+const TraceParentHeader = "Traceparent"
+
+// SpanContext identifies a span in a trace.
+type SpanContext struct {
+	// TraceID is 32 lowercase hex characters.
+	TraceID string
+	// SpanID is 16 lowercase hex characters, empty when only
+	// the trace is known.
+	SpanID string
+}
+
+// IsValid returns true if the trace ID is valid.
+func (sc SpanContext) IsValid() bool {
+	return IsTraceID(sc.TraceID) && (sc.SpanID == "" || isHex(sc.SpanID, 16))
+}
+
+// TraceParent returns the context in 'traceparent' format
+// (e.g. "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01").
+func (sc SpanContext) TraceParent() string {
+	if !sc.IsValid() || sc.SpanID == "" {
+		return ""
+	}
+	return "00-" + sc.TraceID + "-" + sc.SpanID + "-01"
+}
+
+// ParseTraceParent parses the context in 'traceparent' format.
+func ParseTraceParent(s string) (SpanContext, error) {
+	ss := strings.Split(strings.TrimSpace(s), "-")
+	if len(ss) < 4 || !isHex(ss[0], 2) || ss[0] == "ff" || (ss[0] == "00" && len(ss) != 4) {
+		return SpanContext{}, fmt.Errorf("trace: invalid traceparent %q", s)
+	}
+	sc := SpanContext{TraceID: ss[1], SpanID: ss[2]}
+	if !sc.IsValid() || sc.SpanID == "" || sc.SpanID == strings.Repeat("0", 16) {
+		return SpanContext{}, fmt.Errorf("trace: invalid traceparent %q", s)
+	}
+	return sc, nil
+}
+
+// IsTraceID returns true if the string is a valid trace ID.
+func IsTraceID(s string) bool {
+	return isHex(s, 32) && s != strings.Repeat("0", 32)
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// NewTraceID returns a random trace ID.
+func NewTraceID() string { return randomHex(16) }
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// fall back to the clock, IDs only need to be unique in practice
+		now := time.Now().UnixNano()
+		for i := range b {
+			b[i] = byte(now >> uint(8*(i%8)))
+		}
+	}
+	return hex.EncodeToString(b)
+}
+
+// Span measures an operation. Spans are exported when ended.
+type Span struct {
+	Name       string            `json:"name"`
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	DurationMS float64           `json:"duration_ms"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// Context returns the context of the span, to propagate to children.
+func (s *Span) Context() SpanContext {
+	return SpanContext{TraceID: s.TraceID, SpanID: s.SpanID}
+}
+
+// SetAttribute sets the attribute of the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = fmt.Sprint(value)
+	s.mu.Unlock()
+}
+
+// SetError records the error of the operation, if not nil.
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Error = err.Error()
+	s.mu.Unlock()
+}
+
+// Finish ends the span and exports it. Only the first call takes effect.
+func (s *Span) Finish() {
+	s.FinishAt(time.Now())
+}
+
+// FinishAt ends the span at the time, and exports it.
+func (s *Span) FinishAt(end time.Time) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = end
+	s.DurationMS = float64(end.Sub(s.Start)) / float64(time.Millisecond)
+	s.mu.Unlock()
+
+	if e := getExporter(); e != nil {
+		e.ExportSpan(s)
+	}
+}
+
+type spanKeyType struct{}
+
+var spanKey spanKeyType
+
+// Start starts the span, as a child of the span or remote parent
+// in the context. It starts a new trace if the context has none.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return StartAt(ctx, name, time.Now())
+}
+
+// StartAt starts the span at the time (e.g. when the item was enqueued).
+func StartAt(ctx context.Context, name string, start time.Time) (context.Context, *Span) {
+	s := &Span{Name: name, SpanID: randomHex(8), Start: start}
+	if parent := SpanContextFrom(ctx); parent.IsValid() {
+		s.TraceID, s.ParentID = parent.TraceID, parent.SpanID
+	} else {
+		s.TraceID = NewTraceID()
+	}
+	return context.WithValue(ctx, spanKey, s.Context()), s
+}
+
+// SpanContextFrom returns the context of the current span, or zero value.
+func SpanContextFrom(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanKey).(SpanContext)
+	return sc
+}
+
+// WithRemoteParent returns the context whose spans are children of the
+// remote span. The span ID may be empty, to only join the trace.
+func WithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey, sc)
+}
+
+// Inject returns the 'traceparent' of the current span in the context,
+// or empty string.
+func Inject(ctx context.Context) string {
+	return SpanContextFrom(ctx).TraceParent()
+}
+
+// Extract returns the context with the remote parent in 'traceparent',
+// or the same context if it is invalid.
+func Extract(ctx context.Context, traceParent string) context.Context {
+	sc, err := ParseTraceParent(traceParent)
+	if err != nil {
+		return ctx
+	}
+	return WithRemoteParent(ctx, sc)
+}
@@ -0,0 +1,127 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *recorder) ExportSpan(s *Span) {
+	r.mu.Lock()
+	r.spans = append(r.spans, s)
+	r.mu.Unlock()
+}
+
+func TestTraceParent(t *testing.T) {
+	tests := []struct {
+		s  string
+		ok bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-01", false},
+		{"", false},
+	}
+	for i, tt := range tests {
+		sc, err := ParseTraceParent(tt.s)
+		if (err == nil) != tt.ok {
+			t.Fatalf("#%d: %q expected ok %v, got %v", i, tt.s, tt.ok, err)
+		}
+		if err == nil && (sc.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID != "00f067aa0ba902b7") {
+			t.Fatalf("#%d: unexpected span context %+v", i, sc)
+		}
+	}
+
+	sc := SpanContext{TraceID: NewTraceID(), SpanID: "00f067aa0ba902b7"}
+	parsed, err := ParseTraceParent(sc.TraceParent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != sc {
+		t.Fatalf("expected %+v, got %+v", sc, parsed)
+	}
+	if tp := (SpanContext{TraceID: sc.TraceID}).TraceParent(); tp != "" {
+		t.Fatalf("expected no traceparent without span ID, got %q", tp)
+	}
+}
+
+func TestSpan(t *testing.T) {
+	r := &recorder{}
+	SetExporter(r)
+	defer SetExporter(nil)
+
+	ctx, root := Start(context.Background(), "root")
+	if root.ParentID != "" || !IsTraceID(root.TraceID) {
+		t.Fatalf("unexpected root span %+v", root)
+	}
+	_, child := Start(ctx, "child")
+	child.SetAttribute("n", 1)
+	child.SetError(fmt.Errorf("failed"))
+	child.Finish()
+	child.Finish()
+
+	// remote child, e.g. worker of the queue item
+	rctx := Extract(context.Background(), Inject(ctx))
+	_, remote := StartAt(rctx, "remote", time.Now().Add(-time.Second))
+	remote.Finish()
+	root.Finish()
+
+	if len(r.spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(r.spans))
+	}
+	for i, s := range r.spans[:2] {
+		if s.TraceID != root.TraceID || s.ParentID != root.SpanID {
+			t.Fatalf("#%d: expected child of %+v, got %+v", i, root.Context(), s)
+		}
+	}
+	if child.Attributes["n"] != "1" || child.Error != "failed" {
+		t.Fatalf("unexpected child span %+v", child)
+	}
+	if remote.DurationMS < 1000 {
+		t.Fatalf("expected duration from the start time, got %v", remote.DurationMS)
+	}
+
+	// invalid parent starts a new trace
+	_, s := Start(Extract(context.Background(), "invalid"), "new")
+	if s.ParentID != "" || s.TraceID == root.TraceID {
+		t.Fatalf("expected new trace, got %+v", s)
+	}
+	// trace without span ID
+	_, s = Start(WithRemoteParent(context.Background(), SpanContext{TraceID: root.TraceID}), "joined")
+	if s.ParentID != "" || s.TraceID != root.TraceID {
+		t.Fatalf("expected span in the trace %q, got %+v", root.TraceID, s)
+	}
+}
+
+func TestJSONExporter(t *testing.T) {
+	var buf bytes.Buffer
+	SetExporter(NewJSONExporter(&buf))
+	defer SetExporter(nil)
+
+	_, s := Start(context.Background(), "test")
+	s.SetAttribute("key", "value")
+	s.Finish()
+
+	var got Span
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "test" || got.TraceID != s.TraceID || got.SpanID != s.SpanID || got.Attributes["key"] != "value" || got.End.IsZero() {
+		t.Fatalf("unexpected span %+v", &got)
+	}
+}
@@ -0,0 +1,123 @@
+package urlutil
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+var (
+	// ErrTooLarge is returned when the content exceeds the size limit.
+	ErrTooLarge = fmt.Errorf("urlutil: content exceeds the size limit")
+
+	// ErrRangeNotSupported is returned when the server ignores the range request,
+	// and responds with the full content.
+	ErrRangeNotSupported = fmt.Errorf("urlutil: range request not supported")
+
+	// ErrRangeNotSatisfiable is returned when the offset is beyond the content
+	// (e.g. the content has already been downloaded).
+	ErrRangeNotSatisfiable = fmt.Errorf("urlutil: range not satisfiable")
+)
+
+// ProgressFunc is called with the number of bytes written so far,
+// and the total number of bytes (-1 if unknown).
+type ProgressFunc func(written, total int64)
+
+type downloadOp struct {
+	progress ProgressFunc
+	offset   int64
+}
+
+// DownloadOption configures Download.
+type DownloadOption func(*downloadOp)
+
+// WithProgress configures the progress callback.
+func WithProgress(fn ProgressFunc) DownloadOption {
+	return func(op *downloadOp) { op.progress = fn }
+}
+
+// WithOffset requests the content from the byte offset, to resume
+// the previous download. The progress and the size limit include the offset,
+// while the returned digest only covers the bytes written by this download.
+func WithOffset(offset int64) DownloadOption {
+	return func(op *downloadOp) { op.offset = offset }
+}
+
+// Download streams the URL contents to the writer, and returns the
+// hex-encoded SHA-256 digest of the written bytes. If 'maxBytes' > 0,
+// it returns 'ErrTooLarge' as soon as the content exceeds 'maxBytes',
+// regardless of the Content-Length header. The writer never receives
+// more than 'maxBytes'.
+func Download(ctx context.Context, ep string, w io.Writer, maxBytes int64, opts ...DownloadOption) (string, error) {
+	return download(ctx, http.DefaultClient, ep, w, maxBytes, opts)
+}
+
+func download(ctx context.Context, cli *http.Client, ep string, w io.Writer, maxBytes int64, opts []DownloadOption) (string, error) {
+	op := downloadOp{}
+	for _, opt := range opts {
+		opt(&op)
+	}
+
+	var header http.Header
+	if op.offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", op.offset)}}
+	}
+	resp, err := do(ctx, cli, http.MethodGet, ep, header)
+	if err != nil {
+		if se, ok := err.(*StatusError); ok && se.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return "", ErrRangeNotSatisfiable
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if op.offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		return "", ErrRangeNotSupported
+	}
+
+	total := resp.ContentLength
+	if total >= 0 {
+		total += op.offset
+	}
+	if maxBytes > 0 && total > maxBytes {
+		return "", ErrTooLarge
+	}
+
+	h := sha256.New()
+	pw := &progressWriter{
+		w:        io.MultiWriter(w, h),
+		written:  op.offset,
+		maxBytes: maxBytes,
+		total:    total,
+		progress: op.progress,
+	}
+	if _, err = io.Copy(pw, resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// progressWriter counts the written bytes, to enforce the size limit
+// and to report progress.
+type progressWriter struct {
+	w        io.Writer
+	written  int64
+	maxBytes int64
+	total    int64
+	progress ProgressFunc
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	if pw.maxBytes > 0 && pw.written+int64(len(p)) > pw.maxBytes {
+		return 0, ErrTooLarge
+	}
+	n, err := pw.w.Write(p)
+	pw.written += int64(n)
+	if pw.progress != nil {
+		pw.progress(pw.written, pw.total)
+	}
+	return n, err
+}
@@ -0,0 +1,130 @@
+package urlutil
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownload(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 1000)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/data", func(w http.ResponseWriter, req *http.Request) {
+		w.Write(data)
+	})
+	mux.HandleFunc("/chunked", func(w http.ResponseWriter, req *http.Request) {
+		// no Content-Length, so the size is only known while reading
+		for i := 0; i < 10; i++ {
+			w.Write(data)
+			w.(http.Flusher).Flush()
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	buf := new(bytes.Buffer)
+	var written, total int64
+	digest, err := Download(context.Background(), ts.URL+"/data", buf, 2000, WithProgress(func(n, t int64) {
+		written, total = n, t
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "41edece42d63e8d9bf515a9ba6932e1c20cbc9f5a5d134645adb5db1b9737ea3"
+	if digest != exp {
+		t.Fatalf("expected digest %q, got %q", exp, digest)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("expected %d bytes, got %d", len(data), buf.Len())
+	}
+	if written != 1000 || total != 1000 {
+		t.Fatalf("expected progress 1000/1000, got %d/%d", written, total)
+	}
+
+	buf.Reset()
+	if _, err = Download(context.Background(), ts.URL+"/data", buf, 500); err != ErrTooLarge {
+		t.Fatalf("expected %v, got %v", ErrTooLarge, err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected no bytes written, got %d", buf.Len())
+	}
+
+	buf.Reset()
+	if _, err = Download(context.Background(), ts.URL+"/chunked", buf, 5500); err != ErrTooLarge {
+		t.Fatalf("expected %v, got %v", ErrTooLarge, err)
+	}
+	if buf.Len() > 5500 {
+		t.Fatalf("expected at most 5500 bytes written, got %d", buf.Len())
+	}
+
+	buf.Reset()
+	if _, err = Download(context.Background(), ts.URL+"/chunked", buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 10000 {
+		t.Fatalf("expected 10000 bytes written, got %d", buf.Len())
+	}
+
+	if _, err = Download(context.Background(), ts.URL+"/not-found", buf, 0); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected 404 error, got %v", err)
+	}
+}
+
+func TestGetContentLengthUnknown(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.(http.Flusher).Flush()
+	}))
+	defer ts.Close()
+
+	if _, _, err := GetContentLength(ts.URL); err != ErrUnknownContentLength {
+		t.Fatalf("expected %v, got %v", ErrUnknownContentLength, err)
+	}
+}
+
+func TestDownloadWithOffset(t *testing.T) {
+	data := []byte("hello world")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/range", func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "data", time.Time{}, bytes.NewReader(data))
+	})
+	mux.HandleFunc("/no-range", func(w http.ResponseWriter, req *http.Request) {
+		w.Write(data)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	buf := bytes.NewBufferString("hello")
+	var written, total int64
+	_, err := Download(context.Background(), ts.URL+"/range", buf, 0, WithOffset(5), WithProgress(func(n, t int64) {
+		written, total = n, t
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("expected %q, got %q", string(data), buf.String())
+	}
+	if written != 11 || total != 11 {
+		t.Fatalf("expected progress 11/11, got %d/%d", written, total)
+	}
+
+	if _, err = Download(context.Background(), ts.URL+"/range", buf, 0, WithOffset(11)); err != ErrRangeNotSatisfiable {
+		t.Fatalf("expected %v, got %v", ErrRangeNotSatisfiable, err)
+	}
+	if _, err = Download(context.Background(), ts.URL+"/range", new(bytes.Buffer), 8, WithOffset(5)); err != ErrTooLarge {
+		t.Fatalf("expected %v, got %v", ErrTooLarge, err)
+	}
+
+	buf.Reset()
+	if _, err = Download(context.Background(), ts.URL+"/no-range", buf, 0, WithOffset(5)); err != ErrRangeNotSupported {
+		t.Fatalf("expected %v, got %v", ErrRangeNotSupported, err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected no bytes written, got %q", buf.String())
+	}
+}
@@ -0,0 +1,261 @@
+package urlutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultDeniedCIDRs is the list of IP ranges that 'Fetcher' denies by default:
+// unspecified, private, shared, loopback, link-local (e.g. cloud metadata
+// servers), benchmarking, multicast and reserved ranges.
+var DefaultDeniedCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+const (
+	// DefaultMaxRedirects is the default maximum number of redirects to follow.
+	DefaultMaxRedirects = 3
+
+	// DefaultFetchTimeout is the default deadline for each request,
+	// including reading the response body.
+	DefaultFetchTimeout = 30 * time.Second
+)
+
+// Fetcher fetches user-supplied URLs with restrictions on schemes,
+// resolved IPs and redirects, so that the URLs cannot reach internal
+// services (e.g. etcd, cloud metadata servers). The resolved IPs are
+// checked on every connection, thus after every redirect.
+type Fetcher struct {
+	schemes      map[string]struct{}
+	allowedCIDRs []string
+	deniedCIDRs  []string
+	allowedNets  []*net.IPNet
+	deniedNets   []*net.IPNet
+	maxRedirects int
+	timeout      time.Duration
+
+	dialer *net.Dialer
+	client *http.Client
+}
+
+// FetcherOption configures Fetcher.
+type FetcherOption func(*Fetcher)
+
+// WithAllowedSchemes overwrites the allowed URL schemes ("http", "https" by default).
+func WithAllowedSchemes(schemes ...string) FetcherOption {
+	return func(f *Fetcher) {
+		f.schemes = make(map[string]struct{}, len(schemes))
+		for _, s := range schemes {
+			f.schemes[strings.ToLower(s)] = struct{}{}
+		}
+	}
+}
+
+// WithAllowedCIDRs allows the IP ranges, even if they are denied.
+func WithAllowedCIDRs(cidrs ...string) FetcherOption {
+	return func(f *Fetcher) { f.allowedCIDRs = cidrs }
+}
+
+// WithDeniedCIDRs overwrites the denied IP ranges ('DefaultDeniedCIDRs' by default).
+func WithDeniedCIDRs(cidrs ...string) FetcherOption {
+	return func(f *Fetcher) { f.deniedCIDRs = cidrs }
+}
+
+// WithMaxRedirects configures the maximum number of redirects to follow.
+// Zero disables redirects.
+func WithMaxRedirects(n int) FetcherOption {
+	return func(f *Fetcher) { f.maxRedirects = n }
+}
+
+// WithFetchTimeout configures the deadline of each request.
+func WithFetchTimeout(timeout time.Duration) FetcherOption {
+	return func(f *Fetcher) { f.timeout = timeout }
+}
+
+// NewFetcher returns a new Fetcher.
+func NewFetcher(opts ...FetcherOption) (*Fetcher, error) {
+	f := &Fetcher{
+		deniedCIDRs:  DefaultDeniedCIDRs,
+		maxRedirects: DefaultMaxRedirects,
+		timeout:      DefaultFetchTimeout,
+	}
+	WithAllowedSchemes("http", "https")(f)
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	var err error
+	if f.allowedNets, err = parseCIDRs(f.allowedCIDRs); err != nil {
+		return nil, err
+	}
+	if f.deniedNets, err = parseCIDRs(f.deniedCIDRs); err != nil {
+		return nil, err
+	}
+
+	f.dialer = &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	f.client = &http.Client{
+		Transport: &http.Transport{
+			// never go through proxies from environment variables,
+			// which would bypass the IP checks
+			Proxy:                 nil,
+			DialContext:           f.dialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > f.maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", f.maxRedirects)
+			}
+			return f.CheckURL(req.URL.String())
+		},
+	}
+	return f, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// CheckURL returns an error if the URL scheme is not allowed,
+// or if the host is an IP that is not allowed.
+func (f *Fetcher) CheckURL(ep string) error {
+	u, err := url.Parse(ep)
+	if err != nil {
+		return err
+	}
+	if _, ok := f.schemes[strings.ToLower(u.Scheme)]; !ok {
+		return fmt.Errorf("scheme %q is not allowed in %q", u.Scheme, ep)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("no host in %q", ep)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return f.CheckIP(ip)
+	}
+	return nil
+}
+
+// CheckIP returns an error if the IP is not allowed.
+// IPs in allowed ranges are always allowed.
+func (f *Fetcher) CheckIP(ip net.IP) error {
+	for _, n := range f.allowedNets {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	for _, n := range f.deniedNets {
+		if n.Contains(ip) {
+			return fmt.Errorf("IP %s is not allowed (in %s)", ip, n)
+		}
+	}
+	return nil
+}
+
+// dialContext resolves the host, and dials only when every resolved IP
+// is allowed, so that DNS records cannot point to internal addresses.
+func (f *Fetcher) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no IP found for %q", host)
+	}
+	for _, ip := range ips {
+		if err = f.CheckIP(ip.IP); err != nil {
+			return nil, fmt.Errorf("%q resolved to forbidden address (%v)", host, err)
+		}
+	}
+
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = f.dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// GetContentLength fetches the file size of the content.
+// It returns 'ErrUnknownContentLength' if the server does not report the size.
+func (f *Fetcher) GetContentLength(ctx context.Context, ep string) (uint64, string, error) {
+	if err := f.CheckURL(ep); err != nil {
+		return 0, "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	return getContentLength(ctx, f.client, ep)
+}
+
+// Get downloads the URL contents.
+func (f *Fetcher) Get(ctx context.Context, ep string) ([]byte, error) {
+	if err := f.CheckURL(ep); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	resp, err := do(ctx, f.client, http.MethodGet, ep, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var data []byte
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return data, nil
+}
+
+// Download streams the URL contents to the writer, with the same
+// restrictions as Get. See 'Download' for details.
+func (f *Fetcher) Download(ctx context.Context, ep string, w io.Writer, maxBytes int64, opts ...DownloadOption) (string, error) {
+	if err := f.CheckURL(ep); err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	return download(ctx, f.client, ep, w, maxBytes, opts)
+}
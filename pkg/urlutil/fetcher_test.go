@@ -0,0 +1,140 @@
+package urlutil
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetcherDeniesLoopback(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	f, err := NewFetcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Get(context.Background(), ts.URL); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("expected forbidden address error, got %v", err)
+	}
+
+	// resolved by DNS, rather than IP literal
+	ep := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+	if _, err = f.Get(context.Background(), ep); err == nil || !strings.Contains(err.Error(), "forbidden address") {
+		t.Fatalf("expected forbidden address error, got %v", err)
+	}
+
+	f, err = NewFetcher(WithAllowedCIDRs("127.0.0.0/8", "::1/128"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := f.Get(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("expected 'hello', got %q", string(data))
+	}
+}
+
+func TestFetcherRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	mux.HandleFunc("/metadata", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "http://169.254.169.254/computeMetadata/v1/", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/file", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "file:///etc/passwd", http.StatusFound)
+	})
+	mux.HandleFunc("/once", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "/ok", http.StatusFound)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	f, err := NewFetcher(WithAllowedCIDRs("127.0.0.0/8"), WithMaxRedirects(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Get(context.Background(), ts.URL+"/once"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Get(context.Background(), ts.URL+"/metadata"); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("expected forbidden address error, got %v", err)
+	}
+	if _, err = f.Get(context.Background(), ts.URL+"/loop"); err == nil || !strings.Contains(err.Error(), "stopped after 2 redirects") {
+		t.Fatalf("expected redirect limit error, got %v", err)
+	}
+	if _, err = f.Get(context.Background(), ts.URL+"/file"); err == nil || !strings.Contains(err.Error(), "scheme") {
+		t.Fatalf("expected scheme error, got %v", err)
+	}
+}
+
+func TestFetcherTimeout(t *testing.T) {
+	donec := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-donec:
+		case <-req.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(donec)
+
+	f, err := NewFetcher(WithAllowedCIDRs("127.0.0.0/8"), WithFetchTimeout(300*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if _, err = f.Get(context.Background(), ts.URL); err == nil {
+		t.Fatal("expected timeout error, got nil")
+	}
+	if took := time.Since(now); took > 3*time.Second {
+		t.Fatalf("took too long %v", took)
+	}
+}
+
+func TestFetcherCheckIP(t *testing.T) {
+	f, err := NewFetcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.0.1", false},
+		{"169.254.169.254", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for i, tt := range tests {
+		err := f.CheckIP(net.ParseIP(tt.ip))
+		if tt.allowed != (err == nil) {
+			t.Fatalf("#%d: %q expected allowed %v, got %v", i, tt.ip, tt.allowed, err)
+		}
+	}
+
+	if _, err = NewFetcher(WithDeniedCIDRs("not-a-cidr")); err == nil {
+		t.Fatal("expected CIDR parse error, got nil")
+	}
+}
@@ -2,6 +2,8 @@
 package urlutil
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -24,14 +26,25 @@ func TrimQuery(ep string) string {
 	return raw
 }
 
+// ErrUnknownContentLength is returned when the server does not report the content length.
+var ErrUnknownContentLength = fmt.Errorf("urlutil: unknown content length")
+
 // GetContentLength fetches the file size of the content.
+// It returns 'ErrUnknownContentLength' if the server does not report the size.
 func GetContentLength(ep string) (uint64, string, error) {
-	resp, err := http.Head(ep)
+	return getContentLength(context.Background(), http.DefaultClient, ep)
+}
+
+func getContentLength(ctx context.Context, cli *http.Client, ep string) (uint64, string, error) {
+	resp, err := do(ctx, cli, http.MethodHead, ep, nil)
 	if err != nil {
 		return 0, "", err
 	}
 	io.Copy(ioutil.Discard, resp.Body)
 	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return 0, "", ErrUnknownContentLength
+	}
 	return uint64(resp.ContentLength), humanize.Bytes(uint64(resp.ContentLength)), nil
 }
 
@@ -52,3 +65,36 @@ func Get(ep string) ([]byte, error) {
 
 	return data, nil
 }
+
+// do sends the request, and returns an error on non-2xx status code.
+func do(ctx context.Context, cli *http.Client, method, ep string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, ep, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	resp, err := cli.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, &StatusError{Method: method, URL: ep, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, nil
+}
+
+// StatusError is returned when the server responds with non-2xx status code.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %q returned %q", e.Method, e.URL, e.Status)
+}
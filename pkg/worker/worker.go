@@ -0,0 +1,403 @@
+// Package worker implements workers that process jobs scheduled by
+// backend/web, with the same protocol as 'backend/worker/worker.py'.
+//
+// A worker claims items with GET requests to the queue endpoint
+// (e.g. "http://localhost:2200/cats-request/queue"), which block until
+// an item is available, and posts the progress and results back to the
+// same endpoint.
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/trace"
+
+	"github.com/golang/glog"
+)
+
+// ErrCanceled is returned when the job is canceled by the requester.
+var ErrCanceled = fmt.Errorf("worker: job canceled")
+
+// TraceIDHeader is the header field for trace ID, same as backend/web.
+const TraceIDHeader = "X-Trace-Id"
+
+// Handler processes an item, and returns the result to be written to
+// the item value. The context is canceled when the job is canceled or
+// the worker is forced to shut down.
+type Handler interface {
+	Process(ctx context.Context, item *etcdqueue.Item) (result string, err error)
+}
+
+// HandlerFunc is an adapter to use functions as handlers.
+type HandlerFunc func(ctx context.Context, item *etcdqueue.Item) (string, error)
+
+// Process calls f(ctx, item).
+func (f HandlerFunc) Process(ctx context.Context, item *etcdqueue.Item) (string, error) {
+	return f(ctx, item)
+}
+
+// Op configures the worker.
+type Op struct {
+	concurrency     int
+	retries         int
+	retryInterval   time.Duration
+	shutdownTimeout time.Duration
+	client          *http.Client
+	apiKey          string
+}
+
+// OpOption configures the worker.
+type OpOption func(*Op)
+
+// WithConcurrency sets the number of jobs to process concurrently.
+func WithConcurrency(n int) OpOption {
+	return func(op *Op) { op.concurrency = n }
+}
+
+// WithRetries sets the number of retries when the handler fails.
+func WithRetries(n int) OpOption {
+	return func(op *Op) { op.retries = n }
+}
+
+// WithRetryInterval sets the interval between retries of handlers and
+// requests to the queue endpoint.
+func WithRetryInterval(d time.Duration) OpOption {
+	return func(op *Op) { op.retryInterval = d }
+}
+
+// WithShutdownTimeout sets how long to wait for in-flight jobs on
+// shutdown, before canceling them. Zero waits until they finish.
+func WithShutdownTimeout(d time.Duration) OpOption {
+	return func(op *Op) { op.shutdownTimeout = d }
+}
+
+// WithHTTPClient sets the HTTP client, without timeout to long-poll items.
+func WithHTTPClient(cli *http.Client) OpOption {
+	return func(op *Op) { op.client = cli }
+}
+
+// WithAPIKey sets the API key of 'worker' scope, when backend requires keys.
+func WithAPIKey(key string) OpOption {
+	return func(op *Op) { op.apiKey = key }
+}
+
+func (op *Op) applyOpts(opts []OpOption) {
+	for _, opt := range opts {
+		opt(op)
+	}
+}
+
+// Worker claims and processes items from a bucket.
+type Worker struct {
+	endpoint string
+	bucket   string
+	handler  Handler
+	op       Op
+}
+
+// New returns a new worker of the queue endpoint, whose parent path is
+// the bucket (e.g. "/cats-request" for ".../cats-request/queue").
+func New(endpoint string, h Handler, opts ...OpOption) (*Worker, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("worker: invalid endpoint %q", endpoint)
+	}
+	op := Op{
+		concurrency:   1,
+		retryInterval: 5 * time.Second,
+		client:        http.DefaultClient,
+	}
+	op.applyOpts(opts)
+	if op.concurrency < 1 {
+		return nil, fmt.Errorf("worker: invalid concurrency %d", op.concurrency)
+	}
+	return &Worker{
+		endpoint: endpoint,
+		bucket:   path.Dir(u.Path),
+		handler:  h,
+		op:       op,
+	}, nil
+}
+
+// Run claims and processes items until the context is canceled. Then it
+// stops claiming new items and waits for in-flight jobs to finish.
+func (w *Worker) Run(ctx context.Context) error {
+	// in-flight jobs outlive the context for graceful shutdown
+	jobCtx, jobCancel := context.WithCancel(context.Background())
+	defer jobCancel()
+
+	glog.Infof("starting worker on %q (bucket %q, concurrency %d)", w.endpoint, w.bucket, w.op.concurrency)
+	var wg sync.WaitGroup
+	wg.Add(w.op.concurrency)
+	for i := 0; i < w.op.concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			w.loop(ctx, jobCtx)
+		}()
+	}
+
+	<-ctx.Done()
+	glog.Infof("shutting down worker on %q", w.endpoint)
+	donec := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(donec)
+	}()
+	if w.op.shutdownTimeout > 0 {
+		select {
+		case <-donec:
+		case <-time.After(w.op.shutdownTimeout):
+			glog.Warningf("canceling in-flight jobs after %v", w.op.shutdownTimeout)
+			jobCancel()
+			<-donec
+		}
+	} else {
+		<-donec
+	}
+	glog.Infof("shut down worker on %q", w.endpoint)
+	return nil
+}
+
+func (w *Worker) loop(ctx, jobCtx context.Context) {
+	for {
+		item, err := w.do(ctx, http.MethodGet, nil)
+		if ctx.Err() != nil {
+			if item != nil && err == nil {
+				// claimed right before shutdown
+				w.process(jobCtx, item)
+			}
+			return
+		}
+		if err != nil {
+			glog.Warningf("failed to fetch item from %q (%v)", w.endpoint, err)
+			sleep(ctx, w.op.retryInterval)
+			continue
+		}
+		if item.Error != "" {
+			glog.Warning(item.Error)
+			sleep(ctx, w.op.retryInterval)
+			continue
+		}
+		if item.Bucket != w.bucket {
+			glog.Warningf("%q is unknown (expected %q)", item.Bucket, w.bucket)
+			continue
+		}
+		w.process(jobCtx, item)
+	}
+}
+
+// process runs the handler with retries, and posts the result.
+// The handler runs in the span of the item, continuing its trace.
+func (w *Worker) process(parent context.Context, item *etcdqueue.Item) {
+	parent, span := trace.Start(trace.Extract(parent, item.TraceParent), "worker.Process")
+	span.SetAttribute("key", item.Key)
+	span.SetAttribute("request_id", item.RequestID)
+	defer span.Finish()
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	r := &reporter{w: w, item: *item, cancel: cancel}
+	ctx = context.WithValue(ctx, reporterKey, r)
+
+	glog.Infof("processing %q (request ID %q, trace %q)", item.Key, item.RequestID, item.TraceID)
+	var (
+		result string
+		err    error
+	)
+	for i := 0; i <= w.op.retries; i++ {
+		if i > 0 {
+			glog.Warningf("retrying %q in %v (%d/%d, %v)", item.Key, w.op.retryInterval, i, w.op.retries, err)
+			if !sleep(ctx, w.op.retryInterval) {
+				break
+			}
+		}
+		it := *item
+		hctx, hspan := trace.Start(ctx, "worker.Handler")
+		hspan.SetAttribute("attempt", i+1)
+		result, err = w.handler.Process(hctx, &it)
+		hspan.SetError(err)
+		hspan.Finish()
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if r.isCanceled() {
+		span.SetAttribute("canceled", true)
+		glog.Infof("canceled %q (request ID %q)", item.Key, item.RequestID)
+		return
+	}
+	span.SetError(err)
+
+	done := *item
+	done.Progress = etcdqueue.MaxProgress
+	if err != nil {
+		done.Error = err.Error()
+	} else {
+		done.Value = result
+	}
+	for {
+		resp, perr := w.do(parent, http.MethodPost, &done)
+		if isCanceled(resp, perr) {
+			glog.Infof("%q was canceled before completion", item.RequestID)
+			break
+		}
+		if perr == nil {
+			if resp.Error != "" {
+				glog.Warning(resp.Error)
+			}
+			break
+		}
+		if isRejected(perr) {
+			glog.Warningf("dropped result of %q rejected by %q (%v, error %q)", item.RequestID, w.endpoint, perr, done.Error)
+			break
+		}
+		glog.Warningf("failed to post %q to %q (%v)", item.RequestID, w.endpoint, perr)
+		if !sleep(parent, w.op.retryInterval) {
+			break
+		}
+	}
+	glog.Infof("processed %q (request ID %q, trace %q, error %q)", item.Key, item.RequestID, item.TraceID, done.Error)
+}
+
+// do sends the request to the queue endpoint, and decodes the response item.
+func (w *Worker) do(ctx context.Context, method string, item *etcdqueue.Item) (*etcdqueue.Item, error) {
+	var body io.Reader
+	if item != nil {
+		bts, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(bts)
+	}
+	req, err := http.NewRequest(method, w.endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if item != nil {
+		req.Header.Set("Content-Type", "application/json")
+		if item.TraceID != "" {
+			// same trace as the request that created the item
+			req.Header.Set(TraceIDHeader, item.TraceID)
+		}
+	}
+	if tp := trace.Inject(ctx); tp != "" {
+		req.Header.Set(trace.TraceParentHeader, tp)
+	}
+	if w.op.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+w.op.apiKey)
+	}
+
+	resp, err := w.op.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{method: method, endpoint: w.endpoint, statusCode: resp.StatusCode, status: resp.Status}
+	}
+	var ret etcdqueue.Item
+	if err = json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+type statusError struct {
+	method     string
+	endpoint   string
+	statusCode int
+	status     string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s %q returned %s", e.method, e.endpoint, e.status)
+}
+
+// isCanceled returns true if backend/web has canceled the request,
+// deleting its request ID from the cache. Backend responds 404, or the
+// item with the error message in legacy mode.
+func isCanceled(resp *etcdqueue.Item, err error) bool {
+	if e, ok := err.(*statusError); ok {
+		return e.statusCode == http.StatusNotFound
+	}
+	return err == nil && (resp.Canceled || strings.HasPrefix(resp.Error, "unknown request ID"))
+}
+
+// isRejected returns true if the queue endpoint rejected the request with
+// 4xx, other than 429, which is not worth retrying (e.g. 400 and 403).
+func isRejected(err error) bool {
+	e, ok := err.(*statusError)
+	return ok && e.statusCode >= 400 && e.statusCode < 500 && e.statusCode != http.StatusTooManyRequests
+}
+
+// sleep returns false if the context is done before the duration.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+type contextKey int
+
+const reporterKey contextKey = iota
+
+type reporter struct {
+	w      *Worker
+	cancel func()
+
+	mu       sync.Mutex
+	item     etcdqueue.Item
+	canceled bool
+}
+
+func (r *reporter) isCanceled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.canceled
+}
+
+// ReportProgress posts the progress (0 to 99) of the job in the context,
+// passed to 'Handler.Process'. It returns ErrCanceled and cancels the
+// context, if the job has been canceled.
+func ReportProgress(ctx context.Context, progress int) error {
+	r, ok := ctx.Value(reporterKey).(*reporter)
+	if !ok {
+		return fmt.Errorf("worker: no job in context")
+	}
+	if progress < 0 || progress >= etcdqueue.MaxProgress {
+		// 'etcdqueue.MaxProgress' is only set when the result is posted
+		return fmt.Errorf("worker: invalid progress %d", progress)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.canceled {
+		return ErrCanceled
+	}
+	r.item.Progress = progress
+	item := r.item
+	resp, err := r.w.do(ctx, http.MethodPost, &item)
+	if isCanceled(resp, err) {
+		r.canceled = true
+		r.cancel()
+		return ErrCanceled
+	}
+	return err
+}
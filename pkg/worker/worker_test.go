@@ -0,0 +1,289 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+// fakeQueue emulates the queue endpoint of backend/web.
+type fakeQueue struct {
+	items chan *etcdqueue.Item
+
+	mu       sync.Mutex
+	posts    map[string][]etcdqueue.Item
+	canceled map[string]bool
+	// statuses are the error statuses to respond to posts of request IDs,
+	// in order, before accepting them.
+	statuses map[string][]int
+}
+
+func newFakeQueue() *fakeQueue {
+	return &fakeQueue{
+		items:    make(chan *etcdqueue.Item, 10),
+		posts:    make(map[string][]etcdqueue.Item),
+		canceled: make(map[string]bool),
+		statuses: make(map[string][]int),
+	}
+}
+
+func (fq *fakeQueue) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		select {
+		case item := <-fq.items:
+			json.NewEncoder(w).Encode(item)
+		case <-req.Context().Done():
+		}
+	case http.MethodPost:
+		var item etcdqueue.Item
+		if err := json.NewDecoder(req.Body).Decode(&item); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fq.mu.Lock()
+		defer fq.mu.Unlock()
+		if fq.canceled[item.RequestID] {
+			if strings.HasPrefix(item.RequestID, "legacy") {
+				json.NewEncoder(w).Encode(&etcdqueue.Item{Error: fmt.Sprintf("unknown request ID %q", item.RequestID)})
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"error":{"code":"not_found","message":"unknown request ID %s"}}`, item.RequestID)
+			return
+		}
+		if ss := fq.statuses[item.RequestID]; len(ss) > 0 {
+			fq.statuses[item.RequestID] = ss[1:]
+			w.WriteHeader(ss[0])
+			return
+		}
+		fq.posts[item.RequestID] = append(fq.posts[item.RequestID], item)
+		json.NewEncoder(w).Encode(&item)
+	}
+}
+
+func (fq *fakeQueue) add(id, value string) {
+	item := etcdqueue.CreateItem("/cats-request", 100, value)
+	item.RequestID = id
+	fq.items <- item
+}
+
+func (fq *fakeQueue) get(id string) []etcdqueue.Item {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	return append([]etcdqueue.Item{}, fq.posts[id]...)
+}
+
+func (fq *fakeQueue) waitDone(t *testing.T, id string) etcdqueue.Item {
+	for i := 0; i < 100; i++ {
+		posts := fq.get(id)
+		if len(posts) > 0 && posts[len(posts)-1].Progress == etcdqueue.MaxProgress {
+			return posts[len(posts)-1]
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%q is not done", id)
+	return etcdqueue.Item{}
+}
+
+func TestWorker(t *testing.T) {
+	fq := newFakeQueue()
+	ts := httptest.NewServer(fq)
+	defer ts.Close()
+
+	var (
+		running, maxRunning int32
+		attempts            int32
+	)
+	h := HandlerFunc(func(ctx context.Context, item *etcdqueue.Item) (string, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+
+		switch item.Value {
+		case "flaky":
+			if atomic.AddInt32(&attempts, 1) < 3 {
+				return "", fmt.Errorf("temporary error")
+			}
+		case "fail":
+			return "", fmt.Errorf("permanent error")
+		case "cancel":
+			for {
+				if err := ReportProgress(ctx, 50); err != nil {
+					if err != ErrCanceled {
+						return "", err
+					}
+					select {
+					case <-ctx.Done():
+					default:
+						t.Error("expected context canceled")
+					}
+					return "", err
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		if err := ReportProgress(ctx, 50); err != nil {
+			return "", err
+		}
+		time.Sleep(100 * time.Millisecond)
+		return "processed " + item.Value, nil
+	})
+
+	w, err := New(ts.URL+"/cats-request/queue", h,
+		WithConcurrency(2),
+		WithRetries(2),
+		WithRetryInterval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	donec := make(chan error)
+	go func() { donec <- w.Run(ctx) }()
+
+	fq.add("a", "a")
+	fq.add("b", "b")
+	for _, id := range []string{"a", "b"} {
+		item := fq.waitDone(t, id)
+		if item.Value != "processed "+id || item.Error != "" {
+			t.Fatalf("unexpected item %+v", item)
+		}
+		posts := fq.get(id)
+		if len(posts) != 2 || posts[0].Progress != 50 {
+			t.Fatalf("expected progress 50 then 100, got %+v", posts)
+		}
+	}
+	if m := atomic.LoadInt32(&maxRunning); m != 2 {
+		t.Fatalf("expected 2 concurrent jobs, got %d", m)
+	}
+
+	fq.add("flaky", "flaky")
+	if item := fq.waitDone(t, "flaky"); item.Value != "processed flaky" {
+		t.Fatalf("unexpected item %+v", item)
+	}
+	fq.add("fail", "fail")
+	if item := fq.waitDone(t, "fail"); item.Error != "permanent error" || item.Value != "fail" {
+		t.Fatalf("unexpected item %+v", item)
+	}
+
+	fq.mu.Lock()
+	fq.canceled["cancel"] = true
+	fq.canceled["legacy-cancel"] = true
+	fq.mu.Unlock()
+	fq.add("cancel", "cancel")
+	fq.add("legacy-cancel", "cancel")
+
+	// graceful shutdown waits for in-flight job
+	fq.add("last", "last")
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err = <-donec; err != nil {
+		t.Fatal(err)
+	}
+	if item := fq.waitDone(t, "last"); item.Value != "processed last" {
+		t.Fatalf("unexpected item %+v", item)
+	}
+	for _, id := range []string{"cancel", "legacy-cancel"} {
+		if posts := fq.get(id); len(posts) != 0 {
+			t.Fatalf("expected no post on canceled job, got %+v", posts)
+		}
+	}
+}
+
+func TestWorkerRejectedResult(t *testing.T) {
+	fq := newFakeQueue()
+	ts := httptest.NewServer(fq)
+	defer ts.Close()
+
+	fq.statuses["forbidden"] = []int{http.StatusForbidden, http.StatusForbidden}
+	fq.statuses["limited"] = []int{http.StatusTooManyRequests}
+
+	h := HandlerFunc(func(ctx context.Context, item *etcdqueue.Item) (string, error) {
+		return item.Value, nil
+	})
+	w, err := New(ts.URL+"/cats-request/queue", h, WithRetryInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	donec := make(chan error)
+	go func() { donec <- w.Run(ctx) }()
+
+	fq.add("forbidden", "forbidden")
+	fq.add("limited", "limited")
+
+	// 429 is retried, and 403 is not
+	if item := fq.waitDone(t, "limited"); item.Value != "limited" {
+		t.Fatalf("unexpected result %+v", item)
+	}
+	left := func() int {
+		fq.mu.Lock()
+		defer fq.mu.Unlock()
+		return len(fq.statuses["forbidden"])
+	}
+	for i := 0; left() != 1; i++ {
+		if i == 100 {
+			t.Fatal("expected result to be posted")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := left(); n != 1 || len(fq.get("forbidden")) != 0 {
+		t.Fatalf("expected rejected result to be dropped after one post, got %d statuses left", n)
+	}
+
+	cancel()
+	select {
+	case <-donec:
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to shut down")
+	}
+}
+
+func TestWorkerShutdownTimeout(t *testing.T) {
+	fq := newFakeQueue()
+	ts := httptest.NewServer(fq)
+	defer ts.Close()
+
+	startc := make(chan struct{})
+	h := HandlerFunc(func(ctx context.Context, item *etcdqueue.Item) (string, error) {
+		close(startc)
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+	w, err := New(ts.URL+"/cats-request/queue", h, WithShutdownTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	donec := make(chan error)
+	go func() { donec <- w.Run(ctx) }()
+
+	fq.add("a", "a")
+	<-startc
+	cancel()
+	select {
+	case <-donec:
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to shut down")
+	}
+
+	if err = ReportProgress(context.Background(), 10); err == nil {
+		t.Fatal("expected error without job")
+	}
+}